@@ -12,6 +12,7 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/torchlabssoftware/subnetwork_system/internal/config"
 	db "github.com/torchlabssoftware/subnetwork_system/internal/db"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 	"github.com/torchlabssoftware/subnetwork_system/internal/server"
 	wsm "github.com/torchlabssoftware/subnetwork_system/internal/server/websocket"
 )
@@ -43,11 +44,17 @@ func main() {
 	}
 	defer chConn.Close()
 
+	//load upstream credential keys
+	keyring, err := secrets.NewKeyring(envConfig.UPSTREAM_ENCRYPTION_KEYS)
+	if err != nil {
+		log.Fatal("Invalid UPSTREAM_ENCRYPTION_KEYS:", err)
+	}
+
 	//create websocket manager
 	websocketManager := wsm.NewWebsocketManager()
 
 	//create router
-	router := server.NewRouter(pgConn, chConn, websocketManager)
+	router := server.NewRouter(pgConn, chConn, websocketManager, keyring)
 
 	//create server
 	srv := &http.Server{
@@ -14,28 +14,30 @@ type Config struct {
 	POSTGRES_DB         string
 	POSTGRES_URL        string
 	Admin_API_KEY       string
-	Worker_API_KEY      string
 	CLICKHOUSE_URL      string
 	CLICKHOUSE_DB       string
 	CLICKHOUSE_USER     string
 	CLICKHOUSE_PASSWORD string
+	// UPSTREAM_ENCRYPTION_KEYS is a comma separated list of id:base64key
+	// pairs; the first one encrypts. See secrets.NewKeyring.
+	UPSTREAM_ENCRYPTION_KEYS string
 }
 
 func Load() Config {
 
 	config := Config{
-		APP_ENV:             getEnv("APP_ENV", "dev"),
-		PORT:                getEnv("PORT", "8080"),
-		POSTGRES_USER:       getEnv("POSTGRES_USER", ""),
-		POSTGRES_PASSWORD:   getEnv("POSTGRES_PASSWORD", ""),
-		POSTGRES_DB:         getEnv("POSTGRES_DB", ""),
-		POSTGRES_URL:        getEnv("POSTGRES_URL", ""),
-		Admin_API_KEY:       getEnv("ADMIN_API_KEY", ""),
-		Worker_API_KEY:      getEnv("WORKER_API_KEY", ""),
-		CLICKHOUSE_URL:      getEnv("CLICKHOUSE_URL", ""),
-		CLICKHOUSE_DB:       getEnv("CLICKHOUSE_DB", ""),
-		CLICKHOUSE_USER:     getEnv("CLICKHOUSE_USER", ""),
-		CLICKHOUSE_PASSWORD: getEnv("CLICKHOUSE_PASSWORD", ""),
+		APP_ENV:                  getEnv("APP_ENV", "dev"),
+		PORT:                     getEnv("PORT", "8080"),
+		POSTGRES_USER:            getEnv("POSTGRES_USER", ""),
+		POSTGRES_PASSWORD:        getEnv("POSTGRES_PASSWORD", ""),
+		POSTGRES_DB:              getEnv("POSTGRES_DB", ""),
+		POSTGRES_URL:             getEnv("POSTGRES_URL", ""),
+		Admin_API_KEY:            getEnv("ADMIN_API_KEY", ""),
+		CLICKHOUSE_URL:           getEnv("CLICKHOUSE_URL", ""),
+		CLICKHOUSE_DB:            getEnv("CLICKHOUSE_DB", ""),
+		CLICKHOUSE_USER:          getEnv("CLICKHOUSE_USER", ""),
+		CLICKHOUSE_PASSWORD:      getEnv("CLICKHOUSE_PASSWORD", ""),
+		UPSTREAM_ENCRYPTION_KEYS: getEnv("UPSTREAM_ENCRYPTION_KEYS", ""),
 	}
 
 	config.validate()
@@ -52,16 +54,16 @@ func getEnv(key, fallback string) string {
 
 func (c *Config) validate() {
 	required := map[string]string{
-		"POSTGRES_USER":       c.POSTGRES_USER,
-		"POSTGRES_PASSWORD":   c.POSTGRES_PASSWORD,
-		"POSTGRES_DB":         c.POSTGRES_DB,
-		"POSTGRES_URL":        c.POSTGRES_URL,
-		"ADMIN_API_KEY":       c.Admin_API_KEY,
-		"WORKER_API_KEY":      c.Worker_API_KEY,
-		"CLICKHOUSE_URL":      c.CLICKHOUSE_URL,
-		"CLICKHOUSE_DB":       c.CLICKHOUSE_DB,
-		"CLICKHOUSE_USER":     c.CLICKHOUSE_USER,
-		"CLICKHOUSE_PASSWORD": c.CLICKHOUSE_PASSWORD,
+		"POSTGRES_USER":            c.POSTGRES_USER,
+		"POSTGRES_PASSWORD":        c.POSTGRES_PASSWORD,
+		"POSTGRES_DB":              c.POSTGRES_DB,
+		"POSTGRES_URL":             c.POSTGRES_URL,
+		"ADMIN_API_KEY":            c.Admin_API_KEY,
+		"CLICKHOUSE_URL":           c.CLICKHOUSE_URL,
+		"CLICKHOUSE_DB":            c.CLICKHOUSE_DB,
+		"CLICKHOUSE_USER":          c.CLICKHOUSE_USER,
+		"CLICKHOUSE_PASSWORD":      c.CLICKHOUSE_PASSWORD,
+		"UPSTREAM_ENCRYPTION_KEYS": c.UPSTREAM_ENCRYPTION_KEYS,
 	}
 
 	for key, val := range required {
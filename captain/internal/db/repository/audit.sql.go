@@ -0,0 +1,144 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.30.0
+// source: audit.sql
+
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const insertAuditLog = `-- name: InsertAuditLog :exec
+INSERT INTO audit_log (actor_token_id, actor_name, request_id, route, action, entity_type, entity_id, before, after)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    CAST($8::text AS jsonb),
+    CAST($9::text AS jsonb)
+)
+`
+
+type InsertAuditLogParams struct {
+	ActorTokenID uuid.NullUUID
+	ActorName    string
+	RequestID    string
+	Route        string
+	Action       string
+	EntityType   string
+	EntityID     string
+	Before       sql.NullString
+	After        sql.NullString
+}
+
+func (q *Queries) InsertAuditLog(ctx context.Context, arg InsertAuditLogParams) error {
+	_, err := q.db.ExecContext(ctx, insertAuditLog,
+		arg.ActorTokenID,
+		arg.ActorName,
+		arg.RequestID,
+		arg.Route,
+		arg.Action,
+		arg.EntityType,
+		arg.EntityID,
+		arg.Before,
+		arg.After,
+	)
+	return err
+}
+
+const listAuditLog = `-- name: ListAuditLog :many
+SELECT
+    a.id,
+    a.actor_token_id,
+    a.actor_name,
+    a.request_id,
+    a.route,
+    a.action,
+    a.entity_type,
+    a.entity_id,
+    COALESCE(a.before::text, 'null')::text AS before,
+    COALESCE(a.after::text, 'null')::text AS after,
+    a.created_at
+FROM audit_log AS a
+WHERE ($1::text IS NULL OR a.actor_name = $1 OR a.actor_token_id::text = $1)
+  AND ($2::text IS NULL OR a.entity_type = $2)
+  AND ($3::text IS NULL OR a.entity_id = $3)
+  AND ($4::timestamptz IS NULL OR a.created_at >= $4)
+  AND ($5::timestamptz IS NULL OR a.created_at < $5)
+ORDER BY a.id DESC
+LIMIT $6
+`
+
+type ListAuditLogParams struct {
+	Actor      sql.NullString
+	EntityType sql.NullString
+	EntityID   sql.NullString
+	FromTime   sql.NullTime
+	ToTime     sql.NullTime
+	RowLimit   int32
+}
+
+type ListAuditLogRow struct {
+	ID           int64
+	ActorTokenID uuid.NullUUID
+	ActorName    string
+	RequestID    string
+	Route        string
+	Action       string
+	EntityType   string
+	EntityID     string
+	Before       string
+	After        string
+	CreatedAt    time.Time
+}
+
+func (q *Queries) ListAuditLog(ctx context.Context, arg ListAuditLogParams) ([]ListAuditLogRow, error) {
+	rows, err := q.db.QueryContext(ctx, listAuditLog,
+		arg.Actor,
+		arg.EntityType,
+		arg.EntityID,
+		arg.FromTime,
+		arg.ToTime,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListAuditLogRow
+	for rows.Next() {
+		var i ListAuditLogRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ActorTokenID,
+			&i.ActorName,
+			&i.RequestID,
+			&i.Route,
+			&i.Action,
+			&i.EntityType,
+			&i.EntityID,
+			&i.Before,
+			&i.After,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -0,0 +1,134 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.30.0
+// source: cluster.sql
+
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const claimWorkerSession = `-- name: ClaimWorkerSession :one
+INSERT INTO worker_session (worker_id, replica_id)
+VALUES ($1, $2)
+ON CONFLICT (worker_id) DO UPDATE
+SET replica_id = EXCLUDED.replica_id, connected_at = NOW(), heartbeat_at = NOW()
+WHERE worker_session.heartbeat_at < NOW() - $3::int * INTERVAL '1 second'
+RETURNING worker_id
+`
+
+type ClaimWorkerSessionParams struct {
+	WorkerID     uuid.UUID
+	ReplicaID    string
+	StaleSeconds int32
+}
+
+func (q *Queries) ClaimWorkerSession(ctx context.Context, arg ClaimWorkerSessionParams) (uuid.UUID, error) {
+	row := q.db.QueryRowContext(ctx, claimWorkerSession, arg.WorkerID, arg.ReplicaID, arg.StaleSeconds)
+	var worker_id uuid.UUID
+	err := row.Scan(&worker_id)
+	return worker_id, err
+}
+
+const consumeWorkerOtp = `-- name: ConsumeWorkerOtp :one
+DELETE FROM worker_otp
+WHERE key = $1 AND expires_at > NOW()
+RETURNING worker_id
+`
+
+func (q *Queries) ConsumeWorkerOtp(ctx context.Context, key string) (uuid.UUID, error) {
+	row := q.db.QueryRowContext(ctx, consumeWorkerOtp, key)
+	var worker_id uuid.UUID
+	err := row.Scan(&worker_id)
+	return worker_id, err
+}
+
+const createWorkerOtp = `-- name: CreateWorkerOtp :exec
+INSERT INTO worker_otp (key, worker_id, expires_at)
+VALUES ($1, $2, $3)
+`
+
+type CreateWorkerOtpParams struct {
+	Key       string
+	WorkerID  uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (q *Queries) CreateWorkerOtp(ctx context.Context, arg CreateWorkerOtpParams) error {
+	_, err := q.db.ExecContext(ctx, createWorkerOtp, arg.Key, arg.WorkerID, arg.ExpiresAt)
+	return err
+}
+
+const deleteExpiredWorkerOtps = `-- name: DeleteExpiredWorkerOtps :exec
+DELETE FROM worker_otp WHERE expires_at <= NOW()
+`
+
+func (q *Queries) DeleteExpiredWorkerOtps(ctx context.Context) error {
+	_, err := q.db.ExecContext(ctx, deleteExpiredWorkerOtps)
+	return err
+}
+
+const heartbeatWorkerSessions = `-- name: HeartbeatWorkerSessions :exec
+UPDATE worker_session SET heartbeat_at = NOW() WHERE replica_id = $1
+`
+
+func (q *Queries) HeartbeatWorkerSessions(ctx context.Context, replicaID string) error {
+	_, err := q.db.ExecContext(ctx, heartbeatWorkerSessions, replicaID)
+	return err
+}
+
+const publishClusterEvent = `-- name: PublishClusterEvent :exec
+SELECT pg_notify($1::text, $2::text)
+`
+
+type PublishClusterEventParams struct {
+	Channel string
+	Payload string
+}
+
+func (q *Queries) PublishClusterEvent(ctx context.Context, arg PublishClusterEventParams) error {
+	_, err := q.db.ExecContext(ctx, publishClusterEvent, arg.Channel, arg.Payload)
+	return err
+}
+
+const releaseReplicaSessions = `-- name: ReleaseReplicaSessions :exec
+DELETE FROM worker_session WHERE replica_id = $1
+`
+
+func (q *Queries) ReleaseReplicaSessions(ctx context.Context, replicaID string) error {
+	_, err := q.db.ExecContext(ctx, releaseReplicaSessions, replicaID)
+	return err
+}
+
+const releaseWorkerSession = `-- name: ReleaseWorkerSession :exec
+DELETE FROM worker_session WHERE worker_id = $1 AND replica_id = $2
+`
+
+type ReleaseWorkerSessionParams struct {
+	WorkerID  uuid.UUID
+	ReplicaID string
+}
+
+func (q *Queries) ReleaseWorkerSession(ctx context.Context, arg ReleaseWorkerSessionParams) error {
+	_, err := q.db.ExecContext(ctx, releaseWorkerSession, arg.WorkerID, arg.ReplicaID)
+	return err
+}
+
+const setWorkerSessionConfigVersion = `-- name: SetWorkerSessionConfigVersion :exec
+UPDATE worker_session SET config_version = $3 WHERE worker_id = $1 AND replica_id = $2
+`
+
+type SetWorkerSessionConfigVersionParams struct {
+	WorkerID      uuid.UUID
+	ReplicaID     string
+	ConfigVersion string
+}
+
+func (q *Queries) SetWorkerSessionConfigVersion(ctx context.Context, arg SetWorkerSessionConfigVersionParams) error {
+	_, err := q.db.ExecContext(ctx, setWorkerSessionConfigVersion, arg.WorkerID, arg.ReplicaID, arg.ConfigVersion)
+	return err
+}
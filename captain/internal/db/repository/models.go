@@ -5,27 +5,63 @@
 package repository
 
 import (
+	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-type Country struct {
+type ApiToken struct {
+	ID        uuid.UUID
+	Name      string
+	TokenHash string
+	Scopes    []string
+	ExpiresAt sql.NullTime
+	RevokedAt sql.NullTime
+	CreatedAt time.Time
+}
+
+type AuditLog struct {
+	ID           int64
+	ActorTokenID uuid.NullUUID
+	ActorName    string
+	RequestID    string
+	Route        string
+	Action       string
+	EntityType   string
+	EntityID     string
+	Before       sql.NullString
+	After        sql.NullString
+	CreatedAt    time.Time
+}
+
+type City struct {
 	ID        uuid.UUID
 	Name      string
 	Code      string
-	RegionID  uuid.UUID
+	CountryID uuid.UUID
+	StateID   uuid.NullUUID
 	CreatedAt time.Time
 }
 
-type Pool struct {
+type Country struct {
 	ID        uuid.UUID
-	Tag       string
+	Name      string
+	Code      string
 	RegionID  uuid.UUID
-	Subdomain string
-	Port      int32
 	CreatedAt time.Time
-	UpdatedAt time.Time
+}
+
+type Pool struct {
+	ID             uuid.UUID
+	Tag            string
+	RegionID       uuid.UUID
+	Subdomain      string
+	Port           int32
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	ResolveLocally bool
 }
 
 type PoolUpstreamWeight struct {
@@ -41,6 +77,14 @@ type Region struct {
 	CreatedAt time.Time
 }
 
+type State struct {
+	ID        uuid.UUID
+	Name      string
+	Code      string
+	CountryID uuid.UUID
+	CreatedAt time.Time
+}
+
 type Upstream struct {
 	ID               uuid.UUID
 	Tag              string
@@ -53,13 +97,28 @@ type Upstream struct {
 	CreatedAt        time.Time
 }
 
-type User struct {
+type UsageBatch struct {
 	ID        uuid.UUID
-	Username  string
-	Password  string
-	Status    string
+	AppliedAt time.Time
+}
+
+type User struct {
+	ID              uuid.UUID
+	Username        string
+	Password        string
+	Status          string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	AccessLogOptOut bool
+	MaxConnections  int32
+	BandwidthLimit  int64
+}
+
+type UserDataDeadLetter struct {
+	ID        int64
+	Rows      json.RawMessage
+	Error     string
 	CreatedAt time.Time
-	UpdatedAt time.Time
 }
 
 type UserIpWhitelist struct {
@@ -70,23 +129,27 @@ type UserIpWhitelist struct {
 }
 
 type UserPool struct {
-	ID        uuid.UUID
-	PoolID    uuid.UUID
-	UserID    uuid.UUID
-	DataLimit int64
-	DataUsage int64
+	ID             uuid.UUID
+	PoolID         uuid.UUID
+	UserID         uuid.UUID
+	DataLimit      int64
+	DataUsage      int64
+	MaxConnections int32
+	BandwidthLimit int64
 }
 
 type Worker struct {
-	ID        uuid.UUID
-	Name      string
-	RegionID  uuid.UUID
-	IpAddress string
-	Port      int32
-	Status    string
-	PoolID    uuid.UUID
-	LastSeen  time.Time
-	CreatedAt time.Time
+	ID              uuid.UUID
+	Name            string
+	RegionID        uuid.UUID
+	IpAddress       string
+	Port            int32
+	Status          string
+	PoolID          uuid.UUID
+	LastSeen        time.Time
+	CreatedAt       time.Time
+	SecretHash      sql.NullString
+	SecretRotatedAt sql.NullTime
 }
 
 type WorkerDomain struct {
@@ -94,3 +157,24 @@ type WorkerDomain struct {
 	WorkerID uuid.UUID
 	Domain   string
 }
+
+type WorkerOtp struct {
+	Key       string
+	WorkerID  uuid.UUID
+	ExpiresAt time.Time
+}
+
+type WorkerSession struct {
+	WorkerID      uuid.UUID
+	ReplicaID     string
+	ConnectedAt   time.Time
+	HeartbeatAt   time.Time
+	ConfigVersion string
+}
+
+type WorkerTelemetrySeq struct {
+	WorkerID     uuid.UUID
+	AnalyticsSeq int64
+	UsageSeq     int64
+	UpdatedAt    time.Time
+}
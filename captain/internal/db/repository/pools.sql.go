@@ -8,11 +8,44 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lib/pq"
 )
 
+const addCity = `-- name: AddCity :one
+INSERT INTO city(name,code,country_id,state_id)
+VALUES($1,$2,$3,$4)
+RETURNING id, name, code, country_id, state_id, created_at
+`
+
+type AddCityParams struct {
+	Name      string
+	Code      string
+	CountryID uuid.UUID
+	StateID   uuid.NullUUID
+}
+
+func (q *Queries) AddCity(ctx context.Context, arg AddCityParams) (City, error) {
+	row := q.db.QueryRowContext(ctx, addCity,
+		arg.Name,
+		arg.Code,
+		arg.CountryID,
+		arg.StateID,
+	)
+	var i City
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Code,
+		&i.CountryID,
+		&i.StateID,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const addCountry = `-- name: AddCountry :one
 INSERT INTO country(name,code,region_id)
 VALUES($1,$2,$3)
@@ -45,6 +78,7 @@ VALUES (
     (SELECT u.id FROM upstream u WHERE u.tag = $2),
     $3
 )
+ON CONFLICT (pool_id, upstream_id) DO UPDATE SET weight = EXCLUDED.weight
 RETURNING id, pool_id, upstream_id, weight
 `
 
@@ -79,6 +113,31 @@ func (q *Queries) AddRegion(ctx context.Context, name string) (Region, error) {
 	return i, err
 }
 
+const addState = `-- name: AddState :one
+INSERT INTO state(name,code,country_id)
+VALUES($1,$2,$3)
+RETURNING id, name, code, country_id, created_at
+`
+
+type AddStateParams struct {
+	Name      string
+	Code      string
+	CountryID uuid.UUID
+}
+
+func (q *Queries) AddState(ctx context.Context, arg AddStateParams) (State, error) {
+	row := q.db.QueryRowContext(ctx, addState, arg.Name, arg.Code, arg.CountryID)
+	var i State
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Code,
+		&i.CountryID,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const addUpstream = `-- name: AddUpstream :one
 INSERT INTO upstream(tag,upstream_provider,config_format,username,password,port,domain)
 VALUES($1,$2,$3,$4,$5,$6,$7)
@@ -120,14 +179,51 @@ func (q *Queries) AddUpstream(ctx context.Context, arg AddUpstreamParams) (Upstr
 	return i, err
 }
 
-const deleteCountry = `-- name: DeleteCountry :exec
+const deleteCity = `-- name: DeleteCity :execrows
+DELETE FROM city
+WHERE country_id = $1 AND code = $2
+`
+
+type DeleteCityParams struct {
+	CountryID uuid.UUID
+	Code      string
+}
+
+func (q *Queries) DeleteCity(ctx context.Context, arg DeleteCityParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteCity, arg.CountryID, arg.Code)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteCountry = `-- name: DeleteCountry :many
 DELETE FROM country as c
 where c.name = $1
+RETURNING c.region_id
 `
 
-func (q *Queries) DeleteCountry(ctx context.Context, name string) error {
-	_, err := q.db.ExecContext(ctx, deleteCountry, name)
-	return err
+func (q *Queries) DeleteCountry(ctx context.Context, name string) ([]uuid.UUID, error) {
+	rows, err := q.db.QueryContext(ctx, deleteCountry, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []uuid.UUID
+	for rows.Next() {
+		var region_id uuid.UUID
+		if err := rows.Scan(&region_id); err != nil {
+			return nil, err
+		}
+		items = append(items, region_id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const deletePool = `-- name: DeletePool :execresult
@@ -164,6 +260,24 @@ func (q *Queries) DeleteRegion(ctx context.Context, name string) error {
 	return err
 }
 
+const deleteState = `-- name: DeleteState :execrows
+DELETE FROM state
+WHERE country_id = $1 AND code = $2
+`
+
+type DeleteStateParams struct {
+	CountryID uuid.UUID
+	Code      string
+}
+
+func (q *Queries) DeleteState(ctx context.Context, arg DeleteStateParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, deleteState, arg.CountryID, arg.Code)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const deleteUpstreamByTag = `-- name: DeleteUpstreamByTag :exec
 DELETE FROM upstream as u
 where u.tag = $1
@@ -174,6 +288,86 @@ func (q *Queries) DeleteUpstreamByTag(ctx context.Context, tag string) error {
 	return err
 }
 
+const getCitiesByCountry = `-- name: GetCitiesByCountry :many
+SELECT ci.id, ci.name, ci.code, ci.country_id, ci.created_at, s.code AS state_code FROM city as ci
+left join state as s on ci.state_id = s.id
+WHERE ci.country_id = $1
+ORDER BY ci.code
+`
+
+type GetCitiesByCountryRow struct {
+	ID        uuid.UUID
+	Name      string
+	Code      string
+	CountryID uuid.UUID
+	CreatedAt time.Time
+	StateCode sql.NullString
+}
+
+func (q *Queries) GetCitiesByCountry(ctx context.Context, countryID uuid.UUID) ([]GetCitiesByCountryRow, error) {
+	rows, err := q.db.QueryContext(ctx, getCitiesByCountry, countryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetCitiesByCountryRow
+	for rows.Next() {
+		var i GetCitiesByCountryRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Code,
+			&i.CountryID,
+			&i.CreatedAt,
+			&i.StateCode,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getCityByCode = `-- name: GetCityByCode :one
+SELECT ci.id, ci.name, ci.code, ci.country_id, ci.created_at, s.code AS state_code FROM city as ci
+left join state as s on ci.state_id = s.id
+WHERE ci.country_id = $1 AND ci.code = $2
+`
+
+type GetCityByCodeParams struct {
+	CountryID uuid.UUID
+	Code      string
+}
+
+type GetCityByCodeRow struct {
+	ID        uuid.UUID
+	Name      string
+	Code      string
+	CountryID uuid.UUID
+	CreatedAt time.Time
+	StateCode sql.NullString
+}
+
+func (q *Queries) GetCityByCode(ctx context.Context, arg GetCityByCodeParams) (GetCityByCodeRow, error) {
+	row := q.db.QueryRowContext(ctx, getCityByCode, arg.CountryID, arg.Code)
+	var i GetCityByCodeRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Code,
+		&i.CountryID,
+		&i.CreatedAt,
+		&i.StateCode,
+	)
+	return i, err
+}
+
 const getCountries = `-- name: GetCountries :many
 SELECT id, name, code, region_id, created_at FROM country
 `
@@ -207,12 +401,52 @@ func (q *Queries) GetCountries(ctx context.Context) ([]Country, error) {
 	return items, nil
 }
 
+const getCountryByCode = `-- name: GetCountryByCode :one
+SELECT id, name, code, region_id, created_at FROM country
+WHERE code = $1
+`
+
+func (q *Queries) GetCountryByCode(ctx context.Context, code string) (Country, error) {
+	row := q.db.QueryRowContext(ctx, getCountryByCode, code)
+	var i Country
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Code,
+		&i.RegionID,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getPoolByTag = `-- name: GetPoolByTag :one
+SELECT id, tag, region_id, subdomain, port, created_at, updated_at, resolve_locally FROM pool
+WHERE tag = $1
+`
+
+func (q *Queries) GetPoolByTag(ctx context.Context, tag string) (Pool, error) {
+	row := q.db.QueryRowContext(ctx, getPoolByTag, tag)
+	var i Pool
+	err := row.Scan(
+		&i.ID,
+		&i.Tag,
+		&i.RegionID,
+		&i.Subdomain,
+		&i.Port,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ResolveLocally,
+	)
+	return i, err
+}
+
 const getPoolByTagWithUpstreams = `-- name: GetPoolByTagWithUpstreams :many
 SELECT 
     p.id AS pool_id,
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.tag AS upstream_tag,
     u.config_format AS config_format,
     u.username AS username,
@@ -230,6 +464,7 @@ type GetPoolByTagWithUpstreamsRow struct {
 	PoolTag        string
 	PoolSubdomain  string
 	PoolPort       int32
+	ResolveLocally bool
 	UpstreamTag    sql.NullString
 	ConfigFormat   sql.NullString
 	Username       sql.NullString
@@ -252,6 +487,7 @@ func (q *Queries) GetPoolByTagWithUpstreams(ctx context.Context, tag string) ([]
 			&i.PoolTag,
 			&i.PoolSubdomain,
 			&i.PoolPort,
+			&i.ResolveLocally,
 			&i.UpstreamTag,
 			&i.ConfigFormat,
 			&i.Username,
@@ -272,6 +508,53 @@ func (q *Queries) GetPoolByTagWithUpstreams(ctx context.Context, tag string) ([]
 	return items, nil
 }
 
+const getPoolIdsByRegion = `-- name: GetPoolIdsByRegion :many
+SELECT id FROM pool
+WHERE region_id = $1
+`
+
+func (q *Queries) GetPoolIdsByRegion(ctx context.Context, regionID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := q.db.QueryContext(ctx, getPoolIdsByRegion, regionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPoolUpstreamWeight = `-- name: GetPoolUpstreamWeight :one
+SELECT puw.weight FROM pool_upstream_weight AS puw
+JOIN pool AS p ON puw.pool_id = p.id
+JOIN upstream AS u ON puw.upstream_id = u.id
+WHERE p.tag = $1 AND u.tag = $2
+`
+
+type GetPoolUpstreamWeightParams struct {
+	Tag   string
+	Tag_2 string
+}
+
+func (q *Queries) GetPoolUpstreamWeight(ctx context.Context, arg GetPoolUpstreamWeightParams) (int32, error) {
+	row := q.db.QueryRowContext(ctx, getPoolUpstreamWeight, arg.Tag, arg.Tag_2)
+	var weight int32
+	err := row.Scan(&weight)
+	return weight, err
+}
+
 const getRegions = `-- name: GetRegions :many
 SELECT id, name, created_at FROM region
 `
@@ -299,6 +582,64 @@ func (q *Queries) GetRegions(ctx context.Context) ([]Region, error) {
 	return items, nil
 }
 
+const getStateByCode = `-- name: GetStateByCode :one
+SELECT id, name, code, country_id, created_at FROM state
+WHERE country_id = $1 AND code = $2
+`
+
+type GetStateByCodeParams struct {
+	CountryID uuid.UUID
+	Code      string
+}
+
+func (q *Queries) GetStateByCode(ctx context.Context, arg GetStateByCodeParams) (State, error) {
+	row := q.db.QueryRowContext(ctx, getStateByCode, arg.CountryID, arg.Code)
+	var i State
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Code,
+		&i.CountryID,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getStatesByCountry = `-- name: GetStatesByCountry :many
+SELECT id, name, code, country_id, created_at FROM state
+WHERE country_id = $1
+ORDER BY code
+`
+
+func (q *Queries) GetStatesByCountry(ctx context.Context, countryID uuid.UUID) ([]State, error) {
+	rows, err := q.db.QueryContext(ctx, getStatesByCountry, countryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []State
+	for rows.Next() {
+		var i State
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Code,
+			&i.CountryID,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getUpstreams = `-- name: GetUpstreams :many
 SELECT id, tag, upstream_provider, username, password, config_format, port, domain, created_at FROM upstream
 `
@@ -377,16 +718,17 @@ func (q *Queries) InsertPoolUpstreamWeight(ctx context.Context, arg InsertPoolUp
 }
 
 const insetPool = `-- name: InsetPool :one
-INSERT INTO pool(tag,region_id,subdomain,port)
-VALUES($1,$2,$3,$4)
-RETURNING id, tag, region_id, subdomain, port, created_at, updated_at
+INSERT INTO pool(tag,region_id,subdomain,port,resolve_locally)
+VALUES($1,$2,$3,$4,$5)
+RETURNING id, tag, region_id, subdomain, port, created_at, updated_at, resolve_locally
 `
 
 type InsetPoolParams struct {
-	Tag       string
-	RegionID  uuid.UUID
-	Subdomain string
-	Port      int32
+	Tag            string
+	RegionID       uuid.UUID
+	Subdomain      string
+	Port           int32
+	ResolveLocally bool
 }
 
 func (q *Queries) InsetPool(ctx context.Context, arg InsetPoolParams) (Pool, error) {
@@ -395,6 +737,7 @@ func (q *Queries) InsetPool(ctx context.Context, arg InsetPoolParams) (Pool, err
 		arg.RegionID,
 		arg.Subdomain,
 		arg.Port,
+		arg.ResolveLocally,
 	)
 	var i Pool
 	err := row.Scan(
@@ -405,6 +748,7 @@ func (q *Queries) InsetPool(ctx context.Context, arg InsetPoolParams) (Pool, err
 		&i.Port,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ResolveLocally,
 	)
 	return i, err
 }
@@ -415,6 +759,7 @@ SELECT
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.tag AS upstream_tag,
     u.config_format AS config_format,
     u.username AS username,
@@ -431,6 +776,7 @@ type ListPoolsWithUpstreamsRow struct {
 	PoolTag        string
 	PoolSubdomain  string
 	PoolPort       int32
+	ResolveLocally bool
 	UpstreamTag    sql.NullString
 	ConfigFormat   sql.NullString
 	Username       sql.NullString
@@ -453,6 +799,7 @@ func (q *Queries) ListPoolsWithUpstreams(ctx context.Context) ([]ListPoolsWithUp
 			&i.PoolTag,
 			&i.PoolSubdomain,
 			&i.PoolPort,
+			&i.ResolveLocally,
 			&i.UpstreamTag,
 			&i.ConfigFormat,
 			&i.Username,
@@ -479,16 +826,18 @@ SET
     region_id = COALESCE($2, region_id),
     subdomain = COALESCE($3, subdomain),
     port = COALESCE($4, port),
+    resolve_locally = COALESCE($5, resolve_locally),
     updated_at = NOW()
 WHERE tag = $1
-RETURNING id, tag, region_id, subdomain, port, created_at, updated_at
+RETURNING id, tag, region_id, subdomain, port, created_at, updated_at, resolve_locally
 `
 
 type UpdatePoolParams struct {
-	Tag       string
-	RegionID  uuid.NullUUID
-	Subdomain sql.NullString
-	Port      sql.NullInt32
+	Tag            string
+	RegionID       uuid.NullUUID
+	Subdomain      sql.NullString
+	Port           sql.NullInt32
+	ResolveLocally sql.NullBool
 }
 
 func (q *Queries) UpdatePool(ctx context.Context, arg UpdatePoolParams) (Pool, error) {
@@ -497,6 +846,7 @@ func (q *Queries) UpdatePool(ctx context.Context, arg UpdatePoolParams) (Pool, e
 		arg.RegionID,
 		arg.Subdomain,
 		arg.Port,
+		arg.ResolveLocally,
 	)
 	var i Pool
 	err := row.Scan(
@@ -507,6 +857,23 @@ func (q *Queries) UpdatePool(ctx context.Context, arg UpdatePoolParams) (Pool, e
 		&i.Port,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ResolveLocally,
 	)
 	return i, err
 }
+
+const updateUpstreamCredentials = `-- name: UpdateUpstreamCredentials :exec
+UPDATE upstream SET username = $2, password = $3
+WHERE id = $1
+`
+
+type UpdateUpstreamCredentialsParams struct {
+	ID       uuid.UUID
+	Username string
+	Password string
+}
+
+func (q *Queries) UpdateUpstreamCredentials(ctx context.Context, arg UpdateUpstreamCredentialsParams) error {
+	_, err := q.db.ExecContext(ctx, updateUpstreamCredentials, arg.ID, arg.Username, arg.Password)
+	return err
+}
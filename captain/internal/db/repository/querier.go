@@ -7,51 +7,98 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Querier interface {
+	AddCity(ctx context.Context, arg AddCityParams) (City, error)
 	AddCountry(ctx context.Context, arg AddCountryParams) (Country, error)
 	AddPoolUpstreamWeight(ctx context.Context, arg AddPoolUpstreamWeightParams) (PoolUpstreamWeight, error)
 	AddRegion(ctx context.Context, name string) (Region, error)
+	AddState(ctx context.Context, arg AddStateParams) (State, error)
 	AddUpstream(ctx context.Context, arg AddUpstreamParams) (Upstream, error)
 	AddUserPoolsByPoolTags(ctx context.Context, arg AddUserPoolsByPoolTagsParams) (AddUserPoolsByPoolTagsRow, error)
 	AddWorkerDomain(ctx context.Context, arg AddWorkerDomainParams) (WorkerDomain, error)
+	AdvanceAnalyticsSeqs(ctx context.Context, arg AdvanceAnalyticsSeqsParams) error
+	AdvanceUsageSeqs(ctx context.Context, arg AdvanceUsageSeqsParams) error
+	ApplyUserPoolUsage(ctx context.Context, arg ApplyUserPoolUsageParams) ([]ApplyUserPoolUsageRow, error)
+	ClaimWorkerSession(ctx context.Context, arg ClaimWorkerSessionParams) (uuid.UUID, error)
+	ConsumeWorkerOtp(ctx context.Context, key string) (uuid.UUID, error)
+	CreateApiToken(ctx context.Context, arg CreateApiTokenParams) (CreateApiTokenRow, error)
 	CreateUser(ctx context.Context, arg CreateUserParams) (User, error)
 	CreateWorker(ctx context.Context, arg CreateWorkerParams) (Worker, error)
-	DeleteCountry(ctx context.Context, name string) error
+	CreateWorkerOtp(ctx context.Context, arg CreateWorkerOtpParams) error
+	DeleteCity(ctx context.Context, arg DeleteCityParams) (int64, error)
+	DeleteCountry(ctx context.Context, name string) ([]uuid.UUID, error)
+	DeleteExpiredWorkerOtps(ctx context.Context) error
 	DeletePool(ctx context.Context, tag string) (sql.Result, error)
 	DeletePoolUpstreamWeight(ctx context.Context, arg DeletePoolUpstreamWeightParams) (sql.Result, error)
 	DeleteRegion(ctx context.Context, name string) error
+	DeleteState(ctx context.Context, arg DeleteStateParams) (int64, error)
 	DeleteUpstreamByTag(ctx context.Context, tag string) error
+	DeleteUsageBatchesBefore(ctx context.Context, appliedAt time.Time) error
 	DeleteUser(ctx context.Context, id uuid.UUID) error
 	DeleteUserIpwhitelist(ctx context.Context, arg DeleteUserIpwhitelistParams) (sql.Result, error)
 	DeleteUserPoolsByTags(ctx context.Context, arg DeleteUserPoolsByTagsParams) (sql.Result, error)
 	DeleteWorkerByName(ctx context.Context, name string) (sql.Result, error)
 	DeleteWorkerDomain(ctx context.Context, arg DeleteWorkerDomainParams) (sql.Result, error)
+	EnsureTelemetrySeqs(ctx context.Context, workerIds []uuid.UUID) error
+	// the pool's highest weighted upstream decides the proxy string syntax
 	GenerateproxyString(ctx context.Context, arg GenerateproxyStringParams) (GenerateproxyStringRow, error)
 	GetAllWorkers(ctx context.Context) ([]GetAllWorkersRow, error)
 	GetAllusers(ctx context.Context) ([]GetAllusersRow, error)
+	GetApiTokenByHash(ctx context.Context, tokenHash string) (GetApiTokenByHashRow, error)
+	GetApiTokens(ctx context.Context) ([]GetApiTokensRow, error)
+	GetCitiesByCountry(ctx context.Context, countryID uuid.UUID) ([]GetCitiesByCountryRow, error)
+	GetCityByCode(ctx context.Context, arg GetCityByCodeParams) (GetCityByCodeRow, error)
+	GetCommittedTelemetrySeq(ctx context.Context, workerID uuid.UUID) (int64, error)
 	GetCountries(ctx context.Context) ([]Country, error)
+	GetCountryByCode(ctx context.Context, code string) (Country, error)
 	GetDatausageById(ctx context.Context, userID uuid.UUID) ([]GetDatausageByIdRow, error)
+	GetPoolByTag(ctx context.Context, tag string) (Pool, error)
 	GetPoolByTagWithUpstreams(ctx context.Context, tag string) ([]GetPoolByTagWithUpstreamsRow, error)
+	GetPoolIdsByRegion(ctx context.Context, regionID uuid.UUID) ([]uuid.UUID, error)
+	// every country of the pool's region with its states and cities, one row per
+	// country, state or city
+	GetPoolTargetingCatalog(ctx context.Context, id uuid.UUID) ([]GetPoolTargetingCatalogRow, error)
+	GetPoolUpstreamWeight(ctx context.Context, arg GetPoolUpstreamWeightParams) (int32, error)
 	GetRegions(ctx context.Context) ([]Region, error)
+	GetStateByCode(ctx context.Context, arg GetStateByCodeParams) (State, error)
+	GetStatesByCountry(ctx context.Context, countryID uuid.UUID) ([]State, error)
 	GetUpstreams(ctx context.Context) ([]Upstream, error)
 	GetUserByUsername(ctx context.Context, username string) (GetUserByUsernameRow, error)
 	GetUserIpwhitelistByUserId(ctx context.Context, id uuid.UUID) ([]string, error)
 	GetUserPoolsByUserId(ctx context.Context, id uuid.UUID) (GetUserPoolsByUserIdRow, error)
 	GetUserbyId(ctx context.Context, id uuid.UUID) (GetUserbyIdRow, error)
+	GetUsernamesByIp(ctx context.Context, ip string) ([]string, error)
 	GetWorkerById(ctx context.Context, id uuid.UUID) (GetWorkerByIdRow, error)
 	GetWorkerByName(ctx context.Context, name string) (GetWorkerByNameRow, error)
 	GetWorkerPoolConfig(ctx context.Context, id uuid.UUID) ([]GetWorkerPoolConfigRow, error)
+	GetWorkerStatuses(ctx context.Context) ([]GetWorkerStatusesRow, error)
+	HeartbeatWorkerSessions(ctx context.Context, replicaID string) error
+	InsertAuditLog(ctx context.Context, arg InsertAuditLogParams) error
 	InsertPoolUpstreamWeight(ctx context.Context, arg InsertPoolUpstreamWeightParams) ([]PoolUpstreamWeight, error)
+	InsertUsageBatch(ctx context.Context, id uuid.UUID) (int64, error)
+	InsertUserDataDeadLetter(ctx context.Context, arg InsertUserDataDeadLetterParams) error
 	InsertUserIpwhitelist(ctx context.Context, arg InsertUserIpwhitelistParams) (InsertUserIpwhitelistRow, error)
 	InsetPool(ctx context.Context, arg InsetPoolParams) (Pool, error)
+	ListAuditLog(ctx context.Context, arg ListAuditLogParams) ([]ListAuditLogRow, error)
 	ListPoolsWithUpstreams(ctx context.Context) ([]ListPoolsWithUpstreamsRow, error)
+	LockTelemetrySeqs(ctx context.Context, workerIds []uuid.UUID) ([]LockTelemetrySeqsRow, error)
+	PublishClusterEvent(ctx context.Context, arg PublishClusterEventParams) error
+	ReleaseReplicaSessions(ctx context.Context, replicaID string) error
+	ReleaseWorkerSession(ctx context.Context, arg ReleaseWorkerSessionParams) error
+	RevokeApiToken(ctx context.Context, id uuid.UUID) (int64, error)
+	RevokeWorkerSecret(ctx context.Context, name string) (RevokeWorkerSecretRow, error)
+	SetWorkerSessionConfigVersion(ctx context.Context, arg SetWorkerSessionConfigVersionParams) error
 	UpdatePool(ctx context.Context, arg UpdatePoolParams) (Pool, error)
+	UpdateUpstreamCredentials(ctx context.Context, arg UpdateUpstreamCredentialsParams) error
 	UpdateUser(ctx context.Context, arg UpdateUserParams) (User, error)
+	UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) (UpdateUserPasswordRow, error)
 	UpdateWorkerLastSeen(ctx context.Context, id uuid.UUID) error
+	UpdateWorkerSecret(ctx context.Context, arg UpdateWorkerSecretParams) (UpdateWorkerSecretRow, error)
 }
 
 var _ Querier = (*Queries)(nil)
@@ -0,0 +1,144 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.30.0
+// source: tokens.sql
+
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const createApiToken = `-- name: CreateApiToken :one
+INSERT INTO api_token (name, token_hash, scopes, expires_at)
+VALUES ($1, $2, $3::text[], $4)
+RETURNING id, name, scopes, expires_at, revoked_at, created_at
+`
+
+type CreateApiTokenParams struct {
+	Name      string
+	TokenHash string
+	Scopes    []string
+	ExpiresAt sql.NullTime
+}
+
+type CreateApiTokenRow struct {
+	ID        uuid.UUID
+	Name      string
+	Scopes    []string
+	ExpiresAt sql.NullTime
+	RevokedAt sql.NullTime
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateApiToken(ctx context.Context, arg CreateApiTokenParams) (CreateApiTokenRow, error) {
+	row := q.db.QueryRowContext(ctx, createApiToken,
+		arg.Name,
+		arg.TokenHash,
+		pq.Array(arg.Scopes),
+		arg.ExpiresAt,
+	)
+	var i CreateApiTokenRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		pq.Array(&i.Scopes),
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getApiTokenByHash = `-- name: GetApiTokenByHash :one
+SELECT id, name, scopes, expires_at, revoked_at, created_at
+FROM api_token
+WHERE token_hash = $1
+`
+
+type GetApiTokenByHashRow struct {
+	ID        uuid.UUID
+	Name      string
+	Scopes    []string
+	ExpiresAt sql.NullTime
+	RevokedAt sql.NullTime
+	CreatedAt time.Time
+}
+
+func (q *Queries) GetApiTokenByHash(ctx context.Context, tokenHash string) (GetApiTokenByHashRow, error) {
+	row := q.db.QueryRowContext(ctx, getApiTokenByHash, tokenHash)
+	var i GetApiTokenByHashRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		pq.Array(&i.Scopes),
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getApiTokens = `-- name: GetApiTokens :many
+SELECT id, name, scopes, expires_at, revoked_at, created_at
+FROM api_token
+ORDER BY created_at DESC
+`
+
+type GetApiTokensRow struct {
+	ID        uuid.UUID
+	Name      string
+	Scopes    []string
+	ExpiresAt sql.NullTime
+	RevokedAt sql.NullTime
+	CreatedAt time.Time
+}
+
+func (q *Queries) GetApiTokens(ctx context.Context) ([]GetApiTokensRow, error) {
+	rows, err := q.db.QueryContext(ctx, getApiTokens)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetApiTokensRow
+	for rows.Next() {
+		var i GetApiTokensRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			pq.Array(&i.Scopes),
+			&i.ExpiresAt,
+			&i.RevokedAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeApiToken = `-- name: RevokeApiToken :execrows
+UPDATE api_token
+SET revoked_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND revoked_at IS NULL
+`
+
+func (q *Queries) RevokeApiToken(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, revokeApiToken, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
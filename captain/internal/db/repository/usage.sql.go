@@ -0,0 +1,214 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.30.0
+// source: usage.sql
+
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const advanceAnalyticsSeqs = `-- name: AdvanceAnalyticsSeqs :exec
+UPDATE worker_telemetry_seq AS t
+SET analytics_seq = GREATEST(t.analytics_seq, v.seq), updated_at = NOW()
+FROM (
+    SELECT
+        UNNEST($1::uuid[]) AS worker_id,
+        UNNEST($2::bigint[]) AS seq
+) AS v
+WHERE t.worker_id = v.worker_id
+`
+
+type AdvanceAnalyticsSeqsParams struct {
+	WorkerIds []uuid.UUID
+	Seqs      []int64
+}
+
+func (q *Queries) AdvanceAnalyticsSeqs(ctx context.Context, arg AdvanceAnalyticsSeqsParams) error {
+	_, err := q.db.ExecContext(ctx, advanceAnalyticsSeqs, pq.Array(arg.WorkerIds), pq.Array(arg.Seqs))
+	return err
+}
+
+const advanceUsageSeqs = `-- name: AdvanceUsageSeqs :exec
+UPDATE worker_telemetry_seq AS t
+SET usage_seq = GREATEST(t.usage_seq, v.seq), updated_at = NOW()
+FROM (
+    SELECT
+        UNNEST($1::uuid[]) AS worker_id,
+        UNNEST($2::bigint[]) AS seq
+) AS v
+WHERE t.worker_id = v.worker_id
+`
+
+type AdvanceUsageSeqsParams struct {
+	WorkerIds []uuid.UUID
+	Seqs      []int64
+}
+
+func (q *Queries) AdvanceUsageSeqs(ctx context.Context, arg AdvanceUsageSeqsParams) error {
+	_, err := q.db.ExecContext(ctx, advanceUsageSeqs, pq.Array(arg.WorkerIds), pq.Array(arg.Seqs))
+	return err
+}
+
+const applyUserPoolUsage = `-- name: ApplyUserPoolUsage :many
+UPDATE user_pools AS up
+SET data_usage = up.data_usage + v.bytes
+FROM (
+    SELECT
+        UNNEST($1::text[]) AS username,
+        UNNEST($2::uuid[]) AS pool_id,
+        UNNEST($3::bigint[]) AS bytes
+) AS v
+JOIN "user" AS u ON u.username = v.username
+WHERE up.user_id = u.id AND up.pool_id = v.pool_id
+RETURNING u.username, up.pool_id, up.data_limit, up.data_usage, v.bytes::bigint AS added_bytes
+`
+
+type ApplyUserPoolUsageParams struct {
+	Usernames []string
+	PoolIds   []uuid.UUID
+	Bytes     []int64
+}
+
+type ApplyUserPoolUsageRow struct {
+	Username   string
+	PoolID     uuid.UUID
+	DataLimit  int64
+	DataUsage  int64
+	AddedBytes int64
+}
+
+func (q *Queries) ApplyUserPoolUsage(ctx context.Context, arg ApplyUserPoolUsageParams) ([]ApplyUserPoolUsageRow, error) {
+	rows, err := q.db.QueryContext(ctx, applyUserPoolUsage, pq.Array(arg.Usernames), pq.Array(arg.PoolIds), pq.Array(arg.Bytes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ApplyUserPoolUsageRow
+	for rows.Next() {
+		var i ApplyUserPoolUsageRow
+		if err := rows.Scan(
+			&i.Username,
+			&i.PoolID,
+			&i.DataLimit,
+			&i.DataUsage,
+			&i.AddedBytes,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const deleteUsageBatchesBefore = `-- name: DeleteUsageBatchesBefore :exec
+DELETE FROM usage_batch
+WHERE applied_at < $1
+`
+
+func (q *Queries) DeleteUsageBatchesBefore(ctx context.Context, appliedAt time.Time) error {
+	_, err := q.db.ExecContext(ctx, deleteUsageBatchesBefore, appliedAt)
+	return err
+}
+
+const ensureTelemetrySeqs = `-- name: EnsureTelemetrySeqs :exec
+INSERT INTO worker_telemetry_seq (worker_id)
+SELECT w.id FROM worker AS w
+WHERE w.id = ANY($1::uuid[])
+ON CONFLICT (worker_id) DO NOTHING
+`
+
+func (q *Queries) EnsureTelemetrySeqs(ctx context.Context, workerIds []uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, ensureTelemetrySeqs, pq.Array(workerIds))
+	return err
+}
+
+const getCommittedTelemetrySeq = `-- name: GetCommittedTelemetrySeq :one
+SELECT GREATEST(analytics_seq, usage_seq)::bigint AS seq
+FROM worker_telemetry_seq
+WHERE worker_id = $1
+`
+
+func (q *Queries) GetCommittedTelemetrySeq(ctx context.Context, workerID uuid.UUID) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getCommittedTelemetrySeq, workerID)
+	var seq int64
+	err := row.Scan(&seq)
+	return seq, err
+}
+
+const insertUsageBatch = `-- name: InsertUsageBatch :execrows
+INSERT INTO usage_batch (id)
+VALUES ($1)
+ON CONFLICT (id) DO NOTHING
+`
+
+func (q *Queries) InsertUsageBatch(ctx context.Context, id uuid.UUID) (int64, error) {
+	result, err := q.db.ExecContext(ctx, insertUsageBatch, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const insertUserDataDeadLetter = `-- name: InsertUserDataDeadLetter :exec
+INSERT INTO user_data_dead_letter (rows, error)
+VALUES (CAST($1::text AS jsonb), $2)
+`
+
+type InsertUserDataDeadLetterParams struct {
+	Rows  string
+	Error string
+}
+
+func (q *Queries) InsertUserDataDeadLetter(ctx context.Context, arg InsertUserDataDeadLetterParams) error {
+	_, err := q.db.ExecContext(ctx, insertUserDataDeadLetter, arg.Rows, arg.Error)
+	return err
+}
+
+const lockTelemetrySeqs = `-- name: LockTelemetrySeqs :many
+SELECT worker_id, analytics_seq, usage_seq
+FROM worker_telemetry_seq
+WHERE worker_id = ANY($1::uuid[])
+ORDER BY worker_id
+FOR UPDATE
+`
+
+type LockTelemetrySeqsRow struct {
+	WorkerID     uuid.UUID
+	AnalyticsSeq int64
+	UsageSeq     int64
+}
+
+func (q *Queries) LockTelemetrySeqs(ctx context.Context, workerIds []uuid.UUID) ([]LockTelemetrySeqsRow, error) {
+	rows, err := q.db.QueryContext(ctx, lockTelemetrySeqs, pq.Array(workerIds))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LockTelemetrySeqsRow
+	for rows.Next() {
+		var i LockTelemetrySeqsRow
+		if err := rows.Scan(&i.WorkerID, &i.AnalyticsSeq, &i.UsageSeq); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
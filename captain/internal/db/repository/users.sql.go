@@ -15,58 +15,94 @@ import (
 )
 
 const addUserPoolsByPoolTags = `-- name: AddUserPoolsByPoolTags :one
-WITH matching_pools AS (
-    SELECT id, tag
-    FROM pool 
-    WHERE tag = ANY($2::text[])
+WITH requested AS (
+    -- set-returning functions in one select list are zipped, so each tag
+    -- keeps the limits given at the same position
+    SELECT
+        UNNEST($2::text[]) AS tag,
+        UNNEST($3::BIGINT[]) AS data_limit,
+        UNNEST($4::INT[]) AS max_connections,
+        UNNEST($5::BIGINT[]) AS bandwidth_limit
+),
+matching_pools AS (
+    SELECT p.id, p.tag, r.data_limit, r.max_connections, r.bandwidth_limit
+    FROM pool AS p
+    JOIN requested AS r ON p.tag = r.tag
 ), 
 inserted_rows AS (
-    INSERT INTO user_pools (user_id, pool_id,data_limit)
-    SELECT $1, id,UNNEST($3::BIGINT[]) FROM matching_pools
+    INSERT INTO user_pools (user_id, pool_id,data_limit,max_connections,bandwidth_limit)
+    SELECT $1, id,data_limit,max_connections,bandwidth_limit FROM matching_pools
     ON CONFLICT (user_id, pool_id) DO NOTHING
-    RETURNING pool_id, user_id,data_limit
+    RETURNING pool_id, user_id,data_limit,max_connections,bandwidth_limit
 )
 SELECT 
     i.user_id, 
     COALESCE(ARRAY_AGG(p.tag), '{}')::TEXT[] AS inserted_tags,
-    COALESCE(ARRAY_AGG(i.data_limit), '{}')::BIGINT[] AS inserted_data_limits
+    COALESCE(ARRAY_AGG(i.data_limit), '{}')::BIGINT[] AS inserted_data_limits,
+    COALESCE(ARRAY_AGG(i.max_connections), '{}')::INT[] AS inserted_max_connections,
+    COALESCE(ARRAY_AGG(i.bandwidth_limit), '{}')::BIGINT[] AS inserted_bandwidth_limits
 FROM inserted_rows i
 JOIN matching_pools p ON i.pool_id = p.id
 GROUP BY i.user_id
 `
 
 type AddUserPoolsByPoolTagsParams struct {
-	UserID     uuid.UUID
-	Tags       []string
-	DataLimits []int64
+	UserID          uuid.UUID
+	Tags            []string
+	DataLimits      []int64
+	MaxConnections  []int32
+	BandwidthLimits []int64
 }
 
 type AddUserPoolsByPoolTagsRow struct {
-	UserID             uuid.UUID
-	InsertedTags       []string
-	InsertedDataLimits []int64
+	UserID                  uuid.UUID
+	InsertedTags            []string
+	InsertedDataLimits      []int64
+	InsertedMaxConnections  []int32
+	InsertedBandwidthLimits []int64
 }
 
 func (q *Queries) AddUserPoolsByPoolTags(ctx context.Context, arg AddUserPoolsByPoolTagsParams) (AddUserPoolsByPoolTagsRow, error) {
-	row := q.db.QueryRowContext(ctx, addUserPoolsByPoolTags, arg.UserID, pq.Array(arg.Tags), pq.Array(arg.DataLimits))
+	row := q.db.QueryRowContext(ctx, addUserPoolsByPoolTags,
+		arg.UserID,
+		pq.Array(arg.Tags),
+		pq.Array(arg.DataLimits),
+		pq.Array(arg.MaxConnections),
+		pq.Array(arg.BandwidthLimits),
+	)
 	var i AddUserPoolsByPoolTagsRow
-	err := row.Scan(&i.UserID, pq.Array(&i.InsertedTags), pq.Array(&i.InsertedDataLimits))
+	err := row.Scan(
+		&i.UserID,
+		pq.Array(&i.InsertedTags),
+		pq.Array(&i.InsertedDataLimits),
+		pq.Array(&i.InsertedMaxConnections),
+		pq.Array(&i.InsertedBandwidthLimits),
+	)
 	return i, err
 }
 
 const createUser = `-- name: CreateUser :one
-INSERT INTO "user"(username,password)
-VALUES ($1,$2)
-RETURNING id, username, password, status, created_at, updated_at
+INSERT INTO "user"(username,password,access_log_opt_out,max_connections,bandwidth_limit)
+VALUES ($1,$2,$3,$4,$5)
+RETURNING id, username, password, status, created_at, updated_at, access_log_opt_out, max_connections, bandwidth_limit
 `
 
 type CreateUserParams struct {
-	Username string
-	Password string
+	Username        string
+	Password        string
+	AccessLogOptOut bool
+	MaxConnections  int32
+	BandwidthLimit  int64
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, createUser, arg.Username, arg.Password)
+	row := q.db.QueryRowContext(ctx, createUser,
+		arg.Username,
+		arg.Password,
+		arg.AccessLogOptOut,
+		arg.MaxConnections,
+		arg.BandwidthLimit,
+	)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -75,6 +111,9 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, e
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.AccessLogOptOut,
+		&i.MaxConnections,
+		&i.BandwidthLimit,
 	)
 	return i, err
 }
@@ -124,11 +163,18 @@ func (q *Queries) DeleteUserPoolsByTags(ctx context.Context, arg DeleteUserPools
 }
 
 const generateproxyString = `-- name: GenerateproxyString :one
-SELECT p.tag,p.subdomain,p.port,u.username,u.password FROM pool as p
+SELECT p.tag,p.subdomain,p.port,u.username,u.password,us.upstream_provider,us.config_format FROM pool as p
 join region as r on p.region_id = r.id
 join country as c on r.id = c.region_id
 join user_pools as up on p.id = up.pool_id
 join "user" as u on up.user_id = u.id
+join lateral (
+    SELECT ups.upstream_provider, ups.config_format FROM pool_upstream_weight as puw
+    join upstream as ups on puw.upstream_id = ups.id
+    where puw.pool_id = p.id
+    ORDER BY puw.weight DESC, ups.tag
+    LIMIT 1
+) as us on true
 where c.code = $1 AND p.tag LIKE $2 AND up.user_id = $3
 `
 
@@ -139,13 +185,16 @@ type GenerateproxyStringParams struct {
 }
 
 type GenerateproxyStringRow struct {
-	Tag       string
-	Subdomain string
-	Port      int32
-	Username  string
-	Password  string
+	Tag              string
+	Subdomain        string
+	Port             int32
+	Username         string
+	Password         string
+	UpstreamProvider string
+	ConfigFormat     string
 }
 
+// the pool's highest weighted upstream decides the proxy string syntax
 func (q *Queries) GenerateproxyString(ctx context.Context, arg GenerateproxyStringParams) (GenerateproxyStringRow, error) {
 	row := q.db.QueryRowContext(ctx, generateproxyString, arg.Code, arg.Tag, arg.UserID)
 	var i GenerateproxyStringRow
@@ -155,6 +204,8 @@ func (q *Queries) GenerateproxyString(ctx context.Context, arg GenerateproxyStri
 		&i.Port,
 		&i.Username,
 		&i.Password,
+		&i.UpstreamProvider,
+		&i.ConfigFormat,
 	)
 	return i, err
 }
@@ -167,6 +218,9 @@ SELECT
     u.status,
     u.created_at,
     u.updated_at,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
     COALESCE(ARRAY_AGG(DISTINCT p.tag) FILTER (WHERE p.tag IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
@@ -177,14 +231,17 @@ GROUP BY u.id
 `
 
 type GetAllusersRow struct {
-	ID          uuid.UUID
-	Username    string
-	Password    string
-	Status      string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	IpWhitelist []string
-	Pools       []string
+	ID              uuid.UUID
+	Username        string
+	Password        string
+	Status          string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	AccessLogOptOut bool
+	MaxConnections  int32
+	BandwidthLimit  int64
+	IpWhitelist     []string
+	Pools           []string
 }
 
 func (q *Queries) GetAllusers(ctx context.Context) ([]GetAllusersRow, error) {
@@ -203,6 +260,9 @@ func (q *Queries) GetAllusers(ctx context.Context) ([]GetAllusersRow, error) {
 			&i.Status,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.AccessLogOptOut,
+			&i.MaxConnections,
+			&i.BandwidthLimit,
 			pq.Array(&i.IpWhitelist),
 			pq.Array(&i.Pools),
 		); err != nil {
@@ -220,16 +280,18 @@ func (q *Queries) GetAllusers(ctx context.Context) ([]GetAllusersRow, error) {
 }
 
 const getDatausageById = `-- name: GetDatausageById :many
-SELECT up.data_limit,up.data_usage,p.tag AS pool_tag 
+SELECT up.data_limit,up.data_usage,up.max_connections,up.bandwidth_limit,p.tag AS pool_tag 
 FROM user_pools AS up 
 INNER JOIN pool AS p ON up.pool_id = p.id
 WHERE up.user_id = $1
 `
 
 type GetDatausageByIdRow struct {
-	DataLimit int64
-	DataUsage int64
-	PoolTag   string
+	DataLimit      int64
+	DataUsage      int64
+	MaxConnections int32
+	BandwidthLimit int64
+	PoolTag        string
 }
 
 func (q *Queries) GetDatausageById(ctx context.Context, userID uuid.UUID) ([]GetDatausageByIdRow, error) {
@@ -241,7 +303,13 @@ func (q *Queries) GetDatausageById(ctx context.Context, userID uuid.UUID) ([]Get
 	var items []GetDatausageByIdRow
 	for rows.Next() {
 		var i GetDatausageByIdRow
-		if err := rows.Scan(&i.DataLimit, &i.DataUsage, &i.PoolTag); err != nil {
+		if err := rows.Scan(
+			&i.DataLimit,
+			&i.DataUsage,
+			&i.MaxConnections,
+			&i.BandwidthLimit,
+			&i.PoolTag,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -261,8 +329,11 @@ SELECT
     u.username,
     u.password,
     u.status,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
-    COALESCE(ARRAY_AGG(DISTINCT (p.tag || ':' || up.data_limit || ':' ||up.data_usage)) FILTER (WHERE p.tag IS NOT NULL AND up.data_limit IS NOT NULL), '{}')::text[] AS pools
+    COALESCE(ARRAY_AGG(DISTINCT (p.tag || ':' || up.data_limit || ':' ||up.data_usage || ':' || up.max_connections || ':' || up.bandwidth_limit)) FILTER (WHERE p.tag IS NOT NULL AND up.data_limit IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
 LEFT JOIN user_ip_whitelist AS iw ON u.id = iw.user_id
 LEFT JOIN user_pools AS up ON u.id = up.user_id
@@ -272,12 +343,15 @@ GROUP BY u.id
 `
 
 type GetUserByUsernameRow struct {
-	ID          uuid.UUID
-	Username    string
-	Password    string
-	Status      string
-	IpWhitelist []string
-	Pools       []string
+	ID              uuid.UUID
+	Username        string
+	Password        string
+	Status          string
+	AccessLogOptOut bool
+	MaxConnections  int32
+	BandwidthLimit  int64
+	IpWhitelist     []string
+	Pools           []string
 }
 
 func (q *Queries) GetUserByUsername(ctx context.Context, username string) (GetUserByUsernameRow, error) {
@@ -288,6 +362,9 @@ func (q *Queries) GetUserByUsername(ctx context.Context, username string) (GetUs
 		&i.Username,
 		&i.Password,
 		&i.Status,
+		&i.AccessLogOptOut,
+		&i.MaxConnections,
+		&i.BandwidthLimit,
 		pq.Array(&i.IpWhitelist),
 		pq.Array(&i.Pools),
 	)
@@ -346,6 +423,9 @@ SELECT
     u.status,
     u.created_at,
     u.updated_at,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
     COALESCE(ARRAY_AGG(DISTINCT p.tag) FILTER (WHERE p.tag IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
@@ -357,14 +437,17 @@ GROUP BY u.id
 `
 
 type GetUserbyIdRow struct {
-	ID          uuid.UUID
-	Username    string
-	Password    string
-	Status      string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
-	IpWhitelist []string
-	Pools       []string
+	ID              uuid.UUID
+	Username        string
+	Password        string
+	Status          string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	AccessLogOptOut bool
+	MaxConnections  int32
+	BandwidthLimit  int64
+	IpWhitelist     []string
+	Pools           []string
 }
 
 func (q *Queries) GetUserbyId(ctx context.Context, id uuid.UUID) (GetUserbyIdRow, error) {
@@ -377,12 +460,45 @@ func (q *Queries) GetUserbyId(ctx context.Context, id uuid.UUID) (GetUserbyIdRow
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.AccessLogOptOut,
+		&i.MaxConnections,
+		&i.BandwidthLimit,
 		pq.Array(&i.IpWhitelist),
 		pq.Array(&i.Pools),
 	)
 	return i, err
 }
 
+const getUsernamesByIp = `-- name: GetUsernamesByIp :many
+SELECT DISTINCT u.username
+FROM "user" AS u
+JOIN user_ip_whitelist AS iw ON u.id = iw.user_id
+WHERE CAST($1::text AS inet) <<= iw.ip_cidr::inet
+`
+
+func (q *Queries) GetUsernamesByIp(ctx context.Context, ip string) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, getUsernamesByIp, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		items = append(items, username)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const insertUserIpwhitelist = `-- name: InsertUserIpwhitelist :one
 WITH inserted AS (
     INSERT INTO user_ip_whitelist (user_id, ip_cidr)
@@ -415,18 +531,30 @@ const updateUser = `-- name: UpdateUser :one
 UPDATE "user" 
 SET 
 status = COALESCE($2,status),
+access_log_opt_out = COALESCE($3,access_log_opt_out),
+max_connections = COALESCE($4,max_connections),
+bandwidth_limit = COALESCE($5,bandwidth_limit),
 updated_at = CURRENT_TIMESTAMP
 WHERE id = $1
-RETURNING id, username, password, status, created_at, updated_at
+RETURNING id, username, password, status, created_at, updated_at, access_log_opt_out, max_connections, bandwidth_limit
 `
 
 type UpdateUserParams struct {
-	ID     uuid.UUID
-	Status sql.NullString
+	ID              uuid.UUID
+	Status          sql.NullString
+	AccessLogOptOut sql.NullBool
+	MaxConnections  sql.NullInt32
+	BandwidthLimit  sql.NullInt64
 }
 
 func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, error) {
-	row := q.db.QueryRowContext(ctx, updateUser, arg.ID, arg.Status)
+	row := q.db.QueryRowContext(ctx, updateUser,
+		arg.ID,
+		arg.Status,
+		arg.AccessLogOptOut,
+		arg.MaxConnections,
+		arg.BandwidthLimit,
+	)
 	var i User
 	err := row.Scan(
 		&i.ID,
@@ -435,6 +563,36 @@ func (q *Queries) UpdateUser(ctx context.Context, arg UpdateUserParams) (User, e
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.AccessLogOptOut,
+		&i.MaxConnections,
+		&i.BandwidthLimit,
 	)
 	return i, err
 }
+
+const updateUserPassword = `-- name: UpdateUserPassword :one
+UPDATE "user"
+SET
+password = $1,
+updated_at = CURRENT_TIMESTAMP
+WHERE id = $2
+RETURNING id, username, updated_at
+`
+
+type UpdateUserPasswordParams struct {
+	Password string
+	ID       uuid.UUID
+}
+
+type UpdateUserPasswordRow struct {
+	ID        uuid.UUID
+	Username  string
+	UpdatedAt time.Time
+}
+
+func (q *Queries) UpdateUserPassword(ctx context.Context, arg UpdateUserPasswordParams) (UpdateUserPasswordRow, error) {
+	row := q.db.QueryRowContext(ctx, updateUserPassword, arg.Password, arg.ID)
+	var i UpdateUserPasswordRow
+	err := row.Scan(&i.ID, &i.Username, &i.UpdatedAt)
+	return i, err
+}
@@ -33,9 +33,9 @@ func (q *Queries) AddWorkerDomain(ctx context.Context, arg AddWorkerDomainParams
 }
 
 const createWorker = `-- name: CreateWorker :one
-INSERT INTO worker (id,region_id,name,ip_address, port, pool_id)
-VALUES ($1,(SELECT id from region where region.name = $6), $2, $3, $4,$5)
-RETURNING id, name, region_id, ip_address, port, status, pool_id, last_seen, created_at
+INSERT INTO worker (id,region_id,name,ip_address, port, pool_id, secret_hash, secret_rotated_at)
+VALUES ($1,(SELECT id from region where region.name = $7), $2, $3, $4,$5,$6,NOW())
+RETURNING id, name, region_id, ip_address, port, status, pool_id, last_seen, created_at, secret_hash, secret_rotated_at
 `
 
 type CreateWorkerParams struct {
@@ -44,6 +44,7 @@ type CreateWorkerParams struct {
 	IpAddress  string
 	Port       int32
 	PoolID     uuid.UUID
+	SecretHash sql.NullString
 	RegionName string
 }
 
@@ -54,6 +55,7 @@ func (q *Queries) CreateWorker(ctx context.Context, arg CreateWorkerParams) (Wor
 		arg.IpAddress,
 		arg.Port,
 		arg.PoolID,
+		arg.SecretHash,
 		arg.RegionName,
 	)
 	var i Worker
@@ -67,6 +69,8 @@ func (q *Queries) CreateWorker(ctx context.Context, arg CreateWorkerParams) (Wor
 		&i.PoolID,
 		&i.LastSeen,
 		&i.CreatedAt,
+		&i.SecretHash,
+		&i.SecretRotatedAt,
 	)
 	return i, err
 }
@@ -104,11 +108,13 @@ SELECT
     w.port,
     w.pool_id,
     r.name AS region_name,
-    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains
+    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains,
+    COALESCE(ws.replica_id, '')::text AS replica_id
 FROM worker w
 JOIN region r ON w.region_id = r.id
 LEFT JOIN worker_domains wd ON w.id = wd.worker_id
-GROUP BY w.id, r.name
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
+GROUP BY w.id, r.name, ws.replica_id
 `
 
 type GetAllWorkersRow struct {
@@ -122,6 +128,7 @@ type GetAllWorkersRow struct {
 	PoolID     uuid.UUID
 	RegionName string
 	Domains    []string
+	ReplicaID  string
 }
 
 func (q *Queries) GetAllWorkers(ctx context.Context) ([]GetAllWorkersRow, error) {
@@ -144,6 +151,7 @@ func (q *Queries) GetAllWorkers(ctx context.Context) ([]GetAllWorkersRow, error)
 			&i.PoolID,
 			&i.RegionName,
 			pq.Array(&i.Domains),
+			&i.ReplicaID,
 		); err != nil {
 			return nil, err
 		}
@@ -158,21 +166,73 @@ func (q *Queries) GetAllWorkers(ctx context.Context) ([]GetAllWorkersRow, error)
 	return items, nil
 }
 
+const getPoolTargetingCatalog = `-- name: GetPoolTargetingCatalog :many
+SELECT c.code AS country_code, s.code AS state_code, NULL::text AS city_code FROM pool p
+join country c on c.region_id = p.region_id
+left join state s on s.country_id = c.id
+WHERE p.id = $1
+UNION ALL
+SELECT c.code AS country_code, s.code AS state_code, ci.code AS city_code FROM pool p
+join country c on c.region_id = p.region_id
+join city ci on ci.country_id = c.id
+left join state s on ci.state_id = s.id
+WHERE p.id = $1
+`
+
+type GetPoolTargetingCatalogRow struct {
+	CountryCode string
+	StateCode   sql.NullString
+	CityCode    sql.NullString
+}
+
+// every country of the pool's region with its states and cities, one row per
+// country, state or city
+func (q *Queries) GetPoolTargetingCatalog(ctx context.Context, id uuid.UUID) ([]GetPoolTargetingCatalogRow, error) {
+	rows, err := q.db.QueryContext(ctx, getPoolTargetingCatalog, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPoolTargetingCatalogRow
+	for rows.Next() {
+		var i GetPoolTargetingCatalogRow
+		if err := rows.Scan(&i.CountryCode, &i.StateCode, &i.CityCode); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getWorkerById = `-- name: GetWorkerById :one
-SELECT w.id,w.name,w.pool_id FROM worker w
+SELECT w.id,w.name,w.pool_id,w.status,w.secret_hash FROM worker w
 WHERE w.id = $1
 `
 
 type GetWorkerByIdRow struct {
-	ID     uuid.UUID
-	Name   string
-	PoolID uuid.UUID
+	ID         uuid.UUID
+	Name       string
+	PoolID     uuid.UUID
+	Status     string
+	SecretHash sql.NullString
 }
 
 func (q *Queries) GetWorkerById(ctx context.Context, id uuid.UUID) (GetWorkerByIdRow, error) {
 	row := q.db.QueryRowContext(ctx, getWorkerById, id)
 	var i GetWorkerByIdRow
-	err := row.Scan(&i.ID, &i.Name, &i.PoolID)
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.PoolID,
+		&i.Status,
+		&i.SecretHash,
+	)
 	return i, err
 }
 
@@ -187,12 +247,14 @@ SELECT
     w.port,
     w.pool_id,
     r.name AS region_name,
-    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains
+    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains,
+    COALESCE(ws.replica_id, '')::text AS replica_id
 FROM worker w
 JOIN region r ON w.region_id = r.id
 LEFT JOIN worker_domains wd ON w.id = wd.worker_id
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
 WHERE w.name = $1
-GROUP BY w.id, r.name
+GROUP BY w.id, r.name, ws.replica_id
 `
 
 type GetWorkerByNameRow struct {
@@ -206,6 +268,7 @@ type GetWorkerByNameRow struct {
 	PoolID     uuid.UUID
 	RegionName string
 	Domains    []string
+	ReplicaID  string
 }
 
 func (q *Queries) GetWorkerByName(ctx context.Context, name string) (GetWorkerByNameRow, error) {
@@ -222,6 +285,7 @@ func (q *Queries) GetWorkerByName(ctx context.Context, name string) (GetWorkerBy
 		&i.PoolID,
 		&i.RegionName,
 		pq.Array(&i.Domains),
+		&i.ReplicaID,
 	)
 	return i, err
 }
@@ -234,6 +298,7 @@ SELECT
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.id AS upstream_id,
     u.tag AS upstream_tag,
     u.domain AS upstream_address,
@@ -258,6 +323,7 @@ type GetWorkerPoolConfigRow struct {
 	PoolTag          string
 	PoolSubdomain    string
 	PoolPort         int32
+	ResolveLocally   bool
 	UpstreamID       uuid.UUID
 	UpstreamTag      string
 	UpstreamAddress  string
@@ -285,6 +351,7 @@ func (q *Queries) GetWorkerPoolConfig(ctx context.Context, id uuid.UUID) ([]GetW
 			&i.PoolTag,
 			&i.PoolSubdomain,
 			&i.PoolPort,
+			&i.ResolveLocally,
 			&i.UpstreamID,
 			&i.UpstreamTag,
 			&i.UpstreamAddress,
@@ -308,6 +375,87 @@ func (q *Queries) GetWorkerPoolConfig(ctx context.Context, id uuid.UUID) ([]GetW
 	return items, nil
 }
 
+const getWorkerStatuses = `-- name: GetWorkerStatuses :many
+SELECT
+    w.id,
+    w.name,
+    w.status,
+    w.last_seen,
+    w.pool_id,
+    r.name AS region_name,
+    COALESCE(ws.replica_id, '')::text AS replica_id,
+    ws.connected_at,
+    COALESCE(ws.config_version, '')::text AS config_version
+FROM worker w
+JOIN region r ON w.region_id = r.id
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
+ORDER BY w.name
+`
+
+type GetWorkerStatusesRow struct {
+	ID            uuid.UUID
+	Name          string
+	Status        string
+	LastSeen      time.Time
+	PoolID        uuid.UUID
+	RegionName    string
+	ReplicaID     string
+	ConnectedAt   sql.NullTime
+	ConfigVersion string
+}
+
+func (q *Queries) GetWorkerStatuses(ctx context.Context) ([]GetWorkerStatusesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkerStatuses)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetWorkerStatusesRow
+	for rows.Next() {
+		var i GetWorkerStatusesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Status,
+			&i.LastSeen,
+			&i.PoolID,
+			&i.RegionName,
+			&i.ReplicaID,
+			&i.ConnectedAt,
+			&i.ConfigVersion,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const revokeWorkerSecret = `-- name: RevokeWorkerSecret :one
+UPDATE worker SET secret_hash = NULL, secret_rotated_at = NOW()
+WHERE name = $1
+RETURNING id, name, secret_rotated_at
+`
+
+type RevokeWorkerSecretRow struct {
+	ID              uuid.UUID
+	Name            string
+	SecretRotatedAt sql.NullTime
+}
+
+func (q *Queries) RevokeWorkerSecret(ctx context.Context, name string) (RevokeWorkerSecretRow, error) {
+	row := q.db.QueryRowContext(ctx, revokeWorkerSecret, name)
+	var i RevokeWorkerSecretRow
+	err := row.Scan(&i.ID, &i.Name, &i.SecretRotatedAt)
+	return i, err
+}
+
 const updateWorkerLastSeen = `-- name: UpdateWorkerLastSeen :exec
 UPDATE worker SET last_seen = NOW() WHERE id = $1
 `
@@ -316,3 +464,27 @@ func (q *Queries) UpdateWorkerLastSeen(ctx context.Context, id uuid.UUID) error
 	_, err := q.db.ExecContext(ctx, updateWorkerLastSeen, id)
 	return err
 }
+
+const updateWorkerSecret = `-- name: UpdateWorkerSecret :one
+UPDATE worker SET secret_hash = $2, secret_rotated_at = NOW()
+WHERE name = $1
+RETURNING id, name, secret_rotated_at
+`
+
+type UpdateWorkerSecretParams struct {
+	Name       string
+	SecretHash sql.NullString
+}
+
+type UpdateWorkerSecretRow struct {
+	ID              uuid.UUID
+	Name            string
+	SecretRotatedAt sql.NullTime
+}
+
+func (q *Queries) UpdateWorkerSecret(ctx context.Context, arg UpdateWorkerSecretParams) (UpdateWorkerSecretRow, error) {
+	row := q.db.QueryRowContext(ctx, updateWorkerSecret, arg.Name, arg.SecretHash)
+	var i UpdateWorkerSecretRow
+	err := row.Scan(&i.ID, &i.Name, &i.SecretRotatedAt)
+	return i, err
+}
@@ -1,45 +1,101 @@
 package server
 
 import (
-	"math/rand"
-	"strconv"
+	"fmt"
+	"net"
 
 	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func GenerateproxyString(poolGroup string, countryCode string, isSticky bool, city string, state string, sessionDuration *int) string {
-	config := ""
-	if countryCode != "" {
-		config += "-country-" + countryCode
+// defaultSessionLifetime is the sticky session lifetime in minutes used when
+// the caller does not ask for one.
+const defaultSessionLifetime = 60
+
+// GenerateproxyString builds the targeting suffix of a proxy password for the
+// pool's provider. Sticky strings get a fresh session id in the provider's
+// format.
+func GenerateproxyString(adapter providers.Adapter, countryCode string, isSticky bool, city string, state string, sessionDuration *int) string {
+	targeting := providers.Targeting{
+		Country: countryCode,
+		State:   state,
+		City:    city,
 	}
-	if state != "" {
-		config += "-state-" + state
+	if isSticky {
+		targeting.Session = adapter.NewSession()
+		targeting.Lifetime = defaultSessionLifetime
+		if sessionDuration != nil && *sessionDuration > 0 {
+			targeting.Lifetime = *sessionDuration
+		}
 	}
-	if city != "" {
-		config += "-city-" + city
+	return adapter.ProxyString(targeting)
+}
+
+// ValidateTargetingCode checks a country, state or city code. Clients write
+// codes into their proxy password between dashes and providers join them with
+// underscores, so only letters and digits are allowed.
+func ValidateTargetingCode(code string) error {
+	if code == "" {
+		return fmt.Errorf("code must not be empty")
 	}
-	switch poolGroup {
-	case "netnut":
-		if isSticky {
-			min := 10000000
-			max := 100000000
-			randInt := rand.Intn(max-min+1) + min
-			config += "-session-" + strconv.Itoa(randInt)
+	for _, r := range code {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Errorf("code may only hold letters and digits: %s", code)
 		}
+	}
+	return nil
+}
 
-	case "geonode":
-		if isSticky {
-			config += "-session-" + uuid.New().String()[:8]
+// ValidateIpWhitelist checks that every entry is a plain IP address or a CIDR
+// range, the two forms workers accept when matching client addresses.
+func ValidateIpWhitelist(entries []string) error {
+	for _, entry := range entries {
+		if net.ParseIP(entry) != nil {
+			continue
 		}
-	case "iproyal":
-		if isSticky {
-			config += "-session-" + uuid.New().String()[:8]
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("invalid ip or cidr: %s", entry)
 		}
 	}
-	if sessionDuration != nil && *sessionDuration <= 0 {
-		config += "-lifetime-" + strconv.Itoa(*sessionDuration)
-	} else {
-		config += "-lifetime-" + "60"
+	return nil
+}
+
+// ValidateMaxConnections checks a concurrent connection limit. 0 means
+// unlimited, so only negative values are rejected.
+func ValidateMaxConnections(max int32) error {
+	if max < 0 {
+		return fmt.Errorf("max_connections must not be negative: %d", max)
+	}
+	return nil
+}
+
+// ValidateBandwidthLimit checks a bandwidth limit in bytes per second. 0
+// means unlimited, so only negative values are rejected.
+func ValidateBandwidthLimit(limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("bandwidth_limit must not be negative: %d", limit)
 	}
-	return config
+	return nil
+}
+
+// NewProxyPassword returns a fresh proxy password for a user. Only its hash is
+// stored, so the value is shown to the caller once.
+func NewProxyPassword() string {
+	return uuid.New().String()[:8]
+}
+
+// HashPassword returns the salted bcrypt hash stored in "user".password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches the stored hash. The
+// comparison runs in constant time.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
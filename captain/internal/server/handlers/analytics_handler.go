@@ -2,12 +2,15 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
 	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
+	middleware "github.com/torchlabssoftware/subnetwork_system/internal/server/middleware"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
@@ -21,64 +24,132 @@ func NewAnalyticsHandler(s models.AnalyticsService) *AnalyticsHandler {
 
 func (h *AnalyticsHandler) RegisterRoutes() chi.Router {
 	r := chi.NewRouter()
+	r.Use(middleware.AdminAuthentication)
+	r.Use(middleware.RequireScope(models.ScopeAnalyticsRead))
 	r.Get("/user/{user_id}/usage", h.GetUserUsage)
 	r.Get("/worker/{worker_id}/health", h.GetWorkerHealth)
+	r.Get("/upstream/{upstream_id}/health", h.GetUpstreamHealth)
 	r.Get("/user/{user_id}/website-access", h.GetUserWebsiteAccess)
+	r.Get("/top-users", h.GetTopUsers)
+	r.Get("/top-destinations", h.GetTopDestinations)
+	r.Get("/traffic/pools", h.GetPoolTraffic)
+	r.Get("/traffic/regions", h.GetRegionTraffic)
+	r.Get("/traffic/protocols", h.GetProtocolTraffic)
 	return r
 }
 
+const (
+	defaultTopLimit = 10
+	maxTopLimit     = 100
+	// maxFleetRange caps the window of the fleet-wide queries in days.
+	maxFleetRange = 366
+	// maxHealthRange caps the window of the health queries in days.
+	maxHealthRange = 366
+)
+
+// maxUsageRange caps how many days a usage query may span per granularity,
+// keeping hourly series to a size a dashboard can draw.
+var maxUsageRange = map[string]int{
+	models.UsageGranularityHour:  31,
+	models.UsageGranularityDay:   366,
+	models.UsageGranularityMonth: 3 * 366,
+}
+
 func (h *AnalyticsHandler) GetUserUsage(w http.ResponseWriter, r *http.Request) {
-	userID := chi.URLParam(r, "user_id")
-	fromStr := r.URL.Query().Get("from")
-	toStr := r.URL.Query().Get("to")
+	userID, err := uuid.Parse(chi.URLParam(r, "user_id"))
+	if err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid user id", err)
+		return
+	}
 	granularity := r.URL.Query().Get("granularity")
 	if granularity == "" {
-		granularity = "hour"
-	}
-	from, err := time.Parse(time.DateOnly, fromStr)
-	if err != nil {
-		from = time.Now().AddDate(0, 0, -7)
+		granularity = models.UsageGranularityHour
 	}
-	to, err := time.Parse(time.DateOnly, toStr)
-	if err != nil {
-		to = time.Now()
+	maxDays, ok := maxUsageRange[granularity]
+	if !ok {
+		functions.RespondwithError(w, http.StatusBadRequest, "granularity must be hour, day or month", fmt.Errorf("invalid granularity %q", granularity))
+		return
 	}
-	uuid, err := uuid.Parse(userID)
-	if err != nil {
-		functions.RespondwithError(w, http.StatusInternalServerError, "failed to parse user id", err)
+	from, to, ok := parseAnalyticsRange(w, r, maxDays)
+	if !ok {
 		return
 	}
-	data, err := h.service.GetUserUsage(r.Context(), uuid, from, to, granularity)
+	data, err := h.service.GetUserUsage(r.Context(), userID, from, to, granularity)
 	if err != nil {
 		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get analytics data", err)
 		return
 	}
-	json.NewEncoder(w).Encode(data)
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+// parseAnalyticsRange reads the from and to dates (YYYY-MM-DD, inclusive),
+// defaulting to the last seven days. It answers 400 and returns false when
+// they are malformed, reversed or span more than maxDays.
+func parseAnalyticsRange(w http.ResponseWriter, r *http.Request, maxDays int) (from, to time.Time, ok bool) {
+	query := r.URL.Query()
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	if value := query.Get("to"); value != "" {
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "to must be a date (YYYY-MM-DD)", err)
+			return from, to, false
+		}
+		to = t
+	}
+	from = to.AddDate(0, 0, -7)
+	if value := query.Get("from"); value != "" {
+		t, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "from must be a date (YYYY-MM-DD)", err)
+			return from, to, false
+		}
+		from = t
+	}
+	if from.After(to) {
+		functions.RespondwithError(w, http.StatusBadRequest, "from must not be after to", fmt.Errorf("from %s is after to %s", from.Format(time.DateOnly), to.Format(time.DateOnly)))
+		return from, to, false
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxDays {
+		functions.RespondwithError(w, http.StatusBadRequest, fmt.Sprintf("range may span at most %d days", maxDays), fmt.Errorf("range spans %d days", days))
+		return from, to, false
+	}
+	return from, to, true
 }
 
 func (h *AnalyticsHandler) GetWorkerHealth(w http.ResponseWriter, r *http.Request) {
-	workerID := chi.URLParam(r, "worker_id")
-	fromStr := r.URL.Query().Get("from")
-	toStr := r.URL.Query().Get("to")
-	from, err := time.Parse("2006-01-02", fromStr)
+	workerID, err := uuid.Parse(chi.URLParam(r, "worker_id"))
 	if err != nil {
-		from = time.Now().AddDate(0, 0, -7)
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid worker id", err)
+		return
 	}
-	to, err := time.Parse("2006-01-02", toStr)
+	from, to, ok := parseAnalyticsRange(w, r, maxHealthRange)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetWorkerHealth(r.Context(), workerID, from, to)
 	if err != nil {
-		to = time.Now()
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get worker health data", err)
+		return
 	}
-	uuid, err := uuid.Parse(workerID)
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+func (h *AnalyticsHandler) GetUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	upstreamID, err := uuid.Parse(chi.URLParam(r, "upstream_id"))
 	if err != nil {
-		functions.RespondwithError(w, http.StatusInternalServerError, "failed to parse worker id", err)
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid upstream id", err)
+		return
+	}
+	from, to, ok := parseAnalyticsRange(w, r, maxHealthRange)
+	if !ok {
 		return
 	}
-	data, err := h.service.GetWorkerHealth(r.Context(), uuid, from, to)
+	data, err := h.service.GetUpstreamHealth(r.Context(), upstreamID, from, to)
 	if err != nil {
-		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get worker health data", err)
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get upstream health data", err)
 		return
 	}
-	json.NewEncoder(w).Encode(data)
+	functions.RespondwithJSON(w, http.StatusOK, data)
 }
 
 func (h *AnalyticsHandler) GetUserWebsiteAccess(w http.ResponseWriter, r *http.Request) {
@@ -106,3 +177,91 @@ func (h *AnalyticsHandler) GetUserWebsiteAccess(w http.ResponseWriter, r *http.R
 	}
 	json.NewEncoder(w).Encode(data)
 }
+
+func (h *AnalyticsHandler) GetTopUsers(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseAnalyticsRange(w, r, maxFleetRange)
+	if !ok {
+		return
+	}
+	limit, ok := parseTopLimit(w, r)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetTopUsers(r.Context(), from, to, limit)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get top users", err)
+		return
+	}
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+func (h *AnalyticsHandler) GetTopDestinations(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseAnalyticsRange(w, r, maxFleetRange)
+	if !ok {
+		return
+	}
+	limit, ok := parseTopLimit(w, r)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetTopDestinations(r.Context(), from, to, limit)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get top destinations", err)
+		return
+	}
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+func (h *AnalyticsHandler) GetPoolTraffic(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseAnalyticsRange(w, r, maxFleetRange)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetPoolTraffic(r.Context(), from, to)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get pool traffic", err)
+		return
+	}
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+func (h *AnalyticsHandler) GetRegionTraffic(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseAnalyticsRange(w, r, maxFleetRange)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetRegionTraffic(r.Context(), from, to)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get region traffic", err)
+		return
+	}
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+func (h *AnalyticsHandler) GetProtocolTraffic(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseAnalyticsRange(w, r, maxFleetRange)
+	if !ok {
+		return
+	}
+	data, err := h.service.GetProtocolTraffic(r.Context(), from, to)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "failed to get protocol traffic", err)
+		return
+	}
+	functions.RespondwithJSON(w, http.StatusOK, data)
+}
+
+// parseTopLimit reads the limit of a top-N query. It answers 400 and returns
+// false when it is not between 1 and maxTopLimit.
+func parseTopLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultTopLimit, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxTopLimit {
+		functions.RespondwithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxTopLimit), fmt.Errorf("invalid limit %q", value))
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
+	middleware "github.com/torchlabssoftware/subnetwork_system/internal/server/middleware"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	service "github.com/torchlabssoftware/subnetwork_system/internal/server/service"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type AuditHandler struct {
+	service service.AuditService
+}
+
+func NewAuditHandler(service service.AuditService) *AuditHandler {
+	return &AuditHandler{
+		service: service,
+	}
+}
+
+func (h *AuditHandler) AdminRoutes() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.AdminAuthentication)
+	r.Use(middleware.RequireScope(models.ScopeAuditRead))
+	r.Get("/", h.getAuditLog)
+	return r
+}
+
+func (h *AuditHandler) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.AuditLogFilter{Limit: defaultAuditLimit}
+
+	if actor := query.Get("actor"); actor != "" {
+		filter.Actor = &actor
+	}
+	if entityType := query.Get("entity_type"); entityType != "" {
+		filter.EntityType = &entityType
+	}
+	if entityId := query.Get("entity_id"); entityId != "" {
+		filter.EntityId = &entityId
+	}
+	if from := query.Get("from"); from != "" {
+		t, err := parseAuditTime(from)
+		if err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid from", err)
+			return
+		}
+		filter.From = &t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := parseAuditTime(to)
+		if err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid to", err)
+			return
+		}
+		filter.To = &t
+	}
+	if filter.From != nil && filter.To != nil && filter.From.After(*filter.To) {
+		functions.RespondwithError(w, http.StatusBadRequest, "from must be before to", fmt.Errorf("from %s is after to %s", filter.From, filter.To))
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			functions.RespondwithError(w, http.StatusBadRequest, "limit must be between 1 and 1000", fmt.Errorf("invalid limit %q", limit))
+			return
+		}
+		filter.Limit = int32(n)
+	}
+
+	response, code, message, err := h.service.GetAuditLog(r.Context(), filter)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, http.StatusOK, response)
+}
+
+// parseAuditTime accepts an RFC3339 timestamp or a plain date.
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -10,6 +10,7 @@ import (
 	middleware "github.com/torchlabssoftware/subnetwork_system/internal/server/middleware"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 	"github.com/torchlabssoftware/subnetwork_system/internal/server/service"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
 )
 
 type PoolHandler struct {
@@ -27,23 +28,33 @@ func (p *PoolHandler) AdminRoutes() http.Handler {
 
 	r.Use(middleware.AdminAuthentication)
 
-	r.Get("/region", p.getRegions)
-	r.Post("/region", p.createRegion)
-	r.Delete("/region", p.DeleteRegion)
-	r.Get("/country", p.getcountries)
-	r.Post("/country", p.createCountry)
-	r.Delete("/country", p.DeleteCountry)
-	r.Get("/upstream", p.getUpstreams)
-	r.Post("/upstream", p.createUpstream)
-	r.Delete("/upstream", p.deleteUpstream)
-
-	r.Post("/", p.createPool)
-	r.Get("/", p.getPools)
-	r.Get("/{tag}", p.getPoolByTag)
-	r.Put("/{tag}", p.updatePool)
-	r.Delete("/{tag}", p.deletePool)
-	r.Post("/weight", p.addPoolUpstreamWeight)
-	r.Delete("/weight", p.deletePoolUpstreamWeight)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopePoolsRead))
+		r.Get("/region", p.getRegions)
+		r.Get("/country", p.getcountries)
+		r.Get("/country/{code}", p.getCountryCatalog)
+		r.Get("/upstream", p.getUpstreams)
+		r.Get("/", p.getPools)
+		r.Get("/{tag}", p.getPoolByTag)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopePoolsWrite))
+		r.Post("/region", p.createRegion)
+		r.Delete("/region", p.DeleteRegion)
+		r.Post("/country", p.createCountry)
+		r.Delete("/country", p.DeleteCountry)
+		r.Post("/country/state", p.createState)
+		r.Delete("/country/state", p.deleteState)
+		r.Post("/country/city", p.createCity)
+		r.Delete("/country/city", p.deleteCity)
+		r.Post("/upstream", p.createUpstream)
+		r.Delete("/upstream", p.deleteUpstream)
+		r.Post("/", p.createPool)
+		r.Put("/{tag}", p.updatePool)
+		r.Delete("/{tag}", p.deletePool)
+		r.Post("/weight", p.addPoolUpstreamWeight)
+		r.Delete("/weight", p.deletePoolUpstreamWeight)
+	})
 	return r
 }
 
@@ -127,6 +138,10 @@ func (p *PoolHandler) createCountry(w http.ResponseWriter, r *http.Request) {
 		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", fmt.Errorf("err in request body"))
 		return
 	}
+	if err := functions.ValidateTargetingCode(*req.Code); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid country code", err)
+		return
+	}
 
 	res, status, message, err := p.Service.CreateCountry(r.Context(), req)
 	if err != nil {
@@ -164,6 +179,126 @@ func (p *PoolHandler) DeleteCountry(w http.ResponseWriter, r *http.Request) {
 	functions.RespondwithJSON(w, http.StatusOK, res)
 }
 
+func (p *PoolHandler) getCountryCatalog(w http.ResponseWriter, r *http.Request) {
+	code := chi.URLParam(r, "code")
+	if code == "" {
+		functions.RespondwithError(w, http.StatusBadRequest, "country code is required", fmt.Errorf("missing code param"))
+		return
+	}
+
+	res, status, message, err := p.Service.GetCountryCatalog(r.Context(), code)
+	if err != nil {
+		functions.RespondwithError(w, status, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, http.StatusOK, res)
+}
+
+func (p *PoolHandler) createState(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", err)
+		return
+	}
+
+	if (req.CountryCode == nil || *req.CountryCode == "") || (req.Name == nil || *req.Name == "") || (req.Code == nil || *req.Code == "") {
+		functions.RespondwithError(w, http.StatusBadRequest, "country_code, name and code are required", fmt.Errorf("missing fields"))
+		return
+	}
+	if err := functions.ValidateTargetingCode(*req.Code); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid state code", err)
+		return
+	}
+
+	res, status, message, err := p.Service.CreateState(r.Context(), req)
+	if err != nil {
+		functions.RespondwithError(w, status, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, http.StatusCreated, res)
+}
+
+func (p *PoolHandler) deleteState(w http.ResponseWriter, r *http.Request) {
+	var req models.DeleteStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", err)
+		return
+	}
+
+	if (req.CountryCode == nil || *req.CountryCode == "") || (req.Code == nil || *req.Code == "") {
+		functions.RespondwithError(w, http.StatusBadRequest, "country_code and code are required", fmt.Errorf("missing fields"))
+		return
+	}
+
+	code, message, err := p.Service.DeleteState(r.Context(), req)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	res := struct {
+		Message string `json:"message"`
+	}{
+		Message: message,
+	}
+
+	functions.RespondwithJSON(w, http.StatusOK, res)
+}
+
+func (p *PoolHandler) createCity(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateCityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", err)
+		return
+	}
+
+	if (req.CountryCode == nil || *req.CountryCode == "") || (req.Name == nil || *req.Name == "") || (req.Code == nil || *req.Code == "") {
+		functions.RespondwithError(w, http.StatusBadRequest, "country_code, name and code are required", fmt.Errorf("missing fields"))
+		return
+	}
+	if err := functions.ValidateTargetingCode(*req.Code); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid city code", err)
+		return
+	}
+
+	res, status, message, err := p.Service.CreateCity(r.Context(), req)
+	if err != nil {
+		functions.RespondwithError(w, status, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, http.StatusCreated, res)
+}
+
+func (p *PoolHandler) deleteCity(w http.ResponseWriter, r *http.Request) {
+	var req models.DeleteCityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", err)
+		return
+	}
+
+	if (req.CountryCode == nil || *req.CountryCode == "") || (req.Code == nil || *req.Code == "") {
+		functions.RespondwithError(w, http.StatusBadRequest, "country_code and code are required", fmt.Errorf("missing fields"))
+		return
+	}
+
+	code, message, err := p.Service.DeleteCity(r.Context(), req)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	res := struct {
+		Message string `json:"message"`
+	}{
+		Message: message,
+	}
+
+	functions.RespondwithJSON(w, http.StatusOK, res)
+}
+
 func (p *PoolHandler) getUpstreams(w http.ResponseWriter, r *http.Request) {
 	upstreams, status, message, err := p.Service.GetUpstreams(r.Context())
 	if err != nil {
@@ -189,6 +324,11 @@ func (p *PoolHandler) createUpstream(w http.ResponseWriter, r *http.Request) {
 		functions.RespondwithError(w, http.StatusBadRequest, "err in request body", fmt.Errorf("err in request body"))
 		return
 	}
+	// without an adapter workers could not build credentials for this upstream
+	if _, err := providers.ForUpstream(*req.UpstreamProvider, *req.ConfigFormat); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid upstream provider or config_format", err)
+		return
+	}
 
 	res, status, message, err := p.Service.CreateUpstream(r.Context(), req)
 	if err != nil {
@@ -342,11 +482,16 @@ func (p *PoolHandler) addPoolUpstreamWeight(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if (req.PoolTag == nil || *req.PoolTag == "") || (req.UpstreamTag == nil || *req.UpstreamTag == "") || (req.Weight == nil || *req.Weight == 0) {
+	if (req.PoolTag == nil || *req.PoolTag == "") || (req.UpstreamTag == nil || *req.UpstreamTag == "") || req.Weight == nil {
 		functions.RespondwithError(w, http.StatusBadRequest, "Pool Tag, Upstream Tag and Weight are required", fmt.Errorf("missing fields"))
 		return
 	}
 
+	if *req.Weight < 0 {
+		functions.RespondwithError(w, http.StatusBadRequest, "Weight must be 0 or greater", fmt.Errorf("invalid weight"))
+		return
+	}
+
 	code, message, err := p.Service.AddPoolUpstreamWeight(r.Context(), req)
 	if err != nil {
 		functions.RespondwithError(w, code, message, err)
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
+	middleware "github.com/torchlabssoftware/subnetwork_system/internal/server/middleware"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	service "github.com/torchlabssoftware/subnetwork_system/internal/server/service"
+)
+
+type TokenHandler struct {
+	service service.TokenService
+}
+
+func NewTokenHandler(service service.TokenService) *TokenHandler {
+	return &TokenHandler{
+		service: service,
+	}
+}
+
+func (h *TokenHandler) AdminRoutes() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.AdminAuthentication)
+	r.Use(middleware.RequireScope(models.ScopeTokensWrite))
+	r.Post("/", h.createToken)
+	r.Get("/", h.getTokens)
+	r.Delete("/{id}", h.revokeToken)
+	return r
+}
+
+func (h *TokenHandler) createToken(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateApiTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid request body", err)
+		return
+	}
+
+	if req.Name == nil || *req.Name == "" {
+		functions.RespondwithError(w, http.StatusBadRequest, "name is required", fmt.Errorf("name is required"))
+		return
+	}
+	if req.Scopes == nil || len(*req.Scopes) == 0 {
+		functions.RespondwithError(w, http.StatusBadRequest, "scopes are required", fmt.Errorf("scopes are required"))
+		return
+	}
+	for _, scope := range *req.Scopes {
+		if !slices.Contains(models.ValidScopes, scope) {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid scope "+scope, fmt.Errorf("invalid scope %s", scope))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		functions.RespondwithError(w, http.StatusBadRequest, "expires_at must be in the future", fmt.Errorf("expires_at is in the past"))
+		return
+	}
+
+	caller, _ := middleware.Principal(r.Context())
+	response, code, message, err := h.service.CreateToken(r.Context(), caller, &req)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, *response)
+}
+
+func (h *TokenHandler) getTokens(w http.ResponseWriter, r *http.Request) {
+	response, code, message, err := h.service.GetTokens(r.Context())
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, http.StatusOK, response)
+}
+
+func (h *TokenHandler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid token id", err)
+		return
+	}
+
+	code, message, err := h.service.RevokeToken(r.Context(), id)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, map[string]string{"message": message})
+}
@@ -26,19 +26,26 @@ func NewUserHandler(service service.UserService) *UserHandler {
 func (h *UserHandler) AdminRoutes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.AdminAuthentication)
-	r.Post("/", h.createUser)
-	r.Get("/", h.getUsers)
-	r.Get("/{id}", h.getUserbyId)
-	r.Patch("/{id}", h.UpdateUserStatus)
-	r.Delete("/{id}", h.deleteUser)
-	r.Get("/{id}/data-usage", h.getDataUsage)
-	r.Get("/{id}/pools", h.getUserAllowPools)
-	r.Post("/{id}/pools", h.addUserAllowPool)
-	r.Delete("/{id}/pools", h.removeUserAllowPool)
-	r.Get("/{id}/ipwhitelist", h.getUserIpWhitelist)
-	r.Post("/{id}/ipwhitelist", h.addUserIpWhitelist)
-	r.Delete("/{id}/ipwhitelist", h.removeUserIpWhitelist)
-	r.Post("/generate", h.GenerateproxyString)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopeUsersRead))
+		r.Get("/", h.getUsers)
+		r.Get("/{id}", h.getUserbyId)
+		r.Get("/{id}/data-usage", h.getDataUsage)
+		r.Get("/{id}/pools", h.getUserAllowPools)
+		r.Get("/{id}/ipwhitelist", h.getUserIpWhitelist)
+		r.Post("/generate", h.GenerateproxyString)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopeUsersWrite))
+		r.Post("/", h.createUser)
+		r.Patch("/{id}", h.UpdateUserStatus)
+		r.Delete("/{id}", h.deleteUser)
+		r.Post("/{id}/rotate-password", h.rotatePassword)
+		r.Post("/{id}/pools", h.addUserAllowPool)
+		r.Delete("/{id}/pools", h.removeUserAllowPool)
+		r.Post("/{id}/ipwhitelist", h.addUserIpWhitelist)
+		r.Delete("/{id}/ipwhitelist", h.removeUserIpWhitelist)
+	})
 	return r
 }
 
@@ -49,6 +56,37 @@ func (h *UserHandler) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.IpWhiteList != nil {
+		if err := functions.ValidateIpWhitelist(*req.IpWhiteList); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid ip whitelist", err)
+			return
+		}
+	}
+	if req.MaxConnections != nil {
+		if err := functions.ValidateMaxConnections(*req.MaxConnections); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid max_connections", err)
+			return
+		}
+	}
+	if req.BandwidthLimit != nil {
+		if err := functions.ValidateBandwidthLimit(*req.BandwidthLimit); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid bandwidth_limit", err)
+			return
+		}
+	}
+	if req.AllowPools != nil {
+		for _, pool := range *req.AllowPools {
+			if err := functions.ValidateMaxConnections(pool.MaxConnections); err != nil {
+				functions.RespondwithError(w, http.StatusBadRequest, "invalid max_connections", err)
+				return
+			}
+			if err := functions.ValidateBandwidthLimit(pool.BandwidthLimit); err != nil {
+				functions.RespondwithError(w, http.StatusBadRequest, "invalid bandwidth_limit", err)
+				return
+			}
+		}
+	}
+
 	responce, code, message, err := h.service.CreateUser(r.Context(), &req)
 	if err != nil {
 		functions.RespondwithError(w, code, message, err)
@@ -103,6 +141,18 @@ func (h *UserHandler) UpdateUserStatus(w http.ResponseWriter, r *http.Request) {
 		functions.RespondwithError(w, http.StatusBadRequest, "invalid body", err)
 		return
 	}
+	if req.MaxConnections != nil {
+		if err := functions.ValidateMaxConnections(*req.MaxConnections); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid max_connections", err)
+			return
+		}
+	}
+	if req.BandwidthLimit != nil {
+		if err := functions.ValidateBandwidthLimit(*req.BandwidthLimit); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid bandwidth_limit", err)
+			return
+		}
+	}
 
 	response, code, message, err := h.service.UpdateUserStatus(r.Context(), id, &req)
 	if err != nil {
@@ -137,6 +187,23 @@ func (h *UserHandler) deleteUser(w http.ResponseWriter, r *http.Request) {
 	functions.RespondwithJSON(w, http.StatusOK, res)
 }
 
+func (h *UserHandler) rotatePassword(w http.ResponseWriter, r *http.Request) {
+	userId := chi.URLParam(r, "id")
+	id, err := uuid.Parse(userId)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid user id", err)
+		return
+	}
+
+	response, code, message, err := h.service.RotatePassword(r.Context(), id)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, *response)
+}
+
 func (h *UserHandler) getDataUsage(w http.ResponseWriter, r *http.Request) {
 	//get the user id
 	userId := chi.URLParam(r, "id")
@@ -187,6 +254,16 @@ func (h *UserHandler) addUserAllowPool(w http.ResponseWriter, r *http.Request) {
 		functions.RespondwithError(w, http.StatusInternalServerError, "server error", err)
 		return
 	}
+	for _, pool := range req.UserPool {
+		if err := functions.ValidateMaxConnections(pool.MaxConnections); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid max_connections", err)
+			return
+		}
+		if err := functions.ValidateBandwidthLimit(pool.BandwidthLimit); err != nil {
+			functions.RespondwithError(w, http.StatusBadRequest, "invalid bandwidth_limit", err)
+			return
+		}
+	}
 
 	response, code, message, err := h.service.AddUserAllowPool(r.Context(), id, &req)
 	if err != nil {
@@ -261,6 +338,11 @@ func (h *UserHandler) addUserIpWhitelist(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := functions.ValidateIpWhitelist(req.IpWhitelist); err != nil {
+		functions.RespondwithError(w, http.StatusBadRequest, "invalid ip whitelist", err)
+		return
+	}
+
 	response, code, message, err := h.service.AddUserIpWhitelist(r.Context(), id, &req)
 	if err != nil {
 		functions.RespondwithError(w, code, message, err)
@@ -3,7 +3,9 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
@@ -28,19 +30,28 @@ func NewWorkerHandler(workerService service.WorkerService) *WorkerHandler {
 func (wh *WorkerHandler) AdminRoutes() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.AdminAuthentication)
-	r.Post("/", wh.AddWorker)
-	r.Get("/", wh.GetAllWorkers)
-	r.Get("/{name}", wh.GetWorkerByName)
-	r.Delete("/{name}", wh.DeleteWorker)
-	r.Post("/{name}/domains", wh.AddWorkerDomain)
-	r.Delete("/{name}/domains", wh.DeleteWorkerDomain)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopeWorkersRead))
+		r.Get("/", wh.GetAllWorkers)
+		r.Get("/status", wh.GetWorkerStatuses)
+		r.Get("/events", wh.StreamWorkerEvents)
+		r.Get("/{name}", wh.GetWorkerByName)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(models.ScopeWorkersWrite))
+		r.Post("/", wh.AddWorker)
+		r.Delete("/{name}", wh.DeleteWorker)
+		r.Post("/{name}/rotate-secret", wh.RotateWorkerSecret)
+		r.Post("/{name}/revoke-secret", wh.RevokeWorkerSecret)
+		r.Post("/{name}/domains", wh.AddWorkerDomain)
+		r.Delete("/{name}/domains", wh.DeleteWorkerDomain)
+	})
 	return r
 }
 
 func (wh *WorkerHandler) WorkerRoutes() http.Handler {
 	r := chi.NewRouter()
-	r.Use(middleware.WorkerAuthentication)
-	r.Post("/ws/login", wh.login)
+	r.With(middleware.WorkerAuthentication).Post("/ws/login", wh.login)
 	r.Get("/ws/serve", wh.serveWS)
 	return r
 }
@@ -55,13 +66,17 @@ func (wh *WorkerHandler) login(w http.ResponseWriter, r *http.Request) {
 		functions.RespondwithError(w, http.StatusBadRequest, "WorkerId is required", fmt.Errorf("worker_id is required"))
 		return
 	}
-	code, message, err := wh.workerService.Login(r.Context(), *req.WorkerId)
+	code, message, err := wh.workerService.Login(r.Context(), *req.WorkerId, middleware.WorkerSecret(r.Context()))
 	if err != nil {
 		functions.RespondwithError(w, code, message, err)
 		return
 	}
 
-	newOTP := wh.workerService.NewOTP(req.WorkerId)
+	newOTP, err := wh.workerService.NewOTP(req.WorkerId)
+	if err != nil {
+		functions.RespondwithError(w, http.StatusInternalServerError, "Failed to create OTP", err)
+		return
+	}
 	resp := &models.WorkerLoginResponce{
 		Otp: newOTP,
 	}
@@ -143,6 +158,61 @@ func (wh *WorkerHandler) GetWorkerByName(w http.ResponseWriter, r *http.Request)
 	functions.RespondwithJSON(w, code, worker)
 }
 
+func (wh *WorkerHandler) GetWorkerStatuses(w http.ResponseWriter, r *http.Request) {
+	statuses, code, message, err := wh.workerService.GetWorkerStatuses(r.Context())
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, statuses)
+}
+
+// workerEventsKeepAlive is how often an idle event stream gets a comment, so
+// proxies do not close it.
+const workerEventsKeepAlive = 15 * time.Second
+
+// StreamWorkerEvents sends worker connects and disconnects as server-sent
+// events until the client goes away.
+func (wh *WorkerHandler) StreamWorkerEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		functions.RespondwithError(w, http.StatusInternalServerError, "Streaming not supported", fmt.Errorf("response writer cannot flush"))
+		return
+	}
+	// The server's write timeout is meant for ordinary responses; lift it so
+	// the stream is not cut off.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("[worker] failed to clear write deadline of event stream: %v", err)
+	}
+	events, unsubscribe := wh.workerService.SubscribeWorkerEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(workerEventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
 func (wh *WorkerHandler) DeleteWorker(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if name == "" {
@@ -165,6 +235,38 @@ func (wh *WorkerHandler) DeleteWorker(w http.ResponseWriter, r *http.Request) {
 	functions.RespondwithJSON(w, code, res)
 }
 
+func (wh *WorkerHandler) RotateWorkerSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		functions.RespondwithError(w, http.StatusBadRequest, "Worker name is required", fmt.Errorf("name is required"))
+		return
+	}
+
+	res, code, message, err := wh.workerService.RotateWorkerSecret(r.Context(), name)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, res)
+}
+
+func (wh *WorkerHandler) RevokeWorkerSecret(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if name == "" {
+		functions.RespondwithError(w, http.StatusBadRequest, "Worker name is required", fmt.Errorf("name is required"))
+		return
+	}
+
+	code, message, err := wh.workerService.RevokeWorkerSecret(r.Context(), name)
+	if err != nil {
+		functions.RespondwithError(w, code, message, err)
+		return
+	}
+
+	functions.RespondwithJSON(w, code, map[string]string{"message": message})
+}
+
 func (wh *WorkerHandler) AddWorkerDomain(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	if name == "" {
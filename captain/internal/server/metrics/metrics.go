@@ -0,0 +1,122 @@
+// Package metrics holds captain's Prometheus metrics. They live on their own
+// registry, served by Handler, rather than the global default one.
+package metrics
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "captain"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// ConnectedWorkers counts the workers holding a websocket on this replica.
+	ConnectedWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connected_workers",
+		Help:      "Workers connected to this replica over websocket.",
+	})
+
+	// AnalyticsQueueDepth is the number of entries waiting in each analytics
+	// buffer for the next ClickHouse flush.
+	AnalyticsQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "analytics_queue_depth",
+		Help:      "Entries buffered for ClickHouse, by queue.",
+	}, []string{"queue"})
+
+	// AnalyticsDropped counts entries rejected because their buffer was full.
+	AnalyticsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "analytics_dropped_total",
+		Help:      "Entries rejected because the analytics buffer was full, by queue.",
+	}, []string{"queue"})
+
+	clickHouseFlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "clickhouse_flush_duration_seconds",
+		Help:      "Time taken to write a batch to ClickHouse, by table.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"table"})
+
+	clickHouseFlushErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clickhouse_flush_errors_total",
+		Help:      "Batches ClickHouse failed to accept, by table.",
+	}, []string{"table"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		ConnectedWorkers,
+		AnalyticsQueueDepth,
+		AnalyticsDropped,
+		clickHouseFlushDuration,
+		clickHouseFlushErrors,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB exports the connection pool stats of db. It only needs calling
+// once per process; later calls for the same name are ignored.
+func RegisterDB(db *sql.DB, name string) {
+	if err := registry.Register(collectors.NewDBStatsCollector(db, name)); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			log.Printf("[metrics] failed to register %s pool stats: %v", name, err)
+		}
+	}
+}
+
+// ObserveClickHouseFlush records a batch write to table that began at start.
+func ObserveClickHouseFlush(table string, start time.Time, err error) {
+	clickHouseFlushDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		clickHouseFlushErrors.WithLabelValues(table).Inc()
+	}
+}
+
+// Middleware records the latency of each request under its chi route
+// pattern, so paths with ids are grouped together. Requests that match no
+// route are counted as "unmatched".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
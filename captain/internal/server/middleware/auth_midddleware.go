@@ -1,14 +1,36 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
 
+	chimiddleware "github.com/go-chi/chi/middleware"
 	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
+type principalKey struct{}
+
+// tokenAuthenticator resolves api tokens other than the root ADMIN_API_KEY.
+// Until it is set only the root key is accepted.
+var tokenAuthenticator models.TokenAuthenticator
+
+func SetTokenAuthenticator(authenticator models.TokenAuthenticator) {
+	tokenAuthenticator = authenticator
+}
+
+// Principal returns the caller authenticated by AdminAuthentication.
+func Principal(ctx context.Context) (*models.ApiPrincipal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*models.ApiPrincipal)
+	return principal, ok
+}
+
+// AdminAuthentication accepts the root ADMIN_API_KEY, which holds every scope,
+// or a named api token, and stores the caller in the request context.
 func AdminAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		adminKey := strings.TrimSpace(os.Getenv("ADMIN_API_KEY"))
@@ -30,23 +52,60 @@ func AdminAuthentication(next http.Handler) http.Handler {
 		}
 
 		key := strings.TrimSpace(parts[1])
-		if key != adminKey {
+		var principal *models.ApiPrincipal
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+			principal = &models.ApiPrincipal{Name: "root", Scopes: []string{models.ScopeAll}}
+		} else if tokenAuthenticator != nil {
+			p, err := tokenAuthenticator.Authenticate(r.Context(), key)
+			if err != nil {
+				http.Error(w, "forbidden", http.StatusUnauthorized)
+				return
+			}
+			principal = p
+		} else {
 			http.Error(w, "forbidden", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		ctx = models.ContextWithAuditActor(ctx, models.AuditActor{
+			TokenID:   principal.TokenID,
+			Name:      principal.Name,
+			Route:     r.Method + " " + r.URL.Path,
+			RequestID: chimiddleware.GetReqID(r.Context()),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireScope rejects requests whose caller was not granted scope. It must
+// run after AdminAuthentication.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := Principal(r.Context())
+			if !ok || !principal.HasScope(scope) {
+				functions.RespondwithError(w, http.StatusForbidden, "missing scope "+scope, fmt.Errorf("caller lacks scope %s", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type workerSecretKey struct{}
+
+// WorkerSecret returns the secret presented to WorkerAuthentication.
+func WorkerSecret(ctx context.Context) string {
+	secret, _ := ctx.Value(workerSecretKey{}).(string)
+	return secret
+}
+
+// WorkerAuthentication extracts the worker's own secret from the ApiKey
+// header. The secret is checked against the worker row by the login handler,
+// since which worker it belongs to is only known from the request body.
 func WorkerAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		workerKey := strings.TrimSpace(os.Getenv("WORKER_API_KEY"))
-		if workerKey == "" {
-			functions.RespondwithError(w, http.StatusInternalServerError, "api key not found", fmt.Errorf("api key not found"))
-			return
-		}
-
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "missing api key", http.StatusUnauthorized)
@@ -60,11 +119,12 @@ func WorkerAuthentication(next http.Handler) http.Handler {
 		}
 
 		key := strings.TrimSpace(parts[1])
-		if key != workerKey {
-			http.Error(w, "forbidden", http.StatusUnauthorized)
+		if key == "" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), workerSecretKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
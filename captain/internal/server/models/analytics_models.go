@@ -21,64 +21,232 @@ type UserDataUsage struct {
 	DestinationHost string    `json:"destination_host"`
 	DestinationPort uint16    `json:"destination_port"`
 	StatusCode      uint16    `json:"status_code"`
+	// RequestCount is how many connections the row covers: 1 for a single
+	// telemetry_usage event, more for a rolled up batch entry.
+	RequestCount uint64 `json:"-"`
+	// Seq is the worker's telemetry sequence number, acked back to the worker
+	// once the row is committed. Zero for workers that do not spool.
+	Seq uint64 `json:"-"`
+}
+
+// UserDataUsageBatch is the usage a worker rolled up over one window, sent as
+// a telemetry_usage_batch event.
+type UserDataUsageBatch struct {
+	WorkerID     uuid.UUID                 `json:"worker_id"`
+	WorkerRegion string                    `json:"worker_region"`
+	WindowStart  time.Time                 `json:"window_start"`
+	WindowEnd    time.Time                 `json:"window_end"`
+	Entries      []UserDataUsageBatchEntry `json:"entries"`
+}
+
+type UserDataUsageBatchEntry struct {
+	UserID          uuid.UUID `json:"user_id"`
+	Username        string    `json:"username"`
+	PoolID          uuid.UUID `json:"pool_id"`
+	PoolName        string    `json:"pool_name"`
+	DestinationHost string    `json:"destination_host"`
+	Protocol        string    `json:"protocol"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	Requests        uint64    `json:"requests"`
 }
 
 type UpstreamHealth struct {
-	UpstreamID  uuid.UUID `json:"upstream_id"`
-	UpstreamTag string    `json:"upstream_tag"`
-	Status      string    `json:"status"`
-	Latency     int64     `json:"latency"`
-	ErrorRate   float32   `json:"error_rate"`
+	UpstreamID  uuid.UUID `ch:"upstream_id" json:"upstream_id"`
+	UpstreamTag string    `ch:"upstream_tag" json:"upstream_tag"`
+	Status      string    `ch:"status" json:"status"`
+	Latency     int64     `ch:"latency" json:"latency"`
+	ErrorRate   float32   `ch:"error_rate" json:"error_rate"`
 }
 
 type WorkerHealth struct {
-	WorkerID              uuid.UUID        `json:"worker_id"`
-	WorkerName            string           `json:"worker_name"`
-	Region                string           `json:"region"`
-	PoolTag               string           `json:"pool_tag"`
-	Status                string           `json:"status"`
-	CpuUsage              float32          `json:"cpu_usage"`
-	MemoryUsage           float32          `json:"memory_usage"`
-	ActiveConnections     uint32           `json:"active_connections"`
-	TotalConnections      uint64           `json:"total_connections"`
-	BytesThroughputPerSec uint64           `json:"bytes_throughput_per_sec"`
-	ErrorRate             float32          `json:"error_rate"`
-	Upstreams             []UpstreamHealth `json:"upstreams"`
+	Timestamp             time.Time        `ch:"timestamp" json:"timestamp"`
+	WorkerID              uuid.UUID        `ch:"worker_id" json:"worker_id"`
+	WorkerName            string           `ch:"worker_name" json:"worker_name"`
+	Region                string           `ch:"region" json:"region"`
+	PoolTag               string           `ch:"pool_tag" json:"pool_tag"`
+	Status                string           `ch:"status" json:"status"`
+	CpuUsage              float32          `ch:"cpu_usage" json:"cpu_usage"`
+	MemoryUsage           float32          `ch:"memory_usage" json:"memory_usage"`
+	ActiveConnections     uint32           `ch:"active_connections" json:"active_connections"`
+	TotalConnections      uint64           `ch:"total_connections" json:"total_connections"`
+	BytesThroughputPerSec uint64           `ch:"bytes_throughput_per_sec" json:"bytes_throughput_per_sec"`
+	ErrorRate             float32          `ch:"error_rate" json:"error_rate"`
+	Upstreams             []UpstreamHealth `ch:"-" json:"upstreams"`
+}
+
+// UpstreamLatencyStats summarises upstream health reports. Each report carries
+// the average latency of the requests since the previous one, so the
+// percentiles are over those averages; reports without requests are left out
+// of the latency figures.
+type UpstreamLatencyStats struct {
+	Reports    uint64  `ch:"reports" json:"reports"`
+	LatencyAvg float64 `ch:"latency_avg" json:"latency_avg"`
+	LatencyP50 float64 `ch:"latency_p50" json:"latency_p50"`
+	LatencyP90 float64 `ch:"latency_p90" json:"latency_p90"`
+	LatencyP99 float64 `ch:"latency_p99" json:"latency_p99"`
+	ErrorRate  float64 `ch:"error_rate" json:"error_rate"`
+}
+
+type UpstreamWorkerHealth struct {
+	WorkerID   uuid.UUID `ch:"worker_id" json:"worker_id"`
+	LastStatus string    `ch:"last_status" json:"last_status"`
+	UpstreamLatencyStats
+}
+
+// UpstreamHealthResponce is an upstream's health between From and To (whole
+// days, inclusive), across all workers and per worker.
+type UpstreamHealthResponce struct {
+	UpstreamID  uuid.UUID `json:"upstream_id"`
+	UpstreamTag string    `json:"upstream_tag"`
+	From        time.Time `json:"from"`
+	To          time.Time `json:"to"`
+	UpstreamLatencyStats
+	Workers []UpstreamWorkerHealth `json:"workers"`
 }
 
 type WebsiteAccess struct {
-	UserID        uuid.UUID `json:"user_id"`
-	Username      string    `json:"username"`
-	Domain        string    `json:"domain"`
-	Subdomain     string    `json:"subdomain"`
-	FullURL       string    `json:"full_url"`
-	BytesSent     uint64    `json:"bytes_sent"`
-	BytesReceived uint64    `json:"bytes_received"`
-	RequestMethod string    `json:"request_method"`
-	StatusCode    uint16    `json:"status_code"`
-	ContentType   string    `json:"content_type"`
-
-	SourceIP string `json:"source_ip"`
-}
-
-type UserUsageHourly struct {
-	Date               time.Time `ch:"date" json:"date"`
-	Hour               time.Time `ch:"hour" json:"hour"`
-	UserID             uuid.UUID `ch:"user_id" json:"user_id"`
-	Username           string    `ch:"username" json:"username"`
+	Timestamp     time.Time `ch:"timestamp" json:"timestamp"`
+	UserID        uuid.UUID `ch:"user_id" json:"user_id"`
+	Username      string    `ch:"username" json:"username"`
+	Domain        string    `ch:"domain" json:"domain"`
+	Subdomain     string    `ch:"subdomain" json:"subdomain"`
+	FullURL       string    `ch:"full_url" json:"full_url"`
+	BytesSent     uint64    `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived uint64    `ch:"bytes_received" json:"bytes_received"`
+	RequestMethod string    `ch:"request_method" json:"request_method"`
+	StatusCode    uint16    `ch:"status_code" json:"status_code"`
+	ContentType   string    `ch:"content_type" json:"content_type"`
+
+	SourceIP string `ch:"source_ip" json:"source_ip"`
+}
+
+// WebsiteAccessBatch is the access log a worker buffered over one window, sent
+// as a telemetry_access_log_batch event.
+type WebsiteAccessBatch struct {
+	WorkerID uuid.UUID       `json:"worker_id"`
+	Entries  []WebsiteAccess `json:"entries"`
+}
+
+const (
+	UsageGranularityHour  = "hour"
+	UsageGranularityDay   = "day"
+	UsageGranularityMonth = "month"
+)
+
+// UserUsageResponce is a user's traffic between From and To (whole days,
+// inclusive): overall totals, totals per pool, and a series bucketed by
+// Granularity.
+type UserUsageResponce struct {
+	UserID      uuid.UUID         `json:"user_id"`
+	Granularity string            `json:"granularity"`
+	From        time.Time         `json:"from"`
+	To          time.Time         `json:"to"`
+	Totals      UserUsageTotals   `json:"totals"`
+	Pools       []UserPoolUsage   `json:"pools"`
+	Buckets     []UserUsageBucket `json:"buckets"`
+}
+
+type UserUsageTotals struct {
+	BytesSent          uint64 `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived      uint64 `ch:"bytes_received" json:"bytes_received"`
+	RequestCount       uint64 `ch:"request_count" json:"request_count"`
+	UniqueDestinations uint64 `ch:"unique_destinations" json:"unique_destinations"`
+}
+
+type UserPoolUsage struct {
+	PoolID             uuid.UUID `ch:"pool_id" json:"pool_id"`
+	PoolName           string    `ch:"pool_name" json:"pool_name"`
+	BytesSent          uint64    `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived      uint64    `ch:"bytes_received" json:"bytes_received"`
+	RequestCount       uint64    `ch:"request_count" json:"request_count"`
+	UniqueDestinations uint64    `ch:"unique_destinations" json:"unique_destinations"`
+}
+
+// UserUsageBucket is one hour, day or month of a user's traffic; Period is
+// its start.
+type UserUsageBucket struct {
+	Period             time.Time `ch:"period" json:"period"`
 	BytesSent          uint64    `ch:"bytes_sent" json:"bytes_sent"`
 	BytesReceived      uint64    `ch:"bytes_received" json:"bytes_received"`
 	RequestCount       uint64    `ch:"request_count" json:"request_count"`
-	UniqueSessions     uint64    `ch:"unique_sessions" json:"unique_sessions"`
 	UniqueDestinations uint64    `ch:"unique_destinations" json:"unique_destinations"`
 }
 
+// TopUser ranks a user by total bytes in a window.
+type TopUser struct {
+	UserID        uuid.UUID `ch:"user_id" json:"user_id"`
+	Username      string    `ch:"username" json:"username"`
+	BytesSent     uint64    `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived uint64    `ch:"bytes_received" json:"bytes_received"`
+	TotalBytes    uint64    `ch:"total_bytes" json:"total_bytes"`
+	RequestCount  uint64    `ch:"request_count" json:"request_count"`
+}
+
+// TopDestination ranks a destination host by total bytes in a window.
+type TopDestination struct {
+	DestinationHost string `ch:"destination_host" json:"destination_host"`
+	BytesSent       uint64 `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived   uint64 `ch:"bytes_received" json:"bytes_received"`
+	TotalBytes      uint64 `ch:"total_bytes" json:"total_bytes"`
+	RequestCount    uint64 `ch:"request_count" json:"request_count"`
+	UniqueUsers     uint64 `ch:"unique_users" json:"unique_users"`
+}
+
+type PoolTraffic struct {
+	PoolID        uuid.UUID `ch:"pool_id" json:"pool_id"`
+	PoolName      string    `ch:"pool_name" json:"pool_name"`
+	BytesSent     uint64    `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived uint64    `ch:"bytes_received" json:"bytes_received"`
+	TotalBytes    uint64    `ch:"total_bytes" json:"total_bytes"`
+	RequestCount  uint64    `ch:"request_count" json:"request_count"`
+	UniqueUsers   uint64    `ch:"unique_users" json:"unique_users"`
+}
+
+type RegionTraffic struct {
+	Region        string `ch:"region" json:"region"`
+	BytesSent     uint64 `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived uint64 `ch:"bytes_received" json:"bytes_received"`
+	TotalBytes    uint64 `ch:"total_bytes" json:"total_bytes"`
+	RequestCount  uint64 `ch:"request_count" json:"request_count"`
+	UniqueUsers   uint64 `ch:"unique_users" json:"unique_users"`
+}
+
+type ProtocolTraffic struct {
+	Protocol      string `ch:"protocol" json:"protocol"`
+	RequestCount  uint64 `ch:"request_count" json:"request_count"`
+	BytesSent     uint64 `ch:"bytes_sent" json:"bytes_sent"`
+	BytesReceived uint64 `ch:"bytes_received" json:"bytes_received"`
+}
+
 type AnalyticsService interface {
-	RecordUserDataUsage(ctx context.Context, data UserDataUsage) error
+	// RecordUserDataUsage queues rows for ClickHouse as a unit: either all of
+	// them are buffered or none are.
+	RecordUserDataUsage(ctx context.Context, data ...UserDataUsage) error
+	// OnUserDataCommitted registers fn to be told the highest committed seq per
+	// worker after each user data batch lands in ClickHouse.
+	OnUserDataCommitted(fn func(workerID uuid.UUID, seq uint64))
 	RecordWorkerHealth(ctx context.Context, data WorkerHealth) error
 	RecordWebsiteAccess(ctx context.Context, data WebsiteAccess) error
-	GetUserUsage(ctx context.Context, userID uuid.UUID, from, to time.Time, granularity string) (interface{}, error)
+	GetUserUsage(ctx context.Context, userID uuid.UUID, from, to time.Time, granularity string) (*UserUsageResponce, error)
 	GetWorkerHealth(ctx context.Context, workerID uuid.UUID, from, to time.Time) ([]WorkerHealth, error)
+	GetLatestWorkerHealth(ctx context.Context, since time.Time) ([]WorkerHealth, error)
+	GetUpstreamHealth(ctx context.Context, upstreamID uuid.UUID, from, to time.Time) (*UpstreamHealthResponce, error)
 	GetUserWebsiteAccess(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]WebsiteAccess, error)
+	GetTopUsers(ctx context.Context, from, to time.Time, limit int) ([]TopUser, error)
+	GetTopDestinations(ctx context.Context, from, to time.Time, limit int) ([]TopDestination, error)
+	GetPoolTraffic(ctx context.Context, from, to time.Time) ([]PoolTraffic, error)
+	GetRegionTraffic(ctx context.Context, from, to time.Time) ([]RegionTraffic, error)
+	GetProtocolTraffic(ctx context.Context, from, to time.Time) ([]ProtocolTraffic, error)
+	StartWorkers()
+}
+
+type UsageService interface {
+	// RecordUsage queues the rows of one telemetry event for the quota ledger
+	// as a unit, waiting for room in the buffer until ctx is done.
+	RecordUsage(ctx context.Context, data ...UserDataUsage) error
+	// OnUsageCommitted registers fn to be told the highest seq per worker whose
+	// usage has been applied to user_pools.
+	OnUsageCommitted(fn func(workerID uuid.UUID, seq uint64))
 	StartWorkers()
 }
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditActor identifies the caller and request behind an admin mutation. It is
+// stored in the request context by the admin authentication middleware.
+type AuditActor struct {
+	TokenID   uuid.UUID
+	Name      string
+	Route     string
+	RequestID string
+}
+
+type auditActorKey struct{}
+
+func ContextWithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+func AuditActorFromContext(ctx context.Context) (AuditActor, bool) {
+	actor, ok := ctx.Value(auditActorKey{}).(AuditActor)
+	return actor, ok
+}
+
+type AuditLogFilter struct {
+	Actor      *string
+	EntityType *string
+	EntityId   *string
+	From       *time.Time
+	To         *time.Time
+	Limit      int32
+}
+
+type AuditLogResponce struct {
+	Id           int64           `json:"id"`
+	ActorTokenId *uuid.UUID      `json:"actor_token_id,omitempty"`
+	ActorName    string          `json:"actor_name"`
+	RequestId    string          `json:"request_id"`
+	Route        string          `json:"route"`
+	Action       string          `json:"action"`
+	EntityType   string          `json:"entity_type"`
+	EntityId     string          `json:"entity_id"`
+	Before       json.RawMessage `json:"before"`
+	After        json.RawMessage `json:"after"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
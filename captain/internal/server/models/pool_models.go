@@ -52,6 +52,56 @@ type DeleteCountryRequest struct {
 	Name *string `json:"name"`
 }
 
+// GetCountryCatalogResponce is a country with the states and cities clients
+// may target in it.
+type GetCountryCatalogResponce struct {
+	GetCountryResponce
+	States []StateResponce `json:"states"`
+	Cities []CityResponce  `json:"cities"`
+}
+
+type CreateStateRequest struct {
+	CountryCode *string `json:"country_code"`
+	Name        *string `json:"name"`
+	Code        *string `json:"code"`
+}
+
+type StateResponce struct {
+	Id        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Code      string    `json:"code"`
+	CountryId uuid.UUID `json:"country_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DeleteStateRequest struct {
+	CountryCode *string `json:"country_code"`
+	Code        *string `json:"code"`
+}
+
+// CreateCityRequest adds a city to a country. StateCode is optional, for
+// cities that are not targeted through a state.
+type CreateCityRequest struct {
+	CountryCode *string `json:"country_code"`
+	StateCode   *string `json:"state_code"`
+	Name        *string `json:"name"`
+	Code        *string `json:"code"`
+}
+
+type CityResponce struct {
+	Id        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Code      string    `json:"code"`
+	CountryId uuid.UUID `json:"country_id"`
+	StateCode string    `json:"state_code,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type DeleteCityRequest struct {
+	CountryCode *string `json:"country_code"`
+	Code        *string `json:"code"`
+}
+
 type GetUpstreamResponce struct {
 	Id               uuid.UUID `json:"id"`
 	Tag              string    `json:"tag"`
@@ -94,6 +144,9 @@ type CreatePoolRequest struct {
 	Subdomain *string                        `json:"subdomain"`
 	Port      *int32                         `json:"port"`
 	UpStreams *[]CreateUpstreamWeightRequest `json:"upstreams"`
+	// ResolveLocally makes workers resolve SOCKS targets themselves instead
+	// of passing the domain name to the upstream.
+	ResolveLocally *bool `json:"resolve_locally"`
 }
 
 type CreateUpstreamWeightRequest struct {
@@ -115,6 +168,8 @@ type CreatePoolResponce struct {
 	UpStreams []CreateUpstreamWeightResponce `json:"upstreams,omitempty"`
 	CreatedAt time.Time                      `json:"created_at,omitempty"`
 	UpdatedAt time.Time                      `json:"updated_at,omitempty"`
+
+	ResolveLocally bool `json:"resolve_locally"`
 }
 
 type PoolUpstream struct {
@@ -132,12 +187,15 @@ type GetPoolsResponse struct {
 	Subdomain string         `json:"subdomain,omitempty"`
 	Port      int32          `json:"port,omitempty"`
 	Upstreams []PoolUpstream `json:"upstreams,omitempty"`
+
+	ResolveLocally bool `json:"resolve_locally"`
 }
 
 type UpdatePoolRequest struct {
-	RegionId  *uuid.UUID `json:"region_id"`
-	Subdomain *string    `json:"subdomain"`
-	Port      *int32     `json:"port"`
+	RegionId       *uuid.UUID `json:"region_id"`
+	Subdomain      *string    `json:"subdomain"`
+	Port           *int32     `json:"port"`
+	ResolveLocally *bool      `json:"resolve_locally"`
 }
 
 type AddPoolUpstreamWeightRequest struct {
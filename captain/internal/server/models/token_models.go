@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeAll           = "*"
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopePoolsRead     = "pools:read"
+	ScopePoolsWrite    = "pools:write"
+	ScopeWorkersRead   = "workers:read"
+	ScopeWorkersWrite  = "workers:write"
+	ScopeAnalyticsRead = "analytics:read"
+	ScopeTokensWrite   = "tokens:write"
+	ScopeAuditRead     = "audit:read"
+	ScopeMetricsRead   = "metrics:read"
+)
+
+// ValidScopes lists the scopes an api token can be minted with.
+var ValidScopes = []string{
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopePoolsRead,
+	ScopePoolsWrite,
+	ScopeWorkersRead,
+	ScopeWorkersWrite,
+	ScopeAnalyticsRead,
+	ScopeTokensWrite,
+	ScopeAuditRead,
+	ScopeMetricsRead,
+}
+
+// ApiPrincipal is the caller behind an admin request: either the root
+// ADMIN_API_KEY or a named api token.
+type ApiPrincipal struct {
+	TokenID uuid.UUID
+	Name    string
+	Scopes  []string
+}
+
+// HasScope reports whether the principal was granted scope. A write scope
+// also grants reading the same resource.
+func (p *ApiPrincipal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+		if resource, ok := strings.CutSuffix(scope, ":read"); ok && s == resource+":write" {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenAuthenticator interface {
+	Authenticate(ctx context.Context, token string) (*ApiPrincipal, error)
+}
+
+type CreateApiTokenRequest struct {
+	Name      *string    `json:"name"`
+	Scopes    *[]string  `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreateApiTokenResponce struct {
+	Id        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Token     string     `json:"token"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type GetApiTokenResponce struct {
+	Id        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -7,8 +7,11 @@ import (
 )
 
 type CreateUserRequest struct {
-	AllowPools  *[]PoolDataStat `json:"allow_pools"`
-	IpWhiteList *[]string       `json:"ip_whitelist"`
+	AllowPools      *[]PoolDataStat `json:"allow_pools"`
+	IpWhiteList     *[]string       `json:"ip_whitelist"`
+	AccessLogOptOut *bool           `json:"access_log_opt_out"`
+	MaxConnections  *int32          `json:"max_connections"`
+	BandwidthLimit  *int64          `json:"bandwidth_limit"`
 }
 
 type CreateUserResponce struct {
@@ -20,39 +23,65 @@ type CreateUserResponce struct {
 	AllowPools  []string  `json:"allow_pools,omitempty"`
 	Created_at  time.Time `json:"created_at,omitempty"`
 	Updated_at  time.Time `json:"updated_at,omitempty"`
+
+	AccessLogOptOut bool  `json:"access_log_opt_out"`
+	MaxConnections  int32 `json:"max_connections"`
+	BandwidthLimit  int64 `json:"bandwidth_limit"`
 }
 
 type GetUserByIdResponce struct {
 	Id          uuid.UUID `json:"id,omitempty"`
 	Username    string    `json:"username,omitempty"`
-	Password    string    `json:"password,omitempty"`
 	Status      string    `json:"status,omitempty"`
 	UserPool    []string  `json:"user_pool,omitempty"`
 	IpWhitelist []string  `json:"ip_whitelist,omitempty"`
 	Created_at  time.Time `json:"created_at,omitempty"`
 	Updated_at  time.Time `json:"updated_at,omitempty"`
+
+	AccessLogOptOut bool  `json:"access_log_opt_out"`
+	MaxConnections  int32 `json:"max_connections"`
+	BandwidthLimit  int64 `json:"bandwidth_limit"`
+}
+
+type RotatePasswordResponce struct {
+	Id        uuid.UUID `json:"id"`
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type UpdateUserRequest struct {
-	Status *string `json:"status"`
+	Status          *string `json:"status"`
+	AccessLogOptOut *bool   `json:"access_log_opt_out"`
+	MaxConnections  *int32  `json:"max_connections"`
+	BandwidthLimit  *int64  `json:"bandwidth_limit"`
 }
 
 type UpdateUserResponce struct {
-	Id        uuid.UUID `json:"id,omitempty"`
-	Status    string    `json:"status,omitempty"`
-	UpdatedAt time.Time `json:"updated_at,omitempty"`
+	Id              uuid.UUID `json:"id,omitempty"`
+	Status          string    `json:"status,omitempty"`
+	AccessLogOptOut bool      `json:"access_log_opt_out"`
+	MaxConnections  int32     `json:"max_connections"`
+	BandwidthLimit  int64     `json:"bandwidth_limit"`
+	UpdatedAt       time.Time `json:"updated_at,omitempty"`
 }
 
 type GetDatausageReponce struct {
-	DataLimit int64  `json:"data_limit"`
-	DataUsage int64  `json:"data_usage"`
-	PoolTag   string `json:"pool_tag"`
+	DataLimit      int64  `json:"data_limit"`
+	DataUsage      int64  `json:"data_usage"`
+	MaxConnections int32  `json:"max_connections"`
+	BandwidthLimit int64  `json:"bandwidth_limit"`
+	PoolTag        string `json:"pool_tag"`
 }
 
+// PoolDataStat is a user's allowance on one pool. A MaxConnections or
+// BandwidthLimit of 0 leaves the pool bounded only by the user's own limit.
 type PoolDataStat struct {
-	Pool      string `json:"pool"`
-	DataLimit int64  `json:"data_limit"`
-	DataUsage int64  `json:"data_usage"`
+	Pool           string `json:"pool"`
+	DataLimit      int64  `json:"data_limit"`
+	DataUsage      int64  `json:"data_usage"`
+	MaxConnections int32  `json:"max_connections"`
+	BandwidthLimit int64  `json:"bandwidth_limit"`
 }
 
 type GetUserPoolResponce struct {
@@ -98,4 +127,5 @@ type GenerateproxyStringRequest struct {
 	City            *string    `json:"city"`
 	IsSticky        *bool      `json:"is_sticky"`
 	SessionDuration *int       `json:"session_duration"`
+	Password        *string    `json:"password"`
 }
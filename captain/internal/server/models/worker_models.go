@@ -1,19 +1,29 @@
 package server
 
 import (
+	"database/sql"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 )
 
 type WebsocketManagerInterface interface {
-	NewOTP(workerId *uuid.UUID) string
+	NewOTP(workerId *uuid.UUID) (string, error)
 	VerifyOTP(otp string) (bool, uuid.UUID)
 	ServeWS(w http.ResponseWriter, r *http.Request, workerID uuid.UUID, workerName string, poolId uuid.UUID)
 	NotifyUserChange(username string)
 	NotifyPoolChange(poolId uuid.UUID)
+	DisconnectWorker(workerID uuid.UUID)
 	SetAnalyticsandQueries(queries *repository.Queries, analytics AnalyticsService)
+	SetUsageService(usage UsageService)
+	SetKeyring(keyring *secrets.Keyring)
+	StartCluster(db *sql.DB)
+	// SubscribeWorkerEvents streams worker connects and disconnects on every
+	// replica until the returned func is called.
+	SubscribeWorkerEvents() (<-chan WorkerStatusEvent, func())
 }
 
 type AddWorkerRequest struct {
@@ -34,6 +44,8 @@ type AddWorkerResponse struct {
 	PoolId     uuid.UUID `json:"pool_id"`
 	CreatedAt  string    `json:"created_at"`
 	Domains    []string  `json:"domains,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	Replica    string    `json:"replica,omitempty"`
 }
 
 type AddWorkerDomainRequest struct {
@@ -51,3 +63,40 @@ type WorkerLoginRequest struct {
 type WorkerLoginResponce struct {
 	Otp string `json:"otp"`
 }
+
+type WorkerSecretResponce struct {
+	Id        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Secret    string    `json:"secret"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+// WorkerStatusResponce is a worker's live state: its session on whichever
+// replica holds it and its latest health report. A worker is stale when it has
+// not answered a ping for longer than the stale threshold, even if its session
+// has not expired yet.
+type WorkerStatusResponce struct {
+	ID                uuid.UUID     `json:"id"`
+	Name              string        `json:"name"`
+	RegionName        string        `json:"region_name"`
+	PoolId            uuid.UUID     `json:"pool_id"`
+	Status            string        `json:"status"`
+	Connected         bool          `json:"connected"`
+	Stale             bool          `json:"stale"`
+	Replica           string        `json:"replica,omitempty"`
+	ConnectedAt       *time.Time    `json:"connected_at,omitempty"`
+	ConfigVersion     string        `json:"config_version,omitempty"`
+	LastSeen          time.Time     `json:"last_seen"`
+	ActiveConnections uint32        `json:"active_connections"`
+	Health            *WorkerHealth `json:"health,omitempty"`
+}
+
+// WorkerStatusEvent is sent on the worker event stream when a worker connects
+// to or disconnects from a replica.
+type WorkerStatusEvent struct {
+	Type       string    `json:"type"`
+	WorkerID   uuid.UUID `json:"worker_id"`
+	WorkerName string    `json:"worker_name"`
+	Replica    string    `json:"replica"`
+	Time       time.Time `json:"time"`
+}
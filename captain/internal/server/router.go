@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
@@ -10,19 +13,23 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 	handlers "github.com/torchlabssoftware/subnetwork_system/internal/server/handlers"
+	"github.com/torchlabssoftware/subnetwork_system/internal/server/metrics"
+	authmiddleware "github.com/torchlabssoftware/subnetwork_system/internal/server/middleware"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 	service "github.com/torchlabssoftware/subnetwork_system/internal/server/service"
 )
 
-func NewRouter(pool *sql.DB, clickHouseConn driver.Conn, websocketManager models.WebsocketManagerInterface) http.Handler {
+func NewRouter(pool *sql.DB, clickHouseConn driver.Conn, websocketManager models.WebsocketManagerInterface, keyring *secrets.Keyring) http.Handler {
 	router := chi.NewRouter()
 
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
+	router.Use(metrics.Middleware)
 	router.Use(middleware.Logger)
-	router.Use(middleware.Timeout(30 * time.Second))
+	router.Use(requestTimeout(30 * time.Second))
 
 	router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"https://*", "http://*"},
@@ -34,24 +41,48 @@ func NewRouter(pool *sql.DB, clickHouseConn driver.Conn, websocketManager models
 	}))
 
 	q := repository.New(pool)
+	metrics.RegisterDB(pool, "postgres")
 
-	analyticsService := service.NewAnalyticsService(clickHouseConn)
-	analyticsService.StartWorkers()
+	analyticsService := service.NewAnalyticsService(clickHouseConn, q, pool)
 	a := handlers.NewAnalyticsHandler(analyticsService)
 
 	websocketManager.SetAnalyticsandQueries(q, analyticsService)
+	analyticsService.StartWorkers()
+	websocketManager.StartCluster(pool)
+
+	usageService := service.NewUsageService(q, pool, websocketManager)
+	websocketManager.SetUsageService(usageService)
+	usageService.StartWorkers()
 
 	u := handlers.NewUserHandler(service.NewUserService(q, pool, websocketManager))
 
-	p := handlers.NewPoolHandler(service.NewPoolService(q, pool, websocketManager))
+	websocketManager.SetKeyring(keyring)
+	poolService := service.NewPoolService(q, pool, websocketManager, keyring)
+	if err := poolService.ReencryptUpstreamCredentials(context.Background()); err != nil {
+		log.Printf("[router] failed to re-encrypt upstream credentials: %v", err)
+	}
+	p := handlers.NewPoolHandler(poolService)
+
+	w := handlers.NewWorkerHandler(service.NewWorkerService(q, pool, websocketManager, analyticsService))
 
-	w := handlers.NewWorkerHandler(service.NewWorkerService(q, pool, websocketManager))
+	tokenService := service.NewTokenService(q, pool)
+	authmiddleware.SetTokenAuthenticator(tokenService)
+	t := handlers.NewTokenHandler(tokenService)
+
+	au := handlers.NewAuditHandler(service.NewAuditService(q))
+
+	router.With(
+		authmiddleware.AdminAuthentication,
+		authmiddleware.RequireScope(models.ScopeMetricsRead),
+	).Handle("/metrics", metrics.Handler())
 
 	router.Route("/admin", func(r chi.Router) {
 		r.Mount("/users", u.AdminRoutes())
 		r.Mount("/pools", p.AdminRoutes())
 		r.Mount("/worker", w.AdminRoutes())
 		r.Mount("/analytics", a.RegisterRoutes())
+		r.Mount("/tokens", t.AdminRoutes())
+		r.Mount("/audit", au.AdminRoutes())
 	})
 
 	router.Route("/worker", func(r chi.Router) {
@@ -61,3 +92,19 @@ func NewRouter(pool *sql.DB, clickHouseConn driver.Conn, websocketManager models
 	return router
 
 }
+
+// requestTimeout bounds every request except event streams, which stay open
+// for as long as the client listens.
+func requestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	withTimeout := middleware.Timeout(timeout)
+	return func(next http.Handler) http.Handler {
+		bounded := withTimeout(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			bounded.ServeHTTP(w, r)
+		})
+	}
+}
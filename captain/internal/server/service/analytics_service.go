@@ -2,75 +2,133 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	"github.com/torchlabssoftware/subnetwork_system/internal/server/metrics"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
+const (
+	// userDataRetryMax caps the backoff between attempts to commit a user
+	// data batch. While it retries the buffer fills and workers are told to
+	// resend later.
+	userDataRetryMax = 30 * time.Second
+	// userDataMaxAttempts is how often ClickHouse may refuse a batch before it
+	// is moved to user_data_dead_letter. Usage is billing data, so it is kept
+	// rather than dropped, but one bad batch must not stall every worker.
+	userDataMaxAttempts = 5
+)
+
+// Queue names the analytics buffers are reported under in metrics.
+const (
+	userDataQueue      = "user_data"
+	websiteAccessQueue = "website_access"
+)
+
 type analyticsService struct {
 	conn              driver.Conn
-	userDataChan      chan models.UserDataUsage
+	queries           *repository.Queries
+	db                *sql.DB
+	userDataChan      chan []models.UserDataUsage
 	websiteAccessChan chan models.WebsiteAccess
+	onUserDataCommit  func(workerID uuid.UUID, seq uint64)
 }
 
-func NewAnalyticsService(conn driver.Conn) models.AnalyticsService {
+func NewAnalyticsService(conn driver.Conn, q *repository.Queries, db *sql.DB) models.AnalyticsService {
 	return &analyticsService{
 		conn:              conn,
-		userDataChan:      make(chan models.UserDataUsage, 10000),
+		queries:           q,
+		db:                db,
+		userDataChan:      make(chan []models.UserDataUsage, 10000),
 		websiteAccessChan: make(chan models.WebsiteAccess, 10000),
 	}
 }
 
-func (s *analyticsService) RecordUserDataUsage(ctx context.Context, data models.UserDataUsage) error {
-	if data.SourceIP == "" {
-		data.SourceIP = "0.0.0.0"
+// RecordUserDataUsage queues data for the next batch, waiting for room in the
+// buffer until ctx is done.
+func (s *analyticsService) RecordUserDataUsage(ctx context.Context, data ...models.UserDataUsage) error {
+	for i := range data {
+		if data[i].SourceIP == "" {
+			data[i].SourceIP = "0.0.0.0"
+		}
+		if data[i].RequestCount == 0 {
+			data[i].RequestCount = 1
+		}
 	}
 	select {
 	case s.userDataChan <- data:
+		metrics.AnalyticsQueueDepth.WithLabelValues(userDataQueue).Set(float64(len(s.userDataChan)))
 		return nil
-	default:
-		return fmt.Errorf("analytics buffer full, dropping user data event")
+	case <-ctx.Done():
+		metrics.AnalyticsDropped.WithLabelValues(userDataQueue).Inc()
+		return fmt.Errorf("analytics buffer full, rejecting user data event")
 	}
 }
 
+// OnUserDataCommitted must be called before StartWorkers.
+func (s *analyticsService) OnUserDataCommitted(fn func(workerID uuid.UUID, seq uint64)) {
+	s.onUserDataCommit = fn
+}
+
 func (s *analyticsService) RecordWebsiteAccess(ctx context.Context, data models.WebsiteAccess) error {
 	if data.SourceIP == "" {
 		data.SourceIP = "0.0.0.0"
 	}
+	if data.Timestamp.IsZero() {
+		data.Timestamp = time.Now()
+	}
 	select {
 	case s.websiteAccessChan <- data:
+		metrics.AnalyticsQueueDepth.WithLabelValues(websiteAccessQueue).Set(float64(len(s.websiteAccessChan)))
 		return nil
 	default:
+		metrics.AnalyticsDropped.WithLabelValues(websiteAccessQueue).Inc()
 		return fmt.Errorf("analytics buffer full, dropping website access event")
 	}
 }
 
-func (s *analyticsService) RecordWorkerHealth(ctx context.Context, data models.WorkerHealth) error {
+// RecordWorkerHealth stores a health report. The worker row and its upstream
+// rows share a timestamp so GetWorkerHealth can put them back together; the
+// worker row also keeps each upstream's latency in upstream_health, keyed by
+// upstream id.
+func (s *analyticsService) RecordWorkerHealth(ctx context.Context, data models.WorkerHealth) (err error) {
+	defer func(start time.Time) { metrics.ObserveClickHouseFlush("worker_health", start, err) }(time.Now())
+	if data.Timestamp.IsZero() {
+		data.Timestamp = time.Now()
+	}
+	upstreamLatency := make(map[string]float32, len(data.Upstreams))
+	for _, u := range data.Upstreams {
+		upstreamLatency[u.UpstreamID.String()] = float32(u.Latency)
+	}
 	queryWorker := `
 		INSERT INTO analytics_db_subnetworksystem.worker_health (
-			worker_id, worker_name, region, pool_tag, status, cpu_usage, memory_usage,
-			active_connections, total_connections, bytes_throughput_per_sec, error_rate
+			timestamp, worker_id, worker_name, region, pool_tag, status, cpu_usage, memory_usage,
+			active_connections, total_connections, bytes_throughput_per_sec, upstream_health, error_rate
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 		)
 	`
 	if err := s.conn.Exec(ctx, queryWorker,
-		data.WorkerID, data.WorkerName, data.Region, data.PoolTag, data.Status, data.CpuUsage, data.MemoryUsage,
-		data.ActiveConnections, data.TotalConnections, data.BytesThroughputPerSec, data.ErrorRate,
+		data.Timestamp, data.WorkerID, data.WorkerName, data.Region, data.PoolTag, data.Status, data.CpuUsage, data.MemoryUsage,
+		data.ActiveConnections, data.TotalConnections, data.BytesThroughputPerSec, upstreamLatency, data.ErrorRate,
 	); err != nil {
 		return fmt.Errorf("failed to insert worker health: %w", err)
 	}
 	if len(data.Upstreams) > 0 {
-		batch, err := s.conn.PrepareBatch(ctx, "INSERT INTO analytics_db_subnetworksystem.worker_upstream_health (worker_id, upstream_id, upstream_tag, status, latency, error_rate)")
+		batch, err := s.conn.PrepareBatch(ctx, "INSERT INTO analytics_db_subnetworksystem.worker_upstream_health (timestamp, worker_id, upstream_id, upstream_tag, status, latency, error_rate)")
 		if err != nil {
 			return fmt.Errorf("failed to prepare batch for upstreams: %w", err)
 		}
 		for _, u := range data.Upstreams {
 			if err := batch.Append(
+				data.Timestamp,
 				data.WorkerID,
 				u.UpstreamID,
 				u.UpstreamTag,
@@ -88,50 +146,207 @@ func (s *analyticsService) RecordWorkerHealth(ctx context.Context, data models.W
 	return nil
 }
 
-func (s *analyticsService) GetUserUsage(ctx context.Context, userID uuid.UUID, from, to time.Time, granularity string) (interface{}, error) {
-	if granularity == "hour" {
-		query := `
-			SELECT 
-				date, hour, user_id, username,
-				sumMerge(bytes_sent) as bytes_sent,
-				sumMerge(bytes_received) as bytes_received,
-				countMerge(request_count) as request_count,
-				uniqMerge(unique_destinations) as unique_destinations
+// userUsageAggregates are the merged columns shared by every user usage query.
+const userUsageAggregates = `
+	sumMerge(bytes_sent) AS bytes_sent,
+	sumMerge(bytes_received) AS bytes_received,
+	sumMerge(request_count) AS request_count,
+	uniqMerge(unique_destinations) AS unique_destinations`
+
+// GetUserUsage reads the user's traffic from the aggregate tables. Hourly
+// buckets come from user_usage_hourly; days, months, totals and the per-pool
+// breakdown from the daily tables. from and to are dates, both inclusive.
+func (s *analyticsService) GetUserUsage(ctx context.Context, userID uuid.UUID, from, to time.Time, granularity string) (*models.UserUsageResponce, error) {
+	var bucketQuery string
+	switch granularity {
+	case models.UsageGranularityHour:
+		bucketQuery = `SELECT hour AS period,` + userUsageAggregates + `
 			FROM analytics_db_subnetworksystem.user_usage_hourly
 			WHERE user_id = ? AND date >= ? AND date <= ?
-			GROUP BY date, hour, user_id, username
-			ORDER BY hour
-		`
-		var results []models.UserUsageHourly
-		if err := s.conn.Select(ctx, &results, query, userID, from, to); err != nil {
-			return nil, err
-		}
-		return results, nil
+			GROUP BY period
+			ORDER BY period`
+	case models.UsageGranularityDay:
+		bucketQuery = `SELECT toDateTime(date) AS period,` + userUsageAggregates + `
+			FROM analytics_db_subnetworksystem.user_usage_daily
+			WHERE user_id = ? AND date >= ? AND date <= ?
+			GROUP BY period
+			ORDER BY period`
+	case models.UsageGranularityMonth:
+		bucketQuery = `SELECT toDateTime(toStartOfMonth(date)) AS period,` + userUsageAggregates + `
+			FROM analytics_db_subnetworksystem.user_usage_daily
+			WHERE user_id = ? AND date >= ? AND date <= ?
+			GROUP BY period
+			ORDER BY period`
+	default:
+		return nil, fmt.Errorf("unsupported granularity: %s", granularity)
 	}
-	return nil, fmt.Errorf("unsupported granularity: %s", granularity)
+
+	response := &models.UserUsageResponce{
+		UserID:      userID,
+		Granularity: granularity,
+		From:        from,
+		To:          to,
+		Pools:       []models.UserPoolUsage{},
+		Buckets:     []models.UserUsageBucket{},
+	}
+	if err := s.conn.Select(ctx, &response.Buckets, bucketQuery, userID, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query usage buckets: %w", err)
+	}
+
+	var totals []models.UserUsageTotals
+	totalsQuery := `SELECT` + userUsageAggregates + `
+		FROM analytics_db_subnetworksystem.user_usage_daily
+		WHERE user_id = ? AND date >= ? AND date <= ?`
+	if err := s.conn.Select(ctx, &totals, totalsQuery, userID, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query usage totals: %w", err)
+	}
+	if len(totals) > 0 {
+		response.Totals = totals[0]
+	}
+
+	poolsQuery := `SELECT pool_id, pool_name,` + userUsageAggregates + `
+		FROM analytics_db_subnetworksystem.user_pool_usage_daily
+		WHERE user_id = ? AND date >= ? AND date <= ?
+		GROUP BY pool_id, pool_name
+		ORDER BY bytes_sent + bytes_received DESC`
+	if err := s.conn.Select(ctx, &response.Pools, poolsQuery, userID, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query usage per pool: %w", err)
+	}
+
+	return response, nil
+}
+
+// workerHealthLimit caps how many reports GetWorkerHealth returns; the most
+// recent ones in the range are kept.
+const workerHealthLimit = 1000
+
+// upstreamHealthRow is a worker_upstream_health row with the timestamp of the
+// report it belongs to.
+type upstreamHealthRow struct {
+	Timestamp time.Time `ch:"timestamp"`
+	models.UpstreamHealth
 }
 
+// GetWorkerHealth returns the worker's health reports, oldest first, each with
+// the upstream health sent alongside it. from and to are dates, both
+// inclusive.
 func (s *analyticsService) GetWorkerHealth(ctx context.Context, workerID uuid.UUID, from, to time.Time) ([]models.WorkerHealth, error) {
 	query := `
-		SELECT 
-			worker_id, worker_name, region, status, cpu_usage, memory_usage,
+		SELECT * FROM (
+			SELECT
+				timestamp, worker_id, worker_name, region, pool_tag, status, cpu_usage, memory_usage,
+				active_connections, total_connections, bytes_throughput_per_sec, error_rate
+			FROM analytics_db_subnetworksystem.worker_health
+			WHERE worker_id = ? AND date >= ? AND date <= ?
+			ORDER BY timestamp DESC
+			LIMIT ?
+		)
+		ORDER BY timestamp
+	`
+	results := []models.WorkerHealth{}
+	if err := s.conn.Select(ctx, &results, query, workerID, from, to, workerHealthLimit); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	reports := make(map[int64]int, len(results))
+	for i := range results {
+		results[i].Upstreams = []models.UpstreamHealth{}
+		reports[results[i].Timestamp.UnixMilli()] = i
+	}
+	upstreamQuery := `
+		SELECT timestamp, upstream_id, upstream_tag, status, latency, error_rate
+		FROM analytics_db_subnetworksystem.worker_upstream_health
+		WHERE worker_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp, upstream_tag
+	`
+	var rows []upstreamHealthRow
+	if err := s.conn.Select(ctx, &rows, upstreamQuery, workerID, results[0].Timestamp, results[len(results)-1].Timestamp); err != nil {
+		return nil, fmt.Errorf("failed to query upstream health: %w", err)
+	}
+	for _, row := range rows {
+		if i, ok := reports[row.Timestamp.UnixMilli()]; ok {
+			results[i].Upstreams = append(results[i].Upstreams, row.UpstreamHealth)
+		}
+	}
+	return results, nil
+}
+
+// GetLatestWorkerHealth returns the most recent health report of every worker
+// that reported since the given time, without upstream health.
+func (s *analyticsService) GetLatestWorkerHealth(ctx context.Context, since time.Time) ([]models.WorkerHealth, error) {
+	query := `
+		SELECT
+			timestamp, worker_id, worker_name, region, pool_tag, status, cpu_usage, memory_usage,
 			active_connections, total_connections, bytes_throughput_per_sec, error_rate
 		FROM analytics_db_subnetworksystem.worker_health
-		WHERE worker_id = ? AND timestamp >= ? AND timestamp <= ?
-		ORDER BY timestamp
-		LIMIT 1000
+		WHERE date >= toDate(?) AND timestamp >= ?
+		ORDER BY timestamp DESC
+		LIMIT 1 BY worker_id
 	`
-	var results []models.WorkerHealth
-	if err := s.conn.Select(ctx, &results, query, workerID, from, to); err != nil {
+	results := []models.WorkerHealth{}
+	if err := s.conn.Select(ctx, &results, query, since, since); err != nil {
 		return nil, err
 	}
+	for i := range results {
+		results[i].Upstreams = []models.UpstreamHealth{}
+	}
 	return results, nil
 }
 
+// upstreamLatencyStats are the aggregate columns behind
+// models.UpstreamLatencyStats. Reports without requests carry no latency and
+// are left out of it; aggregates over no rows are reported as 0, not NaN.
+const upstreamLatencyStats = `
+	count() AS reports,
+	ifNotFinite(avgIf(latency, latency > 0), 0) AS latency_avg,
+	ifNotFinite(quantileIf(0.5)(latency, latency > 0), 0) AS latency_p50,
+	ifNotFinite(quantileIf(0.9)(latency, latency > 0), 0) AS latency_p90,
+	ifNotFinite(quantileIf(0.99)(latency, latency > 0), 0) AS latency_p99,
+	ifNotFinite(avg(error_rate), 0) AS error_rate`
+
+// GetUpstreamHealth summarises the upstream's health reports from every
+// worker. from and to are dates, both inclusive.
+func (s *analyticsService) GetUpstreamHealth(ctx context.Context, upstreamID uuid.UUID, from, to time.Time) (*models.UpstreamHealthResponce, error) {
+	response := &models.UpstreamHealthResponce{
+		UpstreamID: upstreamID,
+		From:       from,
+		To:         to,
+		Workers:    []models.UpstreamWorkerHealth{},
+	}
+
+	var summary []struct {
+		UpstreamTag string `ch:"upstream_tag"`
+		models.UpstreamLatencyStats
+	}
+	summaryQuery := `SELECT argMax(upstream_tag, timestamp) AS upstream_tag,` + upstreamLatencyStats + `
+		FROM analytics_db_subnetworksystem.worker_upstream_health
+		WHERE upstream_id = ? AND date >= ? AND date <= ?`
+	if err := s.conn.Select(ctx, &summary, summaryQuery, upstreamID, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query upstream health: %w", err)
+	}
+	if len(summary) > 0 {
+		response.UpstreamTag = summary[0].UpstreamTag
+		response.UpstreamLatencyStats = summary[0].UpstreamLatencyStats
+	}
+
+	workersQuery := `SELECT worker_id, argMax(status, timestamp) AS last_status,` + upstreamLatencyStats + `
+		FROM analytics_db_subnetworksystem.worker_upstream_health
+		WHERE upstream_id = ? AND date >= ? AND date <= ?
+		GROUP BY worker_id
+		ORDER BY latency_p50 DESC`
+	if err := s.conn.Select(ctx, &response.Workers, workersQuery, upstreamID, from, to); err != nil {
+		return nil, fmt.Errorf("failed to query upstream health per worker: %w", err)
+	}
+	return response, nil
+}
+
 func (s *analyticsService) GetUserWebsiteAccess(ctx context.Context, userID uuid.UUID, from, to time.Time) ([]models.WebsiteAccess, error) {
 	query := `
 		SELECT
-			user_id, username, domain, subdomain, full_url,
+			timestamp, user_id, username, domain, subdomain, full_url,
 			bytes_sent, bytes_received, request_method, status_code,
 			content_type, source_ip
 		FROM analytics_db_subnetworksystem.website_access
@@ -146,6 +361,87 @@ func (s *analyticsService) GetUserWebsiteAccess(ctx context.Context, userID uuid
 	return results, nil
 }
 
+// trafficAggregates are the merged byte and request columns of traffic_daily
+// and destination_usage_daily.
+const trafficAggregates = `
+	sumMerge(bytes_sent) AS bytes_sent,
+	sumMerge(bytes_received) AS bytes_received,
+	bytes_sent + bytes_received AS total_bytes,
+	sumMerge(request_count) AS request_count`
+
+func (s *analyticsService) GetTopUsers(ctx context.Context, from, to time.Time, limit int) ([]models.TopUser, error) {
+	query := `SELECT user_id, any(username) AS username,` + trafficAggregates + `
+		FROM analytics_db_subnetworksystem.traffic_daily
+		WHERE date >= ? AND date <= ?
+		GROUP BY user_id
+		ORDER BY total_bytes DESC
+		LIMIT ?`
+	results := []models.TopUser{}
+	if err := s.conn.Select(ctx, &results, query, from, to, limit); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *analyticsService) GetTopDestinations(ctx context.Context, from, to time.Time, limit int) ([]models.TopDestination, error) {
+	query := `SELECT destination_host,` + trafficAggregates + `,
+			uniqMerge(unique_users) AS unique_users
+		FROM analytics_db_subnetworksystem.destination_usage_daily
+		WHERE date >= ? AND date <= ?
+		GROUP BY destination_host
+		ORDER BY total_bytes DESC
+		LIMIT ?`
+	results := []models.TopDestination{}
+	if err := s.conn.Select(ctx, &results, query, from, to, limit); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *analyticsService) GetPoolTraffic(ctx context.Context, from, to time.Time) ([]models.PoolTraffic, error) {
+	query := `SELECT pool_id, any(pool_name) AS pool_name,` + trafficAggregates + `,
+			uniq(user_id) AS unique_users
+		FROM analytics_db_subnetworksystem.traffic_daily
+		WHERE date >= ? AND date <= ?
+		GROUP BY pool_id
+		ORDER BY total_bytes DESC`
+	results := []models.PoolTraffic{}
+	if err := s.conn.Select(ctx, &results, query, from, to); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *analyticsService) GetRegionTraffic(ctx context.Context, from, to time.Time) ([]models.RegionTraffic, error) {
+	query := `SELECT worker_region AS region,` + trafficAggregates + `,
+			uniq(user_id) AS unique_users
+		FROM analytics_db_subnetworksystem.traffic_daily
+		WHERE date >= ? AND date <= ?
+		GROUP BY region
+		ORDER BY total_bytes DESC`
+	results := []models.RegionTraffic{}
+	if err := s.conn.Select(ctx, &results, query, from, to); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *analyticsService) GetProtocolTraffic(ctx context.Context, from, to time.Time) ([]models.ProtocolTraffic, error) {
+	query := `SELECT protocol,
+			sumMerge(request_count) AS request_count,
+			sumMerge(bytes_sent) AS bytes_sent,
+			sumMerge(bytes_received) AS bytes_received
+		FROM analytics_db_subnetworksystem.traffic_daily
+		WHERE date >= ? AND date <= ?
+		GROUP BY protocol
+		ORDER BY request_count DESC`
+	results := []models.ProtocolTraffic{}
+	if err := s.conn.Select(ctx, &results, query, from, to); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 func (s *analyticsService) StartWorkers() {
 	go s.processUserDataBatch()
 	go s.processWebsiteAccessBatch()
@@ -155,56 +451,151 @@ func (s *analyticsService) processUserDataBatch() {
 	batchSize := 1000
 	flushInterval := 5 * time.Second
 	batch := make([]models.UserDataUsage, 0, batchSize)
+	// buffered is the highest seq taken from each worker, so an event resent
+	// after a nack that only the quota side saw is not written twice
+	buffered := make(map[uuid.UUID]uint64)
 	ticker := time.NewTicker(flushInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case item := <-s.userDataChan:
-			batch = append(batch, item)
+		case items := <-s.userDataChan:
+			metrics.AnalyticsQueueDepth.WithLabelValues(userDataQueue).Set(float64(len(s.userDataChan)))
+			if len(items) == 0 {
+				continue
+			}
+			if seq := items[0].Seq; seq != 0 {
+				if seq <= buffered[items[0].WorkerID] {
+					continue
+				}
+				buffered[items[0].WorkerID] = seq
+			}
+			batch = append(batch, items...)
 			if len(batch) >= batchSize {
-				s.flushUserData(batch)
+				s.commitUserData(batch)
 				batch = batch[:0]
 			}
 		case <-ticker.C:
 			if len(batch) > 0 {
-				s.flushUserData(batch)
+				s.commitUserData(batch)
 				batch = batch[:0]
 			}
 		}
 	}
 }
 
-func (s *analyticsService) flushUserData(items []models.UserDataUsage) {
-	if len(items) == 0 {
+// commitUserData retries the batch until it is committed, to ClickHouse or
+// after userDataMaxAttempts to the dead letter table, and then acks the
+// highest seq of each worker in it.
+func (s *analyticsService) commitUserData(items []models.UserDataUsage) {
+	seqs := make(map[uuid.UUID]uint64)
+	for _, data := range items {
+		if data.Seq > seqs[data.WorkerID] {
+			seqs[data.WorkerID] = data.Seq
+		}
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.commitUserDataOnce(context.Background(), items, seqs, attempt >= userDataMaxAttempts)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to commit user data batch of %d rows (attempt %d), retrying in %s: %v", len(items), attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, userDataRetryMax)
+	}
+	if s.onUserDataCommit == nil {
 		return
 	}
+	for workerID, seq := range seqs {
+		s.onUserDataCommit(workerID, seq)
+	}
+}
+
+// commitUserDataOnce writes the rows above each worker's committed analytics
+// seq to ClickHouse; the rest are replays of rows already written, possibly by
+// another replica. The seqs stay locked until ClickHouse has the rows and then
+// advance, so two replicas never both write a replay. With deadLetter set a
+// batch ClickHouse refuses is stored in user_data_dead_letter instead.
+func (s *analyticsService) commitUserDataOnce(ctx context.Context, items []models.UserDataUsage, seqs map[uuid.UUID]uint64, deadLetter bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	qtx := s.queries.WithTx(tx)
+
+	committed, err := lockTelemetrySeqs(ctx, qtx, seqs)
+	if err != nil {
+		return err
+	}
+	fresh := make([]models.UserDataUsage, 0, len(items))
+	for _, data := range items {
+		if data.Seq != 0 && data.Seq <= uint64(committed[data.WorkerID].AnalyticsSeq) {
+			continue
+		}
+		fresh = append(fresh, data)
+	}
+
+	if err := s.flushUserData(fresh); err != nil {
+		if !deadLetter {
+			return err
+		}
+		rows, marshalErr := json.Marshal(fresh)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		log.Printf("Moving user data batch of %d rows to the dead letter table: %v", len(fresh), err)
+		if err := qtx.InsertUserDataDeadLetter(ctx, repository.InsertUserDataDeadLetterParams{
+			Rows:  string(rows),
+			Error: err.Error(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(seqs) > 0 {
+		workerIDs, values := seqArgs(seqs)
+		if err := qtx.AdvanceAnalyticsSeqs(ctx, repository.AdvanceAnalyticsSeqsParams{WorkerIds: workerIDs, Seqs: values}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *analyticsService) flushUserData(items []models.UserDataUsage) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+	defer func(start time.Time) { metrics.ObserveClickHouseFlush("user_data_usage", start, err) }(time.Now())
 	ctx := context.Background()
 	query := `INSERT INTO analytics_db_subnetworksystem.user_data_usage (
 			user_id, username, pool_id, pool_name, worker_id, worker_region,
 			bytes_sent, bytes_received, source_ip,
-			protocol, destination_host, destination_port, status_code
+			protocol, destination_host, destination_port, status_code, request_count
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 		)`
 	batch, err := s.conn.PrepareBatch(ctx, query)
 	if err != nil {
-		log.Printf("Failed to prepare user data batch: %v", err)
-		return
+		return fmt.Errorf("prepare batch: %v", err)
 	}
 	for _, data := range items {
 		err := batch.Append(
 			data.UserID, data.Username, data.PoolID, data.PoolName, data.WorkerID, data.WorkerRegion,
 			data.BytesSent, data.BytesReceived, data.SourceIP,
-			data.Protocol, data.DestinationHost, data.DestinationPort, data.StatusCode,
+			data.Protocol, data.DestinationHost, data.DestinationPort, data.StatusCode, data.RequestCount,
 		)
 		if err != nil {
-			log.Printf("Failed to append user data to batch: %v", err)
-			continue
+			_ = batch.Abort()
+			return fmt.Errorf("append row: %v", err)
 		}
 	}
 	if err := batch.Send(); err != nil {
-		log.Printf("Failed to send user data batch: %v", err)
+		return fmt.Errorf("send batch: %v", err)
 	}
+	return nil
 }
 
 func (s *analyticsService) processWebsiteAccessBatch() {
@@ -216,6 +607,7 @@ func (s *analyticsService) processWebsiteAccessBatch() {
 	for {
 		select {
 		case item := <-s.websiteAccessChan:
+			metrics.AnalyticsQueueDepth.WithLabelValues(websiteAccessQueue).Set(float64(len(s.websiteAccessChan)))
 			batch = append(batch, item)
 			if len(batch) >= batchSize {
 				s.flushWebsiteAccess(batch)
@@ -236,20 +628,22 @@ func (s *analyticsService) flushWebsiteAccess(items []models.WebsiteAccess) {
 	}
 	ctx := context.Background()
 	query := `INSERT INTO analytics_db_subnetworksystem.website_access (
-			user_id, username, domain, subdomain, full_url,
+			timestamp, user_id, username, domain, subdomain, full_url,
 			bytes_sent, bytes_received, request_method, status_code,
 			content_type, source_ip
 		) VALUES (
-			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
 		)`
+	start := time.Now()
 	batch, err := s.conn.PrepareBatch(ctx, query)
 	if err != nil {
+		metrics.ObserveClickHouseFlush("website_access", start, err)
 		log.Printf("Failed to prepare website access batch: %v", err)
 		return
 	}
 	for _, data := range items {
 		err := batch.Append(
-			data.UserID, data.Username, data.Domain, data.Subdomain, data.FullURL,
+			data.Timestamp, data.UserID, data.Username, data.Domain, data.Subdomain, data.FullURL,
 			data.BytesSent, data.BytesReceived, data.RequestMethod, data.StatusCode,
 			data.ContentType, data.SourceIP,
 		)
@@ -258,7 +652,9 @@ func (s *analyticsService) flushWebsiteAccess(items []models.WebsiteAccess) {
 			continue
 		}
 	}
-	if err := batch.Send(); err != nil {
+	err = batch.Send()
+	metrics.ObserveClickHouseFlush("website_access", start, err)
+	if err != nil {
 		log.Printf("Failed to send website access batch: %v", err)
 	}
 }
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+)
+
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+	auditActionDelete = "delete"
+)
+
+// redacted replaces secrets in audit snapshots.
+const redacted = "[redacted]"
+
+// errNothingChanged aborts an audited mutation that matched no rows, so no
+// audit record is written for it.
+var errNothingChanged = errors.New("nothing changed")
+
+// auditRecord describes one admin mutation. Before and After are marshalled to
+// JSON; nil is stored as NULL.
+type auditRecord struct {
+	Action     string
+	EntityType string
+	EntityID   string
+	Before     interface{}
+	After      interface{}
+}
+
+// auditedTx runs fn in a transaction and appends the audit record it returns in
+// the same transaction, so a mutation is never committed without its trail.
+func auditedTx(ctx context.Context, db *sql.DB, queries *repository.Queries, fn func(qtx *repository.Queries) (auditRecord, error)) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	qtx := queries.WithTx(tx)
+	record, err := fn(qtx)
+	if err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, qtx, record); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordAudit(ctx context.Context, qtx *repository.Queries, record auditRecord) error {
+	actor, ok := models.AuditActorFromContext(ctx)
+	if !ok {
+		actor = models.AuditActor{Name: "system"}
+	}
+	before, err := auditJSON(record.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJSON(record.After)
+	if err != nil {
+		return err
+	}
+	return qtx.InsertAuditLog(ctx, repository.InsertAuditLogParams{
+		ActorTokenID: uuid.NullUUID{UUID: actor.TokenID, Valid: actor.TokenID != uuid.Nil},
+		ActorName:    actor.Name,
+		RequestID:    actor.RequestID,
+		Route:        actor.Route,
+		Action:       record.Action,
+		EntityType:   record.EntityType,
+		EntityID:     record.EntityID,
+		Before:       before,
+		After:        after,
+	})
+}
+
+func auditJSON(v interface{}) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+type AuditService interface {
+	GetAuditLog(ctx context.Context, filter models.AuditLogFilter) (response []models.AuditLogResponce, code int, message string, err error)
+}
+
+type auditService struct {
+	queries *repository.Queries
+}
+
+func NewAuditService(queries *repository.Queries) AuditService {
+	return &auditService{queries: queries}
+}
+
+func (s *auditService) GetAuditLog(ctx context.Context, filter models.AuditLogFilter) (response []models.AuditLogResponce, code int, message string, err error) {
+	params := repository.ListAuditLogParams{
+		RowLimit: filter.Limit,
+	}
+	if filter.Actor != nil {
+		params.Actor = sql.NullString{String: *filter.Actor, Valid: true}
+	}
+	if filter.EntityType != nil {
+		params.EntityType = sql.NullString{String: *filter.EntityType, Valid: true}
+	}
+	if filter.EntityId != nil {
+		params.EntityID = sql.NullString{String: *filter.EntityId, Valid: true}
+	}
+	if filter.From != nil {
+		params.FromTime = sql.NullTime{Time: *filter.From, Valid: true}
+	}
+	if filter.To != nil {
+		params.ToTime = sql.NullTime{Time: *filter.To, Valid: true}
+	}
+
+	rows, err := s.queries.ListAuditLog(ctx, params)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "server error", err
+	}
+
+	response = []models.AuditLogResponce{}
+	for _, row := range rows {
+		entry := models.AuditLogResponce{
+			Id:         row.ID,
+			ActorName:  row.ActorName,
+			RequestId:  row.RequestID,
+			Route:      row.Route,
+			Action:     row.Action,
+			EntityType: row.EntityType,
+			EntityId:   row.EntityID,
+			Before:     json.RawMessage(row.Before),
+			After:      json.RawMessage(row.After),
+			CreatedAt:  row.CreatedAt,
+		}
+		if row.ActorTokenID.Valid {
+			entry.ActorTokenId = &row.ActorTokenID.UUID
+		}
+		response = append(response, entry)
+	}
+
+	return response, http.StatusOK, "", nil
+}
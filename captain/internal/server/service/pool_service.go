@@ -9,6 +9,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
@@ -19,6 +20,11 @@ type PoolService interface {
 	GetCountries(ctx context.Context) ([]models.GetCountryResponce, int, string, error)
 	CreateCountry(ctx context.Context, req models.CreateCountryRequest) (models.CreateCountryResponce, int, string, error)
 	DeleteCountry(ctx context.Context, name string) (int, string, error)
+	GetCountryCatalog(ctx context.Context, code string) (*models.GetCountryCatalogResponce, int, string, error)
+	CreateState(ctx context.Context, req models.CreateStateRequest) (models.StateResponce, int, string, error)
+	DeleteState(ctx context.Context, req models.DeleteStateRequest) (int, string, error)
+	CreateCity(ctx context.Context, req models.CreateCityRequest) (models.CityResponce, int, string, error)
+	DeleteCity(ctx context.Context, req models.DeleteCityRequest) (int, string, error)
 	GetUpstreams(ctx context.Context) ([]models.GetUpstreamResponce, int, string, error)
 	CreateUpstream(ctx context.Context, req models.CreateUpstreamRequest) (models.CreateUpstreamResponce, int, string, error)
 	DeleteUpstream(ctx context.Context, tag string) (int, string, error)
@@ -29,19 +35,22 @@ type PoolService interface {
 	DeletePool(ctx context.Context, tag string) (int, string, error)
 	AddPoolUpstreamWeight(ctx context.Context, req models.AddPoolUpstreamWeightRequest) (int, string, error)
 	DeletePoolUpstreamWeight(ctx context.Context, req models.DeletePoolUpstreamWeightRequest) (int, string, error)
+	ReencryptUpstreamCredentials(ctx context.Context) error
 }
 
 type PoolServiceImpl struct {
 	Queries   *repository.Queries
 	DB        *sql.DB
 	wsManager models.WebsocketManagerInterface
+	keyring   *secrets.Keyring
 }
 
-func NewPoolService(queries *repository.Queries, db *sql.DB, wsManager models.WebsocketManagerInterface) PoolService {
+func NewPoolService(queries *repository.Queries, db *sql.DB, wsManager models.WebsocketManagerInterface, keyring *secrets.Keyring) PoolService {
 	return &PoolServiceImpl{
 		Queries:   queries,
 		DB:        db,
 		wsManager: wsManager,
+		keyring:   keyring,
 	}
 }
 
@@ -67,7 +76,20 @@ func (s *PoolServiceImpl) GetRegions(ctx context.Context) ([]models.GetRegionRes
 }
 
 func (s *PoolServiceImpl) CreateRegion(ctx context.Context, req models.CreateRegionRequest) (models.CreateRegionResponce, int, string, error) {
-	region, err := s.Queries.AddRegion(ctx, *req.Name)
+	var region repository.Region
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		region, err = qtx.AddRegion(ctx, *req.Name)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "region",
+			EntityID:   region.ID.String(),
+			After:      models.CreateRegionResponce{Id: region.ID, Name: region.Name, CreatedAt: region.CreatedAt},
+		}, nil
+	})
 	if err != nil {
 		return models.CreateRegionResponce{}, http.StatusInternalServerError, "failed to create region", err
 	}
@@ -82,7 +104,18 @@ func (s *PoolServiceImpl) CreateRegion(ctx context.Context, req models.CreateReg
 }
 
 func (s *PoolServiceImpl) DeleteRegion(ctx context.Context, name string) (int, string, error) {
-	if err := s.Queries.DeleteRegion(ctx, name); err != nil {
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		if err := qtx.DeleteRegion(ctx, name); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "region",
+			EntityID:   name,
+			Before:     models.DeleteRegionRequest{Name: &name},
+		}, nil
+	})
+	if err != nil {
 		return http.StatusInternalServerError, "failed to delete region", err
 	}
 	return http.StatusOK, "region deleted", nil
@@ -118,7 +151,26 @@ func (s *PoolServiceImpl) CreateCountry(ctx context.Context, req models.CreateCo
 		RegionID: *req.RegionId,
 	}
 
-	country, err := s.Queries.AddCountry(ctx, args)
+	var country repository.Country
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		country, err = qtx.AddCountry(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "country",
+			EntityID:   country.ID.String(),
+			After: models.CreateCountryResponce{
+				Id:        country.ID,
+				Name:      country.Name,
+				Code:      country.Code,
+				RegionId:  country.RegionID,
+				CreatedAt: country.CreatedAt,
+			},
+		}, nil
+	})
 	if err != nil {
 		return models.CreateCountryResponce{}, http.StatusInternalServerError, "failed to create country", err
 	}
@@ -131,16 +183,258 @@ func (s *PoolServiceImpl) CreateCountry(ctx context.Context, req models.CreateCo
 		CreatedAt: country.CreatedAt,
 	}
 
+	s.notifyRegionPools(ctx, country.RegionID)
 	return res, http.StatusCreated, "country created", nil
 }
 
 func (s *PoolServiceImpl) DeleteCountry(ctx context.Context, name string) (int, string, error) {
-	if err := s.Queries.DeleteCountry(ctx, name); err != nil {
+	var regionIds []uuid.UUID
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		if regionIds, err = qtx.DeleteCountry(ctx, name); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "country",
+			EntityID:   name,
+			Before:     models.DeleteCountryRequest{Name: &name},
+		}, nil
+	})
+	if err != nil {
 		return http.StatusInternalServerError, "failed to delete country", err
 	}
+	for _, regionId := range regionIds {
+		s.notifyRegionPools(ctx, regionId)
+	}
 	return http.StatusOK, "country deleted", nil
 }
 
+// GetCountryCatalog returns a country with its states and cities.
+func (s *PoolServiceImpl) GetCountryCatalog(ctx context.Context, code string) (*models.GetCountryCatalogResponce, int, string, error) {
+	country, err := s.Queries.GetCountryByCode(ctx, code)
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, "country not found", err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to get country", err
+	}
+	states, err := s.Queries.GetStatesByCountry(ctx, country.ID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to get states", err
+	}
+	cities, err := s.Queries.GetCitiesByCountry(ctx, country.ID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to get cities", err
+	}
+
+	res := &models.GetCountryCatalogResponce{
+		GetCountryResponce: models.GetCountryResponce{
+			Id:        country.ID,
+			Name:      country.Name,
+			Code:      country.Code,
+			RegionId:  country.RegionID,
+			CreatedAt: country.CreatedAt,
+		},
+		States: []models.StateResponce{},
+		Cities: []models.CityResponce{},
+	}
+	for _, state := range states {
+		res.States = append(res.States, stateSnapshot(state))
+	}
+	for _, city := range cities {
+		res.Cities = append(res.Cities, models.CityResponce{
+			Id:        city.ID,
+			Name:      city.Name,
+			Code:      city.Code,
+			CountryId: city.CountryID,
+			StateCode: city.StateCode.String,
+			CreatedAt: city.CreatedAt,
+		})
+	}
+	return res, http.StatusOK, "", nil
+}
+
+func (s *PoolServiceImpl) CreateState(ctx context.Context, req models.CreateStateRequest) (models.StateResponce, int, string, error) {
+	country, err := s.Queries.GetCountryByCode(ctx, *req.CountryCode)
+	if err == sql.ErrNoRows {
+		return models.StateResponce{}, http.StatusNotFound, "country not found", err
+	}
+	if err != nil {
+		return models.StateResponce{}, http.StatusInternalServerError, "failed to create state", err
+	}
+
+	var state repository.State
+	err = auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		state, err = qtx.AddState(ctx, repository.AddStateParams{
+			Name:      *req.Name,
+			Code:      *req.Code,
+			CountryID: country.ID,
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "state",
+			EntityID:   state.ID.String(),
+			After:      stateSnapshot(state),
+		}, nil
+	})
+	if err != nil {
+		return models.StateResponce{}, http.StatusInternalServerError, "failed to create state", err
+	}
+
+	s.notifyRegionPools(ctx, country.RegionID)
+	return stateSnapshot(state), http.StatusCreated, "state created", nil
+}
+
+// DeleteState removes a state along with its cities.
+func (s *PoolServiceImpl) DeleteState(ctx context.Context, req models.DeleteStateRequest) (int, string, error) {
+	country, err := s.Queries.GetCountryByCode(ctx, *req.CountryCode)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, "country not found", err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "failed to delete state", err
+	}
+
+	err = auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		state, err := qtx.GetStateByCode(ctx, repository.GetStateByCodeParams{CountryID: country.ID, Code: *req.Code})
+		if err == sql.ErrNoRows {
+			return auditRecord{}, errNothingChanged
+		}
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if _, err := qtx.DeleteState(ctx, repository.DeleteStateParams{CountryID: country.ID, Code: *req.Code}); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "state",
+			EntityID:   state.ID.String(),
+			Before:     stateSnapshot(state),
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted", nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "failed to delete state", err
+	}
+
+	s.notifyRegionPools(ctx, country.RegionID)
+	return http.StatusOK, "state deleted", nil
+}
+
+func (s *PoolServiceImpl) CreateCity(ctx context.Context, req models.CreateCityRequest) (models.CityResponce, int, string, error) {
+	country, err := s.Queries.GetCountryByCode(ctx, *req.CountryCode)
+	if err == sql.ErrNoRows {
+		return models.CityResponce{}, http.StatusNotFound, "country not found", err
+	}
+	if err != nil {
+		return models.CityResponce{}, http.StatusInternalServerError, "failed to create city", err
+	}
+	args := repository.AddCityParams{
+		Name:      *req.Name,
+		Code:      *req.Code,
+		CountryID: country.ID,
+	}
+	if req.StateCode != nil && *req.StateCode != "" {
+		state, err := s.Queries.GetStateByCode(ctx, repository.GetStateByCodeParams{CountryID: country.ID, Code: *req.StateCode})
+		if err == sql.ErrNoRows {
+			return models.CityResponce{}, http.StatusNotFound, "state not found", err
+		}
+		if err != nil {
+			return models.CityResponce{}, http.StatusInternalServerError, "failed to create city", err
+		}
+		args.StateID = uuid.NullUUID{UUID: state.ID, Valid: true}
+	}
+
+	var res models.CityResponce
+	err = auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		city, err := qtx.AddCity(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		res = models.CityResponce{
+			Id:        city.ID,
+			Name:      city.Name,
+			Code:      city.Code,
+			CountryId: city.CountryID,
+			CreatedAt: city.CreatedAt,
+		}
+		if req.StateCode != nil {
+			res.StateCode = *req.StateCode
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "city",
+			EntityID:   city.ID.String(),
+			After:      res,
+		}, nil
+	})
+	if err != nil {
+		return models.CityResponce{}, http.StatusInternalServerError, "failed to create city", err
+	}
+
+	s.notifyRegionPools(ctx, country.RegionID)
+	return res, http.StatusCreated, "city created", nil
+}
+
+func (s *PoolServiceImpl) DeleteCity(ctx context.Context, req models.DeleteCityRequest) (int, string, error) {
+	country, err := s.Queries.GetCountryByCode(ctx, *req.CountryCode)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, "country not found", err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "failed to delete city", err
+	}
+
+	err = auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		deleted, err := qtx.DeleteCity(ctx, repository.DeleteCityParams{CountryID: country.ID, Code: *req.Code})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if deleted == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "city",
+			EntityID:   *req.CountryCode + "/" + *req.Code,
+			Before:     req,
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted", nil
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "failed to delete city", err
+	}
+
+	s.notifyRegionPools(ctx, country.RegionID)
+	return http.StatusOK, "city deleted", nil
+}
+
+// notifyRegionPools makes the workers of every pool in the region reload
+// their configuration, which carries the region's targeting catalog.
+func (s *PoolServiceImpl) notifyRegionPools(ctx context.Context, regionId uuid.UUID) {
+	if s.wsManager == nil {
+		return
+	}
+	poolIds, err := s.Queries.GetPoolIdsByRegion(ctx, regionId)
+	if err != nil {
+		log.Printf("[pool] failed to get pools of region %s: %v", regionId, err)
+		return
+	}
+	for _, poolId := range poolIds {
+		s.wsManager.NotifyPoolChange(poolId)
+	}
+}
+
 func (s *PoolServiceImpl) GetUpstreams(ctx context.Context) ([]models.GetUpstreamResponce, int, string, error) {
 	upstreams, err := s.Queries.GetUpstreams(ctx)
 	if err != nil {
@@ -170,18 +464,49 @@ func (s *PoolServiceImpl) GetUpstreams(ctx context.Context) ([]models.GetUpstrea
 }
 
 func (s *PoolServiceImpl) CreateUpstream(ctx context.Context, req models.CreateUpstreamRequest) (models.CreateUpstreamResponce, int, string, error) {
+	username, err := s.keyring.Encrypt(*req.Username)
+	if err != nil {
+		return models.CreateUpstreamResponce{}, http.StatusInternalServerError, "failed to create upstream", err
+	}
+	password, err := s.keyring.Encrypt(*req.Password)
+	if err != nil {
+		return models.CreateUpstreamResponce{}, http.StatusInternalServerError, "failed to create upstream", err
+	}
 
 	args := repository.AddUpstreamParams{
 		Tag:              *req.Tag,
 		UpstreamProvider: *req.UpstreamProvider,
 		ConfigFormat:     *req.ConfigFormat,
-		Username:         *req.Username,
-		Password:         *req.Password,
+		Username:         username,
+		Password:         password,
 		Port:             int32(*req.Port),
 		Domain:           *req.Domain,
 	}
 
-	upstream, err := s.Queries.AddUpstream(ctx, args)
+	var upstream repository.Upstream
+	err = auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		upstream, err = qtx.AddUpstream(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "upstream",
+			EntityID:   upstream.ID.String(),
+			After: models.CreateUpstreamResponce{
+				Id:               upstream.ID,
+				Tag:              upstream.Tag,
+				UpstreamProvider: upstream.UpstreamProvider,
+				ConfigFormat:     upstream.ConfigFormat,
+				Username:         redacted,
+				Password:         redacted,
+				Port:             int(upstream.Port),
+				Domain:           upstream.Domain,
+				CreatedAt:        upstream.CreatedAt,
+			},
+		}, nil
+	})
 	if err != nil {
 		return models.CreateUpstreamResponce{}, http.StatusInternalServerError, "failed to create upstream", err
 	}
@@ -191,8 +516,8 @@ func (s *PoolServiceImpl) CreateUpstream(ctx context.Context, req models.CreateU
 		Tag:              upstream.Tag,
 		UpstreamProvider: upstream.UpstreamProvider,
 		ConfigFormat:     upstream.ConfigFormat,
-		Username:         upstream.Username,
-		Password:         upstream.Password,
+		Username:         redacted,
+		Password:         redacted,
 		Port:             int(upstream.Port),
 		Domain:           upstream.Domain,
 		CreatedAt:        upstream.CreatedAt,
@@ -202,12 +527,63 @@ func (s *PoolServiceImpl) CreateUpstream(ctx context.Context, req models.CreateU
 }
 
 func (s *PoolServiceImpl) DeleteUpstream(ctx context.Context, tag string) (int, string, error) {
-	if err := s.Queries.DeleteUpstreamByTag(ctx, tag); err != nil {
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		if err := qtx.DeleteUpstreamByTag(ctx, tag); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "upstream",
+			EntityID:   tag,
+			Before:     models.DeleteUpstreamRequest{Tag: &tag},
+		}, nil
+	})
+	if err != nil {
 		return http.StatusInternalServerError, "failed to delete upstream", err
 	}
 	return http.StatusOK, "upstream deleted", nil
 }
 
+// ReencryptUpstreamCredentials seals cleartext credentials and those under a
+// retired key with the active key. It runs at startup, so rotating the key is
+// a matter of prepending the new key and restarting.
+func (s *PoolServiceImpl) ReencryptUpstreamCredentials(ctx context.Context) error {
+	upstreams, err := s.Queries.GetUpstreams(ctx)
+	if err != nil {
+		return err
+	}
+	for _, upstream := range upstreams {
+		if !s.keyring.NeedsReencrypt(upstream.Username) && !s.keyring.NeedsReencrypt(upstream.Password) {
+			continue
+		}
+		username, err := s.reencrypt(upstream.Username)
+		if err != nil {
+			return fmt.Errorf("upstream %s username: %v", upstream.Tag, err)
+		}
+		password, err := s.reencrypt(upstream.Password)
+		if err != nil {
+			return fmt.Errorf("upstream %s password: %v", upstream.Tag, err)
+		}
+		if err := s.Queries.UpdateUpstreamCredentials(ctx, repository.UpdateUpstreamCredentialsParams{
+			ID:       upstream.ID,
+			Username: username,
+			Password: password,
+		}); err != nil {
+			return err
+		}
+		log.Printf("[pool] re-encrypted credentials of upstream %s", upstream.Tag)
+	}
+	return nil
+}
+
+func (s *PoolServiceImpl) reencrypt(value string) (string, error) {
+	plaintext, err := s.keyring.Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return s.keyring.Encrypt(plaintext)
+}
+
 func (s *PoolServiceImpl) GetPools(ctx context.Context) ([]models.GetPoolsResponse, int, string, error) {
 	rows, err := s.Queries.ListPoolsWithUpstreams(ctx)
 	if err != nil {
@@ -231,6 +607,8 @@ func (s *PoolServiceImpl) GetPools(ctx context.Context) ([]models.GetPoolsRespon
 				Subdomain: row.PoolSubdomain,
 				Port:      row.PoolPort,
 				Upstreams: []models.PoolUpstream{},
+
+				ResolveLocally: row.ResolveLocally,
 			}
 			poolMap[row.PoolID] = pool
 			orderedPools = append(orderedPools, pool)
@@ -240,8 +618,8 @@ func (s *PoolServiceImpl) GetPools(ctx context.Context) ([]models.GetPoolsRespon
 			pool.Upstreams = append(pool.Upstreams, models.PoolUpstream{
 				Tag:          row.UpstreamTag.String,
 				ConfigFormat: row.ConfigFormat.String,
-				Username:     row.Username.String,
-				Password:     row.Password.String,
+				Username:     redacted,
+				Password:     redacted,
 				Port:         row.UpstreamPort.Int32,
 				Domain:       row.UpstreamDomain.String,
 			})
@@ -276,6 +654,8 @@ func (s *PoolServiceImpl) GetPoolByTag(ctx context.Context, tag string) (*models
 				Subdomain: row.PoolSubdomain,
 				Port:      row.PoolPort,
 				Upstreams: []models.PoolUpstream{},
+
+				ResolveLocally: row.ResolveLocally,
 			}
 		}
 
@@ -283,8 +663,8 @@ func (s *PoolServiceImpl) GetPoolByTag(ctx context.Context, tag string) (*models
 			poolResponse.Upstreams = append(poolResponse.Upstreams, models.PoolUpstream{
 				Tag:          row.UpstreamTag.String,
 				ConfigFormat: row.ConfigFormat.String,
-				Username:     row.Username.String,
-				Password:     row.Password.String,
+				Username:     redacted,
+				Password:     redacted,
 				Port:         row.UpstreamPort.Int32,
 				Domain:       row.UpstreamDomain.String,
 			})
@@ -312,6 +692,9 @@ func (s *PoolServiceImpl) CreatePool(ctx context.Context, req models.CreatePoolR
 		Subdomain: *req.Subdomain,
 		Port:      *req.Port,
 	}
+	if req.ResolveLocally != nil {
+		args.ResolveLocally = *req.ResolveLocally
+	}
 
 	pool, err := qtx.InsetPool(ctx, args)
 	if err != nil {
@@ -337,10 +720,6 @@ func (s *PoolServiceImpl) CreatePool(ctx context.Context, req models.CreatePoolR
 		return models.CreatePoolResponce{}, http.StatusBadRequest, "server error", err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return models.CreatePoolResponce{}, http.StatusInternalServerError, "failed to create pool", err
-	}
-
 	upstreamsRes := []models.CreateUpstreamWeightResponce{}
 
 	for i, puw := range poolUpstreamWeights {
@@ -359,6 +738,22 @@ func (s *PoolServiceImpl) CreatePool(ctx context.Context, req models.CreatePoolR
 		UpStreams: upstreamsRes,
 		CreatedAt: pool.CreatedAt,
 		UpdatedAt: pool.UpdatedAt,
+
+		ResolveLocally: pool.ResolveLocally,
+	}
+
+	err = recordAudit(ctx, qtx, auditRecord{
+		Action:     auditActionCreate,
+		EntityType: "pool",
+		EntityID:   pool.ID.String(),
+		After:      res,
+	})
+	if err != nil {
+		return models.CreatePoolResponce{}, http.StatusInternalServerError, "failed to create pool", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.CreatePoolResponce{}, http.StatusInternalServerError, "failed to create pool", err
 	}
 
 	return res, http.StatusCreated, "pool created", nil
@@ -386,8 +781,28 @@ func (s *PoolServiceImpl) UpdatePool(ctx context.Context, tag string, req models
 		Subdomain: subdomain,
 		Port:      port,
 	}
+	if req.ResolveLocally != nil {
+		args.ResolveLocally = sql.NullBool{Bool: *req.ResolveLocally, Valid: true}
+	}
 
-	updatedPool, err := s.Queries.UpdatePool(ctx, args)
+	var updatedPool repository.Pool
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		before, err := qtx.GetPoolByTag(ctx, tag)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		updatedPool, err = qtx.UpdatePool(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionUpdate,
+			EntityType: "pool",
+			EntityID:   updatedPool.ID.String(),
+			Before:     poolSnapshot(before),
+			After:      poolSnapshot(updatedPool),
+		}, nil
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.CreatePoolResponce{}, http.StatusNotFound, "Pool not found", err
@@ -403,6 +818,8 @@ func (s *PoolServiceImpl) UpdatePool(ctx context.Context, tag string, req models
 		Port:      updatedPool.Port,
 		CreatedAt: updatedPool.CreatedAt,
 		UpdatedAt: updatedPool.UpdatedAt,
+
+		ResolveLocally: updatedPool.ResolveLocally,
 	}
 
 	s.wsManager.NotifyPoolChange(updatedPool.ID)
@@ -411,23 +828,37 @@ func (s *PoolServiceImpl) UpdatePool(ctx context.Context, tag string, req models
 }
 
 func (s *PoolServiceImpl) DeletePool(ctx context.Context, tag string) (int, string, error) {
-	pool, err := s.Queries.GetPoolByTagWithUpstreams(ctx, tag)
-	if err != nil {
-		return http.StatusInternalServerError, "Failed to delete pool", err
+	var pool repository.Pool
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		pool, err = qtx.GetPoolByTag(ctx, tag)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		result, err := qtx.DeletePool(ctx, tag)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "pool",
+			EntityID:   pool.ID.String(),
+			Before:     poolSnapshot(pool),
+		}, nil
+	})
+	if err == sql.ErrNoRows || err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted", nil
 	}
-	result, err := s.Queries.DeletePool(ctx, tag)
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to delete pool", err
 	}
-	rowsAffected, _ := result.RowsAffected()
-	log.Println(rowsAffected)
-	if rowsAffected == 0 {
-		return http.StatusNotFound, "Nothing deleted", nil
-	}
 
 	if s.wsManager != nil {
-		log.Println(pool[0].PoolID)
-		s.wsManager.NotifyPoolChange(pool[0].PoolID)
+		log.Println(pool.ID)
+		s.wsManager.NotifyPoolChange(pool.ID)
 	}
 	return http.StatusOK, "deleted", nil
 }
@@ -439,7 +870,30 @@ func (s *PoolServiceImpl) AddPoolUpstreamWeight(ctx context.Context, req models.
 		Weight: *req.Weight,
 	}
 
-	_, err := s.Queries.AddPoolUpstreamWeight(ctx, args)
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		record := auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "pool_upstream_weight",
+			EntityID:   *req.PoolTag + "/" + *req.UpstreamTag,
+		}
+		before, err := qtx.GetPoolUpstreamWeight(ctx, repository.GetPoolUpstreamWeightParams{
+			Tag:   *req.PoolTag,
+			Tag_2: *req.UpstreamTag,
+		})
+		switch {
+		case err == nil:
+			record.Action = auditActionUpdate
+			record.Before = models.AddPoolUpstreamWeightRequest{PoolTag: req.PoolTag, UpstreamTag: req.UpstreamTag, Weight: &before}
+		case err != sql.ErrNoRows:
+			return auditRecord{}, err
+		}
+		weight, err := qtx.AddPoolUpstreamWeight(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		record.After = models.AddPoolUpstreamWeightRequest{PoolTag: req.PoolTag, UpstreamTag: req.UpstreamTag, Weight: &weight.Weight}
+		return record, nil
+	})
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to add upstream weight", err
 	}
@@ -456,18 +910,62 @@ func (s *PoolServiceImpl) DeletePoolUpstreamWeight(ctx context.Context, req mode
 		Tag_2: *req.UpstreamTag,
 	}
 
-	result, err := s.Queries.DeletePoolUpstreamWeight(ctx, args)
+	err := auditedTx(ctx, s.DB, s.Queries, func(qtx *repository.Queries) (auditRecord, error) {
+		before, err := qtx.GetPoolUpstreamWeight(ctx, repository.GetPoolUpstreamWeightParams{
+			Tag:   *req.PoolTag,
+			Tag_2: *req.UpstreamTag,
+		})
+		if err == sql.ErrNoRows {
+			return auditRecord{}, errNothingChanged
+		}
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if _, err := qtx.DeletePoolUpstreamWeight(ctx, args); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "pool_upstream_weight",
+			EntityID:   *req.PoolTag + "/" + *req.UpstreamTag,
+			Before:     models.AddPoolUpstreamWeightRequest{PoolTag: req.PoolTag, UpstreamTag: req.UpstreamTag, Weight: &before},
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted", nil
+	}
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to delete upstream weight", err
 	}
-	rowsAffected, _ := result.RowsAffected()
-	log.Println(rowsAffected)
-	if rowsAffected == 0 {
-		return http.StatusNotFound, "Nothing deleted", nil
-	}
 
 	//change later
 	pool, err := s.Queries.GetPoolByTagWithUpstreams(ctx, *req.PoolTag)
 	s.wsManager.NotifyPoolChange(pool[0].PoolID)
 	return http.StatusOK, "deleted", nil
 }
+
+// stateSnapshot is the API and audit view of a state row.
+func stateSnapshot(state repository.State) models.StateResponce {
+	return models.StateResponce{
+		Id:        state.ID,
+		Name:      state.Name,
+		Code:      state.Code,
+		CountryId: state.CountryID,
+		CreatedAt: state.CreatedAt,
+	}
+}
+
+// poolSnapshot is the audit view of a pool row.
+func poolSnapshot(pool repository.Pool) models.CreatePoolResponce {
+	return models.CreatePoolResponce{
+		Id:        pool.ID,
+		Tag:       pool.Tag,
+		RegionId:  pool.RegionID,
+		Subdomain: pool.Subdomain,
+		Port:      pool.Port,
+		CreatedAt: pool.CreatedAt,
+		UpdatedAt: pool.UpdatedAt,
+
+		ResolveLocally: pool.ResolveLocally,
+	}
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+)
+
+// apiTokenPrefix marks captain api tokens so they are easy to spot in logs and
+// secret scanners.
+const apiTokenPrefix = "snt_"
+
+type TokenService interface {
+	models.TokenAuthenticator
+	CreateToken(ctx context.Context, caller *models.ApiPrincipal, req *models.CreateApiTokenRequest) (response *models.CreateApiTokenResponce, code int, message string, err error)
+	GetTokens(ctx context.Context) (response []models.GetApiTokenResponce, code int, message string, err error)
+	RevokeToken(ctx context.Context, id uuid.UUID) (code int, message string, err error)
+}
+
+type tokenService struct {
+	queries *repository.Queries
+	db      *sql.DB
+}
+
+func NewTokenService(queries *repository.Queries, db *sql.DB) TokenService {
+	return &tokenService{queries: queries, db: db}
+}
+
+// newSecret returns prefix followed by 32 random bytes, base64url encoded.
+func newSecret(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashSecret is how api tokens and worker secrets are stored. The secrets are
+// high entropy, so a plain sha256 is enough and keeps lookups by hash cheap.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *tokenService) Authenticate(ctx context.Context, token string) (*models.ApiPrincipal, error) {
+	row, err := s.queries.GetApiTokenByHash(ctx, hashSecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if row.RevokedAt.Valid {
+		return nil, fmt.Errorf("api token %s is revoked", row.ID)
+	}
+	if row.ExpiresAt.Valid && time.Now().After(row.ExpiresAt.Time) {
+		return nil, fmt.Errorf("api token %s is expired", row.ID)
+	}
+	return &models.ApiPrincipal{
+		TokenID: row.ID,
+		Name:    row.Name,
+		Scopes:  row.Scopes,
+	}, nil
+}
+
+// CreateToken mints a token for req.Name. The caller can only hand out scopes
+// it holds itself. The token is returned once; only its hash is stored.
+func (s *tokenService) CreateToken(ctx context.Context, caller *models.ApiPrincipal, req *models.CreateApiTokenRequest) (response *models.CreateApiTokenResponce, code int, message string, err error) {
+	for _, scope := range *req.Scopes {
+		if !caller.HasScope(scope) {
+			return nil, http.StatusForbidden, "cannot grant scope " + scope, fmt.Errorf("%s does not hold scope %s", caller.Name, scope)
+		}
+	}
+
+	token, err := newSecret(apiTokenPrefix)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to create token", err
+	}
+
+	params := repository.CreateApiTokenParams{
+		Name:      *req.Name,
+		TokenHash: hashSecret(token),
+		Scopes:    *req.Scopes,
+	}
+	if req.ExpiresAt != nil {
+		params.ExpiresAt = sql.NullTime{Time: *req.ExpiresAt, Valid: true}
+	}
+
+	var row repository.CreateApiTokenRow
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		var err error
+		row, err = qtx.CreateApiToken(ctx, params)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "api_token",
+			EntityID:   row.ID.String(),
+			After: models.GetApiTokenResponce{
+				Id:        row.ID,
+				Name:      row.Name,
+				Scopes:    row.Scopes,
+				ExpiresAt: nullTimePtr(row.ExpiresAt),
+				CreatedAt: row.CreatedAt,
+			},
+		}, nil
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to create token", err
+	}
+
+	response = &models.CreateApiTokenResponce{
+		Id:        row.ID,
+		Name:      row.Name,
+		Token:     token,
+		Scopes:    row.Scopes,
+		ExpiresAt: nullTimePtr(row.ExpiresAt),
+		CreatedAt: row.CreatedAt,
+	}
+
+	return response, http.StatusCreated, "token created", nil
+}
+
+func (s *tokenService) GetTokens(ctx context.Context) (response []models.GetApiTokenResponce, code int, message string, err error) {
+	rows, err := s.queries.GetApiTokens(ctx)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "server error", err
+	}
+
+	response = []models.GetApiTokenResponce{}
+	for _, row := range rows {
+		response = append(response, models.GetApiTokenResponce{
+			Id:        row.ID,
+			Name:      row.Name,
+			Scopes:    row.Scopes,
+			ExpiresAt: nullTimePtr(row.ExpiresAt),
+			RevokedAt: nullTimePtr(row.RevokedAt),
+			CreatedAt: row.CreatedAt,
+		})
+	}
+
+	return response, http.StatusOK, "", nil
+}
+
+func (s *tokenService) RevokeToken(ctx context.Context, id uuid.UUID) (code int, message string, err error) {
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		rows, err := qtx.RevokeApiToken(ctx, id)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if rows == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     "revoke",
+			EntityType: "api_token",
+			EntityID:   id.String(),
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "token not found", fmt.Errorf("no active token with id %s", id)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "server error", err
+	}
+	return http.StatusOK, "token revoked", nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+)
+
+type usageKey struct {
+	username string
+	poolID   uuid.UUID
+}
+
+// usageEvent is the usage of one telemetry event, kept apart until it is
+// applied so replays can be told from new usage by seq.
+type usageEvent struct {
+	workerID uuid.UUID
+	seq      uint64
+	totals   map[usageKey]int64
+}
+
+// usageBatch is a set of usage events applied to user_pools in one
+// transaction. Its id is recorded in usage_batch alongside the update, so a
+// batch retried after an unknown commit outcome is never counted twice. seqs
+// holds the highest telemetry seq of each worker the batch covers.
+type usageBatch struct {
+	id     uuid.UUID
+	events []usageEvent
+	seqs   map[uuid.UUID]uint64
+}
+
+type usageService struct {
+	queries       *repository.Queries
+	db            *sql.DB
+	wsManager     models.WebsocketManagerInterface
+	usageChan     chan []models.UserDataUsage
+	onUsageCommit func(workerID uuid.UUID, seq uint64)
+}
+
+func NewUsageService(q *repository.Queries, db *sql.DB, wsManager models.WebsocketManagerInterface) models.UsageService {
+	return &usageService{
+		queries:   q,
+		db:        db,
+		wsManager: wsManager,
+		usageChan: make(chan []models.UserDataUsage, 10000),
+	}
+}
+
+// RecordUsage queues data for the next batch, waiting for room in the buffer
+// until ctx is done. The caller must not ack the event until it is committed
+// (see OnUsageCommitted).
+func (s *usageService) RecordUsage(ctx context.Context, data ...models.UserDataUsage) error {
+	if len(data) == 0 {
+		return nil
+	}
+	select {
+	case s.usageChan <- data:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("usage buffer full, rejecting usage event")
+	}
+}
+
+// OnUsageCommitted must be called before StartWorkers.
+func (s *usageService) OnUsageCommitted(fn func(workerID uuid.UUID, seq uint64)) {
+	s.onUsageCommit = fn
+}
+
+func (s *usageService) StartWorkers() {
+	go s.processUsageBatch()
+}
+
+func (s *usageService) processUsageBatch() {
+	flushInterval := 10 * time.Second
+	retention := 24 * time.Hour
+	var pending []usageEvent
+	pendingSeqs := make(map[uuid.UUID]uint64)
+	// buffered is the highest seq taken from each worker, so an event resent
+	// after a nack that only the analytics side saw is not counted twice
+	buffered := make(map[uuid.UUID]uint64)
+	var inflight *usageBatch
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+	for {
+		select {
+		case items := <-s.usageChan:
+			workerID, seq := items[0].WorkerID, items[0].Seq
+			if seq != 0 {
+				if seq <= buffered[workerID] {
+					continue
+				}
+				buffered[workerID] = seq
+				pendingSeqs[workerID] = seq
+			}
+			event := usageEvent{workerID: workerID, seq: seq, totals: make(map[usageKey]int64)}
+			for _, item := range items {
+				if item.Username == "" || item.PoolID == uuid.Nil {
+					continue
+				}
+				key := usageKey{username: item.Username, poolID: item.PoolID}
+				event.totals[key] += int64(item.BytesSent + item.BytesReceived)
+			}
+			pending = append(pending, event)
+		case <-ticker.C:
+			if inflight == nil && len(pending) > 0 {
+				inflight = &usageBatch{id: uuid.New(), events: pending, seqs: pendingSeqs}
+				pending = nil
+				pendingSeqs = make(map[uuid.UUID]uint64)
+			}
+			if inflight == nil {
+				continue
+			}
+			if err := s.applyUsageBatch(context.Background(), inflight); err != nil {
+				log.Printf("Failed to apply usage batch %s, retrying: %v", inflight.id, err)
+				continue
+			}
+			if s.onUsageCommit != nil {
+				for workerID, seq := range inflight.seqs {
+					s.onUsageCommit(workerID, seq)
+				}
+			}
+			inflight = nil
+		case <-cleanup.C:
+			if err := s.queries.DeleteUsageBatchesBefore(context.Background(), time.Now().Add(-retention)); err != nil {
+				log.Printf("Failed to clean up usage batches: %v", err)
+			}
+		}
+	}
+}
+
+// applyUsageBatch adds the batch to user_pools. Events at or below a worker's
+// committed usage seq are replays of usage already counted, possibly by
+// another replica, and are left out; the seqs advance in the same transaction.
+func (s *usageService) applyUsageBatch(ctx context.Context, batch *usageBatch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	qtx := s.queries.WithTx(tx)
+
+	inserted, err := qtx.InsertUsageBatch(ctx, batch.id)
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		log.Printf("Usage batch %s already applied, skipping", batch.id)
+		return nil
+	}
+
+	committed, err := lockTelemetrySeqs(ctx, qtx, batch.seqs)
+	if err != nil {
+		return err
+	}
+	totals := make(map[usageKey]int64)
+	for _, event := range batch.events {
+		if event.seq != 0 && event.seq <= uint64(committed[event.workerID].UsageSeq) {
+			continue
+		}
+		for key, bytes := range event.totals {
+			totals[key] += bytes
+		}
+	}
+
+	var rows []repository.ApplyUserPoolUsageRow
+	if len(totals) > 0 {
+		args := repository.ApplyUserPoolUsageParams{
+			Usernames: make([]string, 0, len(totals)),
+			PoolIds:   make([]uuid.UUID, 0, len(totals)),
+			Bytes:     make([]int64, 0, len(totals)),
+		}
+		for key, bytes := range totals {
+			args.Usernames = append(args.Usernames, key.username)
+			args.PoolIds = append(args.PoolIds, key.poolID)
+			args.Bytes = append(args.Bytes, bytes)
+		}
+		rows, err = qtx.ApplyUserPoolUsage(ctx, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(batch.seqs) > 0 {
+		workerIDs, seqs := seqArgs(batch.seqs)
+		if err := qtx.AdvanceUsageSeqs(ctx, repository.AdvanceUsageSeqsParams{WorkerIds: workerIDs, Seqs: seqs}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if row.DataUsage >= row.DataLimit && row.DataUsage-row.AddedBytes < row.DataLimit {
+			log.Printf("User %s reached data limit in pool %s, notifying workers", row.Username, row.PoolID)
+			s.wsManager.NotifyUserChange(row.Username)
+		}
+	}
+	return nil
+}
+
+// lockTelemetrySeqs locks and returns the committed seqs of the workers in
+// seqs, creating the rows of workers seen for the first time.
+func lockTelemetrySeqs(ctx context.Context, qtx *repository.Queries, seqs map[uuid.UUID]uint64) (map[uuid.UUID]repository.LockTelemetrySeqsRow, error) {
+	committed := make(map[uuid.UUID]repository.LockTelemetrySeqsRow, len(seqs))
+	if len(seqs) == 0 {
+		return committed, nil
+	}
+	workerIDs, _ := seqArgs(seqs)
+	if err := qtx.EnsureTelemetrySeqs(ctx, workerIDs); err != nil {
+		return nil, err
+	}
+	rows, err := qtx.LockTelemetrySeqs(ctx, workerIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		committed[row.WorkerID] = row
+	}
+	return committed, nil
+}
+
+func seqArgs(seqs map[uuid.UUID]uint64) ([]uuid.UUID, []int64) {
+	workerIDs := make([]uuid.UUID, 0, len(seqs))
+	values := make([]int64, 0, len(seqs))
+	for workerID, seq := range seqs {
+		workerIDs = append(workerIDs, workerID)
+		values = append(values, int64(seq))
+	}
+	return workerIDs, values
+}
@@ -10,14 +10,24 @@ import (
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
 	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
 )
 
+// proxyPasswordPlaceholder stands in for the password in generated proxy
+// strings when the request does not carry it.
+const proxyPasswordPlaceholder = "<password>"
+
+// defaultMaxConnections is the concurrent connection limit given to users
+// created without one, the cap workers used to apply to everyone.
+const defaultMaxConnections = 50
+
 type UserService interface {
 	CreateUser(ctx context.Context, user *models.CreateUserRequest) (responce *models.CreateUserResponce, code int, message string, err error)
 	GetUserByID(ctx context.Context, id uuid.UUID) (response *models.GetUserByIdResponce, code int, message string, err error)
 	GetUsers(ctx context.Context) (response []models.GetUserByIdResponce, code int, message string, err error)
 	UpdateUserStatus(ctx context.Context, id uuid.UUID, req *models.UpdateUserRequest) (response *models.UpdateUserResponce, code int, message string, err error)
 	DeleteUser(ctx context.Context, id uuid.UUID) (code int, message string, err error)
+	RotatePassword(ctx context.Context, id uuid.UUID) (response *models.RotatePasswordResponce, code int, message string, err error)
 	GetDataUsage(ctx context.Context, id uuid.UUID) (response []models.GetDatausageReponce, code int, message string, err error)
 	GetUserAllowPools(ctx context.Context, id uuid.UUID) (response *models.GetUserPoolResponce, code int, message string, err error)
 	AddUserAllowPool(ctx context.Context, id uuid.UUID, req *models.AddUserPoolRequest) (response *models.AddUserPoolResponce, code int, message string, err error)
@@ -50,10 +60,25 @@ func (u *userService) CreateUser(context context.Context, req *models.CreateUser
 
 	qtx := u.queries.WithTx(ctx)
 
-	//insert user data
+	//insert user data, only the password hash is stored
+	password := functions.NewProxyPassword()
+	passwordHash, err := functions.HashPassword(password)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to create user", err
+	}
 	createUserParams := repository.CreateUserParams{
-		Username: uuid.New().String()[:8],
-		Password: uuid.New().String()[:8],
+		Username:       uuid.New().String()[:8],
+		Password:       passwordHash,
+		MaxConnections: defaultMaxConnections,
+	}
+	if req.AccessLogOptOut != nil {
+		createUserParams.AccessLogOptOut = *req.AccessLogOptOut
+	}
+	if req.MaxConnections != nil {
+		createUserParams.MaxConnections = *req.MaxConnections
+	}
+	if req.BandwidthLimit != nil {
+		createUserParams.BandwidthLimit = *req.BandwidthLimit
 	}
 
 	user, err := qtx.CreateUser(context, createUserParams)
@@ -66,16 +91,22 @@ func (u *userService) CreateUser(context context.Context, req *models.CreateUser
 	if req.AllowPools != nil && len(*req.AllowPools) > 0 {
 		pools_tags := []string{}
 		dataLimit := []int64{}
+		maxConnections := []int32{}
+		bandwidthLimits := []int64{}
 
 		for _, pool := range *req.AllowPools {
 			pools_tags = append(pools_tags, pool.Pool)
 			dataLimit = append(dataLimit, pool.DataLimit)
+			maxConnections = append(maxConnections, pool.MaxConnections)
+			bandwidthLimits = append(bandwidthLimits, pool.BandwidthLimit)
 		}
 
 		poolArgs := repository.AddUserPoolsByPoolTagsParams{
-			UserID:     user.ID,
-			Tags:       pools_tags,
-			DataLimits: dataLimit,
+			UserID:          user.ID,
+			Tags:            pools_tags,
+			DataLimits:      dataLimit,
+			MaxConnections:  maxConnections,
+			BandwidthLimits: bandwidthLimits,
 		}
 
 		addedPools, err = qtx.AddUserPoolsByPoolTags(context, poolArgs)
@@ -100,19 +131,35 @@ func (u *userService) CreateUser(context context.Context, req *models.CreateUser
 
 	}
 
-	if err := ctx.Commit(); err != nil {
-		return nil, http.StatusInternalServerError, "failed to create user", err
-	}
-
 	responce = &models.CreateUserResponce{
 		Id:          user.ID,
 		Username:    user.Username,
-		Password:    user.Password,
+		Password:    password,
 		Status:      user.Status,
 		IpWhitelist: ipWhitelist.IpWhitelist,
 		AllowPools:  addedPools.InsertedTags,
 		Created_at:  user.CreatedAt,
 		Updated_at:  user.UpdatedAt,
+
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
+	}
+
+	after := *responce
+	after.Password = redacted
+	err = recordAudit(context, qtx, auditRecord{
+		Action:     auditActionCreate,
+		EntityType: "user",
+		EntityID:   user.ID.String(),
+		After:      after,
+	})
+	if err != nil {
+		return nil, http.StatusInternalServerError, "failed to create user", err
+	}
+
+	if err := ctx.Commit(); err != nil {
+		return nil, http.StatusInternalServerError, "failed to create user", err
 	}
 
 	return responce, http.StatusCreated, "user created", nil
@@ -130,17 +177,37 @@ func (u *userService) GetUserByID(ctx context.Context, id uuid.UUID) (response *
 	response = &models.GetUserByIdResponce{
 		Id:          user.ID,
 		Username:    user.Username,
-		Password:    user.Password,
 		Status:      user.Status,
 		IpWhitelist: user.IpWhitelist,
 		UserPool:    user.Pools,
 		Created_at:  user.CreatedAt,
 		Updated_at:  user.UpdatedAt,
+
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
 	}
 
 	return response, http.StatusOK, "", nil
 }
 
+// userSnapshot is the audit view of a user; the password hash is left out.
+func userSnapshot(user repository.GetUserbyIdRow) models.GetUserByIdResponce {
+	return models.GetUserByIdResponce{
+		Id:          user.ID,
+		Username:    user.Username,
+		Status:      user.Status,
+		IpWhitelist: user.IpWhitelist,
+		UserPool:    user.Pools,
+		Created_at:  user.CreatedAt,
+		Updated_at:  user.UpdatedAt,
+
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
+	}
+}
+
 func (u *userService) GetUsers(ctx context.Context) (response []models.GetUserByIdResponce, code int, message string, err error) {
 	users, err := u.queries.GetAllusers(ctx)
 	if err != nil {
@@ -152,12 +219,15 @@ func (u *userService) GetUsers(ctx context.Context) (response []models.GetUserBy
 		response = append(response, models.GetUserByIdResponce{
 			Id:          user.ID,
 			Username:    user.Username,
-			Password:    user.Password,
 			Status:      user.Status,
 			IpWhitelist: user.IpWhitelist,
 			UserPool:    user.Pools,
 			Created_at:  user.CreatedAt,
 			Updated_at:  user.UpdatedAt,
+
+			AccessLogOptOut: user.AccessLogOptOut,
+			MaxConnections:  user.MaxConnections,
+			BandwidthLimit:  user.BandwidthLimit,
 		})
 	}
 	return response, http.StatusOK, "", nil
@@ -171,8 +241,38 @@ func (u *userService) UpdateUserStatus(ctx context.Context, id uuid.UUID, req *m
 	if req.Status != nil && *req.Status != "" {
 		params.Status = sql.NullString{String: *req.Status, Valid: true}
 	}
+	if req.AccessLogOptOut != nil {
+		params.AccessLogOptOut = sql.NullBool{Bool: *req.AccessLogOptOut, Valid: true}
+	}
+	if req.MaxConnections != nil {
+		params.MaxConnections = sql.NullInt32{Int32: *req.MaxConnections, Valid: true}
+	}
+	if req.BandwidthLimit != nil {
+		params.BandwidthLimit = sql.NullInt64{Int64: *req.BandwidthLimit, Valid: true}
+	}
 
-	user, err := u.queries.UpdateUser(ctx, params)
+	var user repository.User
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		before, err := qtx.GetUserbyId(ctx, id)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		user, err = qtx.UpdateUser(ctx, params)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		after, err := qtx.GetUserbyId(ctx, id)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionUpdate,
+			EntityType: "user",
+			EntityID:   id.String(),
+			Before:     userSnapshot(before),
+			After:      userSnapshot(after),
+		}, nil
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, http.StatusNotFound, "user not found", err
@@ -181,9 +281,12 @@ func (u *userService) UpdateUserStatus(ctx context.Context, id uuid.UUID, req *m
 	}
 
 	response = &models.UpdateUserResponce{
-		Id:        user.ID,
-		Status:    user.Status,
-		UpdatedAt: user.UpdatedAt,
+		Id:              user.ID,
+		Status:          user.Status,
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
+		UpdatedAt:       user.UpdatedAt,
 	}
 
 	//change later
@@ -193,8 +296,22 @@ func (u *userService) UpdateUserStatus(ctx context.Context, id uuid.UUID, req *m
 }
 
 func (u *userService) DeleteUser(ctx context.Context, id uuid.UUID) (code int, message string, err error) {
-	user, _ := u.queries.GetUserbyId(ctx, id)
-	err = u.queries.DeleteUser(ctx, id)
+	var user repository.GetUserbyIdRow
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		user, err = qtx.GetUserbyId(ctx, id)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if err := qtx.DeleteUser(ctx, id); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "user",
+			EntityID:   id.String(),
+			Before:     userSnapshot(user),
+		}, nil
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return http.StatusNotFound, "user not found", err
@@ -206,6 +323,50 @@ func (u *userService) DeleteUser(ctx context.Context, id uuid.UUID) (code int, m
 	return http.StatusOK, "user deleted", nil
 }
 
+// RotatePassword replaces the user's password with a new random one. Workers
+// drop the cached user and its open connections, so the old password stops
+// working right away.
+func (u *userService) RotatePassword(ctx context.Context, id uuid.UUID) (response *models.RotatePasswordResponce, code int, message string, err error) {
+	password := functions.NewProxyPassword()
+	passwordHash, err := functions.HashPassword(password)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "server error", err
+	}
+
+	var user repository.UpdateUserPasswordRow
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		user, err = qtx.UpdateUserPassword(ctx, repository.UpdateUserPasswordParams{
+			ID:       id,
+			Password: passwordHash,
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     "rotate_password",
+			EntityType: "user",
+			EntityID:   id.String(),
+		}, nil
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, http.StatusNotFound, "user not found", err
+		}
+		return nil, http.StatusInternalServerError, "server error", err
+	}
+
+	u.wsManager.NotifyUserChange(user.Username)
+
+	response = &models.RotatePasswordResponce{
+		Id:        user.ID,
+		Username:  user.Username,
+		Password:  password,
+		UpdatedAt: user.UpdatedAt,
+	}
+
+	return response, http.StatusOK, "", nil
+}
+
 func (u *userService) GetDataUsage(ctx context.Context, id uuid.UUID) (response []models.GetDatausageReponce, code int, message string, err error) {
 	dataUsages, err := u.queries.GetDatausageById(ctx, id)
 	if err != nil {
@@ -215,9 +376,11 @@ func (u *userService) GetDataUsage(ctx context.Context, id uuid.UUID) (response
 	response = []models.GetDatausageReponce{}
 	for _, dataUsage := range dataUsages {
 		response = append(response, models.GetDatausageReponce{
-			DataLimit: dataUsage.DataLimit,
-			DataUsage: dataUsage.DataUsage,
-			PoolTag:   dataUsage.PoolTag,
+			DataLimit:      dataUsage.DataLimit,
+			DataUsage:      dataUsage.DataUsage,
+			MaxConnections: dataUsage.MaxConnections,
+			BandwidthLimit: dataUsage.BandwidthLimit,
+			PoolTag:        dataUsage.PoolTag,
 		})
 	}
 
@@ -247,19 +410,37 @@ func (u *userService) GetUserAllowPools(ctx context.Context, id uuid.UUID) (resp
 func (u *userService) AddUserAllowPool(ctx context.Context, id uuid.UUID, req *models.AddUserPoolRequest) (response *models.AddUserPoolResponce, code int, message string, err error) {
 	tags := []string{}
 	dataLimits := []int64{}
+	maxConnections := []int32{}
+	bandwidthLimits := []int64{}
 
 	for _, pool := range req.UserPool {
 		tags = append(tags, pool.Pool)
 		dataLimits = append(dataLimits, pool.DataLimit)
+		maxConnections = append(maxConnections, pool.MaxConnections)
+		bandwidthLimits = append(bandwidthLimits, pool.BandwidthLimit)
 	}
 
 	args := repository.AddUserPoolsByPoolTagsParams{
-		UserID:     id,
-		Tags:       tags,
-		DataLimits: dataLimits,
+		UserID:          id,
+		Tags:            tags,
+		DataLimits:      dataLimits,
+		MaxConnections:  maxConnections,
+		BandwidthLimits: bandwidthLimits,
 	}
 
-	pool, err := u.queries.AddUserPoolsByPoolTags(ctx, args)
+	var pool repository.AddUserPoolsByPoolTagsRow
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		pool, err = qtx.AddUserPoolsByPoolTags(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "user_pool",
+			EntityID:   id.String(),
+			After:      req.UserPool,
+		}, nil
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, http.StatusNotFound, "Nothing added to the database", err
@@ -271,8 +452,10 @@ func (u *userService) AddUserAllowPool(ctx context.Context, id uuid.UUID, req *m
 
 	for i, d := range pool.InsertedDataLimits {
 		userPool = append(userPool, models.PoolDataStat{
-			Pool:      pool.InsertedTags[i],
-			DataLimit: d,
+			Pool:           pool.InsertedTags[i],
+			DataLimit:      d,
+			MaxConnections: pool.InsertedMaxConnections[i],
+			BandwidthLimit: pool.InsertedBandwidthLimits[i],
 		})
 	}
 
@@ -293,14 +476,27 @@ func (u *userService) RemoveUserAllowPool(ctx context.Context, id uuid.UUID, req
 		Column2: req.UserPool,
 	}
 
-	res, err := u.queries.DeleteUserPoolsByTags(ctx, args)
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		res, err := qtx.DeleteUserPoolsByTags(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "user_pool",
+			EntityID:   id.String(),
+			Before:     req.UserPool,
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted from the database", nil
+	}
 	if err != nil {
 		return http.StatusInternalServerError, "server error", err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		return http.StatusNotFound, "Nothing deleted from the database", nil
-	}
 
 	//change later
 	user, err := u.queries.GetUserbyId(ctx, id)
@@ -331,7 +527,19 @@ func (u *userService) AddUserIpWhitelist(ctx context.Context, id uuid.UUID, req
 		IpWhitelist: req.IpWhitelist,
 	}
 
-	iplist, err := u.queries.InsertUserIpwhitelist(ctx, args)
+	var iplist repository.InsertUserIpwhitelistRow
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		iplist, err = qtx.InsertUserIpwhitelist(ctx, args)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "user_ip_whitelist",
+			EntityID:   id.String(),
+			After:      iplist.IpWhitelist,
+		}, nil
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, http.StatusNotFound, "nothing added to the database", err
@@ -356,14 +564,27 @@ func (u *userService) RemoveUserIpWhitelist(ctx context.Context, id uuid.UUID, r
 		Column2: req.IpCidr,
 	}
 
-	res, err := u.queries.DeleteUserIpwhitelist(ctx, arg)
+	err = auditedTx(ctx, u.db, u.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		res, err := qtx.DeleteUserIpwhitelist(ctx, arg)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "user_ip_whitelist",
+			EntityID:   id.String(),
+			Before:     req.IpCidr,
+		}, nil
+	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "Nothing deleted from the database", nil
+	}
 	if err != nil {
 		return http.StatusInternalServerError, "server error", err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		return http.StatusNotFound, "Nothing deleted from the database", nil
-	}
 
 	//change later
 	user, err := u.queries.GetUserbyId(ctx, id)
@@ -384,23 +605,43 @@ func (u *userService) GenerateProxyString(ctx context.Context, req *models.Gener
 		return nil, http.StatusInternalServerError, "server error", err
 	}
 
+	// only the hash is stored, so the password is embedded only when the
+	// caller supplies it and it matches
+	password := proxyPasswordPlaceholder
+	if req.Password != nil {
+		if !functions.CheckPassword(data.Password, *req.Password) {
+			return nil, http.StatusBadRequest, "incorrect password", fmt.Errorf("password does not match user %s", data.Username)
+		}
+		password = *req.Password
+	}
 	userName := data.Username
-	password := data.Password
 	subdomain := data.Subdomain
 	port := data.Port
 
+	adapter, err := providers.ForUpstream(data.UpstreamProvider, data.ConfigFormat)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "server error", err
+	}
+	if req.City == nil {
+		val := ""
+		req.City = &val
+	}
+	if req.State == nil {
+		val := ""
+		req.State = &val
+	}
+	unsupported := providers.Unsupported(adapter, providers.Targeting{Country: *req.CountryCode, State: *req.State, City: *req.City})
+	if len(unsupported) > 0 {
+		return nil, http.StatusBadRequest, fmt.Sprintf("%s targeting is not supported by this pool", unsupported[0]), fmt.Errorf("provider %s does not support %v targeting", data.UpstreamProvider, unsupported)
+	}
+	if code, message, err := u.checkTargeting(ctx, *req.CountryCode, *req.State, *req.City); err != nil {
+		return nil, code, message, err
+	}
+
 	res := []string{}
 
 	for i := 0; i < *req.Amount; i++ {
-		if req.City == nil {
-			val := ""
-			req.City = &val
-		}
-		if req.State == nil {
-			val := ""
-			req.State = &val
-		}
-		config := functions.GenerateproxyString(*req.PoolGroup, *req.CountryCode, *req.IsSticky, *req.City, *req.State, req.SessionDuration)
+		config := functions.GenerateproxyString(adapter, *req.CountryCode, *req.IsSticky, *req.City, *req.State, req.SessionDuration)
 		switch *req.Format {
 		case "ip:port:user:pass":
 			proxyString := fmt.Sprintf("%s"+".trytorchlabs.com"+":%d:%s:%s%s", subdomain, port, userName, password, config)
@@ -415,3 +656,37 @@ func (u *userService) GenerateProxyString(ctx context.Context, req *models.Gener
 	}
 	return res, http.StatusOK, "", nil
 }
+
+// checkTargeting rejects a state or city that is not in the country's
+// catalog, as workers would refuse it.
+func (u *userService) checkTargeting(ctx context.Context, countryCode, state, city string) (int, string, error) {
+	if state == "" && city == "" {
+		return http.StatusOK, "", nil
+	}
+	country, err := u.queries.GetCountryByCode(ctx, countryCode)
+	if err != nil {
+		return http.StatusInternalServerError, "server error", err
+	}
+	if state != "" {
+		_, err := u.queries.GetStateByCode(ctx, repository.GetStateByCodeParams{CountryID: country.ID, Code: state})
+		if err == sql.ErrNoRows {
+			return http.StatusBadRequest, "unknown state", fmt.Errorf("state %s is not in country %s", state, countryCode)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, "server error", err
+		}
+	}
+	if city != "" {
+		row, err := u.queries.GetCityByCode(ctx, repository.GetCityByCodeParams{CountryID: country.ID, Code: city})
+		if err == sql.ErrNoRows {
+			return http.StatusBadRequest, "unknown city", fmt.Errorf("city %s is not in country %s", city, countryCode)
+		}
+		if err != nil {
+			return http.StatusInternalServerError, "server error", err
+		}
+		if state != "" && row.StateCode.Valid && row.StateCode.String != state {
+			return http.StatusBadRequest, "unknown city", fmt.Errorf("city %s is not in state %s", city, state)
+		}
+	}
+	return http.StatusOK, "", nil
+}
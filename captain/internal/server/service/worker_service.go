@@ -2,23 +2,32 @@ package service
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
 type WorkerService interface {
-	Login(ctx context.Context, req uuid.UUID) (code int, message string, err error)
+	Login(ctx context.Context, workerId uuid.UUID, secret string) (code int, message string, err error)
 	CreateWorker(ctx context.Context, req *models.AddWorkerRequest) (res *models.AddWorkerResponse, code int, message string, err error)
 	GetWorkers(ctx context.Context) (res []models.AddWorkerResponse, code int, message string, err error)
 	GetWorkerByName(ctx context.Context, name string) (res *models.AddWorkerResponse, code int, message string, err error)
+	GetWorkerStatuses(ctx context.Context) (res []models.WorkerStatusResponce, code int, message string, err error)
+	SubscribeWorkerEvents() (<-chan models.WorkerStatusEvent, func())
 	DeleteWorker(ctx context.Context, name string) (code int, message string, err error)
+	RotateWorkerSecret(ctx context.Context, name string) (res *models.WorkerSecretResponce, code int, message string, err error)
+	RevokeWorkerSecret(ctx context.Context, name string) (code int, message string, err error)
 	AddWorkerDomain(ctx context.Context, name string, req *models.AddWorkerDomainRequest) (code int, message string, err error)
 	DeleteWorkerDomain(ctx context.Context, name string, req *models.DeleteWorkerDomainRequest) (code int, message string, err error)
-	NewOTP(workerId *uuid.UUID) string
+	NewOTP(workerId *uuid.UUID) (string, error)
 	VerifyOTP(otp string) (bool, uuid.UUID)
 	ServeWS(w http.ResponseWriter, r *http.Request, workerID uuid.UUID)
 }
@@ -27,25 +36,38 @@ type workerService struct {
 	queries   *repository.Queries
 	db        *sql.DB
 	wsManager models.WebsocketManagerInterface
+	analytics models.AnalyticsService
 }
 
-func NewWorkerService(queries *repository.Queries, db *sql.DB, wsManager models.WebsocketManagerInterface) WorkerService {
+func NewWorkerService(queries *repository.Queries, db *sql.DB, wsManager models.WebsocketManagerInterface, analytics models.AnalyticsService) WorkerService {
 	workerService := &workerService{
 		queries:   queries,
 		db:        db,
 		wsManager: wsManager,
+		analytics: analytics,
 	}
 	return workerService
 }
 
-func (s *workerService) Login(ctx context.Context, req uuid.UUID) (code int, message string, err error) {
-	_, err = s.queries.GetWorkerById(ctx, req)
+// workerSecretPrefix marks worker secrets, as apiTokenPrefix does for tokens.
+const workerSecretPrefix = "snw_"
+
+// Login checks secret against the one issued to the worker. Unknown workers
+// and wrong secrets get the same answer so worker ids cannot be probed.
+func (s *workerService) Login(ctx context.Context, workerId uuid.UUID, secret string) (code int, message string, err error) {
+	worker, err := s.queries.GetWorkerById(ctx, workerId)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return http.StatusNotFound, "Worker not found", err
+			return http.StatusUnauthorized, "Invalid worker credentials", err
 		}
 		return http.StatusInternalServerError, "Failed to get worker", err
 	}
+	if !worker.SecretHash.Valid || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(worker.SecretHash.String)) != 1 {
+		return http.StatusUnauthorized, "Invalid worker credentials", fmt.Errorf("invalid secret for worker %s", worker.Name)
+	}
+	if worker.Status != "active" {
+		return http.StatusForbidden, "Worker is not active", fmt.Errorf("worker %s is %s", worker.Name, worker.Status)
+	}
 	return http.StatusOK, "", nil
 }
 
@@ -62,30 +84,49 @@ func (s *workerService) CreateWorker(ctx context.Context, req *models.AddWorkerR
 	default:
 		name = "globe-" + id.String()
 	}
-	worker, err := s.queries.CreateWorker(ctx, repository.CreateWorkerParams{
-		ID:         id,
-		Name:       name,
-		RegionName: *req.RegionName,
-		IpAddress:  *req.IPAddress,
-		Port:       *req.Port,
-		PoolID:     *req.PoolId,
+	secret, err := newSecret(workerSecretPrefix)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Internal Server Error", err
+	}
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		worker, err := qtx.CreateWorker(ctx, repository.CreateWorkerParams{
+			ID:         id,
+			Name:       name,
+			RegionName: *req.RegionName,
+			IpAddress:  *req.IPAddress,
+			Port:       *req.Port,
+			PoolID:     *req.PoolId,
+			SecretHash: sql.NullString{String: hashSecret(secret), Valid: true},
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		res = &models.AddWorkerResponse{
+			ID:         worker.ID.String(),
+			Name:       worker.Name,
+			RegionName: *req.RegionName,
+			IpAddress:  worker.IpAddress,
+			Status:     worker.Status,
+			Port:       worker.Port,
+			PoolId:     worker.PoolID,
+			LastSeen:   worker.LastSeen.Format("2006-01-02T15:04:05.999999Z"),
+			CreatedAt:  worker.CreatedAt.Format("2006-01-02T15:04:05.999999Z"),
+			Domains:    []string{},
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "worker",
+			EntityID:   worker.ID.String(),
+			After:      *res,
+		}, nil
 	})
 	if err != nil {
 		return nil, http.StatusInternalServerError, "Internal Server Error", err
 	}
 
-	return &models.AddWorkerResponse{
-		ID:         worker.ID.String(),
-		Name:       worker.Name,
-		RegionName: *req.RegionName,
-		IpAddress:  worker.IpAddress,
-		Status:     worker.Status,
-		Port:       worker.Port,
-		PoolId:     worker.PoolID,
-		LastSeen:   worker.LastSeen.Format("2006-01-02T15:04:05.999999Z"),
-		CreatedAt:  worker.CreatedAt.Format("2006-01-02T15:04:05.999999Z"),
-		Domains:    []string{},
-	}, http.StatusOK, "", nil
+	// The secret is only ever returned here and on rotation.
+	res.Secret = secret
+	return res, http.StatusOK, "", nil
 }
 
 func (s *workerService) GetWorkers(ctx context.Context) (res []models.AddWorkerResponse, code int, message string, err error) {
@@ -110,6 +151,7 @@ func (s *workerService) GetWorkers(ctx context.Context) (res []models.AddWorkerR
 			LastSeen:   worker.LastSeen.Format("2006-01-02T15:04:05.999999Z"),
 			CreatedAt:  worker.CreatedAt.Format("2006-01-02T15:04:05.999999Z"),
 			Domains:    worker.Domains,
+			Replica:    worker.ReplicaID,
 		})
 	}
 
@@ -136,25 +178,189 @@ func (s *workerService) GetWorkerByName(ctx context.Context, name string) (res *
 		LastSeen:   worker.LastSeen.Format("2006-01-02T15:04:05.999999Z"),
 		CreatedAt:  worker.CreatedAt.Format("2006-01-02T15:04:05.999999Z"),
 		Domains:    worker.Domains,
+		Replica:    worker.ReplicaID,
 	}, http.StatusOK, "", nil
 }
 
-func (s *workerService) DeleteWorker(ctx context.Context, name string) (code int, message string, err error) {
-	res, err := s.queries.DeleteWorkerByName(ctx, name)
+const (
+	// workerStaleAfter is how long a worker may go without answering a ping,
+	// which it does every few seconds, before its status is marked stale.
+	workerStaleAfter = time.Minute
+	// workerHealthWindow is how far back GetWorkerStatuses looks for each
+	// worker's latest health report.
+	workerHealthWindow = 10 * time.Minute
+)
+
+// GetWorkerStatuses merges each worker's session, held by whichever replica it
+// is connected to, with its latest health report. Health is left out rather
+// than failing the request when analytics are unavailable.
+func (s *workerService) GetWorkerStatuses(ctx context.Context) (res []models.WorkerStatusResponce, code int, message string, err error) {
+	workers, err := s.queries.GetWorkerStatuses(ctx)
 	if err != nil {
-		return http.StatusInternalServerError, "Internal Server Error", err
+		return nil, http.StatusInternalServerError, "Internal Server Error", err
+	}
+
+	now := time.Now()
+	health := make(map[uuid.UUID]*models.WorkerHealth)
+	reports, err := s.analytics.GetLatestWorkerHealth(ctx, now.Add(-workerHealthWindow))
+	if err != nil {
+		log.Printf("[worker] failed to get latest worker health: %v", err)
+	}
+	for i := range reports {
+		health[reports[i].WorkerID] = &reports[i]
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
+
+	res = make([]models.WorkerStatusResponce, 0, len(workers))
+	for _, worker := range workers {
+		status := models.WorkerStatusResponce{
+			ID:            worker.ID,
+			Name:          worker.Name,
+			RegionName:    worker.RegionName,
+			PoolId:        worker.PoolID,
+			Status:        worker.Status,
+			Connected:     worker.ReplicaID != "",
+			Replica:       worker.ReplicaID,
+			ConfigVersion: worker.ConfigVersion,
+			LastSeen:      worker.LastSeen,
+			Stale:         now.Sub(worker.LastSeen) > workerStaleAfter,
+			Health:        health[worker.ID],
+		}
+		if worker.ConnectedAt.Valid {
+			status.ConnectedAt = &worker.ConnectedAt.Time
+		}
+		if status.Connected && status.Health != nil {
+			status.ActiveConnections = status.Health.ActiveConnections
+		}
+		res = append(res, status)
+	}
+	return res, http.StatusOK, "", nil
+}
+
+func (s *workerService) SubscribeWorkerEvents() (<-chan models.WorkerStatusEvent, func()) {
+	return s.wsManager.SubscribeWorkerEvents()
+}
+
+func (s *workerService) DeleteWorker(ctx context.Context, name string) (code int, message string, err error) {
+	var workerId uuid.UUID
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		worker, err := qtx.GetWorkerByName(ctx, name)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		workerId = worker.ID
+		if _, err := qtx.DeleteWorkerByName(ctx, name); err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "worker",
+			EntityID:   worker.ID.String(),
+			Before:     workerSnapshot(worker),
+		}, nil
+	})
+	if err == sql.ErrNoRows {
 		return http.StatusNotFound, "Worker not found", nil
 	}
+	if err != nil {
+		return http.StatusInternalServerError, "Internal Server Error", err
+	}
+	s.wsManager.DisconnectWorker(workerId)
 	return http.StatusOK, "worker deleted successfully", nil
 }
 
+// RotateWorkerSecret issues a new secret for the worker. The old one stops
+// working immediately; an open session stays up until it reconnects.
+func (s *workerService) RotateWorkerSecret(ctx context.Context, name string) (res *models.WorkerSecretResponce, code int, message string, err error) {
+	secret, err := newSecret(workerSecretPrefix)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Internal Server Error", err
+	}
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		row, err := qtx.UpdateWorkerSecret(ctx, repository.UpdateWorkerSecretParams{
+			Name:       name,
+			SecretHash: sql.NullString{String: hashSecret(secret), Valid: true},
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		res = &models.WorkerSecretResponce{
+			Id:        row.ID,
+			Name:      row.Name,
+			Secret:    secret,
+			RotatedAt: row.SecretRotatedAt.Time,
+		}
+		return auditRecord{
+			Action:     "rotate_secret",
+			EntityType: "worker",
+			EntityID:   row.ID.String(),
+		}, nil
+	})
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, "Worker not found", err
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, "Internal Server Error", err
+	}
+	return res, http.StatusOK, "", nil
+}
+
+// RevokeWorkerSecret removes the worker's secret and drops its live session.
+// The worker cannot log in again until a new secret is rotated in.
+func (s *workerService) RevokeWorkerSecret(ctx context.Context, name string) (code int, message string, err error) {
+	var workerId uuid.UUID
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		row, err := qtx.RevokeWorkerSecret(ctx, name)
+		if err != nil {
+			return auditRecord{}, err
+		}
+		workerId = row.ID
+		return auditRecord{
+			Action:     "revoke_secret",
+			EntityType: "worker",
+			EntityID:   row.ID.String(),
+		}, nil
+	})
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, "Worker not found", err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, "Internal Server Error", err
+	}
+	s.wsManager.DisconnectWorker(workerId)
+	return http.StatusOK, "worker secret revoked", nil
+}
+
+// workerSnapshot is the audit view of a worker row.
+func workerSnapshot(worker repository.GetWorkerByNameRow) models.AddWorkerResponse {
+	return models.AddWorkerResponse{
+		ID:         worker.ID.String(),
+		Name:       worker.Name,
+		RegionName: worker.RegionName,
+		IpAddress:  worker.IpAddress,
+		Status:     worker.Status,
+		Port:       worker.Port,
+		PoolId:     worker.PoolID,
+		LastSeen:   worker.LastSeen.Format("2006-01-02T15:04:05.999999Z"),
+		CreatedAt:  worker.CreatedAt.Format("2006-01-02T15:04:05.999999Z"),
+		Domains:    worker.Domains,
+	}
+}
+
 func (s *workerService) AddWorkerDomain(ctx context.Context, name string, req *models.AddWorkerDomainRequest) (code int, message string, err error) {
-	_, err = s.queries.AddWorkerDomain(ctx, repository.AddWorkerDomainParams{
-		Name:    name,
-		Column2: req.Domain,
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		domain, err := qtx.AddWorkerDomain(ctx, repository.AddWorkerDomainParams{
+			Name:    name,
+			Column2: req.Domain,
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		return auditRecord{
+			Action:     auditActionCreate,
+			EntityType: "worker_domain",
+			EntityID:   domain.WorkerID.String(),
+			After:      req,
+		}, nil
 	})
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -166,21 +372,34 @@ func (s *workerService) AddWorkerDomain(ctx context.Context, name string, req *m
 }
 
 func (s *workerService) DeleteWorkerDomain(ctx context.Context, name string, req *models.DeleteWorkerDomainRequest) (code int, message string, err error) {
-	result, err := s.queries.DeleteWorkerDomain(ctx, repository.DeleteWorkerDomainParams{
-		Name:    name,
-		Column2: req.Domain,
+	err = auditedTx(ctx, s.db, s.queries, func(qtx *repository.Queries) (auditRecord, error) {
+		result, err := qtx.DeleteWorkerDomain(ctx, repository.DeleteWorkerDomainParams{
+			Name:    name,
+			Column2: req.Domain,
+		})
+		if err != nil {
+			return auditRecord{}, err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			return auditRecord{}, errNothingChanged
+		}
+		return auditRecord{
+			Action:     auditActionDelete,
+			EntityType: "worker_domain",
+			EntityID:   name,
+			Before:     req,
+		}, nil
 	})
+	if err == errNothingChanged {
+		return http.StatusNotFound, "No domains deleted", nil
+	}
 	if err != nil {
 		return http.StatusInternalServerError, "Failed to delete domain", err
 	}
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return http.StatusNotFound, "No domains deleted", nil
-	}
 	return http.StatusOK, "Domain deleted successfully", nil
 }
 
-func (s *workerService) NewOTP(workerId *uuid.UUID) string {
+func (s *workerService) NewOTP(workerId *uuid.UUID) (string, error) {
 	return s.wsManager.NewOTP(workerId)
 }
 
@@ -193,5 +412,10 @@ func (s *workerService) ServeWS(w http.ResponseWriter, r *http.Request, workerID
 	if err != nil {
 		return
 	}
+	// The worker may have been suspended or revoked since it got its OTP.
+	if worker.Status != "active" || !worker.SecretHash.Valid {
+		functions.RespondwithError(w, http.StatusForbidden, "Worker is not active", fmt.Errorf("worker %s is %s", worker.Name, worker.Status))
+		return
+	}
 	s.wsManager.ServeWS(w, r, workerID, worker.Name, worker.PoolID)
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+)
+
+const (
+	// clusterChannel is the Postgres NOTIFY channel captain replicas use to
+	// fan out events to workers attached to other replicas.
+	clusterChannel = "captain_events"
+
+	sessionHeartbeatInterval = 15 * time.Second
+	// sessionStaleAfter is how long a session row survives without a
+	// heartbeat before another replica may take the worker over.
+	sessionStaleAfter = 3 * sessionHeartbeatInterval
+)
+
+// clusterEvent is published on clusterChannel. Origin is the publishing
+// replica, which has already delivered the event to its own workers.
+type clusterEvent struct {
+	Type     string    `json:"type"`
+	Origin   string    `json:"origin"`
+	Username string    `json:"username,omitempty"`
+	PoolID   uuid.UUID `json:"pool_id,omitempty"`
+	WorkerID uuid.UUID `json:"worker_id,omitempty"`
+	Seq      uint64    `json:"seq,omitempty"`
+
+	WorkerName string `json:"worker_name,omitempty"`
+}
+
+func newReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "captain"
+	}
+	return host + "-" + uuid.NewString()[:8]
+}
+
+// StartCluster starts the background work that lets several captain replicas
+// share one database: OTP expiry, session heartbeats and the event listener.
+func (ws *WebsocketManager) StartCluster(db *sql.DB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ws.stopCluster = cancel
+	go ws.otpRetention(ctx)
+	go ws.heartbeatSessions(ctx)
+	go ws.listenClusterEvents(ctx, db)
+	log.Printf("[cluster] replica %s started", ws.ReplicaID)
+}
+
+// publish delivers event to local workers and then to the other replicas.
+func (ws *WebsocketManager) publish(event clusterEvent) {
+	event.Origin = ws.ReplicaID
+	ws.dispatch(event)
+	if ws.queries == nil {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[cluster] failed to marshal %s event: %v", event.Type, err)
+		return
+	}
+	if err := ws.queries.PublishClusterEvent(context.Background(), repository.PublishClusterEventParams{
+		Channel: clusterChannel,
+		Payload: string(payload),
+	}); err != nil {
+		log.Printf("[cluster] failed to publish %s event: %v", event.Type, err)
+	}
+}
+
+func (ws *WebsocketManager) dispatch(event clusterEvent) {
+	switch event.Type {
+	case "user_change":
+		ws.notifyLocalUserChange(event.Username)
+	case "pool_change":
+		ws.notifyLocalPoolChange(event.PoolID)
+	case "disconnect_worker":
+		ws.disconnectLocalWorker(event.WorkerID)
+	case "telemetry_ack":
+		ws.ackLocalTelemetry(event.WorkerID, event.Seq)
+	case "worker_connected", "worker_disconnected":
+		ws.notifyWorkerEvent(event)
+	default:
+		log.Printf("[cluster] unknown event type %q", event.Type)
+	}
+}
+
+func (ws *WebsocketManager) handleClusterEvent(payload string) {
+	var event clusterEvent
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		log.Printf("[cluster] invalid event payload: %v", err)
+		return
+	}
+	if event.Origin == ws.ReplicaID {
+		return
+	}
+	ws.dispatch(event)
+}
+
+// listenClusterEvents holds a dedicated connection on LISTEN and reconnects
+// when it drops. Events sent while it is down are not replayed.
+func (ws *WebsocketManager) listenClusterEvents(ctx context.Context, db *sql.DB) {
+	for {
+		err := ws.listenOnce(ctx, db)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[cluster] event listener stopped, reconnecting: %v", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ws *WebsocketManager) listenOnce(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("cluster events need the pgx driver, got %T", driverConn)
+		}
+		pgxConn := stdConn.Conn()
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+clusterChannel); err != nil {
+			return err
+		}
+		defer func() {
+			_, _ = pgxConn.Exec(context.Background(), "UNLISTEN "+clusterChannel)
+		}()
+		for {
+			notification, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			ws.handleClusterEvent(notification.Payload)
+		}
+	})
+}
+
+// claimSession records this replica as the holder of the worker's session.
+// It fails while another replica holds a live session for the worker.
+func (ws *WebsocketManager) claimSession(workerID uuid.UUID) bool {
+	if ws.queries == nil {
+		return true
+	}
+	_, err := ws.queries.ClaimWorkerSession(context.Background(), repository.ClaimWorkerSessionParams{
+		WorkerID:     workerID,
+		ReplicaID:    ws.ReplicaID,
+		StaleSeconds: int32(sessionStaleAfter / time.Second),
+	})
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[cluster] failed to claim session for worker %s: %v", workerID, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (ws *WebsocketManager) releaseSession(workerID uuid.UUID) {
+	if ws.queries == nil {
+		return
+	}
+	if err := ws.queries.ReleaseWorkerSession(context.Background(), repository.ReleaseWorkerSessionParams{
+		WorkerID:  workerID,
+		ReplicaID: ws.ReplicaID,
+	}); err != nil {
+		log.Printf("[cluster] failed to release session for worker %s: %v", workerID, err)
+	}
+}
+
+func (ws *WebsocketManager) heartbeatSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.queries.HeartbeatWorkerSessions(ctx, ws.ReplicaID); err != nil {
+				log.Printf("[cluster] failed to heartbeat sessions: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -2,67 +2,54 @@ package server
 
 import (
 	"context"
-	"sync"
+	"database/sql"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
 )
 
-type OTP struct {
-	Key      string
-	Created  time.Time
-	WorkerID uuid.UUID
-}
-
-type RetentionMap struct {
-	data map[string]*OTP
-	sync.RWMutex
-}
-
-func NewRetentionMap(context context.Context, retentionPeriod time.Duration) *RetentionMap {
-	rm := RetentionMap{
-		data: make(map[string]*OTP),
+// otpTTL is how long an OTP from /worker/ws/login stays valid. OTPs live in
+// Postgres so the websocket can land on any captain replica.
+const otpTTL = 10 * time.Second
+
+func (ws *WebsocketManager) NewOTP(workerId *uuid.UUID) (string, error) {
+	key := uuid.NewString()
+	err := ws.queries.CreateWorkerOtp(context.Background(), repository.CreateWorkerOtpParams{
+		Key:       key,
+		WorkerID:  *workerId,
+		ExpiresAt: time.Now().Add(otpTTL),
+	})
+	if err != nil {
+		return "", err
 	}
-	go rm.Retention(context, retentionPeriod)
-	return &rm
+	return key, nil
 }
 
-func (rm *RetentionMap) NewOTP(workerID uuid.UUID) OTP {
-	rm.Lock()
-	defer rm.Unlock()
-	o := OTP{
-		Key:      uuid.NewString(),
-		Created:  time.Now(),
-		WorkerID: workerID,
-	}
-	(*rm).data[o.Key] = &o
-	return o
-}
-
-func (rm *RetentionMap) VerifyOTP(key string) (bool, uuid.UUID) {
-	rm.Lock()
-	defer rm.Unlock()
-	if otp, ok := (*rm).data[key]; ok {
-		delete((*rm).data, key)
-		return true, otp.WorkerID
+// VerifyOTP consumes otp, so each one can open a single session.
+func (ws *WebsocketManager) VerifyOTP(otp string) (bool, uuid.UUID) {
+	workerID, err := ws.queries.ConsumeWorkerOtp(context.Background(), otp)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[websocket] failed to verify otp: %v", err)
+		}
+		return false, uuid.Nil
 	}
-	return false, uuid.Nil
+	return true, workerID
 }
 
-func (rm *RetentionMap) Retention(ctx context.Context, timePeriod time.Duration) {
-	ticker := time.NewTicker(1 * time.Second)
+// otpRetention purges expired OTPs that were never used.
+func (ws *WebsocketManager) otpRetention(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			rm.Lock()
-			for _, otp := range rm.data {
-				if otp.Created.Add(timePeriod).Before(time.Now()) {
-					delete(rm.data, otp.Key)
-				}
+			if err := ws.queries.DeleteExpiredWorkerOtps(ctx); err != nil {
+				log.Printf("[websocket] failed to purge expired otps: %v", err)
 			}
-			rm.Unlock()
 		case <-ctx.Done():
 			return
 		}
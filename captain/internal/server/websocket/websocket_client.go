@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,6 +23,17 @@ type Worker struct {
 	ID         uuid.UUID
 	Name       string
 	PoolId     uuid.UUID
+	// telemetrySeq is the last telemetry seq accepted on this connection and
+	// nackedSeq the one rejected last, while waiting for the worker to resend
+	// it. Both are only touched by the read loop.
+	telemetrySeq uint64
+	nackedSeq    uint64
+
+	// done is closed when the read loop ends. Replies sent off the read loop
+	// go through send, which stops using egress from then on.
+	done    chan struct{}
+	closeMu sync.RWMutex
+	closed  bool
 }
 
 type WorkerList map[uuid.UUID]*Worker
@@ -31,6 +43,21 @@ func NewWorker(conn *websocket.Conn, manager *WebsocketManager) *Worker {
 		Connection: conn,
 		Manager:    manager,
 		egress:     make(chan Event, 100),
+		done:       make(chan struct{}),
+	}
+}
+
+// send queues event for the worker from outside its read loop. It drops the
+// event once the worker disconnected.
+func (w *Worker) send(event Event) {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.egress <- event:
+	case <-w.done:
 	}
 }
 
@@ -38,7 +65,11 @@ func (w *Worker) ReadMessage() {
 	defer func() {
 		w.Manager.RemoveWorker(w)
 		w.Connection.Close()
+		close(w.done)
+		w.closeMu.Lock()
+		w.closed = true
 		close(w.egress)
+		w.closeMu.Unlock()
 	}()
 	if err := w.Connection.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		log.Println("[websocket] failed to set read deadline:", err)
@@ -112,6 +143,28 @@ func (w *Worker) WriteMessage() {
 	}
 }
 
+// acceptsTelemetry reports whether a telemetry event should be processed.
+// Replays of events already accepted on this connection are skipped, and
+// after a nack only the rejected event is taken until the worker rewinds.
+// Events without a seq are always processed.
+func (w *Worker) acceptsTelemetry(seq uint64) bool {
+	if seq == 0 {
+		return true
+	}
+	if w.nackedSeq != 0 {
+		return seq == w.nackedSeq
+	}
+	return seq > w.telemetrySeq
+}
+
+func (w *Worker) acceptedTelemetry(seq uint64) {
+	if seq == 0 {
+		return
+	}
+	w.telemetrySeq = seq
+	w.nackedSeq = 0
+}
+
 func (w *Worker) PongHandler(pongMsg string) error {
 	log.Println("[websocket] pong from", w.Name)
 	if err := w.Manager.queries.UpdateWorkerLastSeen(context.Background(), w.ID); err != nil {
@@ -4,16 +4,26 @@ import (
 	"github.com/google/uuid"
 )
 
+// Event is a message on the worker websocket. Workers number spooled
+// telemetry with Seq; other events leave it zero.
 type Event struct {
 	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
 type EventHandler func(event Event, w *Worker) error
 
 type LoginPayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	// RequestID is echoed in the reply so the worker can tell apart logins of
+	// the same user that are in flight at once.
+	RequestID string `json:"request_id"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+type IpLoginPayload struct {
+	ClientIP string `json:"client_ip"`
 }
 
 type ReplyPayload struct {
@@ -24,10 +34,21 @@ type ReplyPayload struct {
 type loginSuccessPayload struct {
 	ID          uuid.UUID `json:"id"`
 	Username    string    `json:"username"`
-	Password    string    `json:"password"`
 	Status      string    `json:"status"`
 	IpWhitelist []string  `json:"ip_whitelist"`
 	Pools       []string  `json:"pools"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+
+	AccessLogOptOut bool  `json:"access_log_opt_out"`
+	MaxConnections  int32 `json:"max_connections"`
+	BandwidthLimit  int64 `json:"bandwidth_limit"`
+}
+
+// loginFailedPayload identifies the login a login_failed reply answers.
+type loginFailedPayload struct {
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type UpstreamConfig struct {
@@ -50,4 +71,27 @@ type ConfigPayload struct {
 	PoolPort      int              `json:"pool_port"`
 	PoolSubdomain string           `json:"pool_subdomain"`
 	Upstreams     []UpstreamConfig `json:"upstreams"`
+	// Countries is the targeting catalog of the pool's region.
+	Countries []TargetingCountry `json:"countries"`
+	// ResolveLocally makes the worker resolve SOCKS targets itself and send
+	// the upstream an IP address instead of the domain name.
+	ResolveLocally bool `json:"resolve_locally"`
+	// TelemetrySeq is the highest telemetry seq committed for the worker. A
+	// worker whose spool restarted below it renumbers its pending events past
+	// it, or they would be dropped as replays.
+	TelemetrySeq uint64 `json:"telemetry_seq"`
+}
+
+// TargetingCountry lists the states and cities clients may target in a
+// country.
+type TargetingCountry struct {
+	Code   string          `json:"code"`
+	States []string        `json:"states"`
+	Cities []TargetingCity `json:"cities"`
+}
+
+// TargetingCity is a city code and, if it has one, the code of its state.
+type TargetingCity struct {
+	Code  string `json:"code"`
+	State string `json:"state,omitempty"`
 }
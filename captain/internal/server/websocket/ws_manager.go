@@ -2,20 +2,45 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/torchlabssoftware/subnetwork_system/internal/db/repository"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 	functions "github.com/torchlabssoftware/subnetwork_system/internal/server/functions"
+	"github.com/torchlabssoftware/subnetwork_system/internal/server/metrics"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 )
 
+// analyticsEnqueueWait is how long a telemetry event waits for room in the
+// analytics buffer before the worker is told to resend it.
+const analyticsEnqueueWait = 2 * time.Second
+
+// userIDCacheTTL bounds how long a username stays resolved to an id for usage
+// rows from workers too old to send the id themselves. User changes drop the
+// entry sooner.
+const userIDCacheTTL = 5 * time.Minute
+
+// Password logins are checked with bcrypt, which is slow on purpose, so they
+// run on loginVerifiers goroutines rather than the worker's read loop. Logins
+// beyond loginQueueSize waiting are dropped and time out on the worker, which
+// unlike a rejection it does not remember.
+const (
+	loginVerifiers = 4
+	loginQueueSize = 256
+)
+
 var (
 	websocketUpgrader = &websocket.Upgrader{
 		ReadBufferSize:  1024 * 1024,
@@ -31,31 +56,87 @@ type WebsocketManager struct {
 	sync.RWMutex
 	Handlers  map[string]EventHandler
 	queries   *repository.Queries
-	OtpMap    *RetentionMap
 	analytics models.AnalyticsService
+	usage     models.UsageService
+	keyring   *secrets.Keyring
+	// ReplicaID names this captain process in the worker_session registry.
+	ReplicaID   string
+	stopCluster context.CancelFunc
+
+	subscribersMu sync.Mutex
+	subscribers   map[chan models.WorkerStatusEvent]struct{}
+
+	logins chan loginRequest
+
+	// commits tracks how far each worker's telemetry has been committed to
+	// analytics and to the quota ledger; a worker is acked up to the lower.
+	commitsMu sync.Mutex
+	commits   map[uuid.UUID]*telemetryCommit
+
+	userIDsMu sync.Mutex
+	userIDs   map[string]cachedUserID
+}
+
+type loginRequest struct {
+	payload LoginPayload
+	worker  *Worker
+}
+
+type cachedUserID struct {
+	id        uuid.UUID
+	expiresAt time.Time
+}
+
+type telemetryCommit struct {
+	analytics uint64
+	usage     uint64
+	acked     uint64
 }
 
 func NewWebsocketManager() *WebsocketManager {
 	w := &WebsocketManager{
-		Workers:  make(WorkerList),
-		Handlers: make(map[string]EventHandler),
-		OtpMap:   NewRetentionMap(context.Background(), 10*time.Second),
+		Workers:     make(WorkerList),
+		Handlers:    make(map[string]EventHandler),
+		ReplicaID:   newReplicaID(),
+		subscribers: make(map[chan models.WorkerStatusEvent]struct{}),
+		logins:      make(chan loginRequest, loginQueueSize),
+		commits:     make(map[uuid.UUID]*telemetryCommit),
+		userIDs:     make(map[string]cachedUserID),
 	}
 	w.setupEventHandlers()
+	for i := 0; i < loginVerifiers; i++ {
+		go w.verifyLogins()
+	}
 	return w
 }
 
 func (ws *WebsocketManager) SetAnalyticsandQueries(queries *repository.Queries, analytics models.AnalyticsService) {
 	ws.analytics = analytics
 	ws.queries = queries
+	analytics.OnUserDataCommitted(ws.analyticsCommitted)
+}
+
+// SetUsageService must be called before the usage service is started.
+func (ws *WebsocketManager) SetUsageService(usage models.UsageService) {
+	ws.usage = usage
+	usage.OnUsageCommitted(ws.usageCommitted)
+}
+
+// SetKeyring sets the keyring used to decrypt upstream credentials before
+// they are sent to workers.
+func (ws *WebsocketManager) SetKeyring(keyring *secrets.Keyring) {
+	ws.keyring = keyring
 }
 
 func (ws *WebsocketManager) setupEventHandlers() {
 	ws.Handlers["verify_user"] = ws.handleLogin
+	ws.Handlers["verify_ip"] = ws.handleIpLogin
 	ws.Handlers["telemetry_usage"] = ws.handleTelemetryUsage
+	ws.Handlers["telemetry_usage_batch"] = ws.handleTelemetryUsageBatch
 	ws.Handlers["telemetry_health"] = ws.handleTelemetryHealth
 	ws.Handlers["request_config"] = ws.handleRequestConfig
 	ws.Handlers["telemetry_access_log"] = ws.handleTelemetryAccessLog
+	ws.Handlers["telemetry_access_log_batch"] = ws.handleTelemetryAccessLogBatch
 }
 
 func (ws *WebsocketManager) RouteEvent(event Event, w *Worker) error {
@@ -88,6 +169,11 @@ func (ws *WebsocketManager) ServeWS(w http.ResponseWriter, r *http.Request, work
 		return
 	}
 	ws.RUnlock()
+	if !ws.claimSession(workerID) {
+		log.Println("Worker already connected to another replica:", workerID)
+		conn.Close()
+		return
+	}
 	go func() {
 		if err := ws.handleRequestConfig(Event{}, worker); err != nil {
 			log.Printf("Failed to send initial configuration to worker %s: %v", workerID, err)
@@ -95,6 +181,7 @@ func (ws *WebsocketManager) ServeWS(w http.ResponseWriter, r *http.Request, work
 	}()
 	log.Println("Worker connected via WebSocket:", workerID)
 	ws.AddWorker(worker)
+	ws.publish(clusterEvent{Type: "worker_connected", WorkerID: workerID, WorkerName: workerName})
 	go worker.ReadMessage()
 	go worker.WriteMessage()
 }
@@ -103,17 +190,26 @@ func (ws *WebsocketManager) AddWorker(w *Worker) {
 	ws.Lock()
 	defer ws.Unlock()
 	ws.Workers[w.ID] = w
+	metrics.ConnectedWorkers.Inc()
 }
 
 func (ws *WebsocketManager) RemoveWorker(w *Worker) {
 	ws.Lock()
-	defer ws.Unlock()
-	if _, ok := ws.Workers[w.ID]; ok {
+	_, ok := ws.Workers[w.ID]
+	if ok {
 		w.Connection.Close()
 		delete(ws.Workers, w.ID)
+		metrics.ConnectedWorkers.Dec()
+	}
+	ws.Unlock()
+	if ok {
+		ws.releaseSession(w.ID)
+		ws.publish(clusterEvent{Type: "worker_disconnected", WorkerID: w.ID, WorkerName: w.Name})
 	}
 }
 
+// handleLogin queues a password login for the login verifiers, so its bcrypt
+// check never holds up the worker's telemetry, acks and pings.
 func (ws *WebsocketManager) handleLogin(event Event, w *Worker) error {
 	var payload LoginPayload
 	data, err := json.Marshal(event.Payload)
@@ -123,20 +219,92 @@ func (ws *WebsocketManager) handleLogin(event Event, w *Worker) error {
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return fmt.Errorf("invalid login payload: %v", err)
 	}
+	select {
+	case ws.logins <- loginRequest{payload: payload, worker: w}:
+	default:
+		log.Printf("[websocket] dropping login of user %s from worker %s, too many logins waiting", payload.Username, w.Name)
+	}
+	return nil
+}
+
+func (ws *WebsocketManager) verifyLogins() {
+	for login := range ws.logins {
+		ws.verifyLogin(login.payload, login.worker)
+	}
+}
+
+// verifyLogin checks a worker's password login and answers it.
+func (ws *WebsocketManager) verifyLogin(payload LoginPayload, w *Worker) {
 	user, err := ws.queries.GetUserByUsername(context.Background(), payload.Username)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[websocket] user login failed: %v", err)
+		w.send(Event{
+			Type:    "error",
+			Payload: ReplyPayload{Success: false, Payload: fmt.Sprintf("user login failed: %v", err)},
+		})
+		return
+	}
+	// an unknown user or a wrong password is answered, so the worker can
+	// remember the rejection; a lookup that failed is left to time out
+	if err == sql.ErrNoRows || !functions.CheckPassword(user.Password, payload.Password) {
+		log.Printf("[websocket] login failed for user %s", payload.Username)
+		w.send(Event{
+			Type:    "login_failed",
+			Payload: ReplyPayload{Success: false, Payload: loginFailedPayload{RequestID: payload.RequestID}},
+		})
+		return
+	}
+	successPayload := loginSuccessPayload{
+		ID:          user.ID,
+		Username:    user.Username,
+		Status:      user.Status,
+		IpWhitelist: user.IpWhitelist,
+		Pools:       user.Pools,
+		RequestID:   payload.RequestID,
+
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
+	}
+	w.send(Event{
+		Type:    "login_success",
+		Payload: ReplyPayload{Success: true, Payload: successPayload},
+	})
+}
+
+// handleIpLogin maps a client address without credentials to the single user
+// whose IP whitelist contains it. Both replies echo the client IP so the
+// worker can match them to the pending lookup; a failure is sent as
+// login_failed so the lookup ends at once rather than timing out.
+func (ws *WebsocketManager) handleIpLogin(event Event, w *Worker) error {
+	var payload IpLoginPayload
+	data, err := json.Marshal(event.Payload)
 	if err != nil {
-		return fmt.Errorf("user login failed: %v", err)
+		return fmt.Errorf("could not marshal payload map: %v", err)
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("invalid ip login payload: %v", err)
 	}
-	if user.Password != payload.Password {
-		return fmt.Errorf("login failed: incorrect password")
+	user, err := ws.lookupIpUser(payload.ClientIP)
+	if err != nil {
+		log.Printf("[websocket] %v", err)
+		w.egress <- Event{
+			Type:    "login_failed",
+			Payload: ReplyPayload{Success: false, Payload: loginFailedPayload{ClientIP: payload.ClientIP}},
+		}
+		return nil
 	}
 	successPayload := loginSuccessPayload{
 		ID:          user.ID,
 		Username:    user.Username,
-		Password:    user.Password,
 		Status:      user.Status,
 		IpWhitelist: user.IpWhitelist,
 		Pools:       user.Pools,
+		ClientIP:    payload.ClientIP,
+
+		AccessLogOptOut: user.AccessLogOptOut,
+		MaxConnections:  user.MaxConnections,
+		BandwidthLimit:  user.BandwidthLimit,
 	}
 	w.egress <- Event{
 		Type:    "login_success",
@@ -145,7 +313,28 @@ func (ws *WebsocketManager) handleLogin(event Event, w *Worker) error {
 	return nil
 }
 
+func (ws *WebsocketManager) lookupIpUser(clientIP string) (repository.GetUserByUsernameRow, error) {
+	if net.ParseIP(clientIP) == nil {
+		return repository.GetUserByUsernameRow{}, fmt.Errorf("ip login failed: invalid client ip %q", clientIP)
+	}
+	usernames, err := ws.queries.GetUsernamesByIp(context.Background(), clientIP)
+	if err != nil {
+		return repository.GetUserByUsernameRow{}, fmt.Errorf("ip login failed: %v", err)
+	}
+	if len(usernames) != 1 {
+		return repository.GetUserByUsernameRow{}, fmt.Errorf("ip login failed: %d users whitelist %s", len(usernames), clientIP)
+	}
+	user, err := ws.queries.GetUserByUsername(context.Background(), usernames[0])
+	if err != nil {
+		return repository.GetUserByUsernameRow{}, fmt.Errorf("ip login failed: %v", err)
+	}
+	return user, nil
+}
+
 func (ws *WebsocketManager) handleTelemetryUsage(event Event, w *Worker) error {
+	if !w.acceptsTelemetry(event.Seq) {
+		return nil
+	}
 	var payload models.UserDataUsage
 	data, err := json.Marshal(event.Payload)
 	if err != nil {
@@ -154,7 +343,121 @@ func (ws *WebsocketManager) handleTelemetryUsage(event Event, w *Worker) error {
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return fmt.Errorf("invalid telemetry usage payload: %v", err)
 	}
-	return ws.analytics.RecordUserDataUsage(context.Background(), payload)
+	payload.RequestCount = 1
+	return ws.recordUsage(event.Seq, w, []models.UserDataUsage{payload})
+}
+
+// handleTelemetryUsageBatch records usage a worker rolled up over a window,
+// one row per entry.
+func (ws *WebsocketManager) handleTelemetryUsageBatch(event Event, w *Worker) error {
+	if !w.acceptsTelemetry(event.Seq) {
+		return nil
+	}
+	var payload models.UserDataUsageBatch
+	data, err := json.Marshal(event.Payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal payload map: %v", err)
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("invalid telemetry usage batch payload: %v", err)
+	}
+	rows := make([]models.UserDataUsage, 0, len(payload.Entries))
+	for _, entry := range payload.Entries {
+		rows = append(rows, models.UserDataUsage{
+			UserID:          entry.UserID,
+			Username:        entry.Username,
+			PoolID:          entry.PoolID,
+			PoolName:        entry.PoolName,
+			WorkerRegion:    payload.WorkerRegion,
+			BytesSent:       entry.BytesSent,
+			BytesReceived:   entry.BytesReceived,
+			Protocol:        entry.Protocol,
+			DestinationHost: entry.DestinationHost,
+			RequestCount:    entry.Requests,
+		})
+	}
+	return ws.recordUsage(event.Seq, w, rows)
+}
+
+// recordUsage buffers rows for ClickHouse and the quota ledger. Spooling
+// workers number their events; those are acked once committed to both (see
+// AckTelemetry), and an event that cannot be buffered is nacked so the worker
+// resends from there.
+func (ws *WebsocketManager) recordUsage(seq uint64, w *Worker, rows []models.UserDataUsage) error {
+	kept := rows[:0]
+	var err error
+	for _, row := range rows {
+		row.WorkerID = w.ID
+		row.Seq = seq
+		if row.UserID == uuid.Nil && row.Username != "" {
+			row.UserID, err = ws.lookupUserID(row.Username)
+			if err == sql.ErrNoRows {
+				log.Printf("[websocket] dropping usage of unknown user %s from worker %s", row.Username, w.Name)
+				err = nil
+				continue
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to resolve user %s for usage: %v", row.Username, err)
+				break
+			}
+		}
+		kept = append(kept, row)
+	}
+	rows = kept
+
+	if err == nil && len(rows) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), analyticsEnqueueWait)
+		defer cancel()
+		err = ws.analytics.RecordUserDataUsage(ctx, rows...)
+		if err == nil && ws.usage != nil {
+			// both buffers drop seqs they already hold, so when only the analytics
+			// one takes the event the resend is not written there twice
+			err = ws.usage.RecordUsage(ctx, rows...)
+		}
+	}
+	if err != nil {
+		if seq == 0 {
+			return err
+		}
+		log.Printf("[websocket] nacking telemetry #%d from worker %s: %v", seq, w.Name, err)
+		w.nackedSeq = seq
+		w.egress <- Event{
+			Type:    "nack",
+			Payload: ReplyPayload{Success: false, Payload: seq},
+		}
+		return nil
+	}
+	w.acceptedTelemetry(seq)
+	return nil
+}
+
+// lookupUserID resolves the id analytics are keyed by for usage rows that only
+// carry a username. Ids are cached across events for userIDCacheTTL; failed
+// lookups are not cached.
+func (ws *WebsocketManager) lookupUserID(username string) (uuid.UUID, error) {
+	ws.userIDsMu.Lock()
+	cached, ok := ws.userIDs[username]
+	ws.userIDsMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.id, nil
+	}
+
+	user, err := ws.queries.GetUserByUsername(context.Background(), username)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	ws.userIDsMu.Lock()
+	ws.userIDs[username] = cachedUserID{id: user.ID, expiresAt: time.Now().Add(userIDCacheTTL)}
+	ws.userIDsMu.Unlock()
+	return user.ID, nil
+}
+
+// forgetUserID drops the cached id of username, so a user deleted and created
+// again under the same name is not billed under the old id.
+func (ws *WebsocketManager) forgetUserID(username string) {
+	ws.userIDsMu.Lock()
+	delete(ws.userIDs, username)
+	ws.userIDsMu.Unlock()
 }
 
 func (ws *WebsocketManager) handleTelemetryHealth(event Event, w *Worker) error {
@@ -166,6 +469,7 @@ func (ws *WebsocketManager) handleTelemetryHealth(event Event, w *Worker) error
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return fmt.Errorf("invalid telemetry health payload: %v", err)
 	}
+	payload.WorkerID = w.ID
 	return ws.analytics.RecordWorkerHealth(context.Background(), payload)
 }
 
@@ -178,7 +482,72 @@ func (ws *WebsocketManager) handleTelemetryAccessLog(event Event, w *Worker) err
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return fmt.Errorf("invalid telemetry access log payload: %v", err)
 	}
-	return ws.analytics.RecordWebsiteAccess(context.Background(), payload)
+	return ws.recordAccessLog([]models.WebsiteAccess{payload})
+}
+
+// handleTelemetryAccessLogBatch records the requests a worker buffered over a
+// window.
+func (ws *WebsocketManager) handleTelemetryAccessLogBatch(event Event, w *Worker) error {
+	var payload models.WebsiteAccessBatch
+	data, err := json.Marshal(event.Payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal payload map: %v", err)
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return fmt.Errorf("invalid telemetry access log batch payload: %v", err)
+	}
+	return ws.recordAccessLog(payload.Entries)
+}
+
+// recordAccessLog buffers entries for ClickHouse, splitting the destination
+// host workers report as the domain. Workers already leave out users who opted
+// out of access logging, but their copy of the flag can be stale, so it is
+// checked again here; entries for unknown users are dropped too.
+func (ws *WebsocketManager) recordAccessLog(entries []models.WebsiteAccess) error {
+	users := make(map[string]*repository.GetUserByUsernameRow)
+	for _, entry := range entries {
+		user, ok := users[entry.Username]
+		if !ok {
+			row, err := ws.queries.GetUserByUsername(context.Background(), entry.Username)
+			if err != nil {
+				if err != sql.ErrNoRows {
+					log.Printf("[websocket] failed to resolve user %s for access log: %v", entry.Username, err)
+				}
+			} else {
+				user = &row
+			}
+			users[entry.Username] = user
+		}
+		if user == nil || user.AccessLogOptOut {
+			continue
+		}
+		entry.UserID = user.ID
+		if entry.Subdomain == "" {
+			entry.Domain, entry.Subdomain = splitDomain(entry.Domain)
+		}
+		if err := ws.analytics.RecordWebsiteAccess(context.Background(), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitDomain splits host into its registrable domain, taken to be the last
+// two labels, and whatever subdomain precedes it. IP addresses are returned
+// whole.
+func splitDomain(host string) (domain, subdomain string) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host, ""
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return host, ""
+	}
+	return strings.Join(labels[len(labels)-2:], "."), strings.Join(labels[:len(labels)-2], ".")
 }
 
 func (ws *WebsocketManager) handleRequestConfig(event Event, w *Worker) error {
@@ -201,36 +570,181 @@ func (ws *WebsocketManager) handleRequestConfig(event Event, w *Worker) error {
 		PoolPort:      int(firstRow.PoolPort),
 		PoolSubdomain: firstRow.PoolSubdomain,
 		Upstreams:     make([]UpstreamConfig, 0),
+
+		ResolveLocally: firstRow.ResolveLocally,
 	}
 	for _, row := range rows {
+		username, err := ws.keyring.Decrypt(row.Username)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt username of upstream %s: %v", row.UpstreamTag, err)
+		}
+		password, err := ws.keyring.Decrypt(row.Password)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt password of upstream %s: %v", row.UpstreamTag, err)
+		}
 		config.Upstreams = append(config.Upstreams, UpstreamConfig{
 			UpstreamID:       row.UpstreamID,
 			UpstreamTag:      row.UpstreamTag,
 			UpstreamFormat:   row.ConfigFormat,
-			UpstreamUsername: row.Username,
-			UpstreamPassword: row.Password,
+			UpstreamUsername: username,
+			UpstreamPassword: password,
 			UpstreamHost:     row.UpstreamAddress,
 			UpstreamPort:     int(row.UpstreamPort),
 			UpstreamProvider: row.UpstreamProvider,
 			Weight:           int(row.Weight),
 		})
 	}
+	catalog, err := ws.queries.GetPoolTargetingCatalog(context.Background(), firstRow.PoolID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch targeting catalog of pool %s: %v", firstRow.PoolTag, err)
+	}
+	config.Countries = targetingCountries(catalog)
+	seq, err := ws.queries.GetCommittedTelemetrySeq(context.Background(), w.ID)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to fetch telemetry seq of worker %s: %v", w.ID, err)
+	}
+	config.TelemetrySeq = uint64(seq)
 	w.egress <- Event{
 		Type:    "config",
 		Payload: ReplyPayload{Success: true, Payload: config},
 	}
+	ws.setConfigVersion(w, config)
 	return nil
 }
 
-func (ws *WebsocketManager) NewOTP(workerId *uuid.UUID) string {
-	return ws.OtpMap.NewOTP(*workerId).Key
+// targetingCountries groups the catalog rows, one per country, state or city,
+// by country.
+func targetingCountries(rows []repository.GetPoolTargetingCatalogRow) []TargetingCountry {
+	countries := make([]TargetingCountry, 0)
+	index := make(map[string]int)
+	for _, row := range rows {
+		i, ok := index[row.CountryCode]
+		if !ok {
+			i = len(countries)
+			index[row.CountryCode] = i
+			countries = append(countries, TargetingCountry{Code: row.CountryCode, States: []string{}, Cities: []TargetingCity{}})
+		}
+		switch {
+		case row.CityCode.Valid:
+			countries[i].Cities = append(countries[i].Cities, TargetingCity{Code: row.CityCode.String, State: row.StateCode.String})
+		case row.StateCode.Valid:
+			countries[i].States = append(countries[i].States, row.StateCode.String)
+		}
+	}
+	return countries
 }
 
-func (ws *WebsocketManager) VerifyOTP(otp string) (bool, uuid.UUID) {
-	return ws.OtpMap.VerifyOTP(otp)
+// setConfigVersion records a digest of the configuration sent to the worker on
+// its session, so the fleet status shows which workers have the same one.
+func (ws *WebsocketManager) setConfigVersion(w *Worker, config ConfigPayload) {
+	// The telemetry seq moves with traffic, not with the configuration.
+	config.TelemetrySeq = 0
+	data, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("[websocket] failed to marshal config of worker %s: %v", w.Name, err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if err := ws.queries.SetWorkerSessionConfigVersion(context.Background(), repository.SetWorkerSessionConfigVersionParams{
+		WorkerID:      w.ID,
+		ReplicaID:     ws.ReplicaID,
+		ConfigVersion: hex.EncodeToString(sum[:6]),
+	}); err != nil {
+		log.Printf("[websocket] failed to record config version of worker %s: %v", w.Name, err)
+	}
 }
 
+// NotifyUserChange tells every worker, on every replica, to drop its cached
+// copy of username.
 func (ws *WebsocketManager) NotifyUserChange(username string) {
+	ws.publish(clusterEvent{Type: "user_change", Username: username})
+}
+
+// NotifyPoolChange tells the workers serving poolId, on every replica, to
+// reload their configuration.
+func (ws *WebsocketManager) NotifyPoolChange(poolId uuid.UUID) {
+	ws.publish(clusterEvent{Type: "pool_change", PoolID: poolId})
+}
+
+// DisconnectWorker closes the live session of a worker whose credentials were
+// revoked, on whichever replica holds it.
+func (ws *WebsocketManager) DisconnectWorker(workerID uuid.UUID) {
+	ws.publish(clusterEvent{Type: "disconnect_worker", WorkerID: workerID})
+}
+
+func (ws *WebsocketManager) analyticsCommitted(workerID uuid.UUID, seq uint64) {
+	ws.telemetryCommitted(workerID, func(c *telemetryCommit) { c.analytics = max(c.analytics, seq) })
+}
+
+func (ws *WebsocketManager) usageCommitted(workerID uuid.UUID, seq uint64) {
+	ws.telemetryCommitted(workerID, func(c *telemetryCommit) { c.usage = max(c.usage, seq) })
+}
+
+// telemetryCommitted acks a worker up to the seq both analytics and, when it
+// is set, the quota ledger have committed.
+func (ws *WebsocketManager) telemetryCommitted(workerID uuid.UUID, update func(c *telemetryCommit)) {
+	ws.commitsMu.Lock()
+	c, ok := ws.commits[workerID]
+	if !ok {
+		c = &telemetryCommit{}
+		ws.commits[workerID] = c
+	}
+	update(c)
+	seq := c.analytics
+	if ws.usage != nil {
+		seq = min(seq, c.usage)
+	}
+	advanced := seq > c.acked
+	if advanced {
+		c.acked = seq
+	}
+	ws.commitsMu.Unlock()
+	if advanced {
+		ws.AckTelemetry(workerID, seq)
+	}
+}
+
+// AckTelemetry tells a worker, on whichever replica holds it, that its
+// telemetry up to seq is committed and can leave its spool.
+func (ws *WebsocketManager) AckTelemetry(workerID uuid.UUID, seq uint64) {
+	ws.publish(clusterEvent{Type: "telemetry_ack", WorkerID: workerID, Seq: seq})
+}
+
+// SubscribeWorkerEvents streams worker connects and disconnects on every
+// replica until the returned func is called. Events are dropped for a
+// subscriber that falls behind.
+func (ws *WebsocketManager) SubscribeWorkerEvents() (<-chan models.WorkerStatusEvent, func()) {
+	ch := make(chan models.WorkerStatusEvent, 16)
+	ws.subscribersMu.Lock()
+	ws.subscribers[ch] = struct{}{}
+	ws.subscribersMu.Unlock()
+	return ch, func() {
+		ws.subscribersMu.Lock()
+		delete(ws.subscribers, ch)
+		ws.subscribersMu.Unlock()
+	}
+}
+
+func (ws *WebsocketManager) notifyWorkerEvent(event clusterEvent) {
+	status := models.WorkerStatusEvent{
+		Type:       strings.TrimPrefix(event.Type, "worker_"),
+		WorkerID:   event.WorkerID,
+		WorkerName: event.WorkerName,
+		Replica:    event.Origin,
+		Time:       time.Now().UTC(),
+	}
+	ws.subscribersMu.Lock()
+	defer ws.subscribersMu.Unlock()
+	for ch := range ws.subscribers {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+func (ws *WebsocketManager) notifyLocalUserChange(username string) {
+	ws.forgetUserID(username)
 	ws.Lock()
 	defer ws.Unlock()
 	for _, worker := range ws.Workers {
@@ -241,7 +755,7 @@ func (ws *WebsocketManager) NotifyUserChange(username string) {
 	}
 }
 
-func (ws *WebsocketManager) NotifyPoolChange(poolId uuid.UUID) {
+func (ws *WebsocketManager) notifyLocalPoolChange(poolId uuid.UUID) {
 	ws.Lock()
 	defer ws.Unlock()
 	for _, worker := range ws.Workers {
@@ -254,13 +768,54 @@ func (ws *WebsocketManager) NotifyPoolChange(poolId uuid.UUID) {
 	}
 }
 
+// disconnectLocalWorker closes the worker's connection if this replica holds
+// it. The read loop notices the closed connection and cleans up.
+func (ws *WebsocketManager) disconnectLocalWorker(workerID uuid.UUID) {
+	ws.RLock()
+	worker, ok := ws.Workers[workerID]
+	ws.RUnlock()
+	if ok {
+		log.Println("[websocket] disconnecting worker", worker.Name)
+		worker.Connection.Close()
+	}
+}
+
+// ackLocalTelemetry never blocks the analytics flush on a slow worker; a
+// dropped ack is covered by the next one, since acks are cumulative.
+func (ws *WebsocketManager) ackLocalTelemetry(workerID uuid.UUID, seq uint64) {
+	ws.RLock()
+	defer ws.RUnlock()
+	worker, ok := ws.Workers[workerID]
+	if !ok {
+		return
+	}
+	select {
+	case worker.egress <- Event{
+		Type:    "ack",
+		Payload: ReplyPayload{Success: true, Payload: seq},
+	}:
+	default:
+		log.Printf("[websocket] egress full, dropping telemetry ack #%d for worker %s", seq, worker.Name)
+	}
+}
+
 func (ws *WebsocketManager) Shutdown() {
+	if ws.stopCluster != nil {
+		ws.stopCluster()
+	}
+	if ws.queries != nil {
+		if err := ws.queries.ReleaseReplicaSessions(context.Background(), ws.ReplicaID); err != nil {
+			log.Printf("[cluster] failed to release sessions of replica %s: %v", ws.ReplicaID, err)
+		}
+	}
 	ws.Lock()
 	defer ws.Unlock()
+	// Closing the connection ends each worker's read loop, which closes its
+	// egress channel; closing it here too would panic.
 	for _, worker := range ws.Workers {
 		worker.Connection.Close()
-		close(worker.egress)
 	}
+	metrics.ConnectedWorkers.Sub(float64(len(ws.Workers)))
 	ws.Workers = make(map[uuid.UUID]*Worker)
 	log.Println("[websocket] All workers shut down")
 }
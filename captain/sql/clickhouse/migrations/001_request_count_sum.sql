@@ -0,0 +1,106 @@
+-- Migrates ClickHouse databases created before request_count became a sum.
+--
+-- schema.sql only runs when the ClickHouse volume is first created, so older
+-- deployments keep request_count as AggregateFunction(count, UInt64) and the
+-- countState() views, which the sumMerge(request_count) queries cannot read.
+-- Count states cannot be converted in place, so each rollup is rebuilt from
+-- its own rows and swapped in. Run it once, with captain stopped so no usage
+-- is inserted meanwhile:
+--
+--   clickhouse-client --multiquery < 001_request_count_sum.sql
+
+ALTER TABLE analytics_db_subnetworksystem.user_data_usage
+    ADD COLUMN IF NOT EXISTS request_count UInt64 DEFAULT 1;
+
+DROP VIEW IF EXISTS analytics_db_subnetworksystem.user_usage_hourly_mv;
+DROP VIEW IF EXISTS analytics_db_subnetworksystem.user_usage_daily_mv;
+
+-- Hourly rollup
+CREATE TABLE analytics_db_subnetworksystem.user_usage_hourly_migrated (
+    date Date,
+    hour DateTime,
+    user_id UUID,
+    username String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_destinations AggregateFunction(uniq, String)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (user_id, date, hour);
+
+INSERT INTO analytics_db_subnetworksystem.user_usage_hourly_migrated
+SELECT
+    date,
+    hour,
+    user_id,
+    username,
+    sumMergeState(bytes_sent),
+    sumMergeState(bytes_received),
+    initializeAggregation('sumState', countMerge(request_count)),
+    uniqMergeState(unique_destinations)
+FROM analytics_db_subnetworksystem.user_usage_hourly
+GROUP BY date, hour, user_id, username;
+
+EXCHANGE TABLES analytics_db_subnetworksystem.user_usage_hourly
+    AND analytics_db_subnetworksystem.user_usage_hourly_migrated;
+DROP TABLE analytics_db_subnetworksystem.user_usage_hourly_migrated;
+
+-- Daily rollup
+CREATE TABLE analytics_db_subnetworksystem.user_usage_daily_migrated (
+    date Date,
+    user_id UUID,
+    username String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_destinations AggregateFunction(uniq, String)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (user_id, date);
+
+INSERT INTO analytics_db_subnetworksystem.user_usage_daily_migrated
+SELECT
+    date,
+    user_id,
+    username,
+    sumMergeState(bytes_sent),
+    sumMergeState(bytes_received),
+    initializeAggregation('sumState', countMerge(request_count)),
+    uniqMergeState(unique_destinations)
+FROM analytics_db_subnetworksystem.user_usage_daily
+GROUP BY date, user_id, username;
+
+EXCHANGE TABLES analytics_db_subnetworksystem.user_usage_daily
+    AND analytics_db_subnetworksystem.user_usage_daily_migrated;
+DROP TABLE analytics_db_subnetworksystem.user_usage_daily_migrated;
+
+-- Views, as in schema.sql
+CREATE MATERIALIZED VIEW analytics_db_subnetworksystem.user_usage_hourly_mv
+TO analytics_db_subnetworksystem.user_usage_hourly
+AS
+SELECT
+    toDate(timestamp) AS date,
+    toStartOfHour(timestamp) AS hour,
+    user_id,
+    username,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(destination_host) AS unique_destinations
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, hour, user_id, username;
+
+CREATE MATERIALIZED VIEW analytics_db_subnetworksystem.user_usage_daily_mv
+TO analytics_db_subnetworksystem.user_usage_daily
+AS
+SELECT
+    date,
+    user_id,
+    username,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(destination_host) AS unique_destinations
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, username;
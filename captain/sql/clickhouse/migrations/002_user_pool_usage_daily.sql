@@ -0,0 +1,46 @@
+-- Adds the per-pool daily rollup to ClickHouse databases created before it,
+-- filled from the usage still held in user_data_usage. Run it once, after
+-- 001, with captain stopped so no usage is inserted meanwhile:
+--
+--   clickhouse-client --multiquery < 002_user_pool_usage_daily.sql
+
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_pool_usage_daily (
+    date Date,
+    user_id UUID,
+    pool_id UUID,
+    pool_name String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_destinations AggregateFunction(uniq, String)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (user_id, date, pool_id, pool_name);
+
+INSERT INTO analytics_db_subnetworksystem.user_pool_usage_daily
+SELECT
+    date,
+    user_id,
+    pool_id,
+    pool_name,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(destination_host) AS unique_destinations
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, pool_id, pool_name;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.user_pool_usage_daily_mv
+TO analytics_db_subnetworksystem.user_pool_usage_daily
+AS
+SELECT
+    date,
+    user_id,
+    pool_id,
+    pool_name,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(destination_host) AS unique_destinations
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, pool_id, pool_name;
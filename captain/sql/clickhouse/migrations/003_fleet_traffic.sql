@@ -0,0 +1,88 @@
+-- Adds the fleet traffic and destination rollups to ClickHouse databases
+-- created before them, filled from the usage still held in user_data_usage.
+-- Run it once, after 002, with captain stopped so no usage is inserted
+-- meanwhile:
+--
+--   clickhouse-client --multiquery < 003_fleet_traffic.sql
+
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.traffic_daily (
+    date Date,
+    user_id UUID,
+    username String,
+    pool_id UUID,
+    pool_name String,
+    worker_region String,
+    protocol String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, pool_id, pool_name, worker_region, protocol, user_id, username);
+
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.destination_usage_daily (
+    date Date,
+    destination_host String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_users AggregateFunction(uniq, UUID)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, destination_host);
+
+INSERT INTO analytics_db_subnetworksystem.traffic_daily
+SELECT
+    date,
+    user_id,
+    username,
+    pool_id,
+    pool_name,
+    worker_region,
+    protocol,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, username, pool_id, pool_name, worker_region, protocol;
+
+INSERT INTO analytics_db_subnetworksystem.destination_usage_daily
+SELECT
+    date,
+    destination_host,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(user_id) AS unique_users
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, destination_host;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.traffic_daily_mv
+TO analytics_db_subnetworksystem.traffic_daily
+AS
+SELECT
+    date,
+    user_id,
+    username,
+    pool_id,
+    pool_name,
+    worker_region,
+    protocol,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, username, pool_id, pool_name, worker_region, protocol;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.destination_usage_daily_mv
+TO analytics_db_subnetworksystem.destination_usage_daily
+AS
+SELECT
+    date,
+    destination_host,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(user_id) AS unique_users
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, destination_host;
@@ -1,3 +1,7 @@
+-- This file only runs when the ClickHouse volume is first created. Databases
+-- created by an older version are brought up to date by running the scripts
+-- in migrations/ in order.
+
 -- Create analytics database
 CREATE DATABASE IF NOT EXISTS analytics_db_subnetworksystem;
 
@@ -17,12 +21,17 @@ CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_data_usage (
     protocol String,
     destination_host String,
     destination_port UInt16,
-    status_code UInt16
+    status_code UInt16,
+    -- Connections rolled into the row; workers aggregate usage per window.
+    request_count UInt64 DEFAULT 1
 ) ENGINE = MergeTree()
 PARTITION BY toYYYYMM(date)
 ORDER BY (user_id, date, timestamp)
 TTL date + INTERVAL 90 DAY;
 
+ALTER TABLE analytics_db_subnetworksystem.user_data_usage
+    ADD COLUMN IF NOT EXISTS request_count UInt64 DEFAULT 1;
+
 -- Hourly aggregated user usage (for fast queries)
 CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_usage_hourly (
     date Date,
@@ -31,7 +40,7 @@ CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_usage_hourly (
     username String,
     bytes_sent AggregateFunction(sum, UInt64),
     bytes_received AggregateFunction(sum, UInt64),
-    request_count AggregateFunction(count, UInt64),
+    request_count AggregateFunction(sum, UInt64),
     unique_destinations AggregateFunction(uniq, String)
 ) ENGINE = AggregatingMergeTree()
 PARTITION BY toYYYYMM(date)
@@ -44,12 +53,55 @@ CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_usage_daily (
     username String,
     bytes_sent AggregateFunction(sum, UInt64),
     bytes_received AggregateFunction(sum, UInt64),
-    request_count AggregateFunction(count, UInt64),
+    request_count AggregateFunction(sum, UInt64),
     unique_destinations AggregateFunction(uniq, String)
 ) ENGINE = AggregatingMergeTree()
 PARTITION BY toYYYYMM(date)
 ORDER BY (user_id, date);
 
+-- Daily user usage per pool
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.user_pool_usage_daily (
+    date Date,
+    user_id UUID,
+    pool_id UUID,
+    pool_name String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_destinations AggregateFunction(uniq, String)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (user_id, date, pool_id, pool_name);
+
+-- Daily fleet traffic by user, pool, worker region and protocol; fleet-wide
+-- views group this by whichever dimensions they need.
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.traffic_daily (
+    date Date,
+    user_id UUID,
+    username String,
+    pool_id UUID,
+    pool_name String,
+    worker_region String,
+    protocol String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, pool_id, pool_name, worker_region, protocol, user_id, username);
+
+-- Daily traffic per destination host
+CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.destination_usage_daily (
+    date Date,
+    destination_host String,
+    bytes_sent AggregateFunction(sum, UInt64),
+    bytes_received AggregateFunction(sum, UInt64),
+    request_count AggregateFunction(sum, UInt64),
+    unique_users AggregateFunction(uniq, UUID)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(date)
+ORDER BY (date, destination_host);
+
 -- Worker health metrics
 CREATE TABLE IF NOT EXISTS analytics_db_subnetworksystem.worker_health (
     timestamp DateTime64(3) DEFAULT now64(3),
@@ -117,7 +169,7 @@ SELECT
     username,
     sumState(bytes_sent) AS bytes_sent,
     sumState(bytes_received) AS bytes_received,
-    countState() AS request_count,
+    sumState(request_count) AS request_count,
     uniqState(destination_host) AS unique_destinations
 FROM analytics_db_subnetworksystem.user_data_usage
 GROUP BY date, hour, user_id, username;
@@ -132,8 +184,52 @@ SELECT
     username,
     sumState(bytes_sent) AS bytes_sent,
     sumState(bytes_received) AS bytes_received,
-    countState() AS request_count,
+    sumState(request_count) AS request_count,
     uniqState(destination_host) AS unique_destinations
 FROM analytics_db_subnetworksystem.user_data_usage
 GROUP BY date, user_id, username;
 
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.user_pool_usage_daily_mv
+TO analytics_db_subnetworksystem.user_pool_usage_daily
+AS
+SELECT
+    date,
+    user_id,
+    pool_id,
+    pool_name,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(destination_host) AS unique_destinations
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, pool_id, pool_name;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.traffic_daily_mv
+TO analytics_db_subnetworksystem.traffic_daily
+AS
+SELECT
+    date,
+    user_id,
+    username,
+    pool_id,
+    pool_name,
+    worker_region,
+    protocol,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, user_id, username, pool_id, pool_name, worker_region, protocol;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS analytics_db_subnetworksystem.destination_usage_daily_mv
+TO analytics_db_subnetworksystem.destination_usage_daily
+AS
+SELECT
+    date,
+    destination_host,
+    sumState(bytes_sent) AS bytes_sent,
+    sumState(bytes_received) AS bytes_received,
+    sumState(request_count) AS request_count,
+    uniqState(user_id) AS unique_users
+FROM analytics_db_subnetworksystem.user_data_usage
+GROUP BY date, destination_host;
@@ -0,0 +1,9 @@
+-- +goose up
+
+CREATE TABLE usage_batch (
+    id UUID PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose down
+DROP TABLE usage_batch;
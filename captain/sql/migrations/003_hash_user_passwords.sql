@@ -0,0 +1,10 @@
+-- +goose up
+-- passwords are stored as bcrypt hashes from now on; hash the existing
+-- plain text ones in place
+UPDATE "user"
+SET password = crypt(password, gen_salt('bf', 10)),
+    updated_at = CURRENT_TIMESTAMP
+WHERE password NOT LIKE '$2_$%';
+
+-- +goose down
+-- bcrypt hashes cannot be reverted to the original passwords
@@ -0,0 +1,10 @@
+-- +goose up
+
+-- Workers authenticate with their own secret. Existing workers have none and
+-- must be issued one through POST /admin/worker/{name}/rotate-secret.
+ALTER TABLE worker ADD COLUMN secret_hash TEXT;
+ALTER TABLE worker ADD COLUMN secret_rotated_at TIMESTAMPTZ;
+
+-- +goose down
+ALTER TABLE worker DROP COLUMN secret_rotated_at;
+ALTER TABLE worker DROP COLUMN secret_hash;
@@ -0,0 +1,24 @@
+-- +goose up
+
+-- One-time passwords handed out by /worker/ws/login. Shared so that any
+-- captain replica can accept the websocket that follows.
+CREATE TABLE worker_otp (
+    key TEXT PRIMARY KEY,
+    worker_id UUID NOT NULL REFERENCES worker(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX worker_otp_expires_at_idx ON worker_otp (expires_at);
+
+-- Which captain replica holds each worker's websocket. Rows whose heartbeat
+-- is stale belong to a replica that died and can be taken over.
+CREATE TABLE worker_session (
+    worker_id UUID PRIMARY KEY REFERENCES worker(id) ON DELETE CASCADE,
+    replica_id TEXT NOT NULL,
+    connected_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose down
+DROP TABLE worker_session;
+DROP TABLE worker_otp;
@@ -0,0 +1,23 @@
+-- +goose up
+
+-- The highest telemetry seq of each worker committed to analytics and to the
+-- quota ledger. Workers replay unacked telemetry after reconnecting, possibly
+-- to another replica, so replays at or below these are dropped.
+CREATE TABLE worker_telemetry_seq (
+    worker_id UUID PRIMARY KEY REFERENCES worker(id) ON DELETE CASCADE,
+    analytics_seq BIGINT NOT NULL DEFAULT 0,
+    usage_seq BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- User data batches ClickHouse kept refusing, kept for replay by hand.
+CREATE TABLE user_data_dead_letter (
+    id BIGSERIAL PRIMARY KEY,
+    rows JSONB NOT NULL,
+    error TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose down
+DROP TABLE user_data_dead_letter;
+DROP TABLE worker_telemetry_seq;
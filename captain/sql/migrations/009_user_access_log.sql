@@ -0,0 +1,8 @@
+-- +goose up
+
+-- Users who opt out of access logging only have their traffic counted; the
+-- hosts and URLs they visit are not recorded.
+ALTER TABLE "user" ADD COLUMN access_log_opt_out BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose down
+ALTER TABLE "user" DROP COLUMN access_log_opt_out;
@@ -0,0 +1,8 @@
+-- +goose up
+
+-- config_version identifies the configuration last sent to the worker, so the
+-- fleet status can show workers running an outdated one.
+ALTER TABLE worker_session ADD COLUMN config_version TEXT NOT NULL DEFAULT '';
+
+-- +goose down
+ALTER TABLE worker_session DROP COLUMN config_version;
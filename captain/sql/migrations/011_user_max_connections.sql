@@ -0,0 +1,11 @@
+-- +goose up
+
+-- max_connections caps the concurrent connections a user may hold on a
+-- worker, overall and per pool. 0 means unlimited; existing users keep the
+-- 50 the worker used to hardcode.
+ALTER TABLE "user" ADD COLUMN max_connections INT NOT NULL DEFAULT 50 CHECK (max_connections >= 0);
+ALTER TABLE user_pools ADD COLUMN max_connections INT NOT NULL DEFAULT 0 CHECK (max_connections >= 0);
+
+-- +goose down
+ALTER TABLE user_pools DROP COLUMN max_connections;
+ALTER TABLE "user" DROP COLUMN max_connections;
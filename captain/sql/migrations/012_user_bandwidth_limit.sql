@@ -0,0 +1,10 @@
+-- +goose up
+
+-- bandwidth_limit caps a user's throughput on a worker in bytes per second,
+-- shared by all of the user's connections. 0 means unlimited.
+ALTER TABLE "user" ADD COLUMN bandwidth_limit BIGINT NOT NULL DEFAULT 0 CHECK (bandwidth_limit >= 0);
+ALTER TABLE user_pools ADD COLUMN bandwidth_limit BIGINT NOT NULL DEFAULT 0 CHECK (bandwidth_limit >= 0);
+
+-- +goose down
+ALTER TABLE user_pools DROP COLUMN bandwidth_limit;
+ALTER TABLE "user" DROP COLUMN bandwidth_limit;
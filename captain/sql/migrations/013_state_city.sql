@@ -0,0 +1,26 @@
+-- +goose up
+
+-- states and cities clients may target within a country. A city may belong
+-- to a state or directly to its country.
+CREATE TABLE state (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    country_id UUID NOT NULL REFERENCES country(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(country_id, code)
+);
+
+CREATE TABLE city (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    country_id UUID NOT NULL REFERENCES country(id) ON DELETE CASCADE,
+    state_id UUID REFERENCES state(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(country_id, code)
+);
+
+-- +goose down
+DROP TABLE city;
+DROP TABLE state;
@@ -0,0 +1,9 @@
+-- +goose up
+
+-- resolve_locally makes workers resolve SOCKS targets themselves and send the
+-- upstream an IP address. By default the upstream gets the domain name, so it
+-- resolves it from the exit location.
+ALTER TABLE pool ADD COLUMN resolve_locally BOOLEAN NOT NULL DEFAULT false;
+
+-- +goose down
+ALTER TABLE pool DROP COLUMN resolve_locally;
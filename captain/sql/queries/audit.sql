@@ -0,0 +1,35 @@
+-- name: InsertAuditLog :exec
+INSERT INTO audit_log (actor_token_id, actor_name, request_id, route, action, entity_type, entity_id, before, after)
+VALUES (
+    sqlc.narg('actor_token_id'),
+    sqlc.arg('actor_name'),
+    sqlc.arg('request_id'),
+    sqlc.arg('route'),
+    sqlc.arg('action'),
+    sqlc.arg('entity_type'),
+    sqlc.arg('entity_id'),
+    CAST(sqlc.narg('before')::text AS jsonb),
+    CAST(sqlc.narg('after')::text AS jsonb)
+);
+
+-- name: ListAuditLog :many
+SELECT
+    a.id,
+    a.actor_token_id,
+    a.actor_name,
+    a.request_id,
+    a.route,
+    a.action,
+    a.entity_type,
+    a.entity_id,
+    COALESCE(a.before::text, 'null')::text AS before,
+    COALESCE(a.after::text, 'null')::text AS after,
+    a.created_at
+FROM audit_log AS a
+WHERE (sqlc.narg('actor')::text IS NULL OR a.actor_name = sqlc.narg('actor') OR a.actor_token_id::text = sqlc.narg('actor'))
+  AND (sqlc.narg('entity_type')::text IS NULL OR a.entity_type = sqlc.narg('entity_type'))
+  AND (sqlc.narg('entity_id')::text IS NULL OR a.entity_id = sqlc.narg('entity_id'))
+  AND (sqlc.narg('from_time')::timestamptz IS NULL OR a.created_at >= sqlc.narg('from_time'))
+  AND (sqlc.narg('to_time')::timestamptz IS NULL OR a.created_at < sqlc.narg('to_time'))
+ORDER BY a.id DESC
+LIMIT sqlc.arg('row_limit');
@@ -0,0 +1,34 @@
+-- name: CreateWorkerOtp :exec
+INSERT INTO worker_otp (key, worker_id, expires_at)
+VALUES ($1, $2, $3);
+
+-- name: ConsumeWorkerOtp :one
+DELETE FROM worker_otp
+WHERE key = $1 AND expires_at > NOW()
+RETURNING worker_id;
+
+-- name: DeleteExpiredWorkerOtps :exec
+DELETE FROM worker_otp WHERE expires_at <= NOW();
+
+-- name: ClaimWorkerSession :one
+INSERT INTO worker_session (worker_id, replica_id)
+VALUES ($1, $2)
+ON CONFLICT (worker_id) DO UPDATE
+SET replica_id = EXCLUDED.replica_id, connected_at = NOW(), heartbeat_at = NOW()
+WHERE worker_session.heartbeat_at < NOW() - sqlc.arg('stale_seconds')::int * INTERVAL '1 second'
+RETURNING worker_id;
+
+-- name: ReleaseWorkerSession :exec
+DELETE FROM worker_session WHERE worker_id = $1 AND replica_id = $2;
+
+-- name: ReleaseReplicaSessions :exec
+DELETE FROM worker_session WHERE replica_id = $1;
+
+-- name: SetWorkerSessionConfigVersion :exec
+UPDATE worker_session SET config_version = $3 WHERE worker_id = $1 AND replica_id = $2;
+
+-- name: HeartbeatWorkerSessions :exec
+UPDATE worker_session SET heartbeat_at = NOW() WHERE replica_id = $1;
+
+-- name: PublishClusterEvent :exec
+SELECT pg_notify(sqlc.arg('channel')::text, sqlc.arg('payload')::text);
@@ -18,9 +18,56 @@ INSERT INTO country(name,code,region_id)
 VALUES($1,$2,$3)
 RETURNING *;
 
--- name: DeleteCountry :exec
+-- name: DeleteCountry :many
 DELETE FROM country as c
-where c.name = $1;
+where c.name = $1
+RETURNING c.region_id;
+
+-- name: GetCountryByCode :one
+SELECT * FROM country
+WHERE code = $1;
+
+-- name: GetStatesByCountry :many
+SELECT * FROM state
+WHERE country_id = $1
+ORDER BY code;
+
+-- name: GetStateByCode :one
+SELECT * FROM state
+WHERE country_id = $1 AND code = $2;
+
+-- name: AddState :one
+INSERT INTO state(name,code,country_id)
+VALUES($1,$2,$3)
+RETURNING *;
+
+-- name: DeleteState :execrows
+DELETE FROM state
+WHERE country_id = $1 AND code = $2;
+
+-- name: GetCitiesByCountry :many
+SELECT ci.id, ci.name, ci.code, ci.country_id, ci.created_at, s.code AS state_code FROM city as ci
+left join state as s on ci.state_id = s.id
+WHERE ci.country_id = $1
+ORDER BY ci.code;
+
+-- name: GetCityByCode :one
+SELECT ci.id, ci.name, ci.code, ci.country_id, ci.created_at, s.code AS state_code FROM city as ci
+left join state as s on ci.state_id = s.id
+WHERE ci.country_id = $1 AND ci.code = $2;
+
+-- name: AddCity :one
+INSERT INTO city(name,code,country_id,state_id)
+VALUES($1,$2,$3,$4)
+RETURNING *;
+
+-- name: DeleteCity :execrows
+DELETE FROM city
+WHERE country_id = $1 AND code = $2;
+
+-- name: GetPoolIdsByRegion :many
+SELECT id FROM pool
+WHERE region_id = $1;
 
 -- name: GetUpstreams :many
 SELECT * FROM upstream;
@@ -35,8 +82,8 @@ DELETE FROM upstream as u
 where u.tag = $1;
 
 -- name: InsetPool :one
-INSERT INTO pool(tag,region_id,subdomain,port)
-VALUES($1,$2,$3,$4)
+INSERT INTO pool(tag,region_id,subdomain,port,resolve_locally)
+VALUES($1,$2,$3,$4,$5)
 RETURNING *;
 
 -- name: InsertPoolUpstreamWeight :many
@@ -51,6 +98,7 @@ SELECT
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.tag AS upstream_tag,
     u.config_format AS config_format,
     u.username AS username,
@@ -67,6 +115,7 @@ SELECT
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.tag AS upstream_tag,
     u.config_format AS config_format,
     u.username AS username,
@@ -84,6 +133,7 @@ SET
     region_id = COALESCE(sqlc.narg('region_id'), region_id),
     subdomain = COALESCE(sqlc.narg('subdomain'), subdomain),
     port = COALESCE(sqlc.narg('port'), port),
+    resolve_locally = COALESCE(sqlc.narg('resolve_locally'), resolve_locally),
     updated_at = NOW()
 WHERE tag = $1
 RETURNING *;
@@ -99,9 +149,24 @@ VALUES (
     (SELECT u.id FROM upstream u WHERE u.tag = $2),
     $3
 )
+ON CONFLICT (pool_id, upstream_id) DO UPDATE SET weight = EXCLUDED.weight
 RETURNING *;
 
 -- name: DeletePoolUpstreamWeight :execresult
 DELETE FROM pool_upstream_weight
 WHERE pool_id = (SELECT p.id FROM pool p WHERE p.tag = $1)
   AND upstream_id = (SELECT u.id FROM upstream u WHERE u.tag = $2);
+
+-- name: GetPoolUpstreamWeight :one
+SELECT puw.weight FROM pool_upstream_weight AS puw
+JOIN pool AS p ON puw.pool_id = p.id
+JOIN upstream AS u ON puw.upstream_id = u.id
+WHERE p.tag = $1 AND u.tag = $2;
+
+-- name: GetPoolByTag :one
+SELECT * FROM pool
+WHERE tag = $1;
+
+-- name: UpdateUpstreamCredentials :exec
+UPDATE upstream SET username = $2, password = $3
+WHERE id = $1;
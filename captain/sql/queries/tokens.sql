@@ -0,0 +1,19 @@
+-- name: CreateApiToken :one
+INSERT INTO api_token (name, token_hash, scopes, expires_at)
+VALUES (sqlc.arg('name'), sqlc.arg('token_hash'), sqlc.arg('scopes')::text[], sqlc.narg('expires_at'))
+RETURNING id, name, scopes, expires_at, revoked_at, created_at;
+
+-- name: GetApiTokenByHash :one
+SELECT id, name, scopes, expires_at, revoked_at, created_at
+FROM api_token
+WHERE token_hash = $1;
+
+-- name: GetApiTokens :many
+SELECT id, name, scopes, expires_at, revoked_at, created_at
+FROM api_token
+ORDER BY created_at DESC;
+
+-- name: RevokeApiToken :execrows
+UPDATE api_token
+SET revoked_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND revoked_at IS NULL;
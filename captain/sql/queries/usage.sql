@@ -0,0 +1,63 @@
+-- name: InsertUsageBatch :execrows
+INSERT INTO usage_batch (id)
+VALUES ($1)
+ON CONFLICT (id) DO NOTHING;
+
+-- name: ApplyUserPoolUsage :many
+UPDATE user_pools AS up
+SET data_usage = up.data_usage + v.bytes
+FROM (
+    SELECT
+        UNNEST(sqlc.arg('usernames')::text[]) AS username,
+        UNNEST(sqlc.arg('pool_ids')::uuid[]) AS pool_id,
+        UNNEST(sqlc.arg('bytes')::bigint[]) AS bytes
+) AS v
+JOIN "user" AS u ON u.username = v.username
+WHERE up.user_id = u.id AND up.pool_id = v.pool_id
+RETURNING u.username, up.pool_id, up.data_limit, up.data_usage, v.bytes::bigint AS added_bytes;
+
+-- name: DeleteUsageBatchesBefore :exec
+DELETE FROM usage_batch
+WHERE applied_at < $1;
+
+-- name: EnsureTelemetrySeqs :exec
+INSERT INTO worker_telemetry_seq (worker_id)
+SELECT w.id FROM worker AS w
+WHERE w.id = ANY(sqlc.arg('worker_ids')::uuid[])
+ON CONFLICT (worker_id) DO NOTHING;
+
+-- name: LockTelemetrySeqs :many
+SELECT worker_id, analytics_seq, usage_seq
+FROM worker_telemetry_seq
+WHERE worker_id = ANY(sqlc.arg('worker_ids')::uuid[])
+ORDER BY worker_id
+FOR UPDATE;
+
+-- name: AdvanceAnalyticsSeqs :exec
+UPDATE worker_telemetry_seq AS t
+SET analytics_seq = GREATEST(t.analytics_seq, v.seq), updated_at = NOW()
+FROM (
+    SELECT
+        UNNEST(sqlc.arg('worker_ids')::uuid[]) AS worker_id,
+        UNNEST(sqlc.arg('seqs')::bigint[]) AS seq
+) AS v
+WHERE t.worker_id = v.worker_id;
+
+-- name: AdvanceUsageSeqs :exec
+UPDATE worker_telemetry_seq AS t
+SET usage_seq = GREATEST(t.usage_seq, v.seq), updated_at = NOW()
+FROM (
+    SELECT
+        UNNEST(sqlc.arg('worker_ids')::uuid[]) AS worker_id,
+        UNNEST(sqlc.arg('seqs')::bigint[]) AS seq
+) AS v
+WHERE t.worker_id = v.worker_id;
+
+-- name: InsertUserDataDeadLetter :exec
+INSERT INTO user_data_dead_letter (rows, error)
+VALUES (CAST(sqlc.arg('rows')::text AS jsonb), sqlc.arg('error'));
+
+-- name: GetCommittedTelemetrySeq :one
+SELECT GREATEST(analytics_seq, usage_seq)::bigint AS seq
+FROM worker_telemetry_seq
+WHERE worker_id = $1;
@@ -1,6 +1,6 @@
 -- name: CreateUser :one
-INSERT INTO "user"(username,password)
-VALUES ($1,$2)
+INSERT INTO "user"(username,password,access_log_opt_out,max_connections,bandwidth_limit)
+VALUES ($1,$2,$3,$4,$5)
 RETURNING *;
 
 -- name: InsertUserIpwhitelist :one
@@ -21,6 +21,9 @@ SELECT
     u.status,
     u.created_at,
     u.updated_at,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
     COALESCE(ARRAY_AGG(DISTINCT p.tag) FILTER (WHERE p.tag IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
@@ -38,6 +41,9 @@ SELECT
     u.status,
     u.created_at,
     u.updated_at,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
     COALESCE(ARRAY_AGG(DISTINCT p.tag) FILTER (WHERE p.tag IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
@@ -50,16 +56,27 @@ GROUP BY u.id;
 UPDATE "user" 
 SET 
 status = COALESCE(sqlc.narg('status'),status),
+access_log_opt_out = COALESCE(sqlc.narg('access_log_opt_out'),access_log_opt_out),
+max_connections = COALESCE(sqlc.narg('max_connections'),max_connections),
+bandwidth_limit = COALESCE(sqlc.narg('bandwidth_limit'),bandwidth_limit),
 updated_at = CURRENT_TIMESTAMP
 WHERE id = $1
 RETURNING *;
 
+-- name: UpdateUserPassword :one
+UPDATE "user"
+SET
+password = sqlc.arg('password'),
+updated_at = CURRENT_TIMESTAMP
+WHERE id = sqlc.arg('id')
+RETURNING id, username, updated_at;
+
 -- name: DeleteUser :exec
 DELETE FROM "user"
 WHERE id = $1;
 
 -- name: GetDatausageById :many
-SELECT up.data_limit,up.data_usage,p.tag AS pool_tag 
+SELECT up.data_limit,up.data_usage,up.max_connections,up.bandwidth_limit,p.tag AS pool_tag 
 FROM user_pools AS up 
 INNER JOIN pool AS p ON up.pool_id = p.id
 WHERE up.user_id = $1;
@@ -76,21 +93,32 @@ WHERE u.id = $1
 group by u.id;
 
 -- name: AddUserPoolsByPoolTags :one
-WITH matching_pools AS (
-    SELECT id, tag
-    FROM pool 
-    WHERE tag = ANY(sqlc.arg('tags')::text[])
+WITH requested AS (
+    -- set-returning functions in one select list are zipped, so each tag
+    -- keeps the limits given at the same position
+    SELECT
+        UNNEST(sqlc.arg('tags')::text[]) AS tag,
+        UNNEST(sqlc.arg('data_limits')::BIGINT[]) AS data_limit,
+        UNNEST(sqlc.arg('max_connections')::INT[]) AS max_connections,
+        UNNEST(sqlc.arg('bandwidth_limits')::BIGINT[]) AS bandwidth_limit
+),
+matching_pools AS (
+    SELECT p.id, p.tag, r.data_limit, r.max_connections, r.bandwidth_limit
+    FROM pool AS p
+    JOIN requested AS r ON p.tag = r.tag
 ), 
 inserted_rows AS (
-    INSERT INTO user_pools (user_id, pool_id,data_limit)
-    SELECT $1, id,UNNEST(sqlc.arg('data_limits')::BIGINT[]) FROM matching_pools
+    INSERT INTO user_pools (user_id, pool_id,data_limit,max_connections,bandwidth_limit)
+    SELECT $1, id,data_limit,max_connections,bandwidth_limit FROM matching_pools
     ON CONFLICT (user_id, pool_id) DO NOTHING
-    RETURNING pool_id, user_id,data_limit
+    RETURNING pool_id, user_id,data_limit,max_connections,bandwidth_limit
 )
 SELECT 
     i.user_id, 
     COALESCE(ARRAY_AGG(p.tag), '{}')::TEXT[] AS inserted_tags,
-    COALESCE(ARRAY_AGG(i.data_limit), '{}')::BIGINT[] AS inserted_data_limits
+    COALESCE(ARRAY_AGG(i.data_limit), '{}')::BIGINT[] AS inserted_data_limits,
+    COALESCE(ARRAY_AGG(i.max_connections), '{}')::INT[] AS inserted_max_connections,
+    COALESCE(ARRAY_AGG(i.bandwidth_limit), '{}')::BIGINT[] AS inserted_bandwidth_limits
 FROM inserted_rows i
 JOIN matching_pools p ON i.pool_id = p.id
 GROUP BY i.user_id;
@@ -127,8 +155,11 @@ SELECT
     u.username,
     u.password,
     u.status,
+    u.access_log_opt_out,
+    u.max_connections,
+    u.bandwidth_limit,
     COALESCE(ARRAY_AGG(DISTINCT iw.ip_cidr) FILTER (WHERE iw.ip_cidr IS NOT NULL), '{}')::text[] AS ip_whitelist,
-    COALESCE(ARRAY_AGG(DISTINCT (p.tag || ':' || up.data_limit || ':' ||up.data_usage)) FILTER (WHERE p.tag IS NOT NULL AND up.data_limit IS NOT NULL), '{}')::text[] AS pools
+    COALESCE(ARRAY_AGG(DISTINCT (p.tag || ':' || up.data_limit || ':' ||up.data_usage || ':' || up.max_connections || ':' || up.bandwidth_limit)) FILTER (WHERE p.tag IS NOT NULL AND up.data_limit IS NOT NULL), '{}')::text[] AS pools
 FROM "user" AS u
 LEFT JOIN user_ip_whitelist AS iw ON u.id = iw.user_id
 LEFT JOIN user_pools AS up ON u.id = up.user_id
@@ -136,12 +167,26 @@ LEFT JOIN pool AS p ON up.pool_id = p.id
 WHERE u.username = $1
 GROUP BY u.id;
 
+-- name: GetUsernamesByIp :many
+SELECT DISTINCT u.username
+FROM "user" AS u
+JOIN user_ip_whitelist AS iw ON u.id = iw.user_id
+WHERE CAST(sqlc.arg('ip')::text AS inet) <<= iw.ip_cidr::inet;
+
 -- name: GenerateproxyString :one
-SELECT p.tag,p.subdomain,p.port,u.username,u.password FROM pool as p
+-- the pool's highest weighted upstream decides the proxy string syntax
+SELECT p.tag,p.subdomain,p.port,u.username,u.password,us.upstream_provider,us.config_format FROM pool as p
 join region as r on p.region_id = r.id
 join country as c on r.id = c.region_id
 join user_pools as up on p.id = up.pool_id
 join "user" as u on up.user_id = u.id
+join lateral (
+    SELECT ups.upstream_provider, ups.config_format FROM pool_upstream_weight as puw
+    join upstream as ups on puw.upstream_id = ups.id
+    where puw.pool_id = p.id
+    ORDER BY puw.weight DESC, ups.tag
+    LIMIT 1
+) as us on true
 where c.code = $1 AND p.tag LIKE $2 AND up.user_id = $3 ;
 
 
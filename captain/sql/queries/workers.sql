@@ -1,6 +1,6 @@
 -- name: CreateWorker :one
-INSERT INTO worker (id,region_id,name,ip_address, port, pool_id)
-VALUES ($1,(SELECT id from region where region.name = sqlc.arg('region_name')), $2, $3, $4,$5)
+INSERT INTO worker (id,region_id,name,ip_address, port, pool_id, secret_hash, secret_rotated_at)
+VALUES ($1,(SELECT id from region where region.name = sqlc.arg('region_name')), $2, $3, $4,$5,$6,NOW())
 RETURNING *;
 
 -- name: GetAllWorkers :many
@@ -14,11 +14,13 @@ SELECT
     w.port,
     w.pool_id,
     r.name AS region_name,
-    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains
+    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains,
+    COALESCE(ws.replica_id, '')::text AS replica_id
 FROM worker w
 JOIN region r ON w.region_id = r.id
 LEFT JOIN worker_domains wd ON w.id = wd.worker_id
-GROUP BY w.id, r.name;
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
+GROUP BY w.id, r.name, ws.replica_id;
 
 -- name: GetWorkerByName :one
 SELECT 
@@ -31,12 +33,14 @@ SELECT
     w.port,
     w.pool_id,
     r.name AS region_name,
-    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains
+    COALESCE(array_agg(wd.domain) FILTER (WHERE wd.domain IS NOT NULL), '{}')::text[] AS domains,
+    COALESCE(ws.replica_id, '')::text AS replica_id
 FROM worker w
 JOIN region r ON w.region_id = r.id
 LEFT JOIN worker_domains wd ON w.id = wd.worker_id
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
 WHERE w.name = $1
-GROUP BY w.id, r.name;
+GROUP BY w.id, r.name, ws.replica_id;
 
 -- name: DeleteWorkerByName :execresult
 DELETE FROM worker WHERE name = $1;
@@ -51,7 +55,7 @@ DELETE FROM worker_domains
 WHERE worker_id = (SELECT id FROM worker WHERE name = $1) AND domain = ANY($2::TEXT[]);
 
 -- name: GetWorkerById :one
-SELECT w.id,w.name,w.pool_id FROM worker w
+SELECT w.id,w.name,w.pool_id,w.status,w.secret_hash FROM worker w
 WHERE w.id = $1;
 
 -- name: GetWorkerPoolConfig :many
@@ -62,6 +66,7 @@ SELECT
     p.tag AS pool_tag,
     p.subdomain AS pool_subdomain,
     p.port AS pool_port,
+    p.resolve_locally AS resolve_locally,
     u.id AS upstream_id,
     u.tag AS upstream_tag,
     u.domain AS upstream_address,
@@ -78,5 +83,45 @@ JOIN upstream u ON puw.upstream_id = u.id
 join region r on r.id = w.region_id
 WHERE w.id = $1;
 
+-- name: GetPoolTargetingCatalog :many
+-- every country of the pool's region with its states and cities, one row per
+-- country, state or city
+SELECT c.code AS country_code, s.code AS state_code, NULL::text AS city_code FROM pool p
+join country c on c.region_id = p.region_id
+left join state s on s.country_id = c.id
+WHERE p.id = $1
+UNION ALL
+SELECT c.code AS country_code, s.code AS state_code, ci.code AS city_code FROM pool p
+join country c on c.region_id = p.region_id
+join city ci on ci.country_id = c.id
+left join state s on ci.state_id = s.id
+WHERE p.id = $1;
+
 -- name: UpdateWorkerLastSeen :exec
 UPDATE worker SET last_seen = NOW() WHERE id = $1;
+
+-- name: UpdateWorkerSecret :one
+UPDATE worker SET secret_hash = $2, secret_rotated_at = NOW()
+WHERE name = $1
+RETURNING id, name, secret_rotated_at;
+
+-- name: RevokeWorkerSecret :one
+UPDATE worker SET secret_hash = NULL, secret_rotated_at = NOW()
+WHERE name = $1
+RETURNING id, name, secret_rotated_at;
+
+-- name: GetWorkerStatuses :many
+SELECT
+    w.id,
+    w.name,
+    w.status,
+    w.last_seen,
+    w.pool_id,
+    r.name AS region_name,
+    COALESCE(ws.replica_id, '')::text AS replica_id,
+    ws.connected_at,
+    COALESCE(ws.config_version, '')::text AS config_version
+FROM worker w
+JOIN region r ON w.region_id = r.id
+LEFT JOIN worker_session ws ON w.id = ws.worker_id
+ORDER BY w.name;
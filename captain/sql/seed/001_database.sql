@@ -17,13 +17,35 @@ CREATE TABLE country (
     created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE state (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    country_id UUID NOT NULL REFERENCES country(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(country_id, code)
+);
+
+CREATE TABLE city (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    country_id UUID NOT NULL REFERENCES country(id) ON DELETE CASCADE,
+    state_id UUID REFERENCES state(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(country_id, code)
+);
+
 CREATE TABLE "user" (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     username TEXT UNIQUE NOT NULL,
     password TEXT NOT NULL,
     status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'suspended', 'deleted')),
     created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    access_log_opt_out BOOLEAN NOT NULL DEFAULT FALSE,
+    max_connections INT NOT NULL DEFAULT 50 CHECK (max_connections >= 0),
+    bandwidth_limit BIGINT NOT NULL DEFAULT 0 CHECK (bandwidth_limit >= 0)
 );
 
 CREATE TABLE user_ip_whitelist (
@@ -42,7 +64,8 @@ CREATE TABLE pool (
     subdomain TEXT NOT NULL,
     port INT NOT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolve_locally BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE user_pools (
@@ -51,6 +74,8 @@ CREATE TABLE user_pools (
     user_id UUID NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
     data_limit BIGINT NOT NULL DEFAULT 0,
     data_usage BIGINT NOT NULL DEFAULT 0,
+    max_connections INT NOT NULL DEFAULT 0 CHECK (max_connections >= 0),
+    bandwidth_limit BIGINT NOT NULL DEFAULT 0 CHECK (bandwidth_limit >= 0),
     UNIQUE(pool_id, user_id)
 );
 
@@ -82,6 +107,8 @@ CREATE TABLE worker (
     port INT NOT NULL,
     status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'suspended', 'deleted')),
     pool_id UUID NOT NULL REFERENCES pool(id) ON DELETE CASCADE, 
+    secret_hash TEXT,
+    secret_rotated_at TIMESTAMPTZ,
     last_seen TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
     created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
@@ -93,3 +120,75 @@ CREATE TABLE worker_domains (
     UNIQUE(worker_id, domain)
 );
 
+
+CREATE TABLE usage_batch (
+    id UUID PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE api_token (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_token_id UUID,
+    actor_name TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    route TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    entity_type TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX audit_log_entity_idx ON audit_log (entity_type, entity_id);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+BEFORE UPDATE OR DELETE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE worker_otp (
+    key TEXT PRIMARY KEY,
+    worker_id UUID NOT NULL REFERENCES worker(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX worker_otp_expires_at_idx ON worker_otp (expires_at);
+
+CREATE TABLE worker_session (
+    worker_id UUID PRIMARY KEY REFERENCES worker(id) ON DELETE CASCADE,
+    replica_id TEXT NOT NULL,
+    connected_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    config_version TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE worker_telemetry_seq (
+    worker_id UUID PRIMARY KEY REFERENCES worker(id) ON DELETE CASCADE,
+    analytics_seq BIGINT NOT NULL DEFAULT 0,
+    usage_seq BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_data_dead_letter (
+    id BIGSERIAL PRIMARY KEY,
+    rows JSONB NOT NULL,
+    error TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
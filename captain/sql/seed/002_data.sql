@@ -39,9 +39,9 @@ INSERT INTO country (name, code, region_id) VALUES
 -- 4. Users
 ----------------------------------------------------------
 INSERT INTO "user" (username, password, status) VALUES
-('gr74gtr4', '82k51ebu', 'active'),
-('345rw3r5', 'alom2rkt', 'active'),
-('fgn9i8wd', '1670omer', 'active');
+('gr74gtr4', crypt('82k51ebu', gen_salt('bf', 10)), 'active'),
+('345rw3r5', crypt('alom2rkt', gen_salt('bf', 10)), 'active'),
+('fgn9i8wd', crypt('1670omer', gen_salt('bf', 10)), 'active');
 
 ----------------------------------------------------------
 -- 5. IP Whitelist
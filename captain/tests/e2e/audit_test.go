@@ -0,0 +1,52 @@
+package e2e
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
+)
+
+func TestE2E_AuditLog_UserSuspension(t *testing.T) {
+	client := GetAdminClient()
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + created.Id.String(),
+		Body:   models.UpdateUserRequest{Status: helpers.Ptr("suspended")},
+	}).RequireStatus(t, http.StatusOK)
+
+	resp := client.Get(t, "/admin/audit/?entity_type=user&entity_id="+created.Id.String())
+	resp.RequireStatus(t, http.StatusOK)
+	var entries []models.AuditLogResponce
+	resp.ParseJSON(t, &entries)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "update", entries[0].Action)
+	assert.Equal(t, "create", entries[1].Action)
+	assert.NotEmpty(t, entries[0].RequestId)
+	assert.Contains(t, entries[0].Route, "PATCH /admin/users/")
+
+	var before, after models.GetUserByIdResponce
+	require.NoError(t, json.Unmarshal(entries[0].Before, &before))
+	require.NoError(t, json.Unmarshal(entries[0].After, &after))
+	assert.Equal(t, "active", before.Status)
+	assert.Equal(t, "suspended", after.Status)
+}
+
+func TestE2E_AuditLog_ScopeAndFilters(t *testing.T) {
+	token := createTestToken(t, "auditor", []string{models.ScopeUsersRead})
+	helpers.NewAdminClient(testServer.URL, token.Token).Get(t, "/admin/audit/").AssertStatus(t, http.StatusForbidden)
+
+	client := GetAdminClient()
+	client.Get(t, "/admin/audit/?from=yesterday").AssertStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/audit/?from=2025-02-01&to=2025-01-01").AssertStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/audit/?limit=0").AssertStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/audit/?actor=root&limit=10").AssertStatus(t, http.StatusOK)
+}
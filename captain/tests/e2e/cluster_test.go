@@ -0,0 +1,97 @@
+package e2e
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
+	server "github.com/torchlabssoftware/subnetwork_system/internal/server"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	wsm "github.com/torchlabssoftware/subnetwork_system/internal/server/websocket"
+	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
+)
+
+// startReplica runs a second captain on the test database.
+func startReplica(t *testing.T) (*httptest.Server, *wsm.WebsocketManager) {
+	keyring, err := secrets.NewKeyring(UpstreamEncryptionKeys)
+	require.NoError(t, err)
+	manager := wsm.NewWebsocketManager()
+	replica := httptest.NewServer(server.NewRouter(GetTestDB(), nil, manager, keyring))
+	t.Cleanup(func() {
+		manager.Shutdown()
+		replica.Close()
+	})
+	return replica, manager
+}
+
+func TestE2E_Cluster_OtpAndFanOutAcrossReplicas(t *testing.T) {
+	replica, manager := startReplica(t)
+	adminClient := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, adminClient))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
+
+	// Log in on the first replica, open the websocket on the second.
+	loginResp := helpers.NewWorkerClient(GetTestServerURL(), created.Secret).Post(t, "/worker/ws/login", models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	})
+	loginResp.RequireStatus(t, http.StatusOK)
+	var login models.WorkerLoginResponce
+	loginResp.ParseJSON(t, &login)
+	wsURL := strings.Replace(replica.URL, "http://", "ws://", 1) + "/worker/ws/serve?otp=" + login.Otp
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	require.NoError(t, err, "OTP issued by one replica should be accepted by another")
+	defer conn.Close()
+	_, ok := waitForWorkerEvent(t, conn, "config", 5*time.Second)
+	require.True(t, ok, "worker should receive its config")
+
+	getResp := adminClient.Get(t, "/admin/worker/"+created.Name)
+	getResp.RequireStatus(t, http.StatusOK)
+	var worker models.AddWorkerResponse
+	getResp.ParseJSON(t, &worker)
+	assert.Equal(t, manager.ReplicaID, worker.Replica)
+
+	// A user change made through the first replica reaches the worker.
+	createResp := adminClient.Post(t, "/admin/users/", models.CreateUserRequest{})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var user models.CreateUserResponce
+	createResp.ParseJSON(t, &user)
+	adminClient.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + user.Id.String(),
+		Body:   models.UpdateUserRequest{Status: helpers.Ptr("suspended")},
+	}).RequireStatus(t, http.StatusOK)
+	_, ok = waitForWorkerEvent(t, conn, "user_change", 5*time.Second)
+	assert.True(t, ok, "user_change should fan out to workers on other replicas")
+}
+
+func TestE2E_Cluster_OtpIsSingleUse(t *testing.T) {
+	replica, _ := startReplica(t)
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, GetAdminClient()))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
+	loginResp := helpers.NewWorkerClient(GetTestServerURL(), created.Secret).Post(t, "/worker/ws/login", models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	})
+	loginResp.RequireStatus(t, http.StatusOK)
+	var login models.WorkerLoginResponce
+	loginResp.ParseJSON(t, &login)
+
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	conn, _, err := dialer.Dial(strings.Replace(GetTestServerURL(), "http://", "ws://", 1)+"/worker/ws/serve?otp="+login.Otp, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, resp, err := dialer.Dial(strings.Replace(replica.URL, "http://", "ws://", 1)+"/worker/ws/serve?otp="+login.Otp, nil)
+	require.Error(t, err, "a used OTP must not open a second session")
+	if resp != nil {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+}
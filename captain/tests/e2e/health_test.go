@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
 )
 
 func TestE2E_DatabaseConnection(t *testing.T) {
@@ -24,8 +26,25 @@ func TestE2E_AdminAuthentication(t *testing.T) {
 }
 
 func TestE2E_WorkerAuthentication(t *testing.T) {
-	client := GetWorkerClient()
+	client := helpers.NewWorkerClient(GetTestServerURL(), "")
 	resp := client.Post(t, "/worker/ws/login", map[string]interface{}{})
-	assert.NotEqual(t, http.StatusUnauthorized, resp.StatusCode,
-		"Worker API key should be valid. Got: %s", resp.String())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode,
+		"Worker login without a secret should be rejected. Got: %s", resp.String())
+}
+
+func TestE2E_Metrics(t *testing.T) {
+	// Make a request so there is a route to report latency for.
+	GetAdminClient().Get(t, "/admin/worker/")
+
+	helpers.NewAdminClient(GetTestServerURL(), "").Get(t, "/metrics").AssertStatus(t, http.StatusUnauthorized)
+	other := createTestToken(t, "dashboards", []string{models.ScopeUsersRead})
+	helpers.NewAdminClient(GetTestServerURL(), other.Token).Get(t, "/metrics").AssertStatus(t, http.StatusForbidden)
+
+	scraper := createTestToken(t, "prometheus", []string{models.ScopeMetricsRead})
+	resp := helpers.NewAdminClient(GetTestServerURL(), scraper.Token).Get(t, "/metrics")
+	resp.RequireStatus(t, http.StatusOK)
+	body := resp.String()
+	assert.Contains(t, body, `captain_http_request_duration_seconds_count{method="GET",route="/admin/worker/"`)
+	assert.Contains(t, body, "captain_websocket_connected_workers")
+	assert.Contains(t, body, "go_sql_open_connections")
 }
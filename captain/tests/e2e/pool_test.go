@@ -2,10 +2,12 @@ package e2e
 
 import (
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
 )
@@ -100,6 +102,79 @@ func TestE2E_GetCountries(t *testing.T) {
 	t.Logf("Found %d countries", len(countries))
 }
 
+func TestE2E_CountryCatalog(t *testing.T) {
+	client := GetAdminClient()
+	regionResp := client.Post(t, "/admin/pools/region", models.CreateRegionRequest{
+		Name: helpers.Ptr("Catalog Test Region " + uuid.New().String()[:8]),
+	})
+	regionResp.RequireStatus(t, http.StatusCreated)
+	var region models.CreateRegionResponce
+	regionResp.ParseJSON(t, &region)
+	countryCode := "C" + uuid.New().String()[:2]
+	client.Post(t, "/admin/pools/country", models.CreateCountryRequest{
+		Name:     helpers.Ptr("Catalog Country"),
+		Code:     helpers.Ptr(countryCode),
+		RegionId: helpers.Ptr(region.Id),
+	}).RequireStatus(t, http.StatusCreated)
+
+	client.Post(t, "/admin/pools/country/state", models.CreateStateRequest{
+		CountryCode: helpers.Ptr(countryCode),
+		Name:        helpers.Ptr("New York"),
+		Code:        helpers.Ptr("ny"),
+	}).RequireStatus(t, http.StatusCreated)
+	client.Post(t, "/admin/pools/country/city", models.CreateCityRequest{
+		CountryCode: helpers.Ptr(countryCode),
+		StateCode:   helpers.Ptr("ny"),
+		Name:        helpers.Ptr("New York City"),
+		Code:        helpers.Ptr("newyork"),
+	}).RequireStatus(t, http.StatusCreated)
+	client.Post(t, "/admin/pools/country/city", models.CreateCityRequest{
+		CountryCode: helpers.Ptr(countryCode),
+		Name:        helpers.Ptr("Capital"),
+		Code:        helpers.Ptr("capital"),
+	}).RequireStatus(t, http.StatusCreated)
+
+	resp := client.Get(t, "/admin/pools/country/"+countryCode)
+	resp.RequireStatus(t, http.StatusOK)
+	var catalog models.GetCountryCatalogResponce
+	resp.ParseJSON(t, &catalog)
+	require.Len(t, catalog.States, 1)
+	assert.Equal(t, "ny", catalog.States[0].Code)
+	require.Len(t, catalog.Cities, 2)
+	assert.Equal(t, "capital", catalog.Cities[0].Code)
+	assert.Empty(t, catalog.Cities[0].StateCode)
+	assert.Equal(t, "newyork", catalog.Cities[1].Code)
+	assert.Equal(t, "ny", catalog.Cities[1].StateCode)
+
+	// deleting a state takes its cities with it
+	client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodDelete,
+		Path:   "/admin/pools/country/state",
+		Body:   models.DeleteStateRequest{CountryCode: helpers.Ptr(countryCode), Code: helpers.Ptr("ny")},
+	}).RequireStatus(t, http.StatusOK)
+	resp = client.Get(t, "/admin/pools/country/"+countryCode)
+	resp.RequireStatus(t, http.StatusOK)
+	resp.ParseJSON(t, &catalog)
+	assert.Empty(t, catalog.States)
+	require.Len(t, catalog.Cities, 1)
+	assert.Equal(t, "capital", catalog.Cities[0].Code)
+}
+
+func TestE2E_CountryCatalog_Rejected(t *testing.T) {
+	client := GetAdminClient()
+	client.Post(t, "/admin/pools/country/state", models.CreateStateRequest{
+		CountryCode: helpers.Ptr("no-such-country"),
+		Name:        helpers.Ptr("State"),
+		Code:        helpers.Ptr("st"),
+	}).RequireStatus(t, http.StatusNotFound)
+	client.Post(t, "/admin/pools/country/city", models.CreateCityRequest{
+		CountryCode: helpers.Ptr("US"),
+		Name:        helpers.Ptr("Bad City"),
+		Code:        helpers.Ptr("bad-city"),
+	}).RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/pools/country/no-such-country").RequireStatus(t, http.StatusNotFound)
+}
+
 // Upstream Tests
 
 func TestE2E_CreateUpstream(t *testing.T) {
@@ -108,7 +183,7 @@ func TestE2E_CreateUpstream(t *testing.T) {
 	reqBody := models.CreateUpstreamRequest{
 		Tag:              helpers.Ptr(upstreamTag),
 		UpstreamProvider: helpers.Ptr("test-provider"),
-		ConfigFormat:     helpers.Ptr("user:pass@host:port"),
+		ConfigFormat:     helpers.Ptr("{{.Username}}-country-{{.Country}}:{{.Password}}"),
 		Username:         helpers.Ptr("testuser"),
 		Password:         helpers.Ptr("testpass"),
 		Port:             helpers.Ptr(8080),
@@ -125,12 +200,56 @@ func TestE2E_CreateUpstream(t *testing.T) {
 	t.Logf("Created upstream: ID=%s, Tag=%s", result.Id, result.Tag)
 }
 
+func TestE2E_CreateUpstream_EncryptsCredentials(t *testing.T) {
+	client := GetAdminClient()
+	upstreamTag := "secret-upstream-" + uuid.New().String()[:8]
+	reqBody := models.CreateUpstreamRequest{
+		Tag:              helpers.Ptr(upstreamTag),
+		UpstreamProvider: helpers.Ptr("test-provider"),
+		ConfigFormat:     helpers.Ptr("{{.Username}}-country-{{.Country}}:{{.Password}}"),
+		Username:         helpers.Ptr("provider-user"),
+		Password:         helpers.Ptr("provider-pass"),
+		Port:             helpers.Ptr(8080),
+		Domain:           helpers.Ptr("proxy.test.com"),
+	}
+	resp := client.Post(t, "/admin/pools/upstream", reqBody)
+	resp.RequireStatus(t, http.StatusCreated)
+	var result models.CreateUpstreamResponce
+	resp.ParseJSON(t, &result)
+	assert.NotEqual(t, "provider-pass", result.Password)
+	assert.NotContains(t, resp.String(), "provider-pass")
+
+	var username, password string
+	err := GetTestDB().QueryRow("SELECT username, password FROM upstream WHERE tag = $1", upstreamTag).Scan(&username, &password)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(username, "enc:v1:"), "username should be encrypted at rest")
+	assert.True(t, strings.HasPrefix(password, "enc:v1:"), "password should be encrypted at rest")
+	assert.NotContains(t, password, "provider-pass")
+}
+
+func TestE2E_CreateUpstream_RejectsUnknownProvider(t *testing.T) {
+	client := GetAdminClient()
+	for _, format := range []string{"user:pass@host:port", "{{.Username}}-{{.Region}}:{{.Password}}"} {
+		reqBody := models.CreateUpstreamRequest{
+			Tag:              helpers.Ptr("unknown-upstream-" + uuid.New().String()[:8]),
+			UpstreamProvider: helpers.Ptr("unknown-provider"),
+			ConfigFormat:     helpers.Ptr(format),
+			Username:         helpers.Ptr("user"),
+			Password:         helpers.Ptr("pass"),
+			Port:             helpers.Ptr(8080),
+			Domain:           helpers.Ptr("proxy.test.com"),
+		}
+		resp := client.Post(t, "/admin/pools/upstream", reqBody)
+		resp.RequireStatus(t, http.StatusBadRequest)
+	}
+}
+
 func TestE2E_GetUpstreams(t *testing.T) {
 	client := GetAdminClient()
 	upstreamTag := "list-upstream-" + uuid.New().String()[:8]
 	createReq := models.CreateUpstreamRequest{
 		Tag:              helpers.Ptr(upstreamTag),
-		UpstreamProvider: helpers.Ptr("provider"),
+		UpstreamProvider: helpers.Ptr("geonode"),
 		ConfigFormat:     helpers.Ptr("format"),
 		Username:         helpers.Ptr("user"),
 		Password:         helpers.Ptr("pass"),
@@ -151,7 +270,7 @@ func TestE2E_DeleteUpstream(t *testing.T) {
 	upstreamTag := "delete-upstream-" + uuid.New().String()[:8]
 	createReq := models.CreateUpstreamRequest{
 		Tag:              helpers.Ptr(upstreamTag),
-		UpstreamProvider: helpers.Ptr("provider"),
+		UpstreamProvider: helpers.Ptr("geonode"),
 		ConfigFormat:     helpers.Ptr("format"),
 		Username:         helpers.Ptr("user"),
 		Password:         helpers.Ptr("pass"),
@@ -264,6 +383,46 @@ func TestE2E_UpdatePool(t *testing.T) {
 	assert.Equal(t, int32(8888), updated.Port)
 }
 
+func TestE2E_PoolResolveLocally(t *testing.T) {
+	client := GetAdminClient()
+	regionName := "Resolve Pool Region " + uuid.New().String()[:8]
+	regionReq := models.CreateRegionRequest{
+		Name: helpers.Ptr(regionName),
+	}
+	regionResp := client.Post(t, "/admin/pools/region", regionReq)
+	regionResp.RequireStatus(t, http.StatusCreated)
+	var region models.CreateRegionResponce
+	regionResp.ParseJSON(t, &region)
+	poolTag := "resolve-pool-" + uuid.New().String()[:8]
+	createReq := models.CreatePoolRequest{
+		Tag:       helpers.Ptr(poolTag),
+		RegionId:  helpers.Ptr(region.Id),
+		Subdomain: helpers.Ptr("resolve"),
+		Port:      helpers.Ptr(int32(7778)),
+	}
+	createResp := client.Post(t, "/admin/pools/", createReq)
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreatePoolResponce
+	createResp.ParseJSON(t, &created)
+	assert.False(t, created.ResolveLocally, "pools should pass domains to the upstream by default")
+
+	updateReq := models.UpdatePoolRequest{
+		ResolveLocally: helpers.Ptr(true),
+	}
+	resp := client.Put(t, "/admin/pools/"+poolTag, updateReq)
+	resp.RequireStatus(t, http.StatusOK)
+	var updated models.CreatePoolResponce
+	resp.ParseJSON(t, &updated)
+	assert.True(t, updated.ResolveLocally)
+	assert.Equal(t, "resolve", updated.Subdomain)
+
+	getResp := client.Get(t, "/admin/pools/"+poolTag)
+	getResp.RequireStatus(t, http.StatusOK)
+	var pool models.GetPoolsResponse
+	getResp.ParseJSON(t, &pool)
+	assert.True(t, pool.ResolveLocally)
+}
+
 func TestE2E_DeletePool(t *testing.T) {
 	client := GetAdminClient()
 	regionName := "Delete Pool Region " + uuid.New().String()[:8]
@@ -311,7 +470,7 @@ func TestE2E_UpstreamPoolWeightWorkflow(t *testing.T) {
 	upstreamTag := "weight-upstream-" + uuid.New().String()[:8]
 	upstreamReq := models.CreateUpstreamRequest{
 		Tag:              helpers.Ptr(upstreamTag),
-		UpstreamProvider: helpers.Ptr("provider"),
+		UpstreamProvider: helpers.Ptr("geonode"),
 		ConfigFormat:     helpers.Ptr("format"),
 		Username:         helpers.Ptr("user"),
 		Password:         helpers.Ptr("pass"),
@@ -328,6 +487,13 @@ func TestE2E_UpstreamPoolWeightWorkflow(t *testing.T) {
 	resp := client.Post(t, "/admin/pools/weight", addWeightReq)
 	resp.RequireStatus(t, http.StatusCreated)
 	t.Logf("Added upstream %s to pool %s with weight", upstreamTag, poolTag)
+	addWeightReq.Weight = helpers.Ptr(int32(0))
+	drainResp := client.Post(t, "/admin/pools/weight", addWeightReq)
+	drainResp.RequireStatus(t, http.StatusCreated)
+	t.Logf("Drained upstream %s in pool %s", upstreamTag, poolTag)
+	addWeightReq.Weight = helpers.Ptr(int32(-1))
+	invalidResp := client.Post(t, "/admin/pools/weight", addWeightReq)
+	invalidResp.AssertStatus(t, http.StatusBadRequest)
 	getPoolResp := client.DoRequest(t, helpers.RequestOptions{
 		Method: http.MethodDelete,
 		Path:   "/admin/pools/weight",
@@ -14,6 +14,7 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/joho/godotenv"
 	"github.com/torchlabssoftware/subnetwork_system/internal/config"
+	"github.com/torchlabssoftware/subnetwork_system/internal/secrets"
 	server "github.com/torchlabssoftware/subnetwork_system/internal/server"
 	websocket "github.com/torchlabssoftware/subnetwork_system/internal/server/websocket"
 	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
@@ -21,17 +22,16 @@ import (
 
 // Test configuration
 var (
-	testServer         *httptest.Server
-	adminClient        *helpers.TestClient
-	workerClient       *helpers.TestClient
-	testDB             *sql.DB
-	AdminAPIKey        string
-	WorkerAPIKey       string
-	PostgresURL        string
-	ClickHouseURL      string
-	ClickHouseDB       string
-	ClickHouseUser     string
-	ClickHousePassword string
+	testServer             *httptest.Server
+	adminClient            *helpers.TestClient
+	testDB                 *sql.DB
+	AdminAPIKey            string
+	PostgresURL            string
+	ClickHouseURL          string
+	ClickHouseDB           string
+	ClickHouseUser         string
+	ClickHousePassword     string
+	UpstreamEncryptionKeys string
 )
 
 func TestMain(m *testing.M) {
@@ -46,12 +46,12 @@ func TestMain(m *testing.M) {
 	}
 	envConfig := config.Load()
 	AdminAPIKey = envConfig.Admin_API_KEY
-	WorkerAPIKey = envConfig.Worker_API_KEY
 	PostgresURL = envConfig.POSTGRES_URL
 	ClickHouseURL = envConfig.CLICKHOUSE_URL
 	ClickHouseDB = envConfig.CLICKHOUSE_DB
 	ClickHouseUser = envConfig.CLICKHOUSE_USER
 	ClickHousePassword = envConfig.CLICKHOUSE_PASSWORD
+	UpstreamEncryptionKeys = envConfig.UPSTREAM_ENCRYPTION_KEYS
 	if err := setup(); err != nil {
 		log.Fatalf("Failed to setup test environment: %v", err)
 	}
@@ -101,12 +101,15 @@ func setup() error {
 	}
 	//create router and server
 	wsManager := websocket.NewWebsocketManager()
-	router := server.NewRouter(testDB, clickhouseConn, wsManager)
+	keyring, err := secrets.NewKeyring(UpstreamEncryptionKeys)
+	if err != nil {
+		return err
+	}
+	router := server.NewRouter(testDB, clickhouseConn, wsManager, keyring)
 	testServer = httptest.NewServer(router)
 	log.Printf("[E2E] Test server started at: %s", testServer.URL)
-	//create admin and worker client
+	//create admin client; workers authenticate with their own secrets
 	adminClient = helpers.NewAdminClient(testServer.URL, AdminAPIKey)
-	workerClient = helpers.NewWorkerClient(testServer.URL, WorkerAPIKey)
 	return nil
 }
 
@@ -124,10 +127,6 @@ func GetAdminClient() *helpers.TestClient {
 	return adminClient
 }
 
-func GetWorkerClient() *helpers.TestClient {
-	return workerClient
-}
-
 func GetTestDB() *sql.DB {
 	return testDB
 }
@@ -1,10 +1,14 @@
 package e2e
 
 import (
+	"encoding/json"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
 )
@@ -18,9 +22,16 @@ func TestE2E_GetUserUsage(t *testing.T) {
 	createResp.RequireStatus(t, http.StatusCreated)
 	var user models.CreateUserResponce
 	createResp.ParseJSON(t, &user)
-	resp := client.Get(t, "/admin/analytics/user/"+user.Id.String()+"/usage?from=2024-01-01&to=2025-12-31")
-	resp.RequireStatus(t, http.StatusOK)
-	t.Logf("User usage response: %s", resp.String())
+	for _, granularity := range []string{"hour", "day", "month"} {
+		resp := client.Get(t, "/admin/analytics/user/"+user.Id.String()+"/usage?from=2025-12-01&to=2025-12-31&granularity="+granularity)
+		resp.RequireStatus(t, http.StatusOK)
+		var usage models.UserUsageResponce
+		resp.ParseJSON(t, &usage)
+		assert.Equal(t, user.Id, usage.UserID)
+		assert.Equal(t, granularity, usage.Granularity)
+		assert.NotNil(t, usage.Buckets)
+		assert.NotNil(t, usage.Pools)
+	}
 }
 
 func TestE2E_GetWorkerHealth(t *testing.T) {
@@ -61,6 +72,244 @@ func TestE2E_GetUserUsage_InvalidDates(t *testing.T) {
 	createResp.RequireStatus(t, http.StatusCreated)
 	var user models.CreateUserResponce
 	createResp.ParseJSON(t, &user)
-	resp := client.Get(t, "/admin/analytics/user/"+user.Id.String()+"/usage?from=invalid&to=also-invalid")
+	base := "/admin/analytics/user/" + user.Id.String() + "/usage"
+	client.Get(t, base+"?from=invalid&to=also-invalid").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, base+"?from=2025-02-01&to=2025-01-01").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, base+"?from=2024-01-01&to=2025-12-31&granularity=hour").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, base+"?granularity=week").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/analytics/user/not-a-uuid/usage").RequireStatus(t, http.StatusBadRequest)
+}
+
+func TestE2E_TelemetryUsage_AppliesDataUsageAndNotifies(t *testing.T) {
+	client := GetAdminClient()
+	poolId := createTestPoolForWorker(t, client)
+	poolUUID, _ := uuid.Parse(poolId)
+	var poolTag string
+	err := GetTestDB().QueryRow("SELECT tag FROM pool WHERE id = $1", poolUUID).Scan(&poolTag)
+	require.NoError(t, err)
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{
+		AllowPools: helpers.Ptr([]models.PoolDataStat{{Pool: poolTag, DataLimit: 1000}}),
+	})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var user models.CreateUserResponce
+	createResp.ParseJSON(t, &user)
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	usage := models.UserDataUsage{
+		Username:      user.Username,
+		PoolID:        poolUUID,
+		BytesSent:     400,
+		BytesReceived: 800,
+		Protocol:      "HTTP",
+	}
+	err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "payload": usage})
+	require.NoError(t, err)
+	payload, ok := waitForWorkerEvent(t, conn, "user_change", 20*time.Second)
+	require.True(t, ok, "Should notify workers when the user crosses the data limit")
+	assert.Contains(t, string(payload), user.Username)
+	resp := client.Get(t, "/admin/users/"+user.Id.String()+"/data-usage")
 	resp.RequireStatus(t, http.StatusOK)
+	var dataUsage []models.GetDatausageReponce
+	resp.ParseJSON(t, &dataUsage)
+	require.Len(t, dataUsage, 1)
+	assert.Equal(t, int64(1200), dataUsage[0].DataUsage)
+}
+
+func TestE2E_TelemetryUsage_AckedAfterCommit(t *testing.T) {
+	client := GetAdminClient()
+	poolId := createTestPoolForWorker(t, client)
+	poolUUID, _ := uuid.Parse(poolId)
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	usage := models.UserDataUsage{
+		Username:      "acked-user",
+		PoolID:        poolUUID,
+		BytesSent:     10,
+		BytesReceived: 20,
+		Protocol:      "HTTP",
+	}
+	waitForAck := func(want uint64) {
+		payload, ok := waitForWorkerEvent(t, conn, "ack", 20*time.Second)
+		require.True(t, ok, "Should ack telemetry once the batch is committed")
+		var ack struct {
+			Success bool   `json:"success"`
+			Payload uint64 `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &ack))
+		assert.True(t, ack.Success)
+		assert.Equal(t, want, ack.Payload)
+	}
+
+	err := conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "seq": 1, "payload": usage})
+	require.NoError(t, err)
+	waitForAck(1)
+
+	// A replay of an accepted event is skipped; the next ack covers seq 2.
+	err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "seq": 1, "payload": usage})
+	require.NoError(t, err)
+	err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "seq": 2, "payload": usage})
+	require.NoError(t, err)
+	waitForAck(2)
+}
+
+func TestE2E_TelemetryUsage_ReplayAfterReconnectCountedOnce(t *testing.T) {
+	client := GetAdminClient()
+	poolId := createTestPoolForWorker(t, client)
+	poolUUID, _ := uuid.Parse(poolId)
+	var poolTag string
+	err := GetTestDB().QueryRow("SELECT tag FROM pool WHERE id = $1", poolUUID).Scan(&poolTag)
+	require.NoError(t, err)
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{
+		AllowPools: helpers.Ptr([]models.PoolDataStat{{Pool: poolTag, DataLimit: 100000}}),
+	})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var user models.CreateUserResponce
+	createResp.ParseJSON(t, &user)
+	usage := models.UserDataUsage{
+		Username:  user.Username,
+		PoolID:    poolUUID,
+		BytesSent: 100,
+		Protocol:  "HTTP",
+	}
+
+	// the worker drops off before seq 1 is committed and replays it
+	worker := createTestWorker(t, poolUUID)
+	conn := dialTestWorker(t, worker)
+	err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "seq": 1, "payload": usage})
+	require.NoError(t, err)
+	conn.Close()
+	time.Sleep(time.Second)
+	conn = dialTestWorker(t, worker)
+	defer conn.Close()
+	for _, seq := range []int{1, 2} {
+		err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage", "seq": seq, "payload": usage})
+		require.NoError(t, err)
+	}
+	for {
+		payload, ok := waitForWorkerEvent(t, conn, "ack", 30*time.Second)
+		require.True(t, ok, "Should ack the replayed telemetry")
+		var ack struct {
+			Payload uint64 `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &ack))
+		if ack.Payload == 2 {
+			break
+		}
+	}
+
+	resp := client.Get(t, "/admin/users/"+user.Id.String()+"/data-usage")
+	resp.RequireStatus(t, http.StatusOK)
+	var dataUsage []models.GetDatausageReponce
+	resp.ParseJSON(t, &dataUsage)
+	require.Len(t, dataUsage, 1)
+	assert.Equal(t, int64(200), dataUsage[0].DataUsage, "The replay of seq 1 should only be counted once")
+}
+
+func TestE2E_TelemetryUsageBatch_AppliesDataUsage(t *testing.T) {
+	client := GetAdminClient()
+	poolId := createTestPoolForWorker(t, client)
+	poolUUID, _ := uuid.Parse(poolId)
+	var poolTag string
+	err := GetTestDB().QueryRow("SELECT tag FROM pool WHERE id = $1", poolUUID).Scan(&poolTag)
+	require.NoError(t, err)
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{
+		AllowPools: helpers.Ptr([]models.PoolDataStat{{Pool: poolTag, DataLimit: 100000}}),
+	})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var user models.CreateUserResponce
+	createResp.ParseJSON(t, &user)
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	batch := models.UserDataUsageBatch{
+		WindowStart: time.Now().Add(-10 * time.Second),
+		WindowEnd:   time.Now(),
+		Entries: []models.UserDataUsageBatchEntry{
+			{UserID: user.Id, Username: user.Username, PoolID: poolUUID, DestinationHost: "example.com", Protocol: "HTTPS", BytesSent: 100, BytesReceived: 200, Requests: 3},
+			{Username: user.Username, PoolID: poolUUID, DestinationHost: "example.org", Protocol: "HTTP", BytesSent: 50, BytesReceived: 150, Requests: 1},
+		},
+	}
+	err = conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage_batch", "seq": 1, "payload": batch})
+	require.NoError(t, err)
+	_, ok := waitForWorkerEvent(t, conn, "ack", 20*time.Second)
+	require.True(t, ok, "Should ack the batch once it is committed")
+	require.Eventually(t, func() bool {
+		resp := client.Get(t, "/admin/users/"+user.Id.String()+"/data-usage")
+		var dataUsage []models.GetDatausageReponce
+		resp.ParseJSON(t, &dataUsage)
+		return len(dataUsage) == 1 && dataUsage[0].DataUsage == 500
+	}, 20*time.Second, time.Second, "Batch entries should count towards the user's quota")
+}
+
+func TestE2E_TelemetryUsageBatch_UnknownUserDropped(t *testing.T) {
+	client := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, client))
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	batch := models.UserDataUsageBatch{
+		WindowStart: time.Now().Add(-10 * time.Second),
+		WindowEnd:   time.Now(),
+		Entries: []models.UserDataUsageBatchEntry{
+			{Username: "e2e-no-such-user-" + uuid.NewString()[:8], PoolID: poolUUID, DestinationHost: "example.com", Protocol: "HTTP", BytesSent: 10, Requests: 1},
+		},
+	}
+	err := conn.WriteJSON(map[string]interface{}{"type": "telemetry_usage_batch", "seq": 1, "payload": batch})
+	require.NoError(t, err)
+	_, nacked := waitForWorkerEvent(t, conn, "nack", 3*time.Second)
+	assert.False(t, nacked, "Usage of an unknown user should be dropped, not resent")
+}
+
+func TestE2E_FleetAnalytics(t *testing.T) {
+	client := GetAdminClient()
+	query := "?from=2025-12-01&to=2025-12-31"
+	for _, path := range []string{"top-users", "top-destinations", "traffic/pools", "traffic/regions", "traffic/protocols"} {
+		resp := client.Get(t, "/admin/analytics/"+path+query)
+		resp.RequireStatus(t, http.StatusOK)
+		var rows []map[string]interface{}
+		resp.ParseJSON(t, &rows)
+		assert.NotNil(t, rows, path)
+	}
+	client.Get(t, "/admin/analytics/top-users"+query+"&limit=5").RequireStatus(t, http.StatusOK)
+	client.Get(t, "/admin/analytics/top-users"+query+"&limit=0").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/analytics/top-destinations"+query+"&limit=1000").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/analytics/traffic/pools?from=2020-01-01&to=2025-12-31").RequireStatus(t, http.StatusBadRequest)
+}
+
+func TestE2E_TelemetryHealth_UpstreamHealth(t *testing.T) {
+	client := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, client))
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	upstreamID := uuid.New()
+	health := models.WorkerHealth{
+		Status: "healthy",
+		Upstreams: []models.UpstreamHealth{
+			{UpstreamID: upstreamID, UpstreamTag: "e2e-upstream", Status: "healthy", Latency: 120, ErrorRate: 5},
+		},
+	}
+	err := conn.WriteJSON(map[string]interface{}{"type": "telemetry_health", "payload": health})
+	require.NoError(t, err)
+
+	query := "?from=" + time.Now().AddDate(0, 0, -1).Format(time.DateOnly) + "&to=" + time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+	var upstream models.UpstreamHealthResponce
+	require.Eventually(t, func() bool {
+		resp := client.Get(t, "/admin/analytics/upstream/"+upstreamID.String()+"/health"+query)
+		resp.RequireStatus(t, http.StatusOK)
+		resp.ParseJSON(t, &upstream)
+		return upstream.Reports == 1
+	}, 10*time.Second, 500*time.Millisecond, "Upstream health should be recorded")
+	assert.Equal(t, "e2e-upstream", upstream.UpstreamTag)
+	assert.Equal(t, float64(120), upstream.LatencyP50)
+	require.Len(t, upstream.Workers, 1)
+	assert.Equal(t, "healthy", upstream.Workers[0].LastStatus)
+
+	resp := client.Get(t, "/admin/analytics/worker/"+upstream.Workers[0].WorkerID.String()+"/health"+query)
+	resp.RequireStatus(t, http.StatusOK)
+	var reports []models.WorkerHealth
+	resp.ParseJSON(t, &reports)
+	require.Len(t, reports, 1)
+	require.Len(t, reports[0].Upstreams, 1)
+	assert.Equal(t, upstreamID, reports[0].Upstreams[0].UpstreamID)
+
+	client.Get(t, "/admin/analytics/upstream/not-a-uuid/health").RequireStatus(t, http.StatusBadRequest)
+	client.Get(t, "/admin/analytics/worker/not-a-uuid/health").RequireStatus(t, http.StatusBadRequest)
 }
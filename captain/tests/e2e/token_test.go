@@ -0,0 +1,79 @@
+package e2e
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
+	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
+)
+
+func createTestToken(t *testing.T, name string, scopes []string) models.CreateApiTokenResponce {
+	client := GetAdminClient()
+	resp := client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Name:   helpers.Ptr(name),
+		Scopes: helpers.Ptr(scopes),
+	})
+	resp.RequireStatus(t, http.StatusCreated)
+	var token models.CreateApiTokenResponce
+	resp.ParseJSON(t, &token)
+	return token
+}
+
+func TestE2E_ApiToken_ScopeChecks(t *testing.T) {
+	token := createTestToken(t, "support", []string{models.ScopeUsersRead})
+	assert.NotEmpty(t, token.Token, "Token should be returned on creation")
+	client := helpers.NewAdminClient(testServer.URL, token.Token)
+	client.Get(t, "/admin/users/").AssertStatus(t, http.StatusOK)
+	client.Post(t, "/admin/users/", models.CreateUserRequest{}).AssertStatus(t, http.StatusForbidden)
+	client.Get(t, "/admin/pools/").AssertStatus(t, http.StatusForbidden)
+}
+
+func TestE2E_ApiToken_WriteImpliesRead(t *testing.T) {
+	token := createTestToken(t, "billing", []string{models.ScopeUsersWrite})
+	client := helpers.NewAdminClient(testServer.URL, token.Token)
+	client.Get(t, "/admin/users/").AssertStatus(t, http.StatusOK)
+	client.Post(t, "/admin/users/", models.CreateUserRequest{}).AssertStatus(t, http.StatusCreated)
+}
+
+func TestE2E_ApiToken_Revoke(t *testing.T) {
+	token := createTestToken(t, "deploy", []string{models.ScopeWorkersRead})
+	client := helpers.NewAdminClient(testServer.URL, token.Token)
+	client.Get(t, "/admin/worker/").AssertStatus(t, http.StatusOK)
+	GetAdminClient().Delete(t, "/admin/tokens/"+token.Id.String()).RequireStatus(t, http.StatusOK)
+	client.Get(t, "/admin/worker/").AssertStatus(t, http.StatusUnauthorized)
+	GetAdminClient().Delete(t, "/admin/tokens/"+token.Id.String()).AssertStatus(t, http.StatusNotFound)
+}
+
+func TestE2E_ApiToken_CannotEscalate(t *testing.T) {
+	token := createTestToken(t, "minter", []string{models.ScopeTokensWrite, models.ScopeUsersRead})
+	client := helpers.NewAdminClient(testServer.URL, token.Token)
+	resp := client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Name:   helpers.Ptr("escalated"),
+		Scopes: helpers.Ptr([]string{models.ScopePoolsWrite}),
+	})
+	resp.AssertStatus(t, http.StatusForbidden)
+	resp = client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Name:   helpers.Ptr("reader"),
+		Scopes: helpers.Ptr([]string{models.ScopeUsersRead}),
+	})
+	resp.AssertStatus(t, http.StatusCreated)
+}
+
+func TestE2E_ApiToken_InvalidRequests(t *testing.T) {
+	client := GetAdminClient()
+	client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Name:   helpers.Ptr("bad-scope"),
+		Scopes: helpers.Ptr([]string{"users:delete"}),
+	}).AssertStatus(t, http.StatusBadRequest)
+	client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Scopes: helpers.Ptr([]string{models.ScopeUsersRead}),
+	}).AssertStatus(t, http.StatusBadRequest)
+	client.Post(t, "/admin/tokens/", models.CreateApiTokenRequest{
+		Name:      helpers.Ptr("expired"),
+		Scopes:    helpers.Ptr([]string{models.ScopeUsersRead}),
+		ExpiresAt: helpers.Ptr(time.Now().Add(-time.Hour)),
+	}).AssertStatus(t, http.StatusBadRequest)
+}
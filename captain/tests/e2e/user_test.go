@@ -6,6 +6,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	models "github.com/torchlabssoftware/subnetwork_system/internal/server/models"
 	"github.com/torchlabssoftware/subnetwork_system/tests/e2e/helpers"
 )
@@ -93,6 +94,116 @@ func TestE2E_UpdateUserStatus(t *testing.T) {
 	assert.Equal(t, "suspended", user.Status)
 }
 
+func TestE2E_UserAccessLogOptOut(t *testing.T) {
+	client := GetAdminClient()
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{AccessLogOptOut: helpers.Ptr(true)})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	assert.True(t, created.AccessLogOptOut)
+
+	resp := client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + created.Id.String(),
+		Body:   models.UpdateUserRequest{AccessLogOptOut: helpers.Ptr(false)},
+	})
+	resp.RequireStatus(t, http.StatusOK)
+	var updated models.UpdateUserResponce
+	resp.ParseJSON(t, &updated)
+	assert.False(t, updated.AccessLogOptOut)
+	assert.Equal(t, "active", updated.Status)
+
+	getResp := client.Get(t, "/admin/users/"+created.Id.String())
+	getResp.RequireStatus(t, http.StatusOK)
+	var user models.GetUserByIdResponce
+	getResp.ParseJSON(t, &user)
+	assert.False(t, user.AccessLogOptOut)
+}
+
+func TestE2E_UserMaxConnections(t *testing.T) {
+	client := GetAdminClient()
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	assert.Equal(t, int32(50), created.MaxConnections)
+
+	resp := client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + created.Id.String(),
+		Body:   models.UpdateUserRequest{MaxConnections: helpers.Ptr(int32(10))},
+	})
+	resp.RequireStatus(t, http.StatusOK)
+	var updated models.UpdateUserResponce
+	resp.ParseJSON(t, &updated)
+	assert.Equal(t, int32(10), updated.MaxConnections)
+
+	client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + created.Id.String(),
+		Body:   models.UpdateUserRequest{MaxConnections: helpers.Ptr(int32(-1))},
+	}).AssertStatus(t, http.StatusBadRequest)
+
+	addReq := models.AddUserPoolRequest{
+		UserPool: []models.PoolDataStat{
+			{Pool: "netnutusa", DataLimit: 1000000, MaxConnections: 5},
+			{Pool: "netnuteu", DataLimit: 2000000},
+		},
+	}
+	client.Post(t, "/admin/users/"+created.Id.String()+"/pools", addReq).RequireStatus(t, http.StatusCreated)
+
+	usageResp := client.Get(t, "/admin/users/"+created.Id.String()+"/data-usage")
+	usageResp.RequireStatus(t, http.StatusOK)
+	var usage []models.GetDatausageReponce
+	usageResp.ParseJSON(t, &usage)
+	require.Len(t, usage, 2)
+	for _, u := range usage {
+		switch u.PoolTag {
+		case "netnutusa":
+			assert.Equal(t, int64(1000000), u.DataLimit)
+			assert.Equal(t, int32(5), u.MaxConnections)
+		case "netnuteu":
+			assert.Equal(t, int64(2000000), u.DataLimit)
+			assert.Equal(t, int32(0), u.MaxConnections)
+		}
+	}
+}
+
+func TestE2E_UserBandwidthLimit(t *testing.T) {
+	client := GetAdminClient()
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{BandwidthLimit: helpers.Ptr(int64(1 << 20))})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	assert.Equal(t, int64(1<<20), created.BandwidthLimit)
+
+	resp := client.DoRequest(t, helpers.RequestOptions{
+		Method: http.MethodPatch,
+		Path:   "/admin/users/" + created.Id.String(),
+		Body:   models.UpdateUserRequest{BandwidthLimit: helpers.Ptr(int64(0))},
+	})
+	resp.RequireStatus(t, http.StatusOK)
+	var updated models.UpdateUserResponce
+	resp.ParseJSON(t, &updated)
+	assert.Equal(t, int64(0), updated.BandwidthLimit)
+
+	client.Post(t, "/admin/users/", models.CreateUserRequest{BandwidthLimit: helpers.Ptr(int64(-1))}).AssertStatus(t, http.StatusBadRequest)
+
+	addReq := models.AddUserPoolRequest{
+		UserPool: []models.PoolDataStat{
+			{Pool: "netnutusa", DataLimit: 1000000, BandwidthLimit: 512 << 10},
+		},
+	}
+	client.Post(t, "/admin/users/"+created.Id.String()+"/pools", addReq).RequireStatus(t, http.StatusCreated)
+
+	usageResp := client.Get(t, "/admin/users/"+created.Id.String()+"/data-usage")
+	usageResp.RequireStatus(t, http.StatusOK)
+	var usage []models.GetDatausageReponce
+	usageResp.ParseJSON(t, &usage)
+	require.Len(t, usage, 1)
+	assert.Equal(t, int64(512<<10), usage[0].BandwidthLimit)
+}
+
 func TestE2E_DeleteUser(t *testing.T) {
 	client := GetAdminClient()
 	createReq := models.CreateUserRequest{}
@@ -106,6 +217,31 @@ func TestE2E_DeleteUser(t *testing.T) {
 	getResp.AssertStatus(t, http.StatusNotFound)
 }
 
+func TestE2E_RotateUserPassword(t *testing.T) {
+	client := GetAdminClient()
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	resp := client.Post(t, "/admin/users/"+created.Id.String()+"/rotate-password", nil)
+	resp.RequireStatus(t, http.StatusOK)
+	var rotated models.RotatePasswordResponce
+	resp.ParseJSON(t, &rotated)
+	assert.Equal(t, created.Id, rotated.Id)
+	assert.Equal(t, created.Username, rotated.Username)
+	assert.NotEmpty(t, rotated.Password)
+	assert.NotEqual(t, created.Password, rotated.Password, "Password should change")
+	getResp := client.Get(t, "/admin/users/"+created.Id.String())
+	getResp.RequireStatus(t, http.StatusOK)
+	assert.NotContains(t, string(getResp.Body), "password", "Password hash should not be returned")
+}
+
+func TestE2E_RotateUserPassword_NotFound(t *testing.T) {
+	client := GetAdminClient()
+	resp := client.Post(t, "/admin/users/"+uuid.New().String()+"/rotate-password", nil)
+	resp.AssertStatus(t, http.StatusNotFound)
+}
+
 func TestE2E_UserIpWhitelist(t *testing.T) {
 	client := GetAdminClient()
 	createReq := models.CreateUserRequest{}
@@ -137,6 +273,22 @@ func TestE2E_UserIpWhitelist(t *testing.T) {
 	assert.NotContains(t, updatedWhitelist.IpWhitelist, "192.168.1.100")
 }
 
+func TestE2E_UserIpWhitelist_Invalid(t *testing.T) {
+	client := GetAdminClient()
+	createReq := models.CreateUserRequest{
+		IpWhiteList: helpers.Ptr([]string{"not-an-ip"}),
+	}
+	client.Post(t, "/admin/users/", createReq).AssertStatus(t, http.StatusBadRequest)
+	createResp := client.Post(t, "/admin/users/", models.CreateUserRequest{})
+	createResp.RequireStatus(t, http.StatusCreated)
+	var created models.CreateUserResponce
+	createResp.ParseJSON(t, &created)
+	addReq := models.AddUserIpwhitelistRequest{
+		IpWhitelist: []string{"10.0.0.0/33"},
+	}
+	client.Post(t, "/admin/users/"+created.Id.String()+"/ipwhitelist", addReq).AssertStatus(t, http.StatusBadRequest)
+}
+
 func TestE2E_UserAuthentication_InvalidAPIKey(t *testing.T) {
 	client := helpers.NewAdminClient(GetTestServerURL(), "invalid-api-key")
 	resp := client.Get(t, "/admin/users/")
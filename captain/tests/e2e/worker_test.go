@@ -1,7 +1,10 @@
 package e2e
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
@@ -178,7 +181,6 @@ func TestE2E_DeleteWorkerDomain(t *testing.T) {
 
 func TestE2E_WorkerLogin(t *testing.T) {
 	adminClient := GetAdminClient()
-	workerClient := GetWorkerClient()
 	poolId := createTestPoolForWorker(t, adminClient)
 	poolUUID, _ := uuid.Parse(poolId)
 	createReq := models.AddWorkerRequest{
@@ -191,10 +193,12 @@ func TestE2E_WorkerLogin(t *testing.T) {
 	createResp.RequireStatus(t, http.StatusOK)
 	var created models.AddWorkerResponse
 	createResp.ParseJSON(t, &created)
+	assert.NotEmpty(t, created.Secret, "Secret should be returned on creation")
 	workerUUID, _ := uuid.Parse(created.ID)
 	loginReq := models.WorkerLoginRequest{
 		WorkerId: helpers.Ptr(workerUUID),
 	}
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), created.Secret)
 	resp := workerClient.Post(t, "/worker/ws/login", loginReq)
 	resp.RequireStatus(t, http.StatusOK)
 	var loginResp models.WorkerLoginResponce
@@ -204,17 +208,17 @@ func TestE2E_WorkerLogin(t *testing.T) {
 }
 
 func TestE2E_WorkerLogin_InvalidWorkerID(t *testing.T) {
-	workerClient := GetWorkerClient()
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), "snw_unknown")
 	nonExistentID := uuid.New()
 	loginReq := models.WorkerLoginRequest{
 		WorkerId: helpers.Ptr(nonExistentID),
 	}
 	resp := workerClient.Post(t, "/worker/ws/login", loginReq)
-	resp.AssertStatus(t, http.StatusNotFound)
+	resp.AssertStatus(t, http.StatusUnauthorized)
 }
 
 func TestE2E_WorkerLogin_MissingWorkerID(t *testing.T) {
-	workerClient := GetWorkerClient()
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), "snw_unknown")
 	loginReq := models.WorkerLoginRequest{
 		WorkerId: nil,
 	}
@@ -223,17 +227,64 @@ func TestE2E_WorkerLogin_MissingWorkerID(t *testing.T) {
 }
 
 func TestE2E_WorkerLogin_InvalidAPIKey(t *testing.T) {
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, GetAdminClient()))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
 	invalidClient := helpers.NewWorkerClient(GetTestServerURL(), "invalid-api-key")
 	loginReq := models.WorkerLoginRequest{
-		WorkerId: helpers.Ptr(uuid.New()),
+		WorkerId: helpers.Ptr(workerUUID),
 	}
 	resp := invalidClient.Post(t, "/worker/ws/login", loginReq)
 	resp.AssertStatus(t, http.StatusUnauthorized)
 }
 
+func TestE2E_WorkerLogin_NotActive(t *testing.T) {
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, GetAdminClient()))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
+	_, err := GetTestDB().Exec("UPDATE worker SET status = 'suspended' WHERE id = $1", workerUUID)
+	require.NoError(t, err)
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), created.Secret)
+	resp := workerClient.Post(t, "/worker/ws/login", models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	})
+	resp.AssertStatus(t, http.StatusForbidden)
+}
+
+func TestE2E_WorkerSecret_Rotate(t *testing.T) {
+	adminClient := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, adminClient))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
+	loginReq := models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	}
+	resp := adminClient.Post(t, "/admin/worker/"+created.Name+"/rotate-secret", nil)
+	resp.RequireStatus(t, http.StatusOK)
+	var rotated models.WorkerSecretResponce
+	resp.ParseJSON(t, &rotated)
+	assert.NotEmpty(t, rotated.Secret)
+	assert.NotEqual(t, created.Secret, rotated.Secret)
+	helpers.NewWorkerClient(GetTestServerURL(), created.Secret).Post(t, "/worker/ws/login", loginReq).AssertStatus(t, http.StatusUnauthorized)
+	helpers.NewWorkerClient(GetTestServerURL(), rotated.Secret).Post(t, "/worker/ws/login", loginReq).AssertStatus(t, http.StatusOK)
+	adminClient.Post(t, "/admin/worker/no-such-worker/rotate-secret", nil).AssertStatus(t, http.StatusNotFound)
+}
+
+func TestE2E_WorkerSecret_Revoke(t *testing.T) {
+	adminClient := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, adminClient))
+	created := createTestWorker(t, poolUUID)
+	workerUUID, _ := uuid.Parse(created.ID)
+	adminClient.Post(t, "/admin/worker/"+created.Name+"/revoke-secret", nil).RequireStatus(t, http.StatusOK)
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), created.Secret)
+	resp := workerClient.Post(t, "/worker/ws/login", models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	})
+	resp.AssertStatus(t, http.StatusUnauthorized)
+}
+
 func TestE2E_WebSocketConnect(t *testing.T) {
 	adminClient := GetAdminClient()
-	workerClient := GetWorkerClient()
 	poolId := createTestPoolForWorker(t, adminClient)
 	poolUUID, _ := uuid.Parse(poolId)
 	createReq := models.AddWorkerRequest{
@@ -250,6 +301,7 @@ func TestE2E_WebSocketConnect(t *testing.T) {
 	loginReq := models.WorkerLoginRequest{
 		WorkerId: helpers.Ptr(workerUUID),
 	}
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), created.Secret)
 	loginResp := workerClient.Post(t, "/worker/ws/login", loginReq)
 	loginResp.RequireStatus(t, http.StatusOK)
 	var login models.WorkerLoginResponce
@@ -257,13 +309,10 @@ func TestE2E_WebSocketConnect(t *testing.T) {
 	serverURL := GetTestServerURL()
 	wsURL := strings.Replace(serverURL, "http://", "ws://", 1)
 	wsURL = wsURL + "/worker/ws/serve?otp=" + login.Otp
-	header := http.Header{}
-	header.Set("Authorization", "ApiKey "+WorkerAPIKey)
-
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
-	conn, resp, err := dialer.Dial(wsURL, header)
+	conn, resp, err := dialer.Dial(wsURL, nil)
 	if err != nil {
 		t.Logf("WebSocket dial error: %v", err)
 		if resp != nil {
@@ -295,12 +344,10 @@ func TestE2E_WebSocketConnect_InvalidOTP(t *testing.T) {
 	serverURL := GetTestServerURL()
 	wsURL := strings.Replace(serverURL, "http://", "ws://", 1)
 	wsURL = wsURL + "/worker/ws/serve?otp=invalid-otp-12345"
-	header := http.Header{}
-	header.Set("Authorization", "ApiKey "+WorkerAPIKey)
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
-	_, resp, err := dialer.Dial(wsURL, header)
+	_, resp, err := dialer.Dial(wsURL, nil)
 	if err != nil {
 		t.Logf("Expected error: %v", err)
 		if resp != nil {
@@ -315,12 +362,10 @@ func TestE2E_WebSocketConnect_MissingOTP(t *testing.T) {
 	serverURL := GetTestServerURL()
 	wsURL := strings.Replace(serverURL, "http://", "ws://", 1)
 	wsURL = wsURL + "/worker/ws/serve"
-	header := http.Header{}
-	header.Set("Authorization", "ApiKey "+WorkerAPIKey)
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 5 * time.Second,
 	}
-	_, resp, err := dialer.Dial(wsURL, header)
+	_, resp, err := dialer.Dial(wsURL, nil)
 	if err != nil {
 		t.Logf("Expected error: %v", err)
 		if resp != nil {
@@ -330,3 +375,221 @@ func TestE2E_WebSocketConnect_MissingOTP(t *testing.T) {
 		t.Error("Expected WebSocket connection to fail with invalid OTP")
 	}
 }
+
+func createTestWorker(t *testing.T, poolUUID uuid.UUID) models.AddWorkerResponse {
+	createReq := models.AddWorkerRequest{
+		RegionName: helpers.Ptr("Europe"),
+		IPAddress:  helpers.Ptr("10.0.0.101"),
+		Port:       helpers.Ptr(int32(9999)),
+		PoolId:     helpers.Ptr(poolUUID),
+	}
+	createResp := GetAdminClient().Post(t, "/admin/worker/", createReq)
+	createResp.RequireStatus(t, http.StatusOK)
+	var created models.AddWorkerResponse
+	createResp.ParseJSON(t, &created)
+	return created
+}
+
+func connectTestWorker(t *testing.T, poolUUID uuid.UUID) *websocket.Conn {
+	return dialTestWorker(t, createTestWorker(t, poolUUID))
+}
+
+func dialTestWorker(t *testing.T, created models.AddWorkerResponse) *websocket.Conn {
+	workerUUID, _ := uuid.Parse(created.ID)
+	workerClient := helpers.NewWorkerClient(GetTestServerURL(), created.Secret)
+	loginResp := workerClient.Post(t, "/worker/ws/login", models.WorkerLoginRequest{
+		WorkerId: helpers.Ptr(workerUUID),
+	})
+	loginResp.RequireStatus(t, http.StatusOK)
+	var login models.WorkerLoginResponce
+	loginResp.ParseJSON(t, &login)
+	wsURL := strings.Replace(GetTestServerURL(), "http://", "ws://", 1) + "/worker/ws/serve?otp=" + login.Otp
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 5 * time.Second,
+	}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Skipf("WebSocket connection not available, skipping: %v", err)
+	}
+	return conn
+}
+
+func waitForWorkerEvent(t *testing.T, conn *websocket.Conn, eventType string, timeout time.Duration) (json.RawMessage, bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(deadline)
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Logf("Error reading message: %v", err)
+			return nil, false
+		}
+		var event struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if json.Unmarshal(message, &event) == nil && event.Type == eventType {
+			return event.Payload, true
+		}
+	}
+	return nil, false
+}
+
+func TestE2E_VerifyIp_UnknownIpFails(t *testing.T) {
+	client := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, client))
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	err := conn.WriteJSON(map[string]interface{}{
+		"type":    "verify_ip",
+		"payload": map[string]string{"client_ip": "198.51.100.77"},
+	})
+	require.NoError(t, err)
+	payload, ok := waitForWorkerEvent(t, conn, "login_failed", 3*time.Second)
+	require.True(t, ok, "An unknown IP should be answered with login_failed")
+	var reply struct {
+		Success bool `json:"success"`
+		Payload struct {
+			ClientIP string `json:"client_ip"`
+		} `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &reply))
+	assert.False(t, reply.Success)
+	assert.Equal(t, "198.51.100.77", reply.Payload.ClientIP)
+}
+
+func TestE2E_VerifyUser_EchoesRequestId(t *testing.T) {
+	client := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, client))
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	err := conn.WriteJSON(map[string]interface{}{
+		"type": "verify_user",
+		"payload": map[string]string{
+			"request_id": "req-1",
+			"username":   "no-such-user-" + uuid.New().String()[:8],
+			"password":   "wrong",
+		},
+	})
+	require.NoError(t, err)
+	payload, ok := waitForWorkerEvent(t, conn, "login_failed", 3*time.Second)
+	require.True(t, ok, "A rejected login should be answered with login_failed")
+	var reply struct {
+		Payload struct {
+			RequestID string `json:"request_id"`
+		} `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &reply))
+	assert.Equal(t, "req-1", reply.Payload.RequestID)
+}
+
+func TestE2E_VerifyUser_BurstAnsweredOffReadLoop(t *testing.T) {
+	client := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, client))
+	conn := connectTestWorker(t, poolUUID)
+	defer conn.Close()
+	username := "no-such-user-" + uuid.New().String()[:8]
+	want := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		requestID := fmt.Sprintf("burst-%d", i)
+		want[requestID] = true
+		err := conn.WriteJSON(map[string]interface{}{
+			"type": "verify_user",
+			"payload": map[string]string{
+				"request_id": requestID,
+				"username":   username,
+				"password":   "wrong",
+			},
+		})
+		require.NoError(t, err)
+	}
+	for len(want) > 0 {
+		payload, ok := waitForWorkerEvent(t, conn, "login_failed", 5*time.Second)
+		require.True(t, ok, "Every login of the burst should be answered, %d left", len(want))
+		var reply struct {
+			Payload struct {
+				RequestID string `json:"request_id"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &reply))
+		assert.True(t, want[reply.Payload.RequestID], "Unexpected reply %q", reply.Payload.RequestID)
+		delete(want, reply.Payload.RequestID)
+	}
+}
+
+func TestE2E_WorkerStatus(t *testing.T) {
+	adminClient := GetAdminClient()
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, adminClient))
+	connected := createTestWorker(t, poolUUID)
+	offline := createTestWorker(t, poolUUID)
+	conn := dialTestWorker(t, connected)
+	defer conn.Close()
+	_, ok := waitForWorkerEvent(t, conn, "config", 5*time.Second)
+	require.True(t, ok, "worker should receive its config")
+
+	resp := adminClient.Get(t, "/admin/worker/status")
+	resp.RequireStatus(t, http.StatusOK)
+	var statuses []models.WorkerStatusResponce
+	resp.ParseJSON(t, &statuses)
+	byName := make(map[string]models.WorkerStatusResponce)
+	for _, status := range statuses {
+		byName[status.Name] = status
+	}
+
+	require.Contains(t, byName, connected.Name)
+	status := byName[connected.Name]
+	assert.True(t, status.Connected)
+	assert.False(t, status.Stale)
+	assert.NotEmpty(t, status.Replica)
+	assert.NotNil(t, status.ConnectedAt)
+	assert.NotEmpty(t, status.ConfigVersion, "config version should be recorded once config is sent")
+
+	require.Contains(t, byName, offline.Name)
+	status = byName[offline.Name]
+	assert.False(t, status.Connected)
+	assert.Empty(t, status.Replica)
+	assert.Empty(t, status.ConfigVersion)
+}
+
+func TestE2E_WorkerEvents_Stream(t *testing.T) {
+	poolUUID, _ := uuid.Parse(createTestPoolForWorker(t, GetAdminClient()))
+	created := createTestWorker(t, poolUUID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, GetTestServerURL()+"/admin/worker/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "ApiKey "+AdminAPIKey)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	conn := dialTestWorker(t, created)
+	_, ok := waitForWorkerEvent(t, conn, "config", 5*time.Second)
+	require.True(t, ok, "worker should receive its config")
+	conn.Close()
+
+	// Read events until both the connect and the disconnect of this worker
+	// have been seen.
+	seen := make(map[string]bool)
+	var eventType string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && !(seen["connected"] && seen["disconnected"]) {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var event models.WorkerStatusEvent
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			if event.WorkerName == created.Name {
+				assert.Equal(t, eventType, event.Type)
+				seen[event.Type] = true
+			}
+		}
+	}
+	assert.True(t, seen["connected"], "stream should report the worker connecting")
+	assert.True(t, seen["disconnected"], "stream should report the worker disconnecting")
+}
@@ -0,0 +1,129 @@
+package providers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"strconv"
+)
+
+func init() {
+	Register("netnut", netnut{})
+	Register("geonode", geonode{})
+	Register("iproyal", iproyal{})
+}
+
+// netnut takes the targeting in the username:
+// user-res_sc-<country>_<state>_<city>-sid-<session>, or user-res-<country>
+// without a state or city.
+type netnut struct{}
+
+func (netnut) Credentials(username, password string, t Targeting) (string, string, error) {
+	user := username
+	if t.Country != "" && (t.City != "" || t.State != "") {
+		user += "-res_sc-" + t.Country
+		if t.State != "" {
+			user += "_" + t.State
+		}
+		if t.City != "" {
+			user += "_" + t.City
+		}
+	} else {
+		user += "-res-" + t.Country
+	}
+	if t.Session != "" {
+		user += "-sid-" + t.Session
+	}
+	return user, password, nil
+}
+
+func (a netnut) ProxyString(t Targeting) string { return proxyString(a, t) }
+
+// NewSession returns an 8 or 9 digit number, as netnut only takes numeric
+// session ids.
+func (netnut) NewSession() string {
+	const lo, hi = 10000000, 100000000
+	n, err := rand.Int(rand.Reader, big.NewInt(hi-lo+1))
+	if err != nil {
+		panic(err)
+	}
+	return strconv.FormatInt(n.Int64()+lo, 10)
+}
+
+func (netnut) Supports() []Field {
+	return []Field{FieldCountry, FieldState, FieldCity, FieldSession}
+}
+
+// geonode takes the targeting in the username:
+// user-country-<country>-state-<state>-city-<city>-session-<session>-lifetime-<minutes>.
+type geonode struct{}
+
+func (geonode) Credentials(username, password string, t Targeting) (string, string, error) {
+	user := username
+	if t.Country != "" {
+		user += "-country-" + t.Country
+	}
+	if t.State != "" {
+		user += "-state-" + t.State
+	}
+	if t.City != "" {
+		user += "-city-" + t.City
+	}
+	if t.Session != "" {
+		user += "-session-" + t.Session
+	}
+	if t.Lifetime > 0 {
+		user += "-lifetime-" + strconv.Itoa(t.Lifetime)
+	}
+	return user, password, nil
+}
+
+func (a geonode) ProxyString(t Targeting) string { return proxyString(a, t) }
+
+func (geonode) NewSession() string { return randomHex(4) }
+
+func (geonode) Supports() []Field {
+	return []Field{FieldCountry, FieldState, FieldCity, FieldSession, FieldLifetime}
+}
+
+// iproyal takes the targeting in the password:
+// pass_country-<country>_city-<city>_session-<session>_lifetime-<n>m, with
+// the lifetime in hours once it reaches an hour.
+type iproyal struct{}
+
+func (iproyal) Credentials(username, password string, t Targeting) (string, string, error) {
+	pass := password
+	if t.Country != "" {
+		pass += "_country-" + t.Country
+	}
+	if t.City != "" {
+		pass += "_city-" + t.City
+	}
+	if t.Session != "" {
+		pass += "_session-" + t.Session
+	}
+	if t.Lifetime > 0 {
+		if t.Lifetime < 60 {
+			pass += "_lifetime-" + strconv.Itoa(t.Lifetime) + "m"
+		} else {
+			pass += "_lifetime-" + strconv.Itoa(t.Lifetime/60) + "h"
+		}
+	}
+	return username, pass, nil
+}
+
+func (a iproyal) ProxyString(t Targeting) string { return proxyString(a, t) }
+
+func (iproyal) NewSession() string { return randomHex(4) }
+
+func (iproyal) Supports() []Field {
+	return []Field{FieldCountry, FieldCity, FieldSession, FieldLifetime}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,3 @@
+module github.com/torchlabssoftware/subnetwork_system/providers
+
+go 1.18
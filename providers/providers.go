@@ -0,0 +1,167 @@
+// Package providers holds the adapters that translate a client's targeting
+// into the credential syntax of each upstream proxy provider. It is shared by
+// captain, which builds the proxy strings handed to users, and the worker,
+// which builds the credentials sent to upstreams.
+package providers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Targeting is what a client asks for in its proxy password.
+type Targeting struct {
+	Country  string
+	State    string
+	City     string
+	Session  string
+	Lifetime int // minutes
+}
+
+// Field names a targeting option a provider may support.
+type Field string
+
+const (
+	FieldCountry  Field = "country"
+	FieldState    Field = "state"
+	FieldCity     Field = "city"
+	FieldSession  Field = "session"
+	FieldLifetime Field = "lifetime"
+)
+
+// Adapter speaks one provider's credential syntax.
+type Adapter interface {
+	// Credentials builds the username and password sent to the upstream from
+	// the upstream account and the client's targeting.
+	Credentials(username, password string, t Targeting) (string, string, error)
+	// ProxyString builds the targeting suffix a client appends to its
+	// password, leaving out fields the provider does not support.
+	ProxyString(t Targeting) string
+	// NewSession returns a fresh session id in a form the provider accepts.
+	NewSession() string
+	// Supports lists the targeting fields the provider honours.
+	Supports() []Field
+}
+
+var (
+	mu       sync.RWMutex
+	adapters = map[string]Adapter{}
+)
+
+// Register makes an adapter available under a provider name, replacing any
+// adapter already registered under it.
+func Register(name string, a Adapter) {
+	mu.Lock()
+	defer mu.Unlock()
+	adapters[name] = a
+}
+
+// Lookup returns the adapter registered under name.
+func Lookup(name string) (Adapter, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	a, ok := adapters[name]
+	return a, ok
+}
+
+// ForUpstream picks the adapter for an upstream from its provider and
+// config_format. A config_format holding a template always wins, so an
+// upstream can override a built-in provider or use one with no adapter;
+// otherwise the provider must be registered.
+func ForUpstream(provider, configFormat string) (Adapter, error) {
+	if IsTemplate(configFormat) {
+		a, err := NewTemplate(configFormat)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	if a, ok := Lookup(provider); ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q: register an adapter or set a template config_format", provider)
+}
+
+// Unsupported returns the fields set in t that a does not support.
+func Unsupported(a Adapter, t Targeting) []Field {
+	var fields []Field
+	for _, f := range t.fields() {
+		if !supports(a, f) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// FormatTargeting writes t in the form clients append to their password,
+// e.g. "-country-us-city-miami-session-ab12cd34-lifetime-30". The worker
+// parses the same form back. A lifetime is only written with a session.
+func FormatTargeting(t Targeting) string {
+	var b strings.Builder
+	if t.Country != "" {
+		b.WriteString("-country-" + t.Country)
+	}
+	if t.State != "" {
+		b.WriteString("-state-" + t.State)
+	}
+	if t.City != "" {
+		b.WriteString("-city-" + t.City)
+	}
+	if t.Session != "" {
+		b.WriteString("-session-" + t.Session)
+		if t.Lifetime > 0 {
+			b.WriteString("-lifetime-" + strconv.Itoa(t.Lifetime))
+		}
+	}
+	return b.String()
+}
+
+// proxyString drops the fields a does not support before formatting t. The
+// lifetime is kept with the session even when the provider ignores it, as the
+// worker pins sessions for that long.
+func proxyString(a Adapter, t Targeting) string {
+	if !supports(a, FieldCountry) {
+		t.Country = ""
+	}
+	if !supports(a, FieldState) {
+		t.State = ""
+	}
+	if !supports(a, FieldCity) {
+		t.City = ""
+	}
+	if !supports(a, FieldSession) {
+		t.Session = ""
+	}
+	return FormatTargeting(t)
+}
+
+func supports(a Adapter, f Field) bool {
+	for _, s := range a.Supports() {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Targeting) fields() []Field {
+	var fields []Field
+	if t.Country != "" {
+		fields = append(fields, FieldCountry)
+	}
+	if t.State != "" {
+		fields = append(fields, FieldState)
+	}
+	if t.City != "" {
+		fields = append(fields, FieldCity)
+	}
+	if t.Session != "" {
+		fields = append(fields, FieldSession)
+	}
+	if t.Lifetime > 0 {
+		fields = append(fields, FieldLifetime)
+	}
+	return fields
+}
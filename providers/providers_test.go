@@ -0,0 +1,134 @@
+package providers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuiltinCredentials(t *testing.T) {
+	tests := []struct {
+		provider string
+		tag      Targeting
+		user     string
+		pass     string
+	}{
+		{"netnut", Targeting{Country: "us"}, "acct-res-us", "secret"},
+		{"netnut", Targeting{Country: "us", State: "ny", City: "newyork", Session: "12345678"}, "acct-res_sc-us_ny_newyork-sid-12345678", "secret"},
+		{"netnut", Targeting{Country: "us", City: "miami"}, "acct-res_sc-us_miami", "secret"},
+		{"geonode", Targeting{}, "acct", "secret"},
+		{"geonode", Targeting{Country: "us", State: "ny", City: "newyork", Session: "ab12", Lifetime: 30}, "acct-country-us-state-ny-city-newyork-session-ab12-lifetime-30", "secret"},
+		{"iproyal", Targeting{Country: "us", City: "miami", Session: "ab12", Lifetime: 30}, "acct", "secret_country-us_city-miami_session-ab12_lifetime-30m"},
+		{"iproyal", Targeting{Session: "ab12", Lifetime: 120}, "acct", "secret_session-ab12_lifetime-2h"},
+	}
+	for _, tt := range tests {
+		a, ok := Lookup(tt.provider)
+		if !ok {
+			t.Fatalf("%s should be registered", tt.provider)
+		}
+		user, pass, err := a.Credentials("acct", "secret", tt.tag)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.provider, err)
+		}
+		if user != tt.user || pass != tt.pass {
+			t.Errorf("%s %+v: expected %s:%s, got %s:%s", tt.provider, tt.tag, tt.user, tt.pass, user, pass)
+		}
+	}
+}
+
+func TestProxyString_DropsUnsupportedFields(t *testing.T) {
+	tag := Targeting{Country: "us", State: "ny", City: "newyork", Session: "ab12", Lifetime: 30}
+	iproyal, _ := Lookup("iproyal")
+	if got, want := iproyal.ProxyString(tag), "-country-us-city-newyork-session-ab12-lifetime-30"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	// netnut ignores the lifetime, but the worker still pins the session for it
+	netnut, _ := Lookup("netnut")
+	if got, want := netnut.ProxyString(tag), "-country-us-state-ny-city-newyork-session-ab12-lifetime-30"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got := netnut.ProxyString(Targeting{Country: "us", Lifetime: 30}); got != "-country-us" {
+		t.Errorf("Lifetime should only be written with a session, got %s", got)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	iproyal, _ := Lookup("iproyal")
+	got := Unsupported(iproyal, Targeting{Country: "us", State: "ny"})
+	if len(got) != 1 || got[0] != FieldState {
+		t.Errorf("Expected state to be unsupported, got %v", got)
+	}
+	geonode, _ := Lookup("geonode")
+	if got := Unsupported(geonode, Targeting{Country: "us", State: "ny", City: "newyork"}); len(got) != 0 {
+		t.Errorf("Expected every field to be supported, got %v", got)
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	netnut, _ := Lookup("netnut")
+	for i := 0; i < 100; i++ {
+		s := netnut.NewSession()
+		if len(s) < 8 || len(s) > 9 || strings.Trim(s, "0123456789") != "" {
+			t.Fatalf("netnut session should be 8 or 9 digits, got %s", s)
+		}
+	}
+	geonode, _ := Lookup("geonode")
+	if a, b := geonode.NewSession(), geonode.NewSession(); len(a) != 8 || a == b {
+		t.Errorf("Expected distinct 8 character sessions, got %s and %s", a, b)
+	}
+}
+
+func TestForUpstream(t *testing.T) {
+	// a plain description leaves the built-in adapter in charge
+	a, err := ForUpstream("netnut", "-res[_sc]-[country]_[state]_[city]-sid-[session]")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user, _, _ := a.Credentials("acct", "secret", Targeting{Country: "us"}); user != "acct-res-us" {
+		t.Errorf("Expected the netnut adapter, got %s", user)
+	}
+
+	// a template overrides it
+	a, err = ForUpstream("netnut", "{{.Username}}-cc-{{.Country}}:{{.Password}}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user, _, _ := a.Credentials("acct", "secret", Targeting{Country: "us"}); user != "acct-cc-us" {
+		t.Errorf("Expected the template adapter, got %s", user)
+	}
+
+	if _, err := ForUpstream("unknown", "user:pass@host:port"); err == nil {
+		t.Error("Unknown provider without a template should be rejected")
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	a, err := NewTemplate("{{.Username}}{{if .Country}}-country-{{.Country}}{{end}}{{if .Session}}-session-{{.Session}}{{end}}:{{.Password}}")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	user, pass, err := a.Credentials("acct", "sec:ret", Targeting{Country: "us", Session: "ab12"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user != "acct-country-us-session-ab12" || pass != "sec:ret" {
+		t.Errorf("Unexpected credentials %s:%s", user, pass)
+	}
+	if user, _, _ := a.Credentials("acct", "secret", Targeting{}); user != "acct" {
+		t.Errorf("Empty targeting should be left out, got %s", user)
+	}
+	if got := Unsupported(a, Targeting{Country: "us", City: "miami", Session: "ab12"}); len(got) != 1 || got[0] != FieldCity {
+		t.Errorf("Expected only city to be unsupported, got %v", got)
+	}
+}
+
+func TestTemplate_Invalid(t *testing.T) {
+	for _, format := range []string{
+		"{{.Username",
+		"{{.Username}}-{{.Region}}:{{.Password}}",
+		"{{.Username}}-country-{{.Country}}",
+	} {
+		if _, err := NewTemplate(format); err == nil {
+			t.Errorf("Expected %q to be rejected", format)
+		}
+	}
+}
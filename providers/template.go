@@ -0,0 +1,94 @@
+package providers
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// templateData is what a config_format template is executed with.
+type templateData struct {
+	Username string
+	Password string
+	Country  string
+	State    string
+	City     string
+	Session  string
+	Lifetime int
+}
+
+var templateFields = []struct {
+	name  string
+	field Field
+}{
+	{".Country", FieldCountry},
+	{".State", FieldState},
+	{".City", FieldCity},
+	{".Session", FieldSession},
+	{".Lifetime", FieldLifetime},
+}
+
+// IsTemplate reports whether an upstream's config_format is a template for
+// the generic adapter rather than a plain description.
+func IsTemplate(configFormat string) bool {
+	return strings.Contains(configFormat, "{{")
+}
+
+// Template is the generic adapter, driven by a text/template taken from the
+// upstream's config_format. The template renders "username:password", split
+// at the first colon, for example
+//
+//	{{.Username}}{{if .Country}}-country-{{.Country}}{{end}}{{if .Session}}-session-{{.Session}}{{end}}:{{.Password}}
+//
+// A field the template mentions is taken to be supported.
+type Template struct {
+	tmpl     *template.Template
+	supports []Field
+}
+
+// NewTemplate parses configFormat and checks it renders a username and
+// password.
+func NewTemplate(configFormat string) (*Template, error) {
+	tmpl, err := template.New("config_format").Option("missingkey=error").Parse(configFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config_format template: %w", err)
+	}
+	a := &Template{tmpl: tmpl}
+	for _, f := range templateFields {
+		if strings.Contains(configFormat, f.name) {
+			a.supports = append(a.supports, f.field)
+		}
+	}
+	sample := Targeting{Country: "us", State: "ny", City: "newyork", Session: "s1", Lifetime: 10}
+	if _, _, err := a.Credentials("user", "pass", sample); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Template) Credentials(username, password string, t Targeting) (string, string, error) {
+	var b strings.Builder
+	err := a.tmpl.Execute(&b, templateData{
+		Username: username,
+		Password: password,
+		Country:  t.Country,
+		State:    t.State,
+		City:     t.City,
+		Session:  t.Session,
+		Lifetime: t.Lifetime,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("invalid config_format template: %w", err)
+	}
+	user, pass, ok := strings.Cut(b.String(), ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid config_format template: it must render username:password")
+	}
+	return user, pass, nil
+}
+
+func (a *Template) ProxyString(t Targeting) string { return proxyString(a, t) }
+
+func (a *Template) NewSession() string { return randomHex(4) }
+
+func (a *Template) Supports() []Field { return a.supports }
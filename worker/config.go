@@ -50,8 +50,9 @@ func initConfig() (err error) {
 
 	// worker Configuration
 	captainURL := envConfig.CaptainURL
-	apiKey := envConfig.WorkerAPIKey
+	apiKey := envConfig.WorkerSecret
 	workerID := app.Flag("worker-id", "Worker ID UUID").String()
+	metricsAddr := app.Flag("metrics", "ip:port to serve prometheus metrics on, empty: disabled").String()
 
 	//########http#########
 	http := app.Command("http", "proxy on http mode")
@@ -130,7 +131,21 @@ func initConfig() (err error) {
 		if err != nil {
 			log.Fatalf("Failed to create worker: %v", err)
 		}
+		spool, err := manager.OpenTelemetrySpool(envConfig.TelemetrySpoolDir, envConfig.TelemetrySpoolMaxSize)
+		if err != nil {
+			log.Fatalf("Failed to open telemetry spool: %v", err)
+		}
+		worker.UseTelemetrySpool(spool)
+		worker.SetUsageWindow(envConfig.TelemetryUsageWindow)
+		worker.SetHealthInterval(envConfig.TelemetryHealthInterval)
 		worker.Start()
+		if *metricsAddr != "" {
+			go func() {
+				if err := worker.ServeMetrics(*metricsAddr); err != nil {
+					log.Fatalf("Failed to serve metrics: %v", err)
+				}
+			}()
+		}
 	} else {
 		log.Println("worker not configured (missing captain-url or worker-id or api-key)")
 	}
@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// accessLogMaxEntries bounds the buffer between flushes. Access logs are best
+// effort, so entries past it are dropped rather than held in memory.
+const accessLogMaxEntries = 10000
+
+// AccessLog buffers access log entries and hands them to flush once per
+// window. Unlike usage it is not spooled: losing a window on a disconnect only
+// loses detail, not billable traffic.
+type AccessLog struct {
+	window time.Duration
+	flush  func([]AccessLogEntry)
+
+	mu      sync.Mutex
+	entries []AccessLogEntry
+	dropped int
+
+	stopCh chan struct{}
+}
+
+func NewAccessLog(window time.Duration, flush func([]AccessLogEntry)) *AccessLog {
+	return &AccessLog{
+		window: window,
+		flush:  flush,
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (a *AccessLog) Start() {
+	go func() {
+		ticker := time.NewTicker(a.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Flush()
+			case <-a.stopCh:
+				a.Flush()
+				return
+			}
+		}
+	}()
+}
+
+func (a *AccessLog) Stop() {
+	close(a.stopCh)
+}
+
+// Add buffers an entry for the current window, dropping it if the buffer is
+// full.
+func (a *AccessLog) Add(entry AccessLogEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) >= accessLogMaxEntries {
+		a.dropped++
+		return
+	}
+	a.entries = append(a.entries, entry)
+}
+
+// Flush hands the buffered entries to the flush func. It does nothing if the
+// buffer is empty.
+func (a *AccessLog) Flush() {
+	a.mu.Lock()
+	entries := a.entries
+	dropped := a.dropped
+	a.entries = nil
+	a.dropped = 0
+	a.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("[AccessLog] buffer full, dropped %d entries", dropped)
+	}
+	if len(entries) == 0 {
+		return
+	}
+	a.flush(entries)
+}
@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestAccessLog_FlushesBufferedEntries(t *testing.T) {
+	var flushed [][]AccessLogEntry
+	a := NewAccessLog(time.Minute, func(e []AccessLogEntry) { flushed = append(flushed, e) })
+	a.Flush()
+	if len(flushed) != 0 {
+		t.Fatal("Should not flush an empty buffer")
+	}
+
+	a.Add(AccessLogEntry{Username: "alice", Domain: "example.com"})
+	a.Add(AccessLogEntry{Username: "alice", Domain: "example.org"})
+	a.Flush()
+	if len(flushed) != 1 || len(flushed[0]) != 2 {
+		t.Fatalf("Expected one flush of 2 entries, got %+v", flushed)
+	}
+	a.Flush()
+	if len(flushed) != 1 {
+		t.Error("Entries should not be flushed twice")
+	}
+}
+
+func TestAccessLog_DropsWhenFull(t *testing.T) {
+	var flushed []AccessLogEntry
+	a := NewAccessLog(time.Minute, func(e []AccessLogEntry) { flushed = e })
+	for i := 0; i < accessLogMaxEntries+10; i++ {
+		a.Add(AccessLogEntry{Username: "alice"})
+	}
+	a.Flush()
+	if len(flushed) != accessLogMaxEntries {
+		t.Errorf("Expected %d entries, got %d", accessLogMaxEntries, len(flushed))
+	}
+}
+
+func TestWorkerManager_RecordAccess_HonoursOptOut(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	var flushed []AccessLogEntry
+	wm.accessLog = NewAccessLog(time.Minute, func(e []AccessLogEntry) { flushed = e })
+	wm.userManager.SetUser(&User{Username: "alice"})
+	wm.userManager.SetUser(&User{Username: "bob", AccessLogOptOut: true})
+
+	wm.RecordAccess(AccessLogEntry{Username: "alice", Domain: "example.com"})
+	wm.RecordAccess(AccessLogEntry{Username: "bob", Domain: "example.com"})
+	wm.RecordAccess(AccessLogEntry{Username: "unknown", Domain: "example.com"})
+	wm.accessLog.Flush()
+
+	if len(flushed) != 1 || flushed[0].Username != "alice" {
+		t.Fatalf("Expected only alice's entry, got %+v", flushed)
+	}
+	if flushed[0].Timestamp.IsZero() {
+		t.Error("Expected the entry to be timestamped")
+	}
+}
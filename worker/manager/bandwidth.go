@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"golang.org/x/time/rate"
+)
+
+// bandwidthMinBurst is the io copy buffer size, the most a single read waits
+// for. A user's bucket holds at least this much so no read can exceed it.
+const bandwidthMinBurst = 32 * 1024
+
+// bandwidthLimit is the bytes per second the user may use on pool: the lower
+// of the user's and the pool's limits, ignoring those set to 0. It returns 0
+// if neither is limited.
+func (user *User) bandwidthLimit(pool string) int64 {
+	limit := user.BandwidthLimit
+	for _, p := range user.Pools {
+		if p.Tag == pool && p.BandwidthLimit > 0 && (limit == 0 || p.BandwidthLimit < limit) {
+			limit = p.BandwidthLimit
+		}
+	}
+	return limit
+}
+
+func bandwidthBurst(limit int64) int {
+	if limit < bandwidthMinBurst {
+		return bandwidthMinBurst
+	}
+	return int(limit)
+}
+
+// setBandwidthLimit brings the user's token bucket in line with limit. The
+// bucket is shared by all of the user's connections, so a changed limit also
+// applies to those already open. The caller holds liveMu.
+func (u *UserManager) setBandwidthLimit(username string, limit int64) {
+	if u.bandwidthLimiters == nil {
+		u.bandwidthLimiters = make(map[string]*rate.Limiter)
+	}
+	limiter, ok := u.bandwidthLimiters[username]
+	switch {
+	case limit <= 0 && ok:
+		// release the connections still waiting on the old bucket
+		limiter.SetLimit(rate.Inf)
+		delete(u.bandwidthLimiters, username)
+	case limit > 0 && ok:
+		if limiter.Limit() != rate.Limit(limit) {
+			limiter.SetBurst(bandwidthBurst(limit))
+			limiter.SetLimit(rate.Limit(limit))
+		}
+	case limit > 0:
+		u.bandwidthLimiters[username] = rate.NewLimiter(rate.Limit(limit), bandwidthBurst(limit))
+	}
+}
+
+// bandwidthLimiter returns the token bucket shared by the user's connections,
+// or nil if the user is not limited.
+func (u *UserManager) bandwidthLimiter(username string) *rate.Limiter {
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	return u.bandwidthLimiters[username]
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestUser_BandwidthLimit(t *testing.T) {
+	user := createTestUser("testuser", "testpass")
+	if limit := user.bandwidthLimit("test-pool"); limit != 0 {
+		t.Errorf("Expected no limit, got %d", limit)
+	}
+	user.BandwidthLimit = 1 << 20
+	if limit := user.bandwidthLimit("test-pool"); limit != 1<<20 {
+		t.Errorf("Expected the user's limit, got %d", limit)
+	}
+	user.Pools[0].BandwidthLimit = 1 << 10
+	if limit := user.bandwidthLimit("test-pool"); limit != 1<<10 {
+		t.Errorf("The lower pool limit should apply, got %d", limit)
+	}
+	if limit := user.bandwidthLimit("other-pool"); limit != 1<<20 {
+		t.Errorf("Pool limit should not apply to other pools, got %d", limit)
+	}
+}
+
+func TestUserManager_BandwidthLimiter_SharedByConnections(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.BandwidthLimit = 1 << 20
+	um.SetUser(user)
+
+	um.addConnection("testuser", "test-pool")
+	first := um.bandwidthLimiter("testuser")
+	if first == nil {
+		t.Fatal("Expected a limiter for a limited user")
+	}
+	if first.Limit() != rate.Limit(1<<20) {
+		t.Errorf("Expected a rate of %d, got %v", 1<<20, first.Limit())
+	}
+	um.addConnection("testuser", "test-pool")
+	if um.bandwidthLimiter("testuser") != first {
+		t.Error("Connections of one user should share a limiter")
+	}
+
+	um.removeConnection("testuser")
+	if um.bandwidthLimiter("testuser") != first {
+		t.Error("Limiter should be kept while the user has connections")
+	}
+	um.removeConnection("testuser")
+	if um.bandwidthLimiter("testuser") != nil {
+		t.Error("Limiter should be dropped with the last connection")
+	}
+}
+
+func TestUserManager_BandwidthLimiter_FollowsRefresh(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.BandwidthLimit = 1 << 20
+	um.SetUser(user)
+	um.addConnection("testuser", "test-pool")
+	limiter := um.bandwidthLimiter("testuser")
+
+	refreshed := createTestUser("testuser", "testpass")
+	refreshed.BandwidthLimit = 1 << 10
+	um.SetUser(refreshed)
+	um.addConnection("testuser", "test-pool")
+	if limiter.Limit() != rate.Limit(1<<10) {
+		t.Errorf("Open connections should get the new rate, got %v", limiter.Limit())
+	}
+	if limiter.Burst() < bandwidthMinBurst {
+		t.Errorf("Burst should cover a full read, got %d", limiter.Burst())
+	}
+
+	um.SetUser(createTestUser("testuser", "testpass"))
+	um.addConnection("testuser", "test-pool")
+	if limiter.Limit() != rate.Inf {
+		t.Error("Removing the limit should release open connections")
+	}
+	if um.bandwidthLimiter("testuser") != nil {
+		t.Error("An unlimited user should have no limiter")
+	}
+}
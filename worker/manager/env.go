@@ -3,7 +3,9 @@ package manager
 import (
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,7 +13,15 @@ import (
 type EnvConfig struct {
 	CaptainURL   string
 	AdminAPIKey  string
-	WorkerAPIKey string
+	WorkerSecret string
+	// TelemetrySpoolDir holds usage telemetry until captain acks it. Mount it
+	// on a volume so unacked usage survives a container restart.
+	TelemetrySpoolDir     string
+	TelemetrySpoolMaxSize int64
+	// TelemetryUsageWindow is how long usage is rolled up before it is sent.
+	TelemetryUsageWindow time.Duration
+	// TelemetryHealthInterval is how often worker and upstream health is sent.
+	TelemetryHealthInterval time.Duration
 }
 
 func EnvLoad() EnvConfig {
@@ -29,8 +39,28 @@ func EnvLoad() EnvConfig {
 	config := EnvConfig{
 		CaptainURL:   getEnv("CAPTAIN_URL", ""),
 		AdminAPIKey:  getEnv("ADMIN_API_KEY", ""),
-		WorkerAPIKey: getEnv("WORKER_API_KEY", ""),
+		WorkerSecret: getEnv("WORKER_SECRET", ""),
+
+		TelemetrySpoolDir: getEnv("TELEMETRY_SPOOL_DIR", "/var/lib/worker/telemetry"),
+	}
+
+	spoolMaxMB, err := strconv.ParseInt(getEnv("TELEMETRY_SPOOL_MAX_MB", "256"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid TELEMETRY_SPOOL_MAX_MB: %v", err)
+	}
+	config.TelemetrySpoolMaxSize = spoolMaxMB << 20
+
+	usageWindow, err := time.ParseDuration(getEnv("TELEMETRY_USAGE_WINDOW", "10s"))
+	if err != nil || usageWindow <= 0 {
+		log.Fatalf("Invalid TELEMETRY_USAGE_WINDOW: %q", getEnv("TELEMETRY_USAGE_WINDOW", ""))
+	}
+	config.TelemetryUsageWindow = usageWindow
+
+	healthInterval, err := time.ParseDuration(getEnv("TELEMETRY_HEALTH_INTERVAL", "30s"))
+	if err != nil || healthInterval <= 0 {
+		log.Fatalf("Invalid TELEMETRY_HEALTH_INTERVAL: %q", getEnv("TELEMETRY_HEALTH_INTERVAL", ""))
 	}
+	config.TelemetryHealthInterval = healthInterval
 
 	config.validate()
 
@@ -46,9 +76,9 @@ func getEnv(key, fallback string) string {
 
 func (c *EnvConfig) validate() {
 	required := map[string]string{
-		"CAPTAIN_URL":    c.CaptainURL,
-		"ADMIN_API_KEY":  c.AdminAPIKey,
-		"WORKER_API_KEY": c.WorkerAPIKey,
+		"CAPTAIN_URL":   c.CaptainURL,
+		"ADMIN_API_KEY": c.AdminAPIKey,
+		"WORKER_SECRET": c.WorkerSecret,
 	}
 
 	var message strings.Builder
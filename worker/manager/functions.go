@@ -27,7 +27,7 @@ func LogintoCaptain(captainURL, workerID, APIKey string) (string, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return "", err
+		return "", fmt.Errorf("captain login failed: %s", resp.Status)
 	}
 	var loginResp WorkerLoginResponse
 	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
@@ -38,9 +38,18 @@ type HealthCollector struct {
 	errorCount        uint64
 	successCount      uint64
 
+	// serviceConnections splits activeConnections by the service (http,
+	// socks) that accepted them.
+	serviceConnections map[string]*uint32
+	serviceMu          sync.RWMutex
+
 	upstreamStats map[uuid.UUID]*UpstreamStats
 	upstreamMu    sync.RWMutex
 
+	// lastBuild is when the previous report was built; throughput is averaged
+	// over the time since.
+	lastBuild time.Time
+
 	sampleTicker *time.Ticker
 	stopCh       chan struct{}
 }
@@ -50,6 +59,9 @@ func NewHealthCollector(workerID uuid.UUID) *HealthCollector {
 		workerID:      workerID,
 		samples:       make([]HealthSample, 0),
 		upstreamStats: make(map[uuid.UUID]*UpstreamStats),
+		lastBuild:     time.Now(),
+
+		serviceConnections: make(map[string]*uint32),
 
 		stopCh: make(chan struct{}),
 	}
@@ -80,6 +92,13 @@ func (h *HealthCollector) Stop() {
 }
 
 func (h *HealthCollector) RecordSample() {
+	sample := takeSample()
+	h.mu.Lock()
+	h.samples = append(h.samples, sample)
+	h.mu.Unlock()
+}
+
+func takeSample() HealthSample {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
 
@@ -95,24 +114,50 @@ func (h *HealthCollector) RecordSample() {
 		cpuUsage = 100
 	}
 
-	sample := HealthSample{
+	return HealthSample{
 		CpuUsage:    cpuUsage,
 		MemoryUsage: memUsage,
 		Timestamp:   time.Now(),
 	}
-
-	h.mu.Lock()
-	h.samples = append(h.samples, sample)
-	h.mu.Unlock()
 }
 
-func (h *HealthCollector) IncrementConnection() {
+func (h *HealthCollector) IncrementConnection(service string) {
 	atomic.AddUint32(&h.activeConnections, 1)
 	atomic.AddUint64(&h.totalConnections, 1)
+	atomic.AddUint32(h.serviceCounter(service), 1)
 }
 
-func (h *HealthCollector) DecrementConnection() {
+func (h *HealthCollector) DecrementConnection(service string) {
 	atomic.AddUint32(&h.activeConnections, ^uint32(0))
+	atomic.AddUint32(h.serviceCounter(service), ^uint32(0))
+}
+
+func (h *HealthCollector) serviceCounter(service string) *uint32 {
+	h.serviceMu.RLock()
+	counter, ok := h.serviceConnections[service]
+	h.serviceMu.RUnlock()
+	if ok {
+		return counter
+	}
+	h.serviceMu.Lock()
+	defer h.serviceMu.Unlock()
+	if counter, ok = h.serviceConnections[service]; !ok {
+		counter = new(uint32)
+		h.serviceConnections[service] = counter
+	}
+	return counter
+}
+
+// ActiveConnectionsByService returns the open connections of each service
+// that has accepted any.
+func (h *HealthCollector) ActiveConnectionsByService() map[string]uint32 {
+	h.serviceMu.RLock()
+	defer h.serviceMu.RUnlock()
+	active := make(map[string]uint32, len(h.serviceConnections))
+	for service, counter := range h.serviceConnections {
+		active[service] = atomic.LoadUint32(counter)
+	}
+	return active
 }
 
 func (h *HealthCollector) AddThroughput(bytes uint64) {
@@ -158,7 +203,15 @@ func (h *HealthCollector) BuildWorkerHealth() WorkerHealth {
 	h.mu.Lock()
 	samples := h.samples
 	h.samples = make([]HealthSample, 0)
+	now := time.Now()
+	elapsed := now.Sub(h.lastBuild)
+	h.lastBuild = now
 	h.mu.Unlock()
+	if len(samples) == 0 {
+		// Reports can be more frequent than sampling; take one now so CPU and
+		// memory are not reported as zero.
+		samples = append(samples, takeSample())
+	}
 
 	var avgCpu, avgMem float32
 	if len(samples) > 0 {
@@ -183,7 +236,10 @@ func (h *HealthCollector) BuildWorkerHealth() WorkerHealth {
 		errorRate = float32(errors) / float32(totalRequests) * 100
 	}
 
-	bytesPerSec := throughput / 3600
+	bytesPerSec := throughput
+	if elapsed >= time.Second {
+		bytesPerSec = uint64(float64(throughput) / elapsed.Seconds())
+	}
 
 	status := "healthy"
 	if errorRate > 50 {
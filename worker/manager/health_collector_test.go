@@ -60,19 +60,19 @@ func TestHealthCollector_RecordSample_Multiple(t *testing.T) {
 func TestHealthCollector_ConnectionTracking(t *testing.T) {
 	workerID := uuid.New()
 	hc := NewHealthCollector(workerID)
-	hc.IncrementConnection()
+	hc.IncrementConnection("http")
 	active := atomic.LoadUint32(&hc.activeConnections)
 	if active != 1 {
 		t.Errorf("Active connections should be 1, got %d", active)
 	}
 	for i := 0; i < 10; i++ {
-		hc.IncrementConnection()
+		hc.IncrementConnection("http")
 	}
 	active = atomic.LoadUint32(&hc.activeConnections)
 	if active != 11 {
 		t.Errorf("Active connections should be 11, got %d", active)
 	}
-	hc.DecrementConnection()
+	hc.DecrementConnection("http")
 	active = atomic.LoadUint32(&hc.activeConnections)
 	if active != 10 {
 		t.Errorf("Active connections should be 10 after decrement, got %d", active)
@@ -176,8 +176,8 @@ func TestHealthCollector_BuildWorkerHealth(t *testing.T) {
 	workerID := uuid.New()
 	hc := NewHealthCollector(workerID)
 	hc.UpdateWorkerInfo("test-worker", "us-east-1")
-	hc.IncrementConnection()
-	hc.IncrementConnection()
+	hc.IncrementConnection("http")
+	hc.IncrementConnection("http")
 	hc.AddThroughput(102400)
 	hc.RecordSuccess()
 	hc.RecordSuccess()
@@ -235,7 +235,7 @@ func TestHealthCollector_BuildWorkerHealth(t *testing.T) {
 func TestHealthCollector_BuildWorkerHealth_Reset(t *testing.T) {
 	workerID := uuid.New()
 	hc := NewHealthCollector(workerID)
-	hc.IncrementConnection()
+	hc.IncrementConnection("http")
 	hc.AddThroughput(102400)
 	hc.RecordSuccess()
 	hc.RecordSample()
@@ -255,11 +255,24 @@ func TestHealthCollector_BuildWorkerHealth_Reset(t *testing.T) {
 	}
 }
 
+func TestHealthCollector_BuildWorkerHealth_ThroughputOverInterval(t *testing.T) {
+	hc := NewHealthCollector(uuid.New())
+	hc.lastBuild = time.Now().Add(-10 * time.Second)
+	hc.AddThroughput(1000)
+	health := hc.BuildWorkerHealth()
+	if health.BytesThroughputPerSec < 95 || health.BytesThroughputPerSec > 100 {
+		t.Errorf("Expected about 100 bytes/sec over 10s, got %d", health.BytesThroughputPerSec)
+	}
+	if health.MemoryUsage == 0 {
+		t.Error("Expected a sample to be taken when none was recorded")
+	}
+}
+
 func TestHealthCollector_StatusDetermination(t *testing.T) {
 	workerID := uuid.New()
 	t.Run("Healthy", func(t *testing.T) {
 		hc := NewHealthCollector(workerID)
-		hc.IncrementConnection()
+		hc.IncrementConnection("http")
 		hc.RecordSuccess()
 		hc.RecordSuccess()
 		hc.RecordSuccess()
@@ -270,7 +283,7 @@ func TestHealthCollector_StatusDetermination(t *testing.T) {
 	})
 	t.Run("Degraded", func(t *testing.T) {
 		hc := NewHealthCollector(workerID)
-		hc.IncrementConnection()
+		hc.IncrementConnection("http")
 		for i := 0; i < 10; i++ {
 			hc.RecordError()
 		}
@@ -313,8 +326,8 @@ func TestHealthCollector_ConcurrentAccess(t *testing.T) {
 	go func() {
 		defer wg.Done()
 		for i := 0; i < 100; i++ {
-			hc.IncrementConnection()
-			hc.DecrementConnection()
+			hc.IncrementConnection("http")
+			hc.DecrementConnection("http")
 		}
 	}()
 	wg.Add(1)
@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "worker"
+
+// Metrics exposes the worker to Prometheus. Open connections are read from the
+// HealthCollector at scrape time; everything else is counted here as it
+// happens. A nil *Metrics records nothing.
+type Metrics struct {
+	registry     *prometheus.Registry
+	userBytes    *prometheus.CounterVec
+	upstreamDial *prometheus.HistogramVec
+	authCache    *prometheus.CounterVec
+	verifyUser   *prometheus.HistogramVec
+}
+
+func NewMetrics(health *HealthCollector) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		userBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "user_bytes_total",
+			Help:      "Bytes proxied per user and pool, by direction.",
+		}, []string{"username", "pool", "direction"}),
+		upstreamDial: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_dial_duration_seconds",
+			Help:      "Time taken to connect to an upstream, by upstream tag and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream", "result"}),
+		authCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_cache_requests_total",
+			Help:      "Credential checks answered from the user cache (hit) or sent to captain (miss).",
+		}, []string{"result"}),
+		verifyUser: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "verify_user_duration_seconds",
+			Help:      "Round trip of verify_user requests to captain, by result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.userBytes,
+		m.upstreamDial,
+		m.authCache,
+		m.verifyUser,
+		&healthMetrics{health: health},
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) AddUserBytes(username, pool string, sent, received uint64) {
+	if m == nil {
+		return
+	}
+	m.userBytes.WithLabelValues(username, pool, "sent").Add(float64(sent))
+	m.userBytes.WithLabelValues(username, pool, "received").Add(float64(received))
+}
+
+func (m *Metrics) ObserveUpstreamDial(upstream string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.upstreamDial.WithLabelValues(upstream, result).Observe(latency.Seconds())
+}
+
+func (m *Metrics) AuthCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.authCache.WithLabelValues(result).Inc()
+}
+
+// ObserveVerifyUser records a verify_user round trip that began at start.
+// result is accepted, rejected or timeout.
+func (m *Metrics) ObserveVerifyUser(result string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.verifyUser.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+var activeConnectionsDesc = prometheus.NewDesc(
+	metricsNamespace+"_active_connections",
+	"Open client connections, by service.",
+	[]string{"service"}, nil,
+)
+
+// healthMetrics reads the HealthCollector's connection counters when scraped,
+// so they are not counted twice.
+type healthMetrics struct {
+	health *HealthCollector
+}
+
+func (c *healthMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeConnectionsDesc
+}
+
+func (c *healthMetrics) Collect(ch chan<- prometheus.Metric) {
+	for service, active := range c.health.ActiveConnectionsByService() {
+		ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue, float64(active), service)
+	}
+}
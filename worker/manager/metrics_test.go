@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics_ReportsWorkerActivity(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	wm.IncrementConnection("http")
+	wm.IncrementConnection("http")
+	wm.IncrementConnection("socks")
+	wm.DecrementConnection("socks", false)
+	wm.RecordDataUsage(100, 200, 1, "alice", "10.0.0.1", "example.com", 443, ProtocolHTTPS)
+	upstream := &Upstream{UpstreamID: uuid.New(), UpstreamTag: "up-1"}
+	wm.RecordUpstreamLatency(upstream, 20*time.Millisecond, nil)
+	wm.RecordUpstreamLatency(upstream, time.Second, errors.New("refused"))
+
+	body := scrapeMetrics(t, wm.metrics)
+	for _, want := range []string{
+		`worker_active_connections{service="http"} 2`,
+		`worker_active_connections{service="socks"} 0`,
+		`worker_user_bytes_total{direction="sent",pool="",username="alice"} 100`,
+		`worker_user_bytes_total{direction="received",pool="",username="alice"} 200`,
+		`worker_upstream_dial_duration_seconds_count{result="success",upstream="up-1"} 1`,
+		`worker_upstream_dial_duration_seconds_count{result="error",upstream="up-1"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestMetrics_CountsAuthCacheAndVerifyUser(t *testing.T) {
+	um := NewUserManager()
+	um.metrics = NewMetrics(NewHealthCollector(uuid.New()))
+	um.SetUser(createTestUser("cached", "testpass"))
+	um.VerifyUser("cached", "testpass", func(Event) {}, "test-pool")
+
+	// captain answers the verify_user request for an uncached user
+	onVerifyUser := func(event Event) {
+		go um.processVerifyUserResponse(UserPayload{RequestID: loginRequestID(event), Username: "fresh", Status: "active", Pools: []string{"test-pool:1000:0"}})
+	}
+	if !um.VerifyUser("fresh", "testpass", onVerifyUser, "test-pool") {
+		t.Fatal("Expected the user to be accepted by captain")
+	}
+
+	body := scrapeMetrics(t, um.metrics)
+	for _, want := range []string{
+		`worker_auth_cache_requests_total{result="hit"} 1`,
+		`worker_auth_cache_requests_total{result="miss"} 1`,
+		`worker_verify_user_duration_seconds_count{result="accepted"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
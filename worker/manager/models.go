@@ -1,11 +1,16 @@
 package manager
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
+// Event is a message on the captain websocket. Seq numbers spooled telemetry
+// so captain can ack it; other events leave it zero.
 type Event struct {
 	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
@@ -30,6 +35,28 @@ type ConfigPayload struct {
 	PoolPort      int              `json:"pool_port"`
 	PoolSubdomain string           `json:"pool_subdomain"`
 	Upstreams     []UpstreamConfig `json:"upstreams"`
+	// Countries is the targeting catalog of the pool's region.
+	Countries []TargetingCountry `json:"countries"`
+	// ResolveLocally makes the worker resolve SOCKS targets itself and send
+	// the upstream an IP address instead of the domain name.
+	ResolveLocally bool `json:"resolve_locally"`
+	// TelemetrySeq is the highest telemetry seq captain has committed for this
+	// worker. The spool is rebased past it before anything is sent.
+	TelemetrySeq uint64 `json:"telemetry_seq"`
+}
+
+// TargetingCountry lists the states and cities clients may target in a
+// country.
+type TargetingCountry struct {
+	Code   string          `json:"code"`
+	States []string        `json:"states"`
+	Cities []TargetingCity `json:"cities"`
+}
+
+// TargetingCity is a city code and, if it has one, the code of its state.
+type TargetingCity struct {
+	Code  string `json:"code"`
+	State string `json:"state,omitempty"`
 }
 
 type UpstreamConfig struct {
@@ -45,25 +72,55 @@ type UpstreamConfig struct {
 }
 
 type UserLoginPayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	// RequestID ties captain's reply to this login, as logins of the same
+	// user with different passwords may be in flight at once.
+	RequestID string `json:"request_id"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+type UserIPLoginPayload struct {
+	ClientIP string `json:"client_ip"`
 }
 
 type UserPayload struct {
 	ID          uuid.UUID `json:"id"`
 	Username    string    `json:"username"`
-	Password    string    `json:"password"`
 	Status      string    `json:"status"`
 	IpWhitelist []string  `json:"ip_whitelist"`
 	Pools       []string  `json:"pools"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+
+	AccessLogOptOut bool  `json:"access_log_opt_out"`
+	MaxConnections  int   `json:"max_connections"`
+	BandwidthLimit  int64 `json:"bandwidth_limit"`
+}
+
+// LoginFailedPayload identifies the login captain rejected.
+type LoginFailedPayload struct {
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
+// PoolLimit is a user's allowance on one pool. A MaxConnections or
+// BandwidthLimit of 0 leaves the pool bounded only by the user's own limit.
 type PoolLimit struct {
-	Tag       string
-	DataLimit int
-	DataUsage int
+	Tag            string
+	DataLimit      int
+	DataUsage      int
+	MaxConnections int
+	BandwidthLimit int64
 }
 
+// Protocols usage is reported under.
+const (
+	ProtocolHTTP   = "HTTP"
+	ProtocolHTTPS  = "HTTPS"
+	ProtocolSOCKS5 = "SOCKS5"
+	ProtocolUDP    = "UDP"
+)
+
 // UserDataUsage tracks per-user data usage for reporting to Captain
 type UserDataUsage struct {
 	UserID          uuid.UUID `json:"user_id"`
@@ -79,6 +136,33 @@ type UserDataUsage struct {
 	DestinationHost string    `json:"destination_host"`
 	DestinationPort uint16    `json:"destination_port"`
 	StatusCode      uint16    `json:"status_code"`
+	// Requests is how many connections or UDP associations the usage
+	// starts; 0 for later datagrams of an association already counted.
+	Requests uint64 `json:"-"`
+}
+
+// UsageBatch is the usage rolled up over one aggregation window, sent to
+// Captain as a telemetry_usage_batch event.
+type UsageBatch struct {
+	WorkerID     uuid.UUID         `json:"worker_id"`
+	WorkerRegion string            `json:"worker_region"`
+	WindowStart  time.Time         `json:"window_start"`
+	WindowEnd    time.Time         `json:"window_end"`
+	Entries      []UsageBatchEntry `json:"entries"`
+}
+
+// UsageBatchEntry totals one (user, pool, destination host, protocol) within
+// a window. Requests counts the connections or datagrams rolled into it.
+type UsageBatchEntry struct {
+	UserID          uuid.UUID `json:"user_id"`
+	Username        string    `json:"username"`
+	PoolID          uuid.UUID `json:"pool_id"`
+	PoolName        string    `json:"pool_name"`
+	DestinationHost string    `json:"destination_host"`
+	Protocol        string    `json:"protocol"`
+	BytesSent       uint64    `json:"bytes_sent"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	Requests        uint64    `json:"requests"`
 }
 
 type WorkerHealth struct {
@@ -103,3 +187,25 @@ type UpstreamHealth struct {
 	Latency     int64     `json:"latency"`
 	ErrorRate   float32   `json:"error_rate"`
 }
+
+// AccessLogEntry is one proxied request. Plain HTTP requests carry the URL,
+// status code and content type; HTTPS and SOCKS connections only the host.
+type AccessLogEntry struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Username      string    `json:"username"`
+	Domain        string    `json:"domain"`
+	FullURL       string    `json:"full_url"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	RequestMethod string    `json:"request_method"`
+	StatusCode    uint16    `json:"status_code"`
+	ContentType   string    `json:"content_type"`
+	SourceIP      string    `json:"source_ip"`
+}
+
+// AccessLogBatch is the access log buffered over one window, sent to Captain
+// as a telemetry_access_log_batch event.
+type AccessLogBatch struct {
+	WorkerID uuid.UUID        `json:"worker_id"`
+	Entries  []AccessLogEntry `json:"entries"`
+}
@@ -2,11 +2,16 @@ package manager
 
 import (
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
 )
 
 type Pool struct {
@@ -15,6 +20,9 @@ type Pool struct {
 	Region        string
 	PoolPort      int
 	PoolSubdomain string
+	// ResolveLocally is set when SOCKS targets are resolved by the worker
+	// rather than the upstream.
+	ResolveLocally bool
 }
 
 type Upstream struct {
@@ -27,6 +35,26 @@ type Upstream struct {
 	UpstreamPort     int
 	UpstreamProvider string
 	Weight           int
+	// Adapter speaks the provider's credential syntax. It is resolved from
+	// UpstreamProvider and UpstreamFormat when left nil.
+	Adapter providers.Adapter
+}
+
+// Credentials builds the username and password to send to the upstream for
+// the client's targeting.
+func (u *Upstream) Credentials(tag providers.Targeting) (string, string, error) {
+	adapter := u.Adapter
+	if adapter == nil {
+		var err error
+		if adapter, err = providers.ForUpstream(u.UpstreamProvider, u.UpstreamFormat); err != nil {
+			return "", "", fmt.Errorf("upstream %s: %w", u.UpstreamTag, err)
+		}
+	}
+	user, pass, err := adapter.Credentials(u.UpstreamUsername, u.UpstreamPassword, tag)
+	if err != nil {
+		return "", "", fmt.Errorf("upstream %s: %w", u.UpstreamTag, err)
+	}
+	return user, pass, nil
 }
 
 func NewPool(poolId uuid.UUID, poolTag string, poolPort int, poolSubdomain string) *Pool {
@@ -42,13 +70,23 @@ func NewPool(poolId uuid.UUID, poolTag string, poolPort int, poolSubdomain strin
 
 type UpstreamManager struct {
 	upstreams []Upstream
+	schedule  []int
+	breakers  map[uuid.UUID]*upstreamBreaker
 	index     uint64
 	mu        sync.RWMutex
+
+	FailureThreshold uint32
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
 }
 
 func NewUpstreamManager() *UpstreamManager {
 	return &UpstreamManager{
-		upstreams: make([]Upstream, 0),
+		upstreams:        make([]Upstream, 0),
+		breakers:         make(map[uuid.UUID]*upstreamBreaker),
+		FailureThreshold: DefaultBreakerFailureThreshold,
+		BaseBackoff:      DefaultBreakerBaseBackoff,
+		MaxBackoff:       DefaultBreakerMaxBackoff,
 	}
 }
 
@@ -56,23 +94,221 @@ func (m *UpstreamManager) SetUpstreams(upstreams []Upstream) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.upstreams = upstreams
-	log.Printf("[UpstreamManager] Updated upstreams, count: %d", len(upstreams))
+	m.schedule = buildWeightedSchedule(upstreams)
+	breakers := make(map[uuid.UUID]*upstreamBreaker, len(upstreams))
+	for _, u := range upstreams {
+		if b, ok := m.breakers[u.UpstreamID]; ok {
+			breakers[u.UpstreamID] = b
+			continue
+		}
+		breakers[u.UpstreamID] = newUpstreamBreaker(m.FailureThreshold, m.BaseBackoff, m.MaxBackoff)
+	}
+	m.breakers = breakers
+	atomic.StoreUint64(&m.index, 0)
+	log.Printf("[UpstreamManager] Updated upstreams, count: %d, schedule length: %d", len(upstreams), len(m.schedule))
 	for i, u := range upstreams {
-		log.Printf("[UpstreamManager] Upstream %d: %s:%d (tag: %s)", i, u.UpstreamHost, u.UpstreamPort, u.UpstreamTag)
+		log.Printf("[UpstreamManager] Upstream %d: %s:%d (tag: %s, weight: %d)", i, u.UpstreamHost, u.UpstreamPort, u.UpstreamTag, u.Weight)
+	}
+}
+
+// Next returns the next upstream in weighted round-robin order, skipping
+// upstreams that are ejected by their circuit breaker and any listed in
+// exclude. It returns nil when no upstream is available.
+func (m *UpstreamManager) Next(exclude ...uuid.UUID) *Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.schedule) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := 0; i < len(m.schedule); i++ {
+		idx := atomic.AddUint64(&m.index, 1) - 1
+		selectedIdx := m.schedule[idx%uint64(len(m.schedule))]
+		upstream := m.upstreams[selectedIdx]
+		if containsUpstreamID(exclude, upstream.UpstreamID) {
+			continue
+		}
+		if b, ok := m.breakers[upstream.UpstreamID]; ok && !b.allow(now) {
+			continue
+		}
+		log.Printf("[UpstreamManager] Weighted round-robin selected upstream %d: %s:%d", selectedIdx, upstream.UpstreamHost, upstream.UpstreamPort)
+		return &upstream
+	}
+	log.Printf("[UpstreamManager] No healthy upstream available")
+	return nil
+}
+
+// NextForKey returns the upstream key maps to by weighted rendezvous hashing,
+// skipping upstreams that are ejected or listed in exclude. Every worker given
+// the same upstreams maps a key to the same upstream, and when it is skipped
+// the key falls back to the next highest scoring one, so the fallback agrees
+// across workers too. It returns nil when no upstream is available.
+func (m *UpstreamManager) NextForKey(key string, exclude ...uuid.UUID) *Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type candidate struct {
+		upstream Upstream
+		score    float64
+	}
+	candidates := make([]candidate, 0, len(m.upstreams))
+	for _, u := range m.upstreams {
+		if u.Weight <= 0 || containsUpstreamID(exclude, u.UpstreamID) {
+			continue
+		}
+		candidates = append(candidates, candidate{u, rendezvousScore(key, u.UpstreamID, u.Weight)})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	now := time.Now()
+	for _, c := range candidates {
+		if b, ok := m.breakers[c.upstream.UpstreamID]; ok && !b.allow(now) {
+			continue
+		}
+		upstream := c.upstream
+		log.Printf("[UpstreamManager] Rendezvous selected upstream %s:%d", upstream.UpstreamHost, upstream.UpstreamPort)
+		return &upstream
+	}
+	log.Printf("[UpstreamManager] No healthy upstream available")
+	return nil
+}
+
+// Get returns the upstream with upstreamID if it is still configured and
+// neither ejected nor listed in exclude. It returns nil otherwise.
+func (m *UpstreamManager) Get(upstreamID uuid.UUID, exclude ...uuid.UUID) *Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if containsUpstreamID(exclude, upstreamID) {
+		return nil
+	}
+	for _, u := range m.upstreams {
+		if u.UpstreamID != upstreamID || u.Weight <= 0 {
+			continue
+		}
+		if b, ok := m.breakers[upstreamID]; ok && !b.allow(time.Now()) {
+			return nil
+		}
+		upstream := u
+		return &upstream
+	}
+	return nil
+}
+
+// rendezvousScore is the weighted rendezvous hashing score of an upstream for
+// key: -weight / ln(h), with h the hash of both mapped into (0, 1).
+func rendezvousScore(key string, upstreamID uuid.UUID, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write(upstreamID[:])
+	unit := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(unit)
+}
+
+// IsAvailable reports whether the upstream is configured and not ejected. It
+// does not consume a half-open probe.
+func (m *UpstreamManager) IsAvailable(upstreamID uuid.UUID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.breakers[upstreamID]
+	return ok && b.status() == ""
+}
+
+// ReportResult feeds the outcome of a connect or handshake back into the
+// upstream's circuit breaker.
+func (m *UpstreamManager) ReportResult(upstreamID uuid.UUID, err error) {
+	m.mu.RLock()
+	b, ok := m.breakers[upstreamID]
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+	if err == nil {
+		if b.status() != "" {
+			log.Printf("[UpstreamManager] Upstream %s recovered", upstreamID)
+		}
+		b.recordSuccess()
+		return
+	}
+	if b.recordFailure(time.Now()) {
+		log.Printf("[UpstreamManager] Upstream %s ejected after failure: %v", upstreamID, err)
 	}
 }
 
-func (m *UpstreamManager) Next() *Upstream {
+// BreakerStatuses returns the health entries of upstreams whose circuit
+// breaker is not closed, with Status set to ejected or recovering.
+func (m *UpstreamManager) BreakerStatuses() []UpstreamHealth {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	if len(m.upstreams) == 0 {
+	statuses := make([]UpstreamHealth, 0)
+	for _, u := range m.upstreams {
+		b, ok := m.breakers[u.UpstreamID]
+		if !ok {
+			continue
+		}
+		if status := b.status(); status != "" {
+			statuses = append(statuses, UpstreamHealth{
+				UpstreamID:  u.UpstreamID,
+				UpstreamTag: u.UpstreamTag,
+				Status:      status,
+			})
+		}
+	}
+	return statuses
+}
+
+func containsUpstreamID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// buildWeightedSchedule expands the upstream weights into one cycle of a
+// smooth weighted round-robin, so Next only has to index into it. Weights are
+// reduced by their GCD to keep the cycle short. Upstreams with a weight of 0
+// (or below) are drained and never appear in the schedule.
+func buildWeightedSchedule(upstreams []Upstream) []int {
+	divisor := 0
+	for _, u := range upstreams {
+		if u.Weight > 0 {
+			divisor = gcd(divisor, u.Weight)
+		}
+	}
+	if divisor == 0 {
 		return nil
 	}
-	idx := atomic.AddUint64(&m.index, 1) - 1
-	selectedIdx := idx % uint64(len(m.upstreams))
-	upstream := m.upstreams[selectedIdx]
-	log.Printf("[UpstreamManager] Round-robin selected upstream %d: %s:%d", selectedIdx, upstream.UpstreamHost, upstream.UpstreamPort)
-	return &upstream
+	weights := make([]int, len(upstreams))
+	total := 0
+	for i, u := range upstreams {
+		if u.Weight > 0 {
+			weights[i] = u.Weight / divisor
+			total += weights[i]
+		}
+	}
+	current := make([]int, len(upstreams))
+	schedule := make([]int, 0, total)
+	for n := 0; n < total; n++ {
+		best := -1
+		for i, w := range weights {
+			if w == 0 {
+				continue
+			}
+			current[i] += w
+			if best == -1 || current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
 }
 
 func (m *UpstreamManager) HasUpstreams() bool {
@@ -1,9 +1,12 @@
 package manager
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
 )
 
 func TestUpstreamManager_NewUpstreamManager(t *testing.T) {
@@ -115,6 +118,181 @@ func TestUpstreamManager_Next_SingleUpstream(t *testing.T) {
 	}
 }
 
+func TestUpstreamManager_Next_Weighted(t *testing.T) {
+	um := NewUpstreamManager()
+	heavy := createTestUpstream("heavy", "127.0.0.1", 3128)
+	heavy.Weight = 5
+	medium := createTestUpstream("medium", "127.0.0.2", 3128)
+	medium.Weight = 3
+	light := createTestUpstream("light", "127.0.0.3", 3128)
+	light.Weight = 2
+	um.SetUpstreams([]Upstream{heavy, medium, light})
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[um.Next().UpstreamTag]++
+	}
+	if counts["heavy"] != 50 || counts["medium"] != 30 || counts["light"] != 20 {
+		t.Errorf("Should select upstreams in proportion to weight, got %v", counts)
+	}
+}
+
+func TestUpstreamManager_Next_WeightedSmooth(t *testing.T) {
+	um := NewUpstreamManager()
+	heavy := createTestUpstream("heavy", "127.0.0.1", 3128)
+	heavy.Weight = 4
+	light := createTestUpstream("light", "127.0.0.2", 3128)
+	um.SetUpstreams([]Upstream{heavy, light})
+	expected := []string{"heavy", "heavy", "light", "heavy", "heavy"}
+	for i, tag := range expected {
+		selected := um.Next()
+		if selected.UpstreamTag != tag {
+			t.Errorf("Selection %d should be %s, got %s", i, tag, selected.UpstreamTag)
+		}
+	}
+}
+
+func TestUpstreamManager_Next_ZeroWeightDrained(t *testing.T) {
+	um := NewUpstreamManager()
+	drained := createTestUpstream("drained", "127.0.0.1", 3128)
+	drained.Weight = 0
+	active := createTestUpstream("active", "127.0.0.2", 3128)
+	um.SetUpstreams([]Upstream{drained, active})
+	for i := 0; i < 10; i++ {
+		selected := um.Next()
+		if selected == nil || selected.UpstreamTag != "active" {
+			t.Fatalf("Should never select a drained upstream, got %v", selected)
+		}
+	}
+}
+
+func TestUpstreamManager_Next_AllDrained(t *testing.T) {
+	um := NewUpstreamManager()
+	drained := createTestUpstream("drained", "127.0.0.1", 3128)
+	drained.Weight = 0
+	um.SetUpstreams([]Upstream{drained})
+	if !um.HasUpstreams() {
+		t.Error("Should still report configured upstreams when all are drained")
+	}
+	if um.Next() != nil {
+		t.Error("Should return nil when all upstreams are drained")
+	}
+}
+
+func TestUpstreamManager_Next_Exclude(t *testing.T) {
+	um := NewUpstreamManager()
+	first := createTestUpstream("upstream1", "127.0.0.1", 3128)
+	second := createTestUpstream("upstream2", "127.0.0.2", 3128)
+	um.SetUpstreams([]Upstream{first, second})
+	for i := 0; i < 4; i++ {
+		selected := um.Next(first.UpstreamID)
+		if selected == nil || selected.UpstreamTag != "upstream2" {
+			t.Fatalf("Should skip excluded upstream, got %v", selected)
+		}
+	}
+	if um.Next(first.UpstreamID, second.UpstreamID) != nil {
+		t.Error("Should return nil when every upstream is excluded")
+	}
+}
+
+func TestUpstreamManager_NextForKey_SameAcrossManagers(t *testing.T) {
+	upstreams := []Upstream{
+		createTestUpstream("upstream1", "127.0.0.1", 3128),
+		createTestUpstream("upstream2", "127.0.0.2", 3128),
+		createTestUpstream("upstream3", "127.0.0.3", 3128),
+	}
+	first := NewUpstreamManager()
+	first.SetUpstreams(upstreams)
+	// another worker may list the pool's upstreams in a different order
+	second := NewUpstreamManager()
+	second.SetUpstreams([]Upstream{upstreams[2], upstreams[0], upstreams[1]})
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("alice\x00session%d", i)
+		a, b := first.NextForKey(key), second.NextForKey(key)
+		if a == nil || b == nil || a.UpstreamID != b.UpstreamID {
+			t.Fatalf("Key %q should map to the same upstream on every manager", key)
+		}
+		if again := first.NextForKey(key); again.UpstreamID != a.UpstreamID {
+			t.Fatalf("Key %q should always map to the same upstream", key)
+		}
+	}
+}
+
+func TestUpstreamManager_NextForKey_Weighted(t *testing.T) {
+	um := NewUpstreamManager()
+	heavy := createTestUpstream("heavy", "127.0.0.1", 3128)
+	heavy.Weight = 3
+	light := createTestUpstream("light", "127.0.0.2", 3128)
+	drained := createTestUpstream("drained", "127.0.0.3", 3128)
+	drained.Weight = 0
+	um.SetUpstreams([]Upstream{heavy, light, drained})
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[um.NextForKey(fmt.Sprintf("session%d", i)).UpstreamTag]++
+	}
+	if counts["drained"] != 0 {
+		t.Error("Should never map a key to a drained upstream")
+	}
+	if counts["heavy"] < 2700 || counts["heavy"] > 3300 {
+		t.Errorf("Should map keys in proportion to weight, got %v", counts)
+	}
+}
+
+func TestUpstreamManager_NextForKey_FallbackAndRecovery(t *testing.T) {
+	um := NewUpstreamManager()
+	um.FailureThreshold = 1
+	um.BaseBackoff = 10 * time.Millisecond
+	um.MaxBackoff = 10 * time.Millisecond
+	um.SetUpstreams([]Upstream{
+		createTestUpstream("upstream1", "127.0.0.1", 3128),
+		createTestUpstream("upstream2", "127.0.0.2", 3128),
+		createTestUpstream("upstream3", "127.0.0.3", 3128),
+	})
+	primary := um.NextForKey("session")
+	excluded := um.NextForKey("session", primary.UpstreamID)
+	if excluded == nil || excluded.UpstreamID == primary.UpstreamID {
+		t.Fatal("Should skip an excluded upstream")
+	}
+
+	um.ReportResult(primary.UpstreamID, fmt.Errorf("connection refused"))
+	fallback := um.NextForKey("session")
+	if fallback == nil || fallback.UpstreamID != excluded.UpstreamID {
+		t.Fatalf("Should fall back to the next upstream in hash order, got %v", fallback)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	probe := um.NextForKey("session")
+	if probe == nil || probe.UpstreamID != primary.UpstreamID {
+		t.Fatal("Should probe the primary upstream once its backoff expires")
+	}
+	um.ReportResult(primary.UpstreamID, nil)
+	if back := um.NextForKey("session"); back.UpstreamID != primary.UpstreamID {
+		t.Error("Should return to the primary upstream once it recovers")
+	}
+}
+
+func TestUpstreamManager_Get(t *testing.T) {
+	um := NewUpstreamManager()
+	um.FailureThreshold = 1
+	first := createTestUpstream("upstream1", "127.0.0.1", 3128)
+	second := createTestUpstream("upstream2", "127.0.0.2", 3128)
+	um.SetUpstreams([]Upstream{first, second})
+
+	if got := um.Get(first.UpstreamID); got == nil || got.UpstreamTag != "upstream1" {
+		t.Fatalf("Should return a configured upstream, got %v", got)
+	}
+	if um.Get(first.UpstreamID, first.UpstreamID) != nil {
+		t.Error("Should not return an excluded upstream")
+	}
+	um.ReportResult(first.UpstreamID, fmt.Errorf("connection refused"))
+	if um.Get(first.UpstreamID) != nil {
+		t.Error("Should not return an ejected upstream")
+	}
+	um.SetUpstreams([]Upstream{second})
+	if um.Get(first.UpstreamID) != nil {
+		t.Error("Should not return a removed upstream")
+	}
+}
+
 func TestUpstream_GetAddress(t *testing.T) {
 	upstream := createTestUpstream("test", "127.0.0.1", 3128)
 	expected := "127.0.0.1:3128"
@@ -196,6 +374,29 @@ func TestUpstreamManager_AtomicOperations(t *testing.T) {
 	}
 }
 
+func TestUpstream_Credentials(t *testing.T) {
+	tag := providers.Targeting{Country: "us", Session: "12345678"}
+
+	netnut := createTestUpstream("netnut", "127.0.0.1", 8080)
+	netnut.UpstreamProvider = "netnut"
+	user, pass, err := netnut.Credentials(tag)
+	if err != nil || user != "user-res-us-sid-12345678" || pass != "pass" {
+		t.Errorf("Unexpected netnut credentials %s:%s (%v)", user, pass, err)
+	}
+
+	templated := createTestUpstream("templated", "127.0.0.1", 8080)
+	templated.UpstreamFormat = "{{.Username}}-cc-{{.Country}}:{{.Password}}"
+	user, pass, err = templated.Credentials(tag)
+	if err != nil || user != "user-cc-us" || pass != "pass" {
+		t.Errorf("Unexpected template credentials %s:%s (%v)", user, pass, err)
+	}
+
+	unknown := createTestUpstream("unknown", "127.0.0.1", 8080)
+	if _, _, err := unknown.Credentials(tag); err == nil {
+		t.Error("Upstream with an unknown provider should not get credentials")
+	}
+}
+
 func createTestUpstream(tag, host string, port int) Upstream {
 	return Upstream{
 		UpstreamID:       uuid.New(),
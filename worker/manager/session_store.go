@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSessionLifetime applies to sticky sessions that do not ask for a
+	// lifetime, matching the one captain puts in generated proxy strings.
+	DefaultSessionLifetime = 60 * time.Minute
+	// MaxSessionLifetime caps the lifetime a client may ask for.
+	MaxSessionLifetime = 24 * time.Hour
+	// DefaultSessionCapacity bounds how many sessions a worker pins at once.
+	DefaultSessionCapacity = 100000
+)
+
+type sessionKey struct {
+	username string
+	session  string
+}
+
+type sessionEntry struct {
+	key      sessionKey
+	upstream Upstream
+	expireAt time.Time
+}
+
+// SessionStore records the upstream each sticky session is pinned to, which
+// the worker keeps sending the session to until it expires. Each session lives for its lifetime
+// from when it was first pinned; once the store is full the least recently
+// used session is evicted.
+type SessionStore struct {
+	capacity int
+
+	mu      sync.Mutex
+	entries map[sessionKey]*list.Element
+	lru     *list.List // most recently used at the front
+	now     func() time.Time
+}
+
+func NewSessionStore(capacity int) *SessionStore {
+	return &SessionStore{
+		capacity: capacity,
+		entries:  make(map[sessionKey]*list.Element),
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get returns the upstream the user's session is pinned to, if the session
+// has not expired.
+func (s *SessionStore) Get(username, session string) (Upstream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[sessionKey{username, session}]
+	if !ok {
+		return Upstream{}, false
+	}
+	entry := elem.Value.(*sessionEntry)
+	if !s.now().Before(entry.expireAt) {
+		s.remove(elem)
+		return Upstream{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return entry.upstream, true
+}
+
+// Pin pins the user's session to upstream. A live session moved to another
+// upstream keeps its expiry; otherwise the session starts with lifetime,
+// defaulted and capped by DefaultSessionLifetime and MaxSessionLifetime.
+func (s *SessionStore) Pin(username, session string, upstream Upstream, lifetime time.Duration) {
+	if lifetime <= 0 {
+		lifetime = DefaultSessionLifetime
+	}
+	if lifetime > MaxSessionLifetime {
+		lifetime = MaxSessionLifetime
+	}
+	key := sessionKey{username, session}
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[key]; ok {
+		entry := elem.Value.(*sessionEntry)
+		entry.upstream = upstream
+		if !now.Before(entry.expireAt) {
+			entry.expireAt = now.Add(lifetime)
+		}
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&sessionEntry{
+		key:      key,
+		upstream: upstream,
+		expireAt: now.Add(lifetime),
+	})
+	for s.capacity > 0 && s.lru.Len() > s.capacity {
+		s.remove(s.lru.Back())
+	}
+}
+
+// Remove drops the user's session.
+func (s *SessionStore) Remove(username, session string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[sessionKey{username, session}]; ok {
+		s.remove(elem)
+	}
+}
+
+// RemoveExpired drops every expired session and returns how many there were.
+func (s *SessionStore) RemoveExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	removed := 0
+	for elem := s.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !now.Before(elem.Value.(*sessionEntry).expireAt) {
+			s.remove(elem)
+			removed++
+		}
+		elem = prev
+	}
+	return removed
+}
+
+func (s *SessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *SessionStore) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.entries, elem.Value.(*sessionEntry).key)
+}
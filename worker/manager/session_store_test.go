@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestSessionStore(capacity int) (*SessionStore, *fakeClock) {
+	clock := &fakeClock{t: time.Now()}
+	s := NewSessionStore(capacity)
+	s.now = clock.now
+	return s, clock
+}
+
+func TestSessionStore_ExpiresAfterLifetime(t *testing.T) {
+	s, clock := newTestSessionStore(10)
+	upstream := Upstream{UpstreamID: uuid.New()}
+	s.Pin("alice", "s1", upstream, 5*time.Minute)
+
+	clock.t = clock.t.Add(4 * time.Minute)
+	if got, ok := s.Get("alice", "s1"); !ok || got.UpstreamID != upstream.UpstreamID {
+		t.Fatal("Session should be pinned within its lifetime")
+	}
+	// using a session does not extend it
+	clock.t = clock.t.Add(time.Minute)
+	if _, ok := s.Get("alice", "s1"); ok {
+		t.Error("Session should expire after its lifetime")
+	}
+	if s.Len() != 0 {
+		t.Errorf("Expired session should be dropped, %d left", s.Len())
+	}
+}
+
+func TestSessionStore_DefaultAndMaxLifetime(t *testing.T) {
+	s, clock := newTestSessionStore(10)
+	s.Pin("alice", "default", Upstream{}, 0)
+	s.Pin("alice", "long", Upstream{}, 48*time.Hour)
+
+	clock.t = clock.t.Add(DefaultSessionLifetime - time.Second)
+	if _, ok := s.Get("alice", "default"); !ok {
+		t.Error("Session without a lifetime should get the default")
+	}
+	clock.t = clock.t.Add(time.Second)
+	if _, ok := s.Get("alice", "default"); ok {
+		t.Error("Session without a lifetime should expire after the default")
+	}
+	clock.t = clock.t.Add(MaxSessionLifetime)
+	if _, ok := s.Get("alice", "long"); ok {
+		t.Error("Lifetime should be capped")
+	}
+}
+
+func TestSessionStore_KeyedByUser(t *testing.T) {
+	s, _ := newTestSessionStore(10)
+	alice := Upstream{UpstreamID: uuid.New()}
+	bob := Upstream{UpstreamID: uuid.New()}
+	s.Pin("alice", "s1", alice, time.Minute)
+	s.Pin("bob", "s1", bob, time.Minute)
+	if got, _ := s.Get("alice", "s1"); got.UpstreamID != alice.UpstreamID {
+		t.Error("Users should not share session ids")
+	}
+	if got, _ := s.Get("bob", "s1"); got.UpstreamID != bob.UpstreamID {
+		t.Error("Users should not share session ids")
+	}
+}
+
+func TestSessionStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	s, _ := newTestSessionStore(2)
+	s.Pin("alice", "s1", Upstream{}, time.Minute)
+	s.Pin("alice", "s2", Upstream{}, time.Minute)
+	s.Get("alice", "s1")
+	s.Pin("alice", "s3", Upstream{}, time.Minute)
+
+	if s.Len() != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", s.Len())
+	}
+	if _, ok := s.Get("alice", "s2"); ok {
+		t.Error("Least recently used session should be evicted")
+	}
+	if _, ok := s.Get("alice", "s1"); !ok {
+		t.Error("Recently used session should be kept")
+	}
+}
+
+func TestSessionStore_RepinKeepsExpiry(t *testing.T) {
+	s, clock := newTestSessionStore(10)
+	s.Pin("alice", "s1", Upstream{UpstreamID: uuid.New()}, 10*time.Minute)
+	clock.t = clock.t.Add(5 * time.Minute)
+	moved := Upstream{UpstreamID: uuid.New()}
+	s.Pin("alice", "s1", moved, 10*time.Minute)
+
+	if got, _ := s.Get("alice", "s1"); got.UpstreamID != moved.UpstreamID {
+		t.Error("Session should be pinned to the new upstream")
+	}
+	clock.t = clock.t.Add(5 * time.Minute)
+	if _, ok := s.Get("alice", "s1"); ok {
+		t.Error("Re-pinning should not extend the session")
+	}
+}
+
+func TestSessionStore_RemoveExpired(t *testing.T) {
+	s, clock := newTestSessionStore(10)
+	s.Pin("alice", "short", Upstream{}, time.Minute)
+	s.Pin("alice", "long", Upstream{}, time.Hour)
+	clock.t = clock.t.Add(2 * time.Minute)
+	if removed := s.RemoveExpired(); removed != 1 {
+		t.Errorf("Expected 1 expired session, got %d", removed)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 session left, got %d", s.Len())
+	}
+}
+
+func TestSessionStore_Concurrent(t *testing.T) {
+	s := NewSessionStore(100)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session := fmt.Sprintf("s%d", i%10)
+			s.Pin("alice", session, Upstream{}, time.Minute)
+			s.Get("alice", session)
+			s.Remove("alice", session)
+		}(i)
+	}
+	wg.Wait()
+}
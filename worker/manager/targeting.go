@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/snail007/goproxy/utils"
+)
+
+// TargetingCatalog holds the countries, states and cities clients of the
+// pool may target, as delivered by captain. Codes are matched without regard
+// to case.
+type TargetingCatalog struct {
+	countries map[string]*catalogCountry
+}
+
+type catalogCountry struct {
+	states map[string]bool
+	cities map[string]string // city code to state code, empty without a state
+}
+
+func NewTargetingCatalog(countries []TargetingCountry) *TargetingCatalog {
+	c := &TargetingCatalog{countries: make(map[string]*catalogCountry, len(countries))}
+	for _, country := range countries {
+		entry := &catalogCountry{
+			states: make(map[string]bool, len(country.States)),
+			cities: make(map[string]string, len(country.Cities)),
+		}
+		for _, state := range country.States {
+			entry.states[strings.ToLower(state)] = true
+		}
+		for _, city := range country.Cities {
+			entry.cities[strings.ToLower(city.Code)] = strings.ToLower(city.State)
+		}
+		c.countries[strings.ToLower(country.Code)] = entry
+	}
+	return c
+}
+
+// Validate rejects targeting that is not in the catalog. An empty catalog,
+// from a pool whose region has no countries yet, accepts anything.
+func (c *TargetingCatalog) Validate(tag utils.Tag) error {
+	if c == nil || len(c.countries) == 0 {
+		return nil
+	}
+	if tag.Country == "" {
+		if tag.State != "" || tag.City != "" {
+			return fmt.Errorf("state and city targeting need a country")
+		}
+		return nil
+	}
+	country, ok := c.countries[strings.ToLower(tag.Country)]
+	if !ok {
+		return fmt.Errorf("unknown country %q", tag.Country)
+	}
+	state := strings.ToLower(tag.State)
+	if state != "" && !country.states[state] {
+		return fmt.Errorf("unknown state %q in country %q", tag.State, tag.Country)
+	}
+	if tag.City != "" {
+		cityState, ok := country.cities[strings.ToLower(tag.City)]
+		if !ok {
+			return fmt.Errorf("unknown city %q in country %q", tag.City, tag.Country)
+		}
+		if state != "" && cityState != "" && cityState != state {
+			return fmt.Errorf("city %q is not in state %q", tag.City, tag.State)
+		}
+	}
+	return nil
+}
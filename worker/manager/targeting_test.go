@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/snail007/goproxy/utils"
+)
+
+func createTestCatalog() *TargetingCatalog {
+	return NewTargetingCatalog([]TargetingCountry{
+		{
+			Code:   "US",
+			States: []string{"ny", "ca"},
+			Cities: []TargetingCity{
+				{Code: "newyork", State: "ny"},
+				{Code: "miami"},
+			},
+		},
+		{Code: "DE"},
+	})
+}
+
+func TestTargetingCatalog_Validate(t *testing.T) {
+	catalog := createTestCatalog()
+	accepted := []utils.Tag{
+		{},
+		{Session: "s1", Lifetime: 30},
+		{Country: "us"},
+		{Country: "US", State: "NY", City: "newyork"},
+		{Country: "us", City: "newyork"},
+		{Country: "us", State: "ca", City: "miami"},
+		{Country: "de"},
+	}
+	for _, tag := range accepted {
+		if err := catalog.Validate(tag); err != nil {
+			t.Errorf("%+v should be accepted: %v", tag, err)
+		}
+	}
+	rejected := []utils.Tag{
+		{Country: "fr"},
+		{State: "ny"},
+		{Country: "us", State: "tx"},
+		{Country: "us", City: "berlin"},
+		{Country: "us", State: "ca", City: "newyork"},
+		{Country: "de", City: "newyork"},
+	}
+	for _, tag := range rejected {
+		if err := catalog.Validate(tag); err == nil {
+			t.Errorf("%+v should be rejected", tag)
+		}
+	}
+}
+
+func TestTargetingCatalog_EmptyAcceptsAnything(t *testing.T) {
+	var catalog *TargetingCatalog
+	if err := catalog.Validate(utils.Tag{Country: "fr", City: "paris"}); err != nil {
+		t.Errorf("Missing catalog should accept targeting: %v", err)
+	}
+	if err := NewTargetingCatalog(nil).Validate(utils.Tag{Country: "fr"}); err != nil {
+		t.Errorf("Empty catalog should accept targeting: %v", err)
+	}
+}
+
+func TestWorkerManager_ValidateTargeting(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	if err := wm.ValidateTargeting(utils.Tag{Country: "fr"}); err != nil {
+		t.Errorf("Targeting should be accepted before the config arrives: %v", err)
+	}
+	wm.processConfig(ConfigPayload{
+		PoolID:    uuid.New(),
+		PoolTag:   "test-pool",
+		Countries: []TargetingCountry{{Code: "US"}},
+	})
+	if err := wm.ValidateTargeting(utils.Tag{Country: "us"}); err != nil {
+		t.Errorf("Country in the catalog should be accepted: %v", err)
+	}
+	if err := wm.ValidateTargeting(utils.Tag{Country: "fr"}); err == nil {
+		t.Error("Country outside the catalog should be rejected")
+	}
+}
@@ -0,0 +1,418 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentExt  = ".seg"
+	spoolAckFile     = "acked"
+	spoolSegmentSize = 4 << 20
+)
+
+// SpoolRecord is one telemetry event kept on disk until captain acks it.
+type SpoolRecord struct {
+	Seq     uint64          `json:"seq"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type spoolSegment struct {
+	path  string
+	first uint64
+	last  uint64
+	size  int64
+}
+
+// TelemetrySpool is an append-only log of telemetry events split into segment
+// files named after their first sequence number. Captain acks are cumulative:
+// an ack for seq N covers every event up to N, and segments that are fully
+// acked are deleted. When the spool outgrows maxBytes the oldest segment is
+// dropped, so a long captain outage loses the oldest usage instead of filling
+// the disk.
+type TelemetrySpool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	segments []*spoolSegment
+	active   *os.File
+	nextSeq  uint64
+	acked    uint64
+	notify   chan struct{}
+}
+
+// OpenTelemetrySpool opens the spool in dir, creating it if needed, and
+// recovers the sequence and ack position from the files already there.
+func OpenTelemetrySpool(dir string, maxBytes int64) (*TelemetrySpool, error) {
+	if maxBytes < spoolSegmentSize {
+		return nil, fmt.Errorf("telemetry spool needs at least %d bytes, got %d", spoolSegmentSize, maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &TelemetrySpool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+	}
+	if err := s.readAcked(); err != nil {
+		return nil, err
+	}
+	if err := s.loadSegments(); err != nil {
+		return nil, err
+	}
+	s.nextSeq = s.acked + 1
+	if n := len(s.segments); n > 0 && s.segments[n-1].last >= s.nextSeq {
+		s.nextSeq = s.segments[n-1].last + 1
+	}
+	s.dropAcked()
+	return s, nil
+}
+
+func (s *TelemetrySpool) readAcked() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolAckFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	acked, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid telemetry spool ack file: %v", err)
+	}
+	s.acked = acked
+	return nil
+}
+
+func (s *TelemetrySpool) writeAcked() error {
+	tmp := filepath.Join(s.dir, spoolAckFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(s.acked, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, spoolAckFile))
+}
+
+func (s *TelemetrySpool) loadSegments() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		seg, err := scanSegment(path)
+		if err != nil {
+			return err
+		}
+		if seg.size == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+	}
+	return nil
+}
+
+// scanSegment finds the sequence range of a segment. A torn last line from a
+// crash mid-write is truncated away.
+func scanSegment(path string) (*spoolSegment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seg := &spoolSegment{path: path}
+	var good int64
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		var rec SpoolRecord
+		if err := json.Unmarshal(data[:i], &rec); err != nil {
+			break
+		}
+		if seg.first == 0 {
+			seg.first = rec.Seq
+		}
+		seg.last = rec.Seq
+		good += int64(i + 1)
+		data = data[i+1:]
+	}
+	if len(data) > 0 {
+		log.Printf("[TelemetrySpool] truncating torn record in %s", path)
+		if err := os.Truncate(path, good); err != nil {
+			return nil, err
+		}
+	}
+	seg.size = good
+	return seg, nil
+}
+
+// Append writes an event to the spool and returns the sequence number it was
+// given.
+func (s *TelemetrySpool) Append(eventType string, payload interface{}) (uint64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(eventType, data)
+}
+
+func (s *TelemetrySpool) append(eventType string, data json.RawMessage) (uint64, error) {
+	rec := SpoolRecord{Seq: s.nextSeq, Type: eventType, Payload: data}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+
+	seg, err := s.activeSegment(int64(len(line)))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.active.Write(line); err != nil {
+		return 0, err
+	}
+	if seg.first == 0 {
+		seg.first = rec.Seq
+	}
+	seg.last = rec.Seq
+	seg.size += int64(len(line))
+	s.nextSeq++
+	s.enforceLimit()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return rec.Seq, nil
+}
+
+// activeSegment returns the segment to append to, rolling over to a new file
+// when the current one cannot take n more bytes.
+func (s *TelemetrySpool) activeSegment(n int64) (*spoolSegment, error) {
+	if count := len(s.segments); count > 0 {
+		seg := s.segments[count-1]
+		if seg.size+n <= spoolSegmentSize {
+			if s.active == nil {
+				// After a restart the last segment is reopened for appending.
+				f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0o644)
+				if err != nil {
+					return nil, err
+				}
+				s.active = f
+			}
+			return seg, nil
+		}
+	}
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.active = f
+	seg := &spoolSegment{path: path}
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+func (s *TelemetrySpool) enforceLimit() {
+	for len(s.segments) > 1 && s.totalSize() > s.maxBytes {
+		oldest := s.segments[0]
+		os.Remove(oldest.path)
+		s.segments = s.segments[1:]
+		if oldest.last > s.acked {
+			first := oldest.first
+			if first <= s.acked {
+				first = s.acked + 1
+			}
+			log.Printf("[TelemetrySpool] spool over %d bytes, dropping %d unacked events", s.maxBytes, oldest.last-first+1)
+			s.acked = oldest.last
+			if err := s.writeAcked(); err != nil {
+				log.Printf("[TelemetrySpool] failed to persist ack position: %v", err)
+			}
+		}
+	}
+}
+
+func (s *TelemetrySpool) totalSize() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Ack marks every event up to seq as committed by captain.
+func (s *TelemetrySpool) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq >= s.nextSeq {
+		seq = s.nextSeq - 1
+	}
+	if seq <= s.acked {
+		return nil
+	}
+	s.acked = seq
+	if err := s.writeAcked(); err != nil {
+		return err
+	}
+	s.dropAcked()
+	return nil
+}
+
+// dropAcked deletes segments whose events are all acked.
+func (s *TelemetrySpool) dropAcked() {
+	for len(s.segments) > 0 && s.segments[0].last <= s.acked {
+		seg := s.segments[0]
+		if len(s.segments) == 1 && s.active != nil {
+			s.active.Close()
+			s.active = nil
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[TelemetrySpool] failed to remove acked segment %s: %v", seg.path, err)
+			return
+		}
+		s.segments = s.segments[1:]
+	}
+}
+
+// Acked returns the highest sequence number captain has acked.
+func (s *TelemetrySpool) Acked() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Pending returns how many events are waiting for an ack.
+func (s *TelemetrySpool) Pending() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextSeq - 1 - s.acked
+}
+
+// Rebase moves the spool past committed, the highest seq captain has
+// committed for this worker. Captain never commits a seq the spool has not
+// handed out, so committed at or past nextSeq means the spool was lost and
+// restarted from 1. Its unacked events are then renumbered to follow committed,
+// or captain would drop them as replays.
+func (s *TelemetrySpool) Rebase(committed uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if committed < s.nextSeq {
+		return nil
+	}
+	records, err := s.read(s.acked+1, int(^uint(0)>>1))
+	if err != nil {
+		return err
+	}
+	log.Printf("[TelemetrySpool] captain committed seq %d past spool seq %d, renumbering %d pending events", committed, s.nextSeq-1, len(records))
+
+	// The renumbered copies are written before the old segments go, so a
+	// crash in between leaves events captain drops as replays, not a gap.
+	old := s.segments
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	s.segments = nil
+	s.nextSeq = committed + 1
+	for _, rec := range records {
+		if _, err := s.append(rec.Type, rec.Payload); err != nil {
+			return err
+		}
+	}
+	s.acked = committed
+	if err := s.writeAcked(); err != nil {
+		return err
+	}
+	for _, seg := range old {
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("[TelemetrySpool] failed to remove renumbered segment %s: %v", seg.path, err)
+		}
+	}
+	return nil
+}
+
+// Read returns up to limit unacked events with a sequence number of at least
+// from, in order.
+func (s *TelemetrySpool) Read(from uint64, limit int) ([]SpoolRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(from, limit)
+}
+
+func (s *TelemetrySpool) read(from uint64, limit int) ([]SpoolRecord, error) {
+	if from <= s.acked {
+		from = s.acked + 1
+	}
+	var records []SpoolRecord
+	for _, seg := range s.segments {
+		if seg.last < from {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), spoolSegmentSize)
+		for scanner.Scan() {
+			var rec SpoolRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("corrupt record in %s: %v", seg.path, err)
+			}
+			if rec.Seq < from {
+				continue
+			}
+			records = append(records, rec)
+			if len(records) >= limit {
+				f.Close()
+				return records, nil
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Notify is signalled after every Append.
+func (s *TelemetrySpool) Notify() <-chan struct{} {
+	return s.notify
+}
+
+// Close releases the open segment file.
+func (s *TelemetrySpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
@@ -0,0 +1,303 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func openTestSpool(t *testing.T, dir string) *TelemetrySpool {
+	t.Helper()
+	spool, err := OpenTelemetrySpool(dir, spoolSegmentSize*2)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	t.Cleanup(func() { spool.Close() })
+	return spool
+}
+
+func spoolSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatalf("Failed to list segments: %v", err)
+	}
+	return paths
+}
+
+func TestTelemetrySpool_AppendReadAck(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir())
+	for i := 1; i <= 3; i++ {
+		seq, err := spool.Append("telemetry_usage", UserDataUsage{Username: "user", BytesSent: uint64(i)})
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		if seq != uint64(i) {
+			t.Errorf("Expected seq %d, got %d", i, seq)
+		}
+	}
+
+	records, err := spool.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 3 || records[0].Seq != 1 || records[2].Seq != 3 {
+		t.Fatalf("Expected seqs 1..3, got %+v", records)
+	}
+
+	if err := spool.Ack(2); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	records, err = spool.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Seq != 3 {
+		t.Errorf("Expected only seq 3 after ack, got %+v", records)
+	}
+	if spool.Pending() != 1 {
+		t.Errorf("Expected 1 pending event, got %d", spool.Pending())
+	}
+}
+
+func TestTelemetrySpool_DeletesAckedSegments(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir)
+	spool.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	spool.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	if err := spool.Ack(2); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if segments := spoolSegments(t, dir); len(segments) != 0 {
+		t.Errorf("Expected acked segments to be deleted, found %v", segments)
+	}
+	seq, err := spool.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	if err != nil {
+		t.Fatalf("Append after full ack failed: %v", err)
+	}
+	if seq != 3 {
+		t.Errorf("Expected seq 3 after full ack, got %d", seq)
+	}
+}
+
+func TestTelemetrySpool_ReopenKeepsUnacked(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenTelemetrySpool(dir, spoolSegmentSize)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		spool.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	}
+	spool.Ack(1)
+	spool.Close()
+
+	reopened := openTestSpool(t, dir)
+	if reopened.Acked() != 1 {
+		t.Errorf("Expected ack position 1 after reopen, got %d", reopened.Acked())
+	}
+	records, err := reopened.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 2 || records[0].Seq != 2 {
+		t.Errorf("Expected seqs 2 and 3 to survive reopen, got %+v", records)
+	}
+	seq, _ := reopened.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	if seq != 4 {
+		t.Errorf("Expected seq to continue at 4, got %d", seq)
+	}
+}
+
+func TestTelemetrySpool_TruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenTelemetrySpool(dir, spoolSegmentSize)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	spool.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	spool.Close()
+
+	segments := spoolSegments(t, dir)
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, got %v", segments)
+	}
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	f.WriteString(`{"seq":2,"type":"telemetry_us`)
+	f.Close()
+
+	reopened := openTestSpool(t, dir)
+	records, err := reopened.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read after torn write failed: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("Expected the torn record to be dropped, got %+v", records)
+	}
+	seq, _ := reopened.Append("telemetry_usage", UserDataUsage{Username: "user"})
+	if seq != 2 {
+		t.Errorf("Expected seq 2 to be reused for the next event, got %d", seq)
+	}
+}
+
+func TestTelemetrySpool_DropsOldestSegmentOverLimit(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir)
+	host := strings.Repeat("a", 64*1024)
+	var last uint64
+	for i := 0; i < 160; i++ {
+		seq, err := spool.Append("telemetry_usage", UserDataUsage{DestinationHost: host})
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		last = seq
+	}
+	if spool.Acked() == 0 {
+		t.Error("Expected the oldest events to be dropped once the spool is full")
+	}
+	var total int64
+	for _, path := range spoolSegments(t, dir) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat segment: %v", err)
+		}
+		total += info.Size()
+	}
+	if total > spoolSegmentSize*2 {
+		t.Errorf("Spool holds %d bytes, limit is %d", total, spoolSegmentSize*2)
+	}
+	records, err := spool.Read(1, 1000)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) == 0 || records[len(records)-1].Seq != last {
+		t.Error("Expected the newest events to be kept")
+	}
+}
+
+func TestTelemetrySpool_RebaseRenumbersPastCommitted(t *testing.T) {
+	dir := t.TempDir()
+	spool := openTestSpool(t, dir)
+	spool.Append("telemetry_usage", UserDataUsage{Username: "first"})
+	spool.Append("telemetry_usage", UserDataUsage{Username: "second"})
+
+	if err := spool.Rebase(1); err != nil {
+		t.Fatalf("Rebase failed: %v", err)
+	}
+	if records, _ := spool.Read(1, 10); len(records) != 2 || records[0].Seq != 1 {
+		t.Fatalf("Expected a seq the spool handed out to leave it alone, got %+v", records)
+	}
+
+	// The spool was lost while captain kept its seq at 100.
+	if err := spool.Rebase(100); err != nil {
+		t.Fatalf("Rebase failed: %v", err)
+	}
+	if spool.Acked() != 100 || spool.Pending() != 2 {
+		t.Errorf("Expected acked=100 pending=2, got acked=%d pending=%d", spool.Acked(), spool.Pending())
+	}
+	if paths := spoolSegments(t, dir); len(paths) != 1 || filepath.Base(paths[0]) != fmt.Sprintf("%020d%s", 101, spoolSegmentExt) {
+		t.Errorf("Expected only the renumbered segment to remain, got %v", paths)
+	}
+	if seq, _ := spool.Append("telemetry_usage", UserDataUsage{Username: "third"}); seq != 103 {
+		t.Errorf("Expected new events to continue at 103, got %d", seq)
+	}
+	spool.Close()
+
+	reopened := openTestSpool(t, dir)
+	records, err := reopened.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 pending events after reopening, got %d", len(records))
+	}
+	for i, want := range []string{"first", "second", "third"} {
+		var usage UserDataUsage
+		json.Unmarshal(records[i].Payload, &usage)
+		if records[i].Seq != uint64(101+i) || usage.Username != want {
+			t.Errorf("Expected %s #%d, got %s #%d", want, 101+i, usage.Username, records[i].Seq)
+		}
+	}
+}
+
+func TestWebsocketManager_ReplaysSpoolAndAcks(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir())
+	spool.Append("telemetry_usage", UserDataUsage{Username: "first"})
+	spool.Append("telemetry_usage", UserDataUsage{Username: "second"})
+
+	worker := &WorkerManager{}
+	worker.UseTelemetrySpool(spool)
+	wm := NewWebsocketManager(worker, &websocket.Conn{})
+	go wm.sendTelemetry(spool)
+	defer close(wm.websocketClient.done)
+
+	select {
+	case event := <-wm.websocketClient.egress:
+		t.Fatalf("Expected nothing to be sent before the config, got %s #%d", event.Type, event.Seq)
+	case <-time.After(100 * time.Millisecond):
+	}
+	wm.configureOnce.Do(func() { close(wm.configured) })
+
+	for want := uint64(1); want <= 2; want++ {
+		select {
+		case event := <-wm.websocketClient.egress:
+			if event.Type != "telemetry_usage" || event.Seq != want {
+				t.Errorf("Expected telemetry_usage #%d, got %s #%d", want, event.Type, event.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event #%d", want)
+		}
+	}
+
+	wm.HandleEvent(Event{Type: "ack", Payload: map[string]interface{}{"success": true, "payload": 2}})
+	if spool.Acked() != 2 {
+		t.Errorf("Expected ack to reach the spool, acked=%d", spool.Acked())
+	}
+
+	spool.Append("telemetry_usage", UserDataUsage{Username: "third"})
+	select {
+	case event := <-wm.websocketClient.egress:
+		if event.Seq != 3 {
+			t.Errorf("Expected new event #3, got #%d", event.Seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a newly spooled event")
+	}
+}
+
+func TestWebsocketManager_ConfigRebasesSpoolBeforeSending(t *testing.T) {
+	spool := openTestSpool(t, t.TempDir())
+	spool.Append("telemetry_usage", UserDataUsage{Username: "first"})
+
+	worker, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	worker.UseTelemetrySpool(spool)
+	wm := NewWebsocketManager(worker, &websocket.Conn{})
+	go wm.sendTelemetry(spool)
+	defer close(wm.websocketClient.done)
+
+	config := createTestConfigPayload()
+	config.TelemetrySeq = 50
+	wm.processConfig(Response{Success: true, Payload: config})
+
+	select {
+	case event := <-wm.websocketClient.egress:
+		if event.Seq != 51 {
+			t.Errorf("Expected the pending event renumbered to #51, got #%d", event.Seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the pending event")
+	}
+}
@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	breakerClosed int32 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	DefaultBreakerFailureThreshold = 3
+	DefaultBreakerBaseBackoff      = 5 * time.Second
+	DefaultBreakerMaxBackoff       = 2 * time.Minute
+)
+
+const (
+	UpstreamStatusEjected    = "ejected"
+	UpstreamStatusRecovering = "recovering"
+)
+
+// upstreamBreaker is a per-upstream circuit breaker. Consecutive failures open
+// it for a backoff window that doubles on every trip; once the window has
+// passed a single half-open probe decides whether the upstream comes back.
+type upstreamBreaker struct {
+	state     int32
+	failures  uint32
+	trips     uint32
+	reopenAt  int64
+	threshold uint32
+	base      time.Duration
+	max       time.Duration
+}
+
+func newUpstreamBreaker(threshold uint32, base, max time.Duration) *upstreamBreaker {
+	return &upstreamBreaker{
+		threshold: threshold,
+		base:      base,
+		max:       max,
+	}
+}
+
+// allow reports whether a request may be sent through the upstream. When the
+// backoff window of an open breaker has passed, exactly one caller wins the
+// half-open probe. A probe that never reports back is replaced by a new one
+// after another base backoff.
+func (b *upstreamBreaker) allow(now time.Time) bool {
+	state := atomic.LoadInt32(&b.state)
+	if state == breakerClosed {
+		return true
+	}
+	deadline := atomic.LoadInt64(&b.reopenAt)
+	if now.UnixNano() < deadline {
+		return false
+	}
+	if !atomic.CompareAndSwapInt64(&b.reopenAt, deadline, now.Add(b.base).UnixNano()) {
+		return false
+	}
+	atomic.CompareAndSwapInt32(&b.state, breakerOpen, breakerHalfOpen)
+	return true
+}
+
+func (b *upstreamBreaker) recordSuccess() {
+	atomic.StoreUint32(&b.failures, 0)
+	atomic.StoreUint32(&b.trips, 0)
+	atomic.StoreInt32(&b.state, breakerClosed)
+}
+
+// recordFailure counts a failed connect or handshake and reports whether the
+// breaker tripped because of it.
+func (b *upstreamBreaker) recordFailure(now time.Time) bool {
+	if atomic.LoadInt32(&b.state) == breakerHalfOpen {
+		b.trip(now)
+		return true
+	}
+	if atomic.AddUint32(&b.failures, 1) < b.threshold {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&b.state, breakerClosed, breakerOpen) {
+		return false
+	}
+	b.trip(now)
+	return true
+}
+
+func (b *upstreamBreaker) trip(now time.Time) {
+	trips := atomic.AddUint32(&b.trips, 1)
+	backoff := b.base
+	for i := uint32(1); i < trips && backoff < b.max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.max {
+		backoff = b.max
+	}
+	atomic.StoreUint32(&b.failures, 0)
+	atomic.StoreInt64(&b.reopenAt, now.Add(backoff).UnixNano())
+	atomic.StoreInt32(&b.state, breakerOpen)
+}
+
+// status returns the breaker state as reported in UpstreamHealth.Status, or an
+// empty string while the breaker is closed.
+func (b *upstreamBreaker) status() string {
+	switch atomic.LoadInt32(&b.state) {
+	case breakerOpen:
+		return UpstreamStatusEjected
+	case breakerHalfOpen:
+		return UpstreamStatusRecovering
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,145 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUpstreamBreaker_TripsAfterThreshold(t *testing.T) {
+	b := newUpstreamBreaker(3, time.Second, time.Minute)
+	now := time.Now()
+	if b.recordFailure(now) || b.recordFailure(now) {
+		t.Error("Should not trip before reaching the failure threshold")
+	}
+	if !b.allow(now) {
+		t.Error("Should allow requests while closed")
+	}
+	if !b.recordFailure(now) {
+		t.Error("Should trip on the third consecutive failure")
+	}
+	if b.allow(now) {
+		t.Error("Should reject requests while open")
+	}
+	if b.status() != UpstreamStatusEjected {
+		t.Errorf("Status should be %s, got %s", UpstreamStatusEjected, b.status())
+	}
+}
+
+func TestUpstreamBreaker_SuccessResetsFailures(t *testing.T) {
+	b := newUpstreamBreaker(2, time.Second, time.Minute)
+	now := time.Now()
+	b.recordFailure(now)
+	b.recordSuccess()
+	if b.recordFailure(now) {
+		t.Error("Should only count consecutive failures")
+	}
+}
+
+func TestUpstreamBreaker_HalfOpenSingleProbe(t *testing.T) {
+	b := newUpstreamBreaker(1, time.Second, time.Minute)
+	now := time.Now()
+	b.recordFailure(now)
+	later := now.Add(2 * time.Second)
+	if !b.allow(later) {
+		t.Error("Should allow a probe once the backoff has passed")
+	}
+	if b.allow(later) {
+		t.Error("Should allow only one probe at a time")
+	}
+	if b.status() != UpstreamStatusRecovering {
+		t.Errorf("Status should be %s, got %s", UpstreamStatusRecovering, b.status())
+	}
+	b.recordSuccess()
+	if !b.allow(later) || b.status() != "" {
+		t.Error("Should close after a successful probe")
+	}
+}
+
+func TestUpstreamBreaker_FailedProbeBacksOff(t *testing.T) {
+	b := newUpstreamBreaker(1, time.Second, 3*time.Second)
+	now := time.Now()
+	b.recordFailure(now)
+	probeAt := now.Add(time.Second)
+	if !b.allow(probeAt) {
+		t.Fatal("Should allow a probe once the backoff has passed")
+	}
+	if !b.recordFailure(probeAt) {
+		t.Error("Should reopen when the probe fails")
+	}
+	if b.allow(probeAt.Add(time.Second)) {
+		t.Error("Should double the backoff after a failed probe")
+	}
+	if !b.allow(probeAt.Add(2 * time.Second)) {
+		t.Error("Should allow a probe after the doubled backoff")
+	}
+	b.recordFailure(probeAt.Add(2 * time.Second))
+	if got := time.Duration(b.reopenAt - probeAt.Add(2*time.Second).UnixNano()); got != 3*time.Second {
+		t.Errorf("Backoff should be capped at 3s, got %s", got)
+	}
+}
+
+func TestUpstreamBreaker_StaleProbeReplaced(t *testing.T) {
+	b := newUpstreamBreaker(1, time.Second, time.Minute)
+	now := time.Now()
+	b.recordFailure(now)
+	b.allow(now.Add(time.Second))
+	if !b.allow(now.Add(2 * time.Second)) {
+		t.Error("Should allow a new probe when the previous one never reported")
+	}
+}
+
+func TestUpstreamManager_ReportResult_Ejects(t *testing.T) {
+	um := NewUpstreamManager()
+	um.FailureThreshold = 2
+	failing := createTestUpstream("failing", "127.0.0.1", 3128)
+	healthy := createTestUpstream("healthy", "127.0.0.2", 3128)
+	um.SetUpstreams([]Upstream{failing, healthy})
+	um.ReportResult(failing.UpstreamID, fmt.Errorf("connection refused"))
+	um.ReportResult(failing.UpstreamID, fmt.Errorf("connection refused"))
+	if um.IsAvailable(failing.UpstreamID) {
+		t.Error("Should eject upstream after consecutive failures")
+	}
+	for i := 0; i < 5; i++ {
+		if selected := um.Next(); selected == nil || selected.UpstreamTag != "healthy" {
+			t.Fatalf("Should skip ejected upstream, got %v", selected)
+		}
+	}
+	statuses := um.BreakerStatuses()
+	if len(statuses) != 1 || statuses[0].UpstreamTag != "failing" || statuses[0].Status != UpstreamStatusEjected {
+		t.Errorf("Should report the ejected upstream, got %v", statuses)
+	}
+}
+
+func TestUpstreamManager_ReportResult_Recovers(t *testing.T) {
+	um := NewUpstreamManager()
+	um.FailureThreshold = 1
+	um.BaseBackoff = 10 * time.Millisecond
+	upstream := createTestUpstream("flaky", "127.0.0.1", 3128)
+	um.SetUpstreams([]Upstream{upstream})
+	um.ReportResult(upstream.UpstreamID, fmt.Errorf("auth failed"))
+	if um.Next() != nil {
+		t.Error("Should return nil while the only upstream is ejected")
+	}
+	time.Sleep(20 * time.Millisecond)
+	probe := um.Next()
+	if probe == nil {
+		t.Fatal("Should hand out a probe after the backoff")
+	}
+	um.ReportResult(probe.UpstreamID, nil)
+	if !um.IsAvailable(upstream.UpstreamID) || len(um.BreakerStatuses()) != 0 {
+		t.Error("Should recover after a successful probe")
+	}
+}
+
+func TestUpstreamManager_SetUpstreams_KeepsBreakerState(t *testing.T) {
+	um := NewUpstreamManager()
+	um.FailureThreshold = 1
+	upstream := createTestUpstream("failing", "127.0.0.1", 3128)
+	um.SetUpstreams([]Upstream{upstream})
+	um.ReportResult(upstream.UpstreamID, fmt.Errorf("connection refused"))
+	um.SetUpstreams([]Upstream{upstream})
+	if um.IsAvailable(upstream.UpstreamID) {
+		t.Error("Should keep the breaker state across config reloads")
+	}
+}
@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultUsageWindow = 10 * time.Second
+	// usageAggregatorMaxKeys flushes a window early when it tracks this many
+	// distinct keys, so a burst of destinations cannot grow it without bound.
+	usageAggregatorMaxKeys = 10000
+)
+
+type usageKey struct {
+	username        string
+	poolID          uuid.UUID
+	destinationHost string
+	protocol        string
+}
+
+// UsageAggregator rolls up per-connection and per-datagram usage into one
+// entry per (user, pool, destination host, protocol) and hands the totals to
+// flush once per window.
+type UsageAggregator struct {
+	window time.Duration
+	flush  func(UsageBatch)
+
+	mu          sync.Mutex
+	windowStart time.Time
+	entries     map[usageKey]*UsageBatchEntry
+
+	stopCh chan struct{}
+}
+
+func NewUsageAggregator(window time.Duration, flush func(UsageBatch)) *UsageAggregator {
+	return &UsageAggregator{
+		window:      window,
+		flush:       flush,
+		windowStart: time.Now(),
+		entries:     make(map[usageKey]*UsageBatchEntry),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+func (a *UsageAggregator) Start() {
+	go func() {
+		ticker := time.NewTicker(a.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.Flush()
+			case <-a.stopCh:
+				a.Flush()
+				return
+			}
+		}
+	}()
+	log.Printf("[UsageAggregator] Started with a %s window", a.window)
+}
+
+func (a *UsageAggregator) Stop() {
+	close(a.stopCh)
+}
+
+// Add counts usage towards the current window.
+func (a *UsageAggregator) Add(usage UserDataUsage) {
+	key := usageKey{
+		username:        usage.Username,
+		poolID:          usage.PoolID,
+		destinationHost: usage.DestinationHost,
+		protocol:        usage.Protocol,
+	}
+
+	a.mu.Lock()
+	entry, ok := a.entries[key]
+	if !ok {
+		entry = &UsageBatchEntry{
+			UserID:          usage.UserID,
+			Username:        usage.Username,
+			PoolID:          usage.PoolID,
+			PoolName:        usage.PoolName,
+			DestinationHost: usage.DestinationHost,
+			Protocol:        usage.Protocol,
+		}
+		a.entries[key] = entry
+	}
+	entry.BytesSent += usage.BytesSent
+	entry.BytesReceived += usage.BytesReceived
+	entry.Requests += usage.Requests
+	full := len(a.entries) >= usageAggregatorMaxKeys
+	a.mu.Unlock()
+
+	if full {
+		a.Flush()
+	}
+}
+
+// Flush hands the current window to the flush func and starts a new one. It
+// does nothing if the window is empty.
+func (a *UsageAggregator) Flush() {
+	a.mu.Lock()
+	if len(a.entries) == 0 {
+		a.windowStart = time.Now()
+		a.mu.Unlock()
+		return
+	}
+	batch := UsageBatch{
+		WindowStart: a.windowStart,
+		WindowEnd:   time.Now(),
+		Entries:     make([]UsageBatchEntry, 0, len(a.entries)),
+	}
+	for _, entry := range a.entries {
+		batch.Entries = append(batch.Entries, *entry)
+	}
+	a.entries = make(map[usageKey]*UsageBatchEntry)
+	a.windowStart = batch.WindowEnd
+	a.mu.Unlock()
+
+	a.flush(batch)
+}
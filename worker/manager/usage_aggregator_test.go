@@ -0,0 +1,114 @@
+package manager
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUsageAggregator_RollsUpByKey(t *testing.T) {
+	var batches []UsageBatch
+	a := NewUsageAggregator(time.Minute, func(b UsageBatch) { batches = append(batches, b) })
+	poolID := uuid.New()
+	aliceID := uuid.New()
+
+	a.Add(UserDataUsage{UserID: aliceID, Username: "alice", PoolID: poolID, DestinationHost: "example.com", Protocol: "HTTPS", BytesSent: 10, BytesReceived: 100, Requests: 1})
+	a.Add(UserDataUsage{UserID: aliceID, Username: "alice", PoolID: poolID, DestinationHost: "example.com", Protocol: "HTTPS", BytesSent: 5, BytesReceived: 50, Requests: 1})
+	a.Add(UserDataUsage{UserID: aliceID, Username: "alice", PoolID: poolID, DestinationHost: "example.com", Protocol: "HTTP", BytesSent: 1, Requests: 1})
+	a.Add(UserDataUsage{Username: "bob", PoolID: poolID, DestinationHost: "example.com", Protocol: "HTTPS", BytesSent: 7, Requests: 1})
+	a.Flush()
+
+	if len(batches) != 1 {
+		t.Fatalf("Expected one batch, got %d", len(batches))
+	}
+	if len(batches[0].Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v", batches[0].Entries)
+	}
+	for _, e := range batches[0].Entries {
+		if e.Username == "alice" && e.Protocol == "HTTPS" {
+			if e.BytesSent != 15 || e.BytesReceived != 150 || e.Requests != 2 {
+				t.Errorf("Unexpected totals for alice over HTTPS: %+v", e)
+			}
+		}
+		if e.Username == "alice" && e.UserID != aliceID {
+			t.Errorf("Expected alice's entries to carry the user id, got %+v", e)
+		}
+	}
+	if batches[0].WindowEnd.Before(batches[0].WindowStart) {
+		t.Error("Window end should not precede window start")
+	}
+}
+
+func TestUsageAggregator_UDPAssociationCountsOnce(t *testing.T) {
+	var batches []UsageBatch
+	a := NewUsageAggregator(time.Minute, func(b UsageBatch) { batches = append(batches, b) })
+
+	a.Add(UserDataUsage{Username: "alice", DestinationHost: "8.8.8.8", Protocol: ProtocolUDP, BytesSent: 40, Requests: 1})
+	for i := 0; i < 9; i++ {
+		a.Add(UserDataUsage{Username: "alice", DestinationHost: "8.8.8.8", Protocol: ProtocolUDP, BytesSent: 40})
+		a.Add(UserDataUsage{Username: "alice", DestinationHost: "8.8.8.8", Protocol: ProtocolUDP, BytesReceived: 80})
+	}
+	a.Flush()
+
+	if len(batches) != 1 || len(batches[0].Entries) != 1 {
+		t.Fatalf("Expected one entry, got %+v", batches)
+	}
+	e := batches[0].Entries[0]
+	if e.Protocol != ProtocolUDP || e.Requests != 1 || e.BytesSent != 400 || e.BytesReceived != 720 {
+		t.Errorf("Expected the association counted as one UDP request, got %+v", e)
+	}
+}
+
+func TestUsageAggregator_EmptyWindowNotFlushed(t *testing.T) {
+	flushed := false
+	a := NewUsageAggregator(time.Minute, func(UsageBatch) { flushed = true })
+	a.Flush()
+	if flushed {
+		t.Error("Should not flush an empty window")
+	}
+}
+
+func TestUsageAggregator_FlushesEarlyWhenFull(t *testing.T) {
+	var batches []UsageBatch
+	a := NewUsageAggregator(time.Minute, func(b UsageBatch) { batches = append(batches, b) })
+	for i := 0; i < usageAggregatorMaxKeys; i++ {
+		a.Add(UserDataUsage{Username: "user", DestinationHost: uuid.NewString(), BytesSent: 1})
+	}
+	if len(batches) != 1 || len(batches[0].Entries) != usageAggregatorMaxKeys {
+		t.Errorf("Expected an early flush of %d entries", usageAggregatorMaxKeys)
+	}
+}
+
+func TestWorkerManager_RecordDataUsage_SpoolsBatch(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	spool := openTestSpool(t, t.TempDir())
+	wm.UseTelemetrySpool(spool)
+
+	for i := 0; i < 5; i++ {
+		wm.RecordDataUsage(100, 200, 1, "alice", "10.0.0.1", "example.com", 443, ProtocolHTTPS)
+	}
+	wm.usageAggregator.Flush()
+
+	records, err := spool.Read(1, 10)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 1 || records[0].Type != "telemetry_usage_batch" {
+		t.Fatalf("Expected one spooled usage batch, got %+v", records)
+	}
+	var batch UsageBatch
+	if err := json.Unmarshal(records[0].Payload, &batch); err != nil {
+		t.Fatalf("Failed to parse batch: %v", err)
+	}
+	if batch.WorkerID != wm.Worker.ID {
+		t.Errorf("Expected worker id %s, got %s", wm.Worker.ID, batch.WorkerID)
+	}
+	if len(batch.Entries) != 1 || batch.Entries[0].Requests != 5 || batch.Entries[0].BytesReceived != 1000 {
+		t.Errorf("Expected 5 connections rolled into one entry, got %+v", batch.Entries)
+	}
+}
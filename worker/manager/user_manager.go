@@ -1,8 +1,12 @@
 package manager
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -10,17 +14,73 @@ import (
 
 	"github.com/google/uuid"
 	util "github.com/snail007/goproxy/utils"
+	"golang.org/x/time/rate"
 )
 
+// failedIPTTL is how long a client IP that failed IP-only authentication is
+// rejected without asking captain again.
+const failedIPTTL = 1 * time.Minute
+
+// failedLoginTTL is how long a username and password captain rejected are
+// refused without asking captain, and its bcrypt check, again.
+const failedLoginTTL = 1 * time.Minute
+
+// verifierKey is a random per-worker key. Cached users only keep an HMAC of
+// their password under this key, never the password itself.
+var verifierKey = newVerifierKey()
+
+func newVerifierKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate password verifier key: %v", err))
+	}
+	return key
+}
+
+func passwordVerifier(password string) []byte {
+	mac := hmac.New(sha256.New, verifierKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
 type User struct {
-	ID              uuid.UUID
-	Username        string
-	Password        string
-	Status          string
-	IpWhitelist     []string
-	Pools           []PoolLimit
-	Sessions        map[string]Upstream
-	connectionCount int
+	ID               uuid.UUID
+	Username         string
+	PasswordVerifier []byte
+	Status           string
+	IpWhitelist      []string
+	Pools            []PoolLimit
+	AccessLogOptOut  bool
+	MaxConnections   int
+	BandwidthLimit   int64
+}
+
+// AllowsIP reports whether the client IP matches the user's whitelist. Entries
+// are plain IPs or CIDR ranges; an empty whitelist allows every address.
+func (user *User) AllowsIP(clientIP string) bool {
+	if len(user.IpWhitelist) == 0 {
+		return true
+	}
+	return ipInWhitelist(user.IpWhitelist, clientIP)
+}
+
+func ipInWhitelist(whitelist []string, clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range whitelist {
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 type CachedUser struct {
@@ -29,19 +89,54 @@ type CachedUser struct {
 	ExpireAt time.Time
 }
 
+// pendingValidation is a login waiting for captain, keyed by its request id,
+// or by client IP for IP-only logins, which every concurrent login from that
+// IP waits on. verifier is the HMAC of the password that was sent, cached with
+// the user once captain accepts it. done is closed once captain answered, so
+// a reply never blocks the event loop, even after the logins timed out.
+type pendingValidation struct {
+	verifier []byte
+	done     chan struct{}
+	once     sync.Once
+	accepted bool
+}
+
+func newPendingValidation(verifier []byte) *pendingValidation {
+	return &pendingValidation{verifier: verifier, done: make(chan struct{})}
+}
+
+// finish records captain's answer; only the first one counts.
+func (p *pendingValidation) finish(accepted bool) {
+	p.once.Do(func() {
+		p.accepted = accepted
+		close(p.done)
+	})
+}
+
 type UserManager struct {
 	cachedUsers        util.ConcurrentMap
+	failedIPs          util.ConcurrentMap
+	failedLogins       util.ConcurrentMap
 	pendingValidations sync.Map
+	liveConnections    map[string]map[net.Conn]struct{}
+	connectionCounts   map[string]int
+	bandwidthLimiters  map[string]*rate.Limiter
+	liveMu             sync.Mutex
 	TTL                time.Duration
+	metrics            *Metrics
 }
 
 func NewUserManager() *UserManager {
 	userManager := &UserManager{
-		cachedUsers: util.NewConcurrentMap(),
-		TTL:         1 * time.Hour,
+		cachedUsers:       util.NewConcurrentMap(),
+		failedIPs:         util.NewConcurrentMap(),
+		failedLogins:      util.NewConcurrentMap(),
+		liveConnections:   make(map[string]map[net.Conn]struct{}),
+		connectionCounts:  make(map[string]int),
+		bandwidthLimiters: make(map[string]*rate.Limiter),
+		TTL:               1 * time.Hour,
 	}
 	go userManager.cleanupLoop(1 * time.Hour)
-	go userManager.resetConnectionCount()
 	return userManager
 }
 
@@ -64,8 +159,20 @@ func (u *UserManager) GetUser(username string) (*User, bool) {
 	return nil, false
 }
 
+// RemoveUser drops the cached user along with the passwords remembered as
+// wrong for it, which may have become right.
 func (u *UserManager) RemoveUser(username string) {
 	u.cachedUsers.Remove(username)
+	prefix := username + "\x00"
+	for _, key := range u.failedLogins.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			u.failedLogins.Remove(key)
+		}
+	}
+}
+
+func failedLoginKey(username string, verifier []byte) string {
+	return username + "\x00" + string(verifier)
 }
 
 func (u *UserManager) cleanupLoop(t time.Duration) {
@@ -78,57 +185,204 @@ func (u *UserManager) cleanupLoop(t time.Duration) {
 				u.RemoveUser(item.Key)
 			}
 		}
+		for _, failed := range []util.ConcurrentMap{u.failedIPs, u.failedLogins} {
+			for item := range failed.IterBuffered() {
+				if time.Now().After(item.Val.(time.Time)) {
+					failed.Remove(item.Key)
+				}
+			}
+		}
 	}
 }
 
 func (u *UserManager) VerifyUser(username, password string, onVerifyUser func(event Event), pool string) bool {
-	if user, ok := u.GetUser(username); ok {
-		if user.Password == password && user.Status == "active" {
-			for _, p := range user.Pools {
-				if p.Tag == pool {
-					if p.DataLimit > p.DataUsage {
-						log.Printf("[UserManager] user login success [username:%v]/n", username)
-						return true
-					}
-					log.Printf("[UserManager] user login failed [username:%v]/n", username)
-					u.RemoveUser(username)
-					return false
-				}
-			}
+	// users cached through IP-only login have no verifier, captain checks
+	// their password
+	verifier := passwordVerifier(password)
+	if user, ok := u.GetUser(username); ok && len(user.PasswordVerifier) > 0 {
+		u.metrics.AuthCacheLookup(true)
+		// a wrong password leaves the cached user alone, or anyone knowing the
+		// username could keep evicting it
+		if !hmac.Equal(user.PasswordVerifier, verifier) {
+			log.Printf("[UserManager] user login failed, wrong password [username:%v]\n", username)
+			return false
 		}
-		log.Printf("[UserManager] user login failed [username:%v]\n", username)
-		u.RemoveUser(username)
+		return u.checkUser(user, pool)
+	}
+	u.metrics.AuthCacheLookup(false)
+	if expireAt, ok := u.failedLogins.Get(failedLoginKey(username, verifier)); ok && time.Now().Before(expireAt.(time.Time)) {
 		return false
 	}
-	respChan := make(chan bool)
-	u.pendingValidations.Store(username, respChan)
-	defer u.pendingValidations.Delete(username)
+	requestID := uuid.NewString()
+	pending := newPendingValidation(verifier)
+	u.pendingValidations.Store(requestID, pending)
+	defer u.pendingValidations.Delete(requestID)
 	payload := UserLoginPayload{
-		Username: username,
-		Password: password,
+		RequestID: requestID,
+		Username:  username,
+		Password:  password,
 	}
+	sentAt := time.Now()
 	onVerifyUser(Event{Type: "verify_user", Payload: payload})
 	select {
-	case result := <-respChan:
-		return result
+	case <-pending.done:
+		if !pending.accepted {
+			u.metrics.ObserveVerifyUser("rejected", sentAt)
+			u.failedLogins.Set(failedLoginKey(username, verifier), time.Now().Add(failedLoginTTL))
+			return false
+		}
+		u.metrics.ObserveVerifyUser("accepted", sentAt)
+		// the cached user may have been replaced by another login since; only
+		// the password captain checked for this one is accepted
+		if user, ok := u.GetUser(username); ok && hmac.Equal(user.PasswordVerifier, verifier) {
+			return u.checkUser(user, pool)
+		}
+		return false
 	case <-time.After(5 * time.Second):
+		u.metrics.ObserveVerifyUser("timeout", sentAt)
 		log.Printf("[UserManager] VerifyUser timeout for %s", username)
 		return false
 	}
 }
 
+// checkUser validates a cached user against the account status and the data
+// quota of the worker's pool, once the credentials (or client IP) have been
+// checked by the caller. Users that fail are evicted so the next attempt asks
+// captain again.
+func (u *UserManager) checkUser(user *User, pool string) bool {
+	if user.Status == "active" {
+		for _, p := range user.Pools {
+			if p.Tag == pool {
+				if p.DataLimit > p.DataUsage {
+					log.Printf("[UserManager] user login success [username:%v]\n", user.Username)
+					return true
+				}
+				log.Printf("[UserManager] user login failed, data limit reached [username:%v]\n", user.Username)
+				u.RemoveUser(user.Username)
+				return false
+			}
+		}
+	}
+	log.Printf("[UserManager] user login failed [username:%v]\n", user.Username)
+	u.RemoveUser(user.Username)
+	return false
+}
+
+func (u *UserManager) VerifyUserIP(username, clientIP string) bool {
+	user, ok := u.GetUser(username)
+	if !ok {
+		return false
+	}
+	if !user.AllowsIP(clientIP) {
+		log.Printf("[UserManager] client ip %s not in whitelist [username:%v]\n", clientIP, username)
+		return false
+	}
+	return true
+}
+
+// VerifyIP authenticates a client that sent no credentials by its source
+// address. A cached user whose whitelist holds the IP is used directly,
+// otherwise captain is asked to map the IP to its owning user. Addresses
+// captain rejects are remembered for failedIPTTL so they do not hit captain
+// every time.
+func (u *UserManager) VerifyIP(clientIP string, onVerifyUser func(event Event), pool string) (string, bool) {
+	if net.ParseIP(clientIP) == nil {
+		return "", false
+	}
+	if expireAt, ok := u.failedIPs.Get(clientIP); ok && time.Now().Before(expireAt.(time.Time)) {
+		return "", false
+	}
+	var matched *User
+	for item := range u.cachedUsers.IterBuffered() {
+		cachedUser := item.Val.(CachedUser)
+		if time.Now().Before(cachedUser.ExpireAt) && len(cachedUser.User.IpWhitelist) > 0 && cachedUser.User.AllowsIP(clientIP) {
+			if matched != nil {
+				log.Printf("[UserManager] ip login failed, %s is whitelisted by several users\n", clientIP)
+				u.failedIPs.Set(clientIP, time.Now().Add(failedIPTTL))
+				return "", false
+			}
+			matched = cachedUser.User
+		}
+	}
+	if matched == nil {
+		// concurrent logins from the IP share one lookup, since captain's
+		// reply only names the IP
+		key := ipValidationKey(clientIP)
+		existing, loaded := u.pendingValidations.LoadOrStore(key, newPendingValidation(nil))
+		pending := existing.(*pendingValidation)
+		if !loaded {
+			defer u.pendingValidations.Delete(key)
+			onVerifyUser(Event{Type: "verify_ip", Payload: UserIPLoginPayload{ClientIP: clientIP}})
+		}
+		select {
+		case <-pending.done:
+			if !pending.accepted {
+				u.failedIPs.Set(clientIP, time.Now().Add(failedIPTTL))
+				return "", false
+			}
+		case <-time.After(5 * time.Second):
+			// a slow captain is no reason to lock the IP out
+			log.Printf("[UserManager] VerifyIP timeout for %s", clientIP)
+			return "", false
+		}
+		for item := range u.cachedUsers.IterBuffered() {
+			cachedUser := item.Val.(CachedUser)
+			if len(cachedUser.User.IpWhitelist) > 0 && cachedUser.User.AllowsIP(clientIP) {
+				matched = cachedUser.User
+				break
+			}
+		}
+		if matched == nil {
+			return "", false
+		}
+	}
+	if !u.checkUser(matched, pool) {
+		return "", false
+	}
+	return matched.Username, true
+}
+
+func ipValidationKey(clientIP string) string {
+	return "ip:" + clientIP
+}
+
+// processLoginFailed ends the pending login captain rejected.
+func (u *UserManager) processLoginFailed(failed LoginFailedPayload) {
+	key := failed.RequestID
+	if failed.ClientIP != "" {
+		key = ipValidationKey(failed.ClientIP)
+	}
+	if key == "" {
+		return
+	}
+	ch, ok := u.pendingValidations.Load(key)
+	if !ok {
+		log.Printf("[UserManager] No pending validation for login: %s", key)
+		return
+	}
+	ch.(*pendingValidation).finish(false)
+}
+
 func (u *UserManager) processVerifyUserResponse(userPayload UserPayload) {
-	ch, ok := u.pendingValidations.Load(userPayload.Username)
+	key := userPayload.RequestID
+	if userPayload.ClientIP != "" {
+		key = ipValidationKey(userPayload.ClientIP)
+	}
+	if key == "" {
+		log.Printf("[UserManager] Login reply for user %s names no request", userPayload.Username)
+		return
+	}
+	ch, ok := u.pendingValidations.Load(key)
 	if !ok {
 		log.Printf("[UserManager] No pending validation for user: %s", userPayload.Username)
 		return
 	}
-	respChan := ch.(chan bool)
+	pending := ch.(*pendingValidation)
 	pools := make([]PoolLimit, 0)
 	for _, pool := range userPayload.Pools {
 		parts := strings.Split(pool, ":")
 		if len(parts) < 3 {
-			log.Printf("[UserManager] Invalid pool format (expected tag:limit:usage): %s", pool)
+			log.Printf("[UserManager] Invalid pool format (expected tag:limit:usage[:max_connections[:bandwidth_limit]]): %s", pool)
 			continue
 		}
 		DataLimit, err := strconv.Atoi(parts[1])
@@ -141,56 +395,140 @@ func (u *UserManager) processVerifyUserResponse(userPayload UserPayload) {
 			log.Printf("[UserManager] Invalid data usage in pool: %s", pool)
 			continue
 		}
+		MaxConnections := 0
+		if len(parts) > 3 {
+			MaxConnections, err = strconv.Atoi(parts[3])
+			if err != nil {
+				log.Printf("[UserManager] Invalid max connections in pool: %s", pool)
+				continue
+			}
+		}
+		var BandwidthLimit int64
+		if len(parts) > 4 {
+			BandwidthLimit, err = strconv.ParseInt(parts[4], 10, 64)
+			if err != nil {
+				log.Printf("[UserManager] Invalid bandwidth limit in pool: %s", pool)
+				continue
+			}
+		}
 		pools = append(pools, PoolLimit{
-			Tag:       parts[0],
-			DataLimit: DataLimit,
-			DataUsage: DataUsage,
+			Tag:            parts[0],
+			DataLimit:      DataLimit,
+			DataUsage:      DataUsage,
+			MaxConnections: MaxConnections,
+			BandwidthLimit: BandwidthLimit,
 		})
 	}
 	user := &User{
-		ID:          userPayload.ID,
-		Username:    userPayload.Username,
-		Password:    userPayload.Password,
-		Status:      userPayload.Status,
-		IpWhitelist: userPayload.IpWhitelist,
-		Pools:       pools,
-		Sessions:    make(map[string]Upstream),
+		ID:               userPayload.ID,
+		Username:         userPayload.Username,
+		PasswordVerifier: pending.verifier,
+		Status:           userPayload.Status,
+		IpWhitelist:      userPayload.IpWhitelist,
+		Pools:            pools,
+		AccessLogOptOut:  userPayload.AccessLogOptOut,
+		MaxConnections:   userPayload.MaxConnections,
+		BandwidthLimit:   userPayload.BandwidthLimit,
 	}
 	u.SetUser(user)
-	respChan <- true
+	pending.finish(true)
 }
 
-func (u *UserManager) addConnection(username string) error {
-	if user, ok := u.cachedUsers.Get(username); ok {
-		cachedUser := user.(CachedUser)
-		if cachedUser.User.connectionCount < 50 {
-			cachedUser.User.connectionCount++
-			return nil
+// maxConnections is the number of concurrent connections the user may hold on
+// pool: the lower of the user's and the pool's limits, ignoring those set to
+// 0. It returns 0 if neither is limited.
+func (user *User) maxConnections(pool string) int {
+	limit := user.MaxConnections
+	for _, p := range user.Pools {
+		if p.Tag == pool && p.MaxConnections > 0 && (limit == 0 || p.MaxConnections < limit) {
+			limit = p.MaxConnections
 		}
-		return fmt.Errorf("user %s has reached the maximum number of connections", username)
 	}
-	return fmt.Errorf("user %s not found", username)
+	return limit
+}
+
+// addConnection counts a new connection of the user on pool, refusing it once
+// the user's limit is reached, and sets up the user's bandwidth limit. Counts
+// are kept apart from the cached user, so refreshing the user from captain
+// does not reset them; each accepted connection must be released with
+// removeConnection.
+func (u *UserManager) addConnection(username, pool string) error {
+	cached, ok := u.cachedUsers.Get(username)
+	if !ok {
+		return fmt.Errorf("user %s not found", username)
+	}
+	user := cached.(CachedUser).User
+	limit := user.maxConnections(pool)
+
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	if u.connectionCounts == nil {
+		u.connectionCounts = make(map[string]int)
+	}
+	if limit > 0 && u.connectionCounts[username] >= limit {
+		return fmt.Errorf("user %s has reached the maximum of %d connections", username, limit)
+	}
+	u.connectionCounts[username]++
+	u.setBandwidthLimit(username, user.bandwidthLimit(pool))
+	return nil
 }
 
 func (u *UserManager) removeConnection(username string) {
-	if user, ok := u.cachedUsers.Get(username); ok {
-		cachedUser := user.(CachedUser)
-		if cachedUser.User.connectionCount >= 0 {
-			cachedUser.User.connectionCount--
-		}
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	if u.connectionCounts[username] <= 1 {
+		delete(u.connectionCounts, username)
+		delete(u.bandwidthLimiters, username)
 		return
 	}
+	u.connectionCounts[username]--
 }
 
-func (u *UserManager) resetConnectionCount() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		for item, val := range u.cachedUsers.Items() {
-			cachedUser := val.(CachedUser)
-			cachedUser.User.connectionCount = 0
-			u.cachedUsers.Set(item, cachedUser)
+// connectionCount returns the user's open connections.
+func (u *UserManager) connectionCount(username string) int {
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	return u.connectionCounts[username]
+}
+
+func (u *UserManager) trackConnection(username string, conn net.Conn) {
+	if conn == nil {
+		return
+	}
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	if u.liveConnections == nil {
+		u.liveConnections = make(map[string]map[net.Conn]struct{})
+	}
+	conns, ok := u.liveConnections[username]
+	if !ok {
+		conns = make(map[net.Conn]struct{})
+		u.liveConnections[username] = conns
+	}
+	conns[conn] = struct{}{}
+}
+
+func (u *UserManager) untrackConnection(username string, conn net.Conn) {
+	u.liveMu.Lock()
+	defer u.liveMu.Unlock()
+	if conns, ok := u.liveConnections[username]; ok {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(u.liveConnections, username)
 		}
+	}
+}
 
+// closeConnections closes every live client connection of the user and returns
+// how many were closed. The services release them through their normal close
+// path.
+func (u *UserManager) closeConnections(username string) int {
+	u.liveMu.Lock()
+	conns := u.liveConnections[username]
+	delete(u.liveConnections, username)
+	u.liveMu.Unlock()
+	for conn := range conns {
+		conn.Close()
 	}
+	return len(conns)
 }
@@ -1,6 +1,10 @@
 package manager
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,8 +35,8 @@ func TestUserManager_SetUser(t *testing.T) {
 	if retrievedUser.Username != user.Username {
 		t.Errorf("Username should match, expected %s, got %s", user.Username, retrievedUser.Username)
 	}
-	if retrievedUser.Password != user.Password {
-		t.Errorf("Password should match, expected %s, got %s", user.Password, retrievedUser.Password)
+	if !hmac.Equal(retrievedUser.PasswordVerifier, user.PasswordVerifier) {
+		t.Error("Password verifier should match")
 	}
 }
 
@@ -105,6 +109,86 @@ func TestUserManager_VerifyUser_InvalidPassword(t *testing.T) {
 	}
 }
 
+func TestUserManager_VerifyUser_WrongPasswordKeepsCachedUser(t *testing.T) {
+	um := NewUserManager()
+	um.SetUser(createTestUser("testuser", "testpass"))
+	onVerifyUser := func(event Event) {
+		t.Error("Captain should not be asked while the user is cached")
+	}
+	if um.VerifyUser("testuser", "wrongpass", onVerifyUser, "test-pool") {
+		t.Error("Invalid password should return false")
+	}
+	if _, ok := um.GetUser("testuser"); !ok {
+		t.Error("A wrong password should not evict the cached user")
+	}
+	if !um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") {
+		t.Error("The right password should still be accepted")
+	}
+}
+
+// Two logins of the same user are in flight; captain accepts the right
+// password and rejects the wrong one. The wrong one must not ride on the
+// other's acceptance.
+func TestUserManager_VerifyUser_ConcurrentLogins(t *testing.T) {
+	um := NewUserManager()
+	requests := make(chan UserLoginPayload, 2)
+	onVerifyUser := func(event Event) {
+		requests <- event.Payload.(UserLoginPayload)
+	}
+	results := make(chan bool, 2)
+	go func() { results <- um.VerifyUser("testuser", "wrongpass", onVerifyUser, "test-pool") }()
+	go func() { results <- um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") }()
+	// both are asked before either is answered
+	pending := []UserLoginPayload{<-requests, <-requests}
+	for _, req := range pending {
+		if req.Password != "testpass" {
+			um.processLoginFailed(LoginFailedPayload{RequestID: req.RequestID})
+			continue
+		}
+		um.processVerifyUserResponse(UserPayload{
+			RequestID: req.RequestID,
+			ID:        uuid.New(),
+			Username:  "testuser",
+			Status:    "active",
+			Pools:     []string{"test-pool:1000:0"},
+		})
+	}
+	accepted := 0
+	for i := 0; i < 2; i++ {
+		if <-results {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("Expected only the right password to be accepted, got %d", accepted)
+	}
+	if um.VerifyUser("testuser", "wrongpass", onVerifyUser, "test-pool") {
+		t.Error("The wrong password should not be cached")
+	}
+}
+
+func TestUserManager_VerifyUser_RejectedLoginIsRemembered(t *testing.T) {
+	um := NewUserManager()
+	asked := 0
+	onVerifyUser := func(event Event) {
+		asked++
+		um.processLoginFailed(LoginFailedPayload{RequestID: loginRequestID(event)})
+	}
+	for i := 0; i < 3; i++ {
+		if um.VerifyUser("testuser", "wrongpass", onVerifyUser, "test-pool") {
+			t.Fatal("Rejected login should return false")
+		}
+	}
+	if asked != 1 {
+		t.Errorf("Expected captain to be asked once, got %d", asked)
+	}
+	um.RemoveUser("testuser")
+	um.VerifyUser("testuser", "wrongpass", onVerifyUser, "test-pool")
+	if asked != 2 {
+		t.Error("A user change should forget the rejected password")
+	}
+}
+
 func TestUserManager_VerifyUser_InactiveUser(t *testing.T) {
 	um := NewUserManager()
 	user := createTestUser("testuser", "testpass")
@@ -139,9 +223,9 @@ func TestUserManager_VerifyUser_CaptainCallback(t *testing.T) {
 		go func() {
 			time.Sleep(10 * time.Millisecond)
 			userPayload := UserPayload{
+				RequestID:   loginRequestID(event),
 				ID:          uuid.New(),
 				Username:    "testuser",
-				Password:    "testpass",
 				Status:      "active",
 				IpWhitelist: []string{"127.0.0.1"},
 				Pools:       []string{"test-pool:1000000:0"},
@@ -158,6 +242,80 @@ func TestUserManager_VerifyUser_CaptainCallback(t *testing.T) {
 	}
 }
 
+func TestUserManager_VerifyUser_CachesVerifierOnly(t *testing.T) {
+	um := NewUserManager()
+	calls := 0
+	onVerifyUser := func(event Event) {
+		calls++
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			um.processVerifyUserResponse(UserPayload{
+				RequestID: loginRequestID(event),
+				ID:        uuid.New(),
+				Username:  "testuser",
+				Status:    "active",
+				Pools:     []string{"test-pool:1000:0"},
+			})
+		}()
+	}
+	if !um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") {
+		t.Fatal("Captain accepted login should return true")
+	}
+	user, _ := um.GetUser("testuser")
+	if bytes.Contains(user.PasswordVerifier, []byte("testpass")) || !hmac.Equal(user.PasswordVerifier, passwordVerifier("testpass")) {
+		t.Error("Cached user should hold the HMAC of the password")
+	}
+	if !um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") {
+		t.Error("Cached verifier should accept the same password")
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 captain call, got %d", calls)
+	}
+}
+
+func TestUserManager_VerifyUser_NoVerifierAsksCaptain(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.PasswordVerifier = nil
+	um.SetUser(user)
+	asked := false
+	onVerifyUser := func(event Event) {
+		asked = true
+		go um.processVerifyUserResponse(UserPayload{
+			RequestID: loginRequestID(event),
+			ID:        user.ID,
+			Username:  "testuser",
+			Status:    "active",
+			Pools:     []string{"test-pool:1000:0"},
+		})
+	}
+	if !um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") {
+		t.Error("Captain accepted login should return true")
+	}
+	if !asked {
+		t.Error("Captain should be asked when no verifier is cached")
+	}
+}
+
+func TestUserManager_VerifyUser_CaptainCallback_ExceededDataLimit(t *testing.T) {
+	um := NewUserManager()
+	onVerifyUser := func(event Event) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			um.processVerifyUserResponse(UserPayload{
+				RequestID: loginRequestID(event),
+				ID:        uuid.New(),
+				Username:  "testuser",
+				Status:    "active",
+				Pools:     []string{"test-pool:1000:1000"},
+			})
+		}()
+	}
+	if um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool") {
+		t.Error("User with exhausted data limit should return false on first login")
+	}
+}
+
 func TestUserManager_VerifyUser_Timeout(t *testing.T) {
 	um := NewUserManager()
 	onVerifyUser := func(event Event) {
@@ -179,18 +337,18 @@ func TestUserManager_ProcessVerifyUserResponse(t *testing.T) {
 	userPayload := UserPayload{
 		ID:          user.ID,
 		Username:    user.Username,
-		Password:    user.Password,
 		Status:      user.Status,
 		IpWhitelist: user.IpWhitelist,
 		Pools:       []string{"test-pool:1000000:0"},
 	}
 	onVerifyUser := func(event Event) {
+		userPayload.RequestID = loginRequestID(event)
 		go func() {
 			um.processVerifyUserResponse(userPayload)
 		}()
 
 	}
-	um.VerifyUser(user.Username, user.Password, onVerifyUser, "test-pool")
+	um.VerifyUser(user.Username, "testpass", onVerifyUser, "test-pool")
 	user, exists := um.GetUser("testuser")
 	if !exists {
 		t.Error("User should be cached after processing response")
@@ -212,17 +370,210 @@ func TestUserManager_ProcessVerifyUserResponse(t *testing.T) {
 	}
 }
 
+func TestUserManager_ProcessVerifyUserResponse_Limits(t *testing.T) {
+	um := NewUserManager()
+	userPayload := UserPayload{
+		ID:             uuid.New(),
+		Username:       "testuser",
+		Status:         "active",
+		Pools:          []string{"test-pool:1000000:0:5:2048"},
+		MaxConnections: 20,
+		BandwidthLimit: 4096,
+	}
+	onVerifyUser := func(event Event) {
+		userPayload.RequestID = loginRequestID(event)
+		go um.processVerifyUserResponse(userPayload)
+	}
+	um.VerifyUser("testuser", "testpass", onVerifyUser, "test-pool")
+	user, exists := um.GetUser("testuser")
+	if !exists {
+		t.Fatal("User should be cached after processing response")
+	}
+	if user.MaxConnections != 20 {
+		t.Errorf("Expected max connections 20, got %d", user.MaxConnections)
+	}
+	if user.Pools[0].MaxConnections != 5 {
+		t.Errorf("Expected pool max connections 5, got %d", user.Pools[0].MaxConnections)
+	}
+	if limit := user.maxConnections("test-pool"); limit != 5 {
+		t.Errorf("The lower pool limit should apply, got %d", limit)
+	}
+	if user.BandwidthLimit != 4096 {
+		t.Errorf("Expected bandwidth limit 4096, got %d", user.BandwidthLimit)
+	}
+	if user.Pools[0].BandwidthLimit != 2048 {
+		t.Errorf("Expected pool bandwidth limit 2048, got %d", user.Pools[0].BandwidthLimit)
+	}
+}
+
+func TestUser_AllowsIP(t *testing.T) {
+	user := createTestUser("testuser", "testpass")
+	user.IpWhitelist = []string{"127.0.0.1", "10.0.0.0/8"}
+	if !user.AllowsIP("127.0.0.1") {
+		t.Error("Exact IP should be allowed")
+	}
+	if !user.AllowsIP("10.20.30.40") {
+		t.Error("IP inside CIDR should be allowed")
+	}
+	if user.AllowsIP("192.168.1.1") {
+		t.Error("IP outside whitelist should be rejected")
+	}
+	user.IpWhitelist = nil
+	if !user.AllowsIP("192.168.1.1") {
+		t.Error("Empty whitelist should allow every IP")
+	}
+}
+
+func TestUserManager_VerifyUserIP(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	um.SetUser(user)
+	if !um.VerifyUserIP("testuser", "127.0.0.1") {
+		t.Error("Whitelisted IP should be allowed")
+	}
+	if um.VerifyUserIP("testuser", "10.0.0.1") {
+		t.Error("IP outside whitelist should be rejected")
+	}
+	if um.VerifyUserIP("unknown", "127.0.0.1") {
+		t.Error("Unknown user should be rejected")
+	}
+}
+
+func TestUserManager_VerifyIP_CacheHit(t *testing.T) {
+	um := NewUserManager()
+	um.SetUser(createTestUser("testuser", "testpass"))
+	onVerifyUser := func(event Event) {
+		t.Error("Captain should not be asked when the IP is cached")
+	}
+	username, ok := um.VerifyIP("127.0.0.1", onVerifyUser, "test-pool")
+	if !ok || username != "testuser" {
+		t.Errorf("Expected testuser, got %q (%v)", username, ok)
+	}
+}
+
+func TestUserManager_VerifyIP_CaptainCallback(t *testing.T) {
+	um := NewUserManager()
+	onVerifyUser := func(event Event) {
+		if event.Type != "verify_ip" {
+			t.Errorf("Expected verify_ip event, got %s", event.Type)
+		}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			um.processVerifyUserResponse(UserPayload{
+				ID:          uuid.New(),
+				Username:    "ipuser",
+				Status:      "active",
+				IpWhitelist: []string{"203.0.113.0/24"},
+				Pools:       []string{"test-pool:1000:0"},
+				ClientIP:    "203.0.113.7",
+			})
+		}()
+	}
+	username, ok := um.VerifyIP("203.0.113.7", onVerifyUser, "test-pool")
+	if !ok || username != "ipuser" {
+		t.Errorf("Expected ipuser, got %q (%v)", username, ok)
+	}
+}
+
+func TestUserManager_VerifyIP_CaptainRejects(t *testing.T) {
+	um := NewUserManager()
+	asked := 0
+	onVerifyUser := func(event Event) {
+		asked++
+		// the reply may beat VerifyIP to its select
+		um.processLoginFailed(LoginFailedPayload{ClientIP: "198.51.100.7"})
+	}
+	start := time.Now()
+	if _, ok := um.VerifyIP("198.51.100.7", onVerifyUser, "test-pool"); ok {
+		t.Error("IP captain rejected should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Rejection should end the lookup at once, took %s", elapsed)
+	}
+	if _, ok := um.VerifyIP("198.51.100.7", onVerifyUser, "test-pool"); ok || asked != 1 {
+		t.Errorf("Rejected IP should be refused without asking captain again, asked %d times", asked)
+	}
+}
+
+func TestUserManager_VerifyIP_ConcurrentLoginsShareLookup(t *testing.T) {
+	um := NewUserManager()
+	var asked int32
+	onVerifyUser := func(event Event) {
+		atomic.AddInt32(&asked, 1)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			um.processVerifyUserResponse(UserPayload{
+				ID:          uuid.New(),
+				Username:    "ipuser",
+				Status:      "active",
+				IpWhitelist: []string{"203.0.113.0/24"},
+				Pools:       []string{"test-pool:1000:0"},
+				ClientIP:    "203.0.113.9",
+			})
+		}()
+	}
+	var wg sync.WaitGroup
+	results := make(chan bool, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok := um.VerifyIP("203.0.113.9", onVerifyUser, "test-pool")
+			results <- ok
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for ok := range results {
+		if !ok {
+			t.Error("Every concurrent login from a whitelisted IP should succeed")
+		}
+	}
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Errorf("Concurrent logins should ask captain once, asked %d times", n)
+	}
+}
+
+func TestUserManager_VerifyIP_TimeoutDoesNotLockOut(t *testing.T) {
+	um := NewUserManager()
+	if _, ok := um.VerifyIP("203.0.113.10", func(event Event) {}, "test-pool"); ok {
+		t.Fatal("Unanswered lookup should fail")
+	}
+	if _, ok := um.failedIPs.Get("203.0.113.10"); ok {
+		t.Error("A timed out lookup should not refuse the IP afterwards")
+	}
+}
+
+func TestUserManager_VerifyIP_Ambiguous(t *testing.T) {
+	um := NewUserManager()
+	um.SetUser(createTestUser("user1", "testpass"))
+	um.SetUser(createTestUser("user2", "testpass"))
+	if _, ok := um.VerifyIP("127.0.0.1", func(event Event) {}, "test-pool"); ok {
+		t.Error("IP whitelisted by several users should be rejected")
+	}
+}
+
+func TestUserManager_VerifyIP_InvalidIP(t *testing.T) {
+	um := NewUserManager()
+	onVerifyUser := func(event Event) {
+		t.Error("Captain should not be asked for an invalid IP")
+	}
+	if _, ok := um.VerifyIP("not-an-ip", onVerifyUser, "test-pool"); ok {
+		t.Error("Invalid IP should be rejected")
+	}
+}
+
 func TestUserManager_AddConnection(t *testing.T) {
 	um := NewUserManager()
 	user := createTestUser("testuser", "testpass")
 	um.SetUser(user)
 	for i := 0; i < 50; i++ {
-		err := um.addConnection("testuser")
+		err := um.addConnection("testuser", "test-pool")
 		if err != nil {
 			t.Errorf("Should be able to add connection within limit: %v", err)
 		}
 	}
-	err := um.addConnection("testuser")
+	err := um.addConnection("testuser", "test-pool")
 	if err == nil {
 		t.Error("Should fail when exceeding connection limit")
 	}
@@ -230,7 +581,7 @@ func TestUserManager_AddConnection(t *testing.T) {
 
 func TestUserManager_AddConnection_UserNotFound(t *testing.T) {
 	um := NewUserManager()
-	err := um.addConnection("nonexistent")
+	err := um.addConnection("nonexistent", "test-pool")
 	if err == nil {
 		t.Error("Should fail for non-existent user")
 	}
@@ -240,8 +591,89 @@ func TestUserManager_RemoveConnection(t *testing.T) {
 	um := NewUserManager()
 	user := createTestUser("testuser", "testpass")
 	um.SetUser(user)
-	um.addConnection("testuser")
+	for i := 0; i < 50; i++ {
+		um.addConnection("testuser", "test-pool")
+	}
+	um.removeConnection("testuser")
+	if err := um.addConnection("testuser", "test-pool"); err != nil {
+		t.Errorf("Closing a connection should free a slot: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		um.removeConnection("testuser")
+	}
+	if n := um.connectionCount("testuser"); n != 0 {
+		t.Errorf("Expected no connections, got %d", n)
+	}
 	um.removeConnection("testuser")
+	if n := um.connectionCount("testuser"); n != 0 {
+		t.Errorf("Count should not go negative, got %d", n)
+	}
+}
+
+func TestUserManager_AddConnection_PoolLimit(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.Pools[0].MaxConnections = 2
+	um.SetUser(user)
+	for i := 0; i < 2; i++ {
+		if err := um.addConnection("testuser", "test-pool"); err != nil {
+			t.Fatalf("Should be able to add connection within pool limit: %v", err)
+		}
+	}
+	if err := um.addConnection("testuser", "test-pool"); err == nil {
+		t.Error("Should fail when exceeding the pool's connection limit")
+	}
+	if err := um.addConnection("testuser", "other-pool"); err != nil {
+		t.Errorf("Pool limit should not apply to other pools: %v", err)
+	}
+}
+
+func TestUserManager_AddConnection_Unlimited(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.MaxConnections = 0
+	um.SetUser(user)
+	for i := 0; i < 200; i++ {
+		if err := um.addConnection("testuser", "test-pool"); err != nil {
+			t.Fatalf("A limit of 0 should allow any number of connections: %v", err)
+		}
+	}
+}
+
+func TestUserManager_AddConnection_SurvivesRefresh(t *testing.T) {
+	um := NewUserManager()
+	user := createTestUser("testuser", "testpass")
+	user.MaxConnections = 1
+	um.SetUser(user)
+	if err := um.addConnection("testuser", "test-pool"); err != nil {
+		t.Fatalf("Should be able to add connection: %v", err)
+	}
+	refreshed := createTestUser("testuser", "testpass")
+	refreshed.MaxConnections = 1
+	um.SetUser(refreshed)
+	if err := um.addConnection("testuser", "test-pool"); err == nil {
+		t.Error("Refreshing the user should not reset its connection count")
+	}
+}
+
+func TestUserManager_AddConnection_Concurrent(t *testing.T) {
+	um := NewUserManager()
+	um.SetUser(createTestUser("testuser", "testpass"))
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if um.addConnection("testuser", "test-pool") == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted != 50 {
+		t.Errorf("Expected exactly 50 connections to be accepted, got %d", accepted)
+	}
 }
 
 func TestUserManager_CleanupLoop(t *testing.T) {
@@ -266,11 +698,11 @@ func TestUserManager_CleanupLoop(t *testing.T) {
 func createTestUser(username, password string) *User {
 	userID := uuid.New()
 	user := &User{
-		ID:          userID,
-		Username:    username,
-		Password:    password,
-		Status:      "active",
-		IpWhitelist: []string{"127.0.0.1"},
+		ID:               userID,
+		Username:         username,
+		PasswordVerifier: passwordVerifier(password),
+		Status:           "active",
+		IpWhitelist:      []string{"127.0.0.1"},
 		Pools: []PoolLimit{
 			{
 				Tag:       "test-pool",
@@ -278,7 +710,11 @@ func createTestUser(username, password string) *User {
 				DataUsage: 0,
 			},
 		},
-		Sessions: make(map[string]Upstream),
+		MaxConnections: 50,
 	}
 	return user
 }
+
+func loginRequestID(event Event) string {
+	return event.Payload.(UserLoginPayload).RequestID
+}
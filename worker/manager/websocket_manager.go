@@ -2,21 +2,41 @@ package manager
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// telemetryReadBatch is how many spooled events are read per disk pass.
+	telemetryReadBatch = 500
+	// telemetryRetryWait is how long the sender backs off after a nack or a
+	// spool read error before resending.
+	telemetryRetryWait = 5 * time.Second
+)
+
+var errConnectionClosed = errors.New("websocket connection closed")
+
 type WebsocketManager struct {
 	worker          *WorkerManager
 	websocketClient *WebsocketClient
+	rewind          chan uint64
+	// configured is closed once the first config, and with it captain's
+	// committed telemetry seq, has been applied.
+	configured    chan struct{}
+	configureOnce sync.Once
 }
 
 func NewWebsocketManager(worker *WorkerManager, conn *websocket.Conn) *WebsocketManager {
 	websocketManager := &WebsocketManager{
-		worker: worker,
+		worker:     worker,
+		rewind:     make(chan uint64, 1),
+		configured: make(chan struct{}),
 	}
 	websocketManager.websocketClient = NewWebsocketClient(conn, websocketManager.HandleEvent)
 	return websocketManager
@@ -27,6 +47,9 @@ func (m *WebsocketManager) Start() {
 	wg.Add(2)
 	go m.websocketClient.ReadMessage(&wg)
 	go m.websocketClient.WriteMessage(&wg)
+	if m.worker.spool != nil {
+		go m.sendTelemetry(m.worker.spool)
+	}
 	log.Println("[worker] WebSocket connected successfully")
 	wg.Wait()
 }
@@ -35,9 +58,86 @@ func (m *WebsocketManager) Stop() {
 	m.websocketClient.Close()
 }
 
-func (w *WebsocketManager) WriteEvent(event Event) {
+// WriteEvent queues event for captain. It gives up when the connection closes
+// or stays backed up for writeWait, instead of blocking the caller.
+func (w *WebsocketManager) WriteEvent(event Event) error {
 	log.Println("[websocket] sending event: ", event.Type)
-	w.websocketClient.egress <- event
+	select {
+	case w.websocketClient.egress <- event:
+		return nil
+	case <-w.websocketClient.done:
+		return errConnectionClosed
+	case <-time.After(writeWait):
+		return fmt.Errorf("timed out queueing %s event", event.Type)
+	}
+}
+
+// sendTelemetry streams spooled events to captain, starting after the last
+// ack so events left unacked by an earlier connection are replayed. A nack
+// rewinds the stream to the rejected event.
+func (m *WebsocketManager) sendTelemetry(spool *TelemetrySpool) {
+	done := m.websocketClient.done
+	// Nothing is sent before the spool is rebased on captain's seq; events
+	// numbered below it would be acked as replays and deleted.
+	select {
+	case <-m.configured:
+	case <-done:
+		return
+	}
+	next := spool.Acked() + 1
+	for {
+		select {
+		case seq := <-m.rewind:
+			next = seq
+			if !m.wait(telemetryRetryWait) {
+				return
+			}
+		default:
+		}
+
+		records, err := spool.Read(next, telemetryReadBatch)
+		if err != nil {
+			log.Printf("[TelemetrySpool] Failed to read spool: %v", err)
+			if !m.wait(telemetryRetryWait) {
+				return
+			}
+			continue
+		}
+		if len(records) == 0 {
+			select {
+			case <-spool.Notify():
+			case seq := <-m.rewind:
+				next = seq
+				if !m.wait(telemetryRetryWait) {
+					return
+				}
+			case <-done:
+				return
+			}
+			continue
+		}
+		for _, rec := range records {
+			select {
+			case m.websocketClient.egress <- Event{Type: rec.Type, Seq: rec.Seq, Payload: rec.Payload}:
+			case <-done:
+				return
+			}
+			next = rec.Seq + 1
+			if len(m.rewind) > 0 {
+				break
+			}
+		}
+	}
+}
+
+// wait sleeps for d and reports whether the connection is still open.
+func (m *WebsocketManager) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.websocketClient.done:
+		return false
+	}
 }
 
 func (m *WebsocketManager) HandleEvent(event Event) {
@@ -47,10 +147,16 @@ func (m *WebsocketManager) HandleEvent(event Event) {
 		m.processConfig(event.Payload)
 	case "login_success":
 		m.processVerifyUserResponse(event.Payload)
+	case "login_failed":
+		m.processLoginFailed(event.Payload)
 	case "user_change":
 		m.processUserChange(event.Payload)
 	case "pool_change":
 		m.processPoolChange(event.Payload)
+	case "ack":
+		m.processAck(event.Payload)
+	case "nack":
+		m.processNack(event.Payload)
 	case "error":
 		log.Printf("[websocket] Error from server: %v", event.Payload)
 	default:
@@ -84,6 +190,12 @@ func (m *WebsocketManager) processConfig(payload interface{}) {
 		return
 	}
 	m.worker.processConfig(cfg)
+	if spool := m.worker.spool; spool != nil {
+		if err := spool.Rebase(cfg.TelemetrySeq); err != nil {
+			log.Printf("[TelemetrySpool] Failed to rebase spool on seq %d: %v", cfg.TelemetrySeq, err)
+		}
+	}
+	m.configureOnce.Do(func() { close(m.configured) })
 }
 
 func (m *WebsocketManager) processVerifyUserResponse(payload interface{}) {
@@ -114,6 +226,31 @@ func (m *WebsocketManager) processVerifyUserResponse(payload interface{}) {
 	m.worker.processVerifyUserResponse(userPayload)
 }
 
+// processLoginFailed ends the pending login captain rejected.
+func (m *WebsocketManager) processLoginFailed(payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[websocket] Failed to marshal login_failed payload: %v", err)
+		return
+	}
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		log.Printf("[websocket] Failed to parse login_failed: %v", err)
+		return
+	}
+	data, err = json.Marshal(resp.Payload)
+	if err != nil {
+		log.Printf("[websocket] Failed to marshal login_failed payload data: %v", err)
+		return
+	}
+	var failed LoginFailedPayload
+	if err := json.Unmarshal(data, &failed); err != nil {
+		log.Printf("[websocket] Failed to parse LoginFailedPayload: %v", err)
+		return
+	}
+	m.worker.processLoginFailed(failed)
+}
+
 func (m *WebsocketManager) processUserChange(payload interface{}) {
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -169,3 +306,49 @@ func (m *WebsocketManager) processPoolChange(payload interface{}) {
 	}
 	m.worker.processPoolChange(poolId)
 }
+
+// processAck handles captain committing every telemetry event up to a seq.
+func (m *WebsocketManager) processAck(payload interface{}) {
+	seq, err := parseSeqPayload(payload)
+	if err != nil {
+		log.Printf("[websocket] Failed to parse ack: %v", err)
+		return
+	}
+	m.worker.processTelemetryAck(seq)
+}
+
+// processNack handles captain rejecting a telemetry event, usually because its
+// analytics buffer is full. Everything from that seq on is sent again.
+func (m *WebsocketManager) processNack(payload interface{}) {
+	seq, err := parseSeqPayload(payload)
+	if err != nil {
+		log.Printf("[websocket] Failed to parse nack: %v", err)
+		return
+	}
+	log.Printf("[websocket] Captain rejected telemetry #%d, resending", seq)
+	select {
+	case <-m.rewind:
+	default:
+	}
+	m.rewind <- seq
+}
+
+func parseSeqPayload(payload interface{}) (uint64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+	data, err = json.Marshal(resp.Payload)
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	if err := json.Unmarshal(data, &seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
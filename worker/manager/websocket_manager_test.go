@@ -131,7 +131,6 @@ func TestWebsocketManager_HandleEvent_VerifyUser(t *testing.T) {
 		Payload: UserPayload{
 			ID:          uuid.New(),
 			Username:    "testuser",
-			Password:    "testpass",
 			Status:      "active",
 			IpWhitelist: []string{"127.0.0.1"},
 			Pools:       []string{"test-pool:1000000:0"},
@@ -220,7 +219,6 @@ func TestWebsocketManager_EventProcessing_Integration(t *testing.T) {
 		{Type: "login_success", Payload: UserPayload{
 			ID:          uuid.New(),
 			Username:    "testuser",
-			Password:    "testpass",
 			Status:      "active",
 			IpWhitelist: []string{"127.0.0.1"},
 			Pools:       []string{"test-pool:1000000:0"},
@@ -252,7 +250,7 @@ func createTestConfigPayload() ConfigPayload {
 				UpstreamPassword: "pass",
 				UpstreamHost:     "127.0.0.1",
 				UpstreamPort:     3128,
-				UpstreamProvider: "test",
+				UpstreamProvider: "netnut",
 				Weight:           1,
 			},
 		},
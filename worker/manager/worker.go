@@ -3,12 +3,19 @@ package manager
 import (
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/snail007/goproxy/utils"
+	"github.com/torchlabssoftware/subnetwork_system/providers"
+	"golang.org/x/time/rate"
 )
 
+const defaultHealthInterval = 30 * time.Second
+
 type worker struct {
 	ID         uuid.UUID
 	Name       string
@@ -24,6 +31,13 @@ type WorkerManager struct {
 	upstreamManager  *UpstreamManager
 	HealthCollector  *HealthCollector
 	userManager      *UserManager
+	sessions         *SessionStore
+	usageAggregator  *UsageAggregator
+	accessLog        *AccessLog
+	spool            *TelemetrySpool
+	healthInterval   time.Duration
+	metrics          *Metrics
+	targeting        atomic.Value // *TargetingCatalog
 }
 
 func NewWorkerManager(workerID, baseURL, apiKey string) (*WorkerManager, error) {
@@ -43,14 +57,57 @@ func NewWorkerManager(workerID, baseURL, apiKey string) (*WorkerManager, error)
 		upstreamManager: upstreamManager,
 		HealthCollector: healthCollector,
 		userManager:     userManager,
+		sessions:        NewSessionStore(DefaultSessionCapacity),
+		healthInterval:  defaultHealthInterval,
+		metrics:         NewMetrics(healthCollector),
 	}
+	userManager.metrics = w.metrics
+	w.usageAggregator = NewUsageAggregator(defaultUsageWindow, w.SendUsageBatch)
+	w.accessLog = NewAccessLog(defaultUsageWindow, w.SendAccessLog)
 	return w, nil
 }
 
+// UseTelemetrySpool makes usage telemetry durable: events are written to spool
+// and replayed on every connection until captain acks them.
+func (c *WorkerManager) UseTelemetrySpool(spool *TelemetrySpool) {
+	c.spool = spool
+}
+
+// SetUsageWindow sets how long usage is rolled up, and access logs buffered,
+// before they are sent to captain. It must be called before Start.
+func (c *WorkerManager) SetUsageWindow(window time.Duration) {
+	c.usageAggregator = NewUsageAggregator(window, c.SendUsageBatch)
+	c.accessLog = NewAccessLog(window, c.SendAccessLog)
+}
+
+// SetHealthInterval sets how often health telemetry is sent to captain. It
+// must be called before Start.
+func (c *WorkerManager) SetHealthInterval(interval time.Duration) {
+	c.healthInterval = interval
+}
+
+// ServeMetrics serves Prometheus metrics on addr at /metrics. It blocks until
+// the listener fails.
+func (c *WorkerManager) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.metrics.Handler())
+	log.Printf("[worker] Serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
 func (c *WorkerManager) Start() {
 	c.HealthCollector.Start()
+	c.usageAggregator.Start()
+	c.accessLog.Start()
 	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.sessions.RemoveExpired()
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(c.healthInterval)
 		defer ticker.Stop()
 		for range ticker.C {
 			c.SendHealthTelemetry()
@@ -93,9 +150,17 @@ func (c *WorkerManager) login() (string, error) {
 func (c *WorkerManager) processConfig(cfg ConfigPayload) {
 	c.Worker.Name = cfg.WorkerName
 	c.Worker.Region = cfg.Region
-	c.Worker.Pool = NewPool(cfg.PoolID, cfg.PoolTag, cfg.PoolPort, cfg.PoolSubdomain)
+	pool := NewPool(cfg.PoolID, cfg.PoolTag, cfg.PoolPort, cfg.PoolSubdomain)
+	pool.ResolveLocally = cfg.ResolveLocally
+	c.Worker.Pool = pool
 	upstreams := make([]Upstream, 0)
 	for _, upstream := range cfg.Upstreams {
+		adapter, err := providers.ForUpstream(upstream.UpstreamProvider, upstream.UpstreamFormat)
+		if err != nil {
+			// every dial would fail and count against its breaker
+			log.Printf("[worker] Skipping upstream %s, it cannot be authenticated: %v", upstream.UpstreamTag, err)
+			continue
+		}
 		upstreams = append(upstreams, Upstream{
 			UpstreamID:       upstream.UpstreamID,
 			UpstreamTag:      upstream.UpstreamTag,
@@ -106,18 +171,24 @@ func (c *WorkerManager) processConfig(cfg ConfigPayload) {
 			UpstreamPort:     int(upstream.UpstreamPort),
 			UpstreamProvider: upstream.UpstreamProvider,
 			Weight:           upstream.Weight,
+			Adapter:          adapter,
 		})
 	}
 	c.upstreamManager.SetUpstreams(upstreams)
+	c.targeting.Store(NewTargetingCatalog(cfg.Countries))
 	c.HealthCollector.UpdateWorkerInfo(cfg.WorkerName, c.Worker.Pool.Region)
 	log.Printf("[worker] Configuration received for Pool: %s", cfg.PoolTag)
-	log.Printf("[worker] Upstreams count: %d", len(cfg.Upstreams))
+	log.Printf("[worker] Upstreams count: %d of %d", len(upstreams), len(cfg.Upstreams))
 }
 
 func (c *WorkerManager) processVerifyUserResponse(userPayload UserPayload) {
 	c.userManager.processVerifyUserResponse(userPayload)
 }
 
+func (c *WorkerManager) processLoginFailed(failed LoginFailedPayload) {
+	c.userManager.processLoginFailed(failed)
+}
+
 func (c *WorkerManager) VerifyUser(user, pass string) bool {
 	poolTag := ""
 	if c.Worker.Pool != nil {
@@ -128,28 +199,89 @@ func (c *WorkerManager) VerifyUser(user, pass string) bool {
 	}, poolTag)
 }
 
+// AllowClientIP reports whether an authenticated user may connect from
+// clientIP according to their IP whitelist.
+func (c *WorkerManager) AllowClientIP(username, clientIP string) bool {
+	if c.userManager == nil {
+		return true
+	}
+	return c.userManager.VerifyUserIP(username, clientIP)
+}
+
+// ValidateTargeting rejects targeting that is not in the pool's catalog.
+func (c *WorkerManager) ValidateTargeting(tag utils.Tag) error {
+	catalog, _ := c.targeting.Load().(*TargetingCatalog)
+	return catalog.Validate(tag)
+}
+
+// ResolveLocally reports whether SOCKS targets should be resolved by the
+// worker. Until the pool's config arrives they are left to the upstream.
+func (c *WorkerManager) ResolveLocally() bool {
+	pool := c.Worker.Pool
+	return pool != nil && pool.ResolveLocally
+}
+
+// VerifyIP authenticates a client that sent no credentials by its source
+// address and returns the user whose whitelist holds it.
+func (c *WorkerManager) VerifyIP(clientIP string) (string, bool) {
+	if c.userManager == nil {
+		return "", false
+	}
+	poolTag := ""
+	if c.Worker.Pool != nil {
+		poolTag = c.Worker.Pool.PoolTag
+	}
+	return c.userManager.VerifyIP(clientIP, func(event Event) {
+		c.websocketManager.WriteEvent(event)
+	}, poolTag)
+}
+
 func (c *WorkerManager) HasUpstreams() bool {
 	return c.upstreamManager != nil && c.upstreamManager.HasUpstreams()
 }
 
-func (c *WorkerManager) NextUpstream(username, session string) *Upstream {
+// NextUpstream returns the upstream for a client request. A session stays on
+// the upstream it is pinned to until the session expires. A new session, or
+// one whose upstream was ejected, removed or is listed in exclude, is pinned
+// to the upstream picked by rendezvous hashing, so every worker of the pool
+// picks the same one; exclude lists upstreams that already failed for this
+// request.
+func (c *WorkerManager) NextUpstream(username, session string, lifetime time.Duration, exclude ...uuid.UUID) *Upstream {
 	if session == "" {
-		return c.upstreamManager.Next()
+		return c.upstreamManager.Next(exclude...)
 	}
-	if user, ok := c.userManager.GetUser(username); ok {
-		sessions := user.Sessions
-		if upstream, ok := sessions[session]; ok {
+	pinned, ok := c.sessions.Get(username, session)
+	if ok {
+		if upstream := c.upstreamManager.Get(pinned.UpstreamID, exclude...); upstream != nil {
 			log.Println("[worker] Using existing upstream for session:", session)
-			return &upstream
+			return upstream
 		}
-		upstream := c.upstreamManager.Next()
-		sessions[session] = *upstream
-		return upstream
 	}
-	return c.upstreamManager.Next()
+	upstream := c.upstreamManager.NextForKey(sessionHashKey(username, session), exclude...)
+	if upstream == nil {
+		return nil
+	}
+	if ok {
+		log.Printf("[worker] Session %s moved from upstream %s to %s", session, pinned.UpstreamTag, upstream.UpstreamTag)
+	}
+	c.sessions.Pin(username, session, *upstream, lifetime)
+	return upstream
+}
+
+// sessionHashKey is the rendezvous hashing key of a user's session. Session
+// ids are chosen by clients, so the username keeps users apart.
+func sessionHashKey(username, session string) string {
+	return username + "\x00" + session
 }
 
 func (c *WorkerManager) RecordUpstreamLatency(upstream *Upstream, connectLatency time.Duration, err error) {
+	if c.upstreamManager != nil {
+		c.upstreamManager.ReportResult(upstream.UpstreamID, err)
+	}
+	c.metrics.ObserveUpstreamDial(upstream.UpstreamTag, connectLatency, err)
+	if c.HealthCollector == nil {
+		return
+	}
 	c.HealthCollector.RecordUpstreamLatency(
 		upstream.UpstreamID,
 		upstream.UpstreamTag,
@@ -158,12 +290,13 @@ func (c *WorkerManager) RecordUpstreamLatency(upstream *Upstream, connectLatency
 	)
 }
 
-func (c *WorkerManager) IncrementConnection() {
-	c.HealthCollector.IncrementConnection()
+// IncrementConnection counts a client connection accepted by service.
+func (c *WorkerManager) IncrementConnection(service string) {
+	c.HealthCollector.IncrementConnection(service)
 }
 
-func (c *WorkerManager) DecrementConnection(isErr bool) {
-	c.HealthCollector.DecrementConnection()
+func (c *WorkerManager) DecrementConnection(service string, isErr bool) {
+	c.HealthCollector.DecrementConnection(service)
 	if isErr {
 		c.HealthCollector.RecordError()
 	} else {
@@ -171,7 +304,10 @@ func (c *WorkerManager) DecrementConnection(isErr bool) {
 	}
 }
 
-func (c *WorkerManager) RecordDataUsage(bytesSent, bytesReceived uint64, username, sourceIP, destHost string, destPort uint16, reqIsHTTPS bool) {
+// RecordDataUsage counts traffic towards the user's usage under protocol.
+// requests is how many connections or UDP associations it starts, so an
+// association reports 1 with its first datagram and 0 after.
+func (c *WorkerManager) RecordDataUsage(bytesSent, bytesReceived, requests uint64, username, sourceIP, destHost string, destPort uint16, protocol string) {
 	if bytesSent > 0 || bytesReceived > 0 {
 		poolID, poolName := c.GetPoolInfo()
 		workerUUID, _ := uuid.Parse(c.Worker.ID.String())
@@ -181,8 +317,12 @@ func (c *WorkerManager) RecordDataUsage(bytesSent, bytesReceived uint64, usernam
 		if c.Worker.Pool != nil {
 			workerRegion = c.Worker.Pool.Region
 		}
+		userID := uuid.Nil
+		if user, ok := c.userManager.GetUser(username); ok {
+			userID = user.ID
+		}
 		usage := UserDataUsage{
-			UserID:          uuid.Nil,
+			UserID:          userID,
 			Username:        username,
 			PoolID:          poolUUID,
 			PoolName:        poolName,
@@ -191,19 +331,32 @@ func (c *WorkerManager) RecordDataUsage(bytesSent, bytesReceived uint64, usernam
 			BytesSent:       atomic.LoadUint64(&bytesSent),
 			BytesReceived:   atomic.LoadUint64(&bytesReceived),
 			SourceIP:        sourceIP,
-			Protocol:        "HTTP",
+			Protocol:        protocol,
 			DestinationHost: destHost,
 			DestinationPort: destPort,
 			StatusCode:      200,
+			Requests:        requests,
 		}
-		if reqIsHTTPS {
-			usage.Protocol = "HTTPS"
-		}
+		c.metrics.AddUserBytes(username, poolName, bytesSent, bytesReceived)
 
-		c.SendDataUsage(usage)
+		c.usageAggregator.Add(usage)
 	}
 }
 
+// RecordAccess adds a request to the access log unless its user opted out.
+// Requests from users not in the cache are left out too, since their choice is
+// unknown.
+func (c *WorkerManager) RecordAccess(entry AccessLogEntry) {
+	user, ok := c.userManager.GetUser(entry.Username)
+	if !ok || user.AccessLogOptOut {
+		return
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	c.accessLog.Add(entry)
+}
+
 func (c *WorkerManager) AddThroughput(bytes uint64) {
 	c.HealthCollector.AddThroughput(bytes)
 }
@@ -219,26 +372,69 @@ func (c *WorkerManager) GetUpstreamAddress() []string {
 	return c.upstreamManager.GetUpstreamAddress()
 }
 
-func (c *WorkerManager) AddUserConnection(username string) error {
-	return c.userManager.addConnection(username)
+// AddUserConnection counts a new client connection against the user and keeps
+// track of it so it can be closed when the user changes on captain.
+func (c *WorkerManager) AddUserConnection(username string, conn net.Conn) error {
+	poolTag := ""
+	if c.Worker.Pool != nil {
+		poolTag = c.Worker.Pool.PoolTag
+	}
+	if err := c.userManager.addConnection(username, poolTag); err != nil {
+		return err
+	}
+	c.userManager.trackConnection(username, conn)
+	return nil
 }
 
-func (c *WorkerManager) RemoveUserConnection(username string) {
+// UserBandwidthLimiter returns the token bucket shared by the user's
+// connections, or nil if the user's bandwidth is not limited. It is only set
+// while the user has a connection added with AddUserConnection.
+func (c *WorkerManager) UserBandwidthLimiter(username string) *rate.Limiter {
+	return c.userManager.bandwidthLimiter(username)
+}
+
+func (c *WorkerManager) RemoveUserConnection(username string, conn net.Conn) {
+	c.userManager.untrackConnection(username, conn)
 	c.userManager.removeConnection(username)
 }
 
-func (c *WorkerManager) SendDataUsage(usage UserDataUsage) {
+// SendUsageBatch spools a window of usage for delivery to captain. Without a
+// spool it falls back to a best-effort send on the current connection.
+func (c *WorkerManager) SendUsageBatch(batch UsageBatch) {
+	batch.WorkerID = c.Worker.ID
+	if c.Worker.Pool != nil {
+		batch.WorkerRegion = c.Worker.Pool.Region
+	}
+	if c.spool == nil {
+		if c.websocketManager == nil {
+			log.Printf("[DataUsage] WebSocket not connected, cannot send data usage")
+			return
+		}
+		if err := c.websocketManager.WriteEvent(Event{Type: "telemetry_usage_batch", Payload: batch}); err != nil {
+			log.Printf("[DataUsage] Failed to send usage batch: %v", err)
+		}
+		return
+	}
+	seq, err := c.spool.Append("telemetry_usage_batch", batch)
+	if err != nil {
+		log.Printf("[DataUsage] Failed to spool usage batch of %d entries: %v", len(batch.Entries), err)
+		return
+	}
+	log.Printf("[DataUsage] Spooled usage batch #%d: %d entries over %s",
+		seq, len(batch.Entries), batch.WindowEnd.Sub(batch.WindowStart).Round(time.Millisecond))
+}
+
+// SendAccessLog sends a window of access log entries on the current
+// connection. They are dropped if captain is not connected.
+func (c *WorkerManager) SendAccessLog(entries []AccessLogEntry) {
 	if c.websocketManager == nil {
-		log.Printf("[DataUsage] WebSocket not connected, cannot send data usage")
+		log.Printf("[AccessLog] WebSocket not connected, dropping %d entries", len(entries))
 		return
 	}
-	event := Event{
-		Type:    "telemetry_usage",
-		Payload: usage,
+	batch := AccessLogBatch{WorkerID: c.Worker.ID, Entries: entries}
+	if err := c.websocketManager.WriteEvent(Event{Type: "telemetry_access_log_batch", Payload: batch}); err != nil {
+		log.Printf("[AccessLog] Failed to send %d entries: %v", len(entries), err)
 	}
-	c.websocketManager.WriteEvent(event)
-	log.Printf("[DataUsage] Sent usage: user=%s, bytes_sent=%d, bytes_received=%d, dest=%s:%d",
-		usage.Username, usage.BytesSent, usage.BytesReceived, usage.DestinationHost, usage.DestinationPort)
 }
 
 func (c *WorkerManager) SendHealthTelemetry() {
@@ -247,23 +443,67 @@ func (c *WorkerManager) SendHealthTelemetry() {
 		return
 	}
 	health := c.HealthCollector.BuildWorkerHealth()
-	health.PoolTag = c.Worker.Pool.PoolTag
+	if c.Worker.Pool != nil {
+		health.PoolTag = c.Worker.Pool.PoolTag
+	}
+	if c.upstreamManager != nil {
+		health.Upstreams = mergeBreakerStatuses(health.Upstreams, c.upstreamManager.BreakerStatuses())
+	}
 	event := Event{
 		Type:    "telemetry_health",
 		Payload: health,
 	}
-	c.websocketManager.WriteEvent(event)
+	if err := c.websocketManager.WriteEvent(event); err != nil {
+		log.Printf("[HealthTelemetry] Failed to send health: %v", err)
+		return
+	}
 	log.Printf("[HealthTelemetry] Sent health: status=%s, cpu=%.2f%%, mem=%.2f%%, active_conns=%d, throughput=%d bytes/sec",
 		health.Status, health.CpuUsage, health.MemoryUsage, health.ActiveConnections, health.BytesThroughputPerSec)
 }
 
+// processUserChange drops the cached user and cuts off its live connections,
+// so clients re-authenticate against the current state on captain (status,
+// password or an exhausted data quota).
 func (c *WorkerManager) processUserChange(username string) {
 	c.userManager.RemoveUser(username)
+	if closed := c.userManager.closeConnections(username); closed > 0 {
+		log.Printf("[worker] Closed %d live connections for changed user %s", closed, username)
+	}
 }
 
 func (c *WorkerManager) processPoolChange(poolId uuid.UUID) {
-	c.websocketManager.WriteEvent(Event{
+	if err := c.websocketManager.WriteEvent(Event{
 		Type:    "request_config",
 		Payload: poolId,
-	})
+	}); err != nil {
+		log.Printf("[worker] Failed to request config for pool %s: %v", poolId, err)
+	}
+}
+
+func (c *WorkerManager) processTelemetryAck(seq uint64) {
+	if c.spool == nil {
+		return
+	}
+	if err := c.spool.Ack(seq); err != nil {
+		log.Printf("[TelemetrySpool] Failed to record ack #%d: %v", seq, err)
+	}
+}
+
+// mergeBreakerStatuses overrides the error-rate status of ejected and
+// recovering upstreams, adding entries for those without traffic in the window.
+func mergeBreakerStatuses(upstreams, breakerStatuses []UpstreamHealth) []UpstreamHealth {
+	for _, breaker := range breakerStatuses {
+		found := false
+		for i := range upstreams {
+			if upstreams[i].UpstreamID == breaker.UpstreamID {
+				upstreams[i].Status = breaker.Status
+				found = true
+				break
+			}
+		}
+		if !found {
+			upstreams = append(upstreams, breaker)
+		}
+	}
+	return upstreams
 }
@@ -1,6 +1,8 @@
 package manager
 
 import (
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
@@ -148,7 +150,7 @@ func TestWorkerManager_ProcessConfig_Upstreams(t *testing.T) {
 				UpstreamPassword: "pass1",
 				UpstreamHost:     "127.0.0.1",
 				UpstreamPort:     3128,
-				UpstreamProvider: "provider1",
+				UpstreamProvider: "geonode",
 				Weight:           1,
 			},
 			{
@@ -159,7 +161,7 @@ func TestWorkerManager_ProcessConfig_Upstreams(t *testing.T) {
 				UpstreamPassword: "pass2",
 				UpstreamHost:     "127.0.0.2",
 				UpstreamPort:     1080,
-				UpstreamProvider: "provider2",
+				UpstreamProvider: "iproyal",
 				Weight:           2,
 			},
 		},
@@ -178,6 +180,29 @@ func TestWorkerManager_ProcessConfig_Upstreams(t *testing.T) {
 	}
 }
 
+func TestWorkerManager_ProcessConfig_SkipsUnauthenticatableUpstream(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	config := createTestConfigPayloadForWorker()
+	broken := config.Upstreams[0]
+	broken.UpstreamID = uuid.New()
+	broken.UpstreamTag = "broken-upstream"
+	broken.UpstreamProvider = "no-such-provider"
+	config.Upstreams = append(config.Upstreams, broken)
+	wm.processConfig(config)
+	for i := 0; i < 4; i++ {
+		upstream := wm.upstreamManager.Next()
+		if upstream == nil {
+			t.Fatal("Should keep the upstream that can be authenticated")
+		}
+		if upstream.UpstreamID == broken.UpstreamID {
+			t.Fatal("Should skip an upstream whose provider has no adapter")
+		}
+	}
+}
+
 func TestWorkerManager_ProcessUserChange(t *testing.T) {
 	workerID := uuid.New().String()
 	baseURL := "https://test-captain.com"
@@ -196,6 +221,24 @@ func TestWorkerManager_ProcessUserChange(t *testing.T) {
 	}
 }
 
+func TestWorkerManager_ProcessUserChange_ClosesLiveConnections(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	wm.userManager.SetUser(createTestUserForWorker("testuser", "testpass"))
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	if err := wm.AddUserConnection("testuser", serverConn); err != nil {
+		t.Fatalf("Should be able to add connection: %v", err)
+	}
+	wm.processUserChange("testuser")
+	if _, err := serverConn.Read(make([]byte, 1)); err == nil {
+		t.Error("Live connection should be closed after user change event")
+	}
+	wm.RemoveUserConnection("testuser", serverConn)
+}
+
 func TestWorkerManager_HasUpstreams(t *testing.T) {
 	workerID := uuid.New().String()
 	baseURL := "https://test-captain.com"
@@ -225,11 +268,11 @@ func TestWorkerManager_AddUserConnection(t *testing.T) {
 	}
 	user := createTestUserForWorker("testuser", "testpass")
 	wm.userManager.SetUser(user)
-	err = wm.AddUserConnection("testuser")
+	err = wm.AddUserConnection("testuser", nil)
 	if err != nil {
 		t.Errorf("Should be able to add connection: %v", err)
 	}
-	err = wm.AddUserConnection("invaliduser")
+	err = wm.AddUserConnection("invaliduser", nil)
 	if err == nil {
 		t.Error("Should not be able to add connection for invalid user")
 	}
@@ -246,14 +289,138 @@ func TestWorkerManager_SendHealthTelemetry(t *testing.T) {
 	wm.SendHealthTelemetry()
 }
 
+func TestWorkerManager_NextUpstream_RepinsEjectedSession(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	wm.upstreamManager.FailureThreshold = 1
+	wm.processConfig(createTestConfigPayload())
+	wm.userManager.SetUser(createTestUserForWorker("testuser", "testpass"))
+	pinned := wm.NextUpstream("testuser", "session1", 0)
+	if pinned == nil {
+		t.Fatal("Should select an upstream for the session")
+	}
+	wm.RecordUpstreamLatency(pinned, time.Millisecond, fmt.Errorf("connection refused"))
+	repinned := wm.NextUpstream("testuser", "session1", 0)
+	if repinned != nil && repinned.UpstreamID == pinned.UpstreamID {
+		t.Error("Should not keep a session on an ejected upstream")
+	}
+}
+
+func TestWorkerManager_NextUpstream_StickySession(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	config := createTestConfigPayload()
+	config.Upstreams = append(config.Upstreams, config.Upstreams[0])
+	config.Upstreams[1].UpstreamID = uuid.New()
+	wm.processConfig(config)
+	pinned := wm.NextUpstream("testuser", "session1", time.Minute)
+	if pinned == nil {
+		t.Fatal("Should select an upstream for the session")
+	}
+	for i := 0; i < 5; i++ {
+		if got := wm.NextUpstream("testuser", "session1", time.Minute); got == nil || got.UpstreamID != pinned.UpstreamID {
+			t.Fatal("Session should stay on its upstream")
+		}
+	}
+	if got := wm.NextUpstream("testuser", "session1", time.Minute, pinned.UpstreamID); got == nil || got.UpstreamID == pinned.UpstreamID {
+		t.Error("Excluded upstream should not be used")
+	}
+}
+
+func TestWorkerManager_NextUpstream_HonorsPinOverHash(t *testing.T) {
+	wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+	if err != nil {
+		t.Fatalf("Failed to create WorkerManager: %v", err)
+	}
+	config := createTestConfigPayload()
+	wm.processConfig(config)
+	sessions := make([]string, 20)
+	for i := range sessions {
+		sessions[i] = fmt.Sprintf("session%d", i)
+		if got := wm.NextUpstream("testuser", sessions[i], time.Minute); got == nil || got.UpstreamID != config.Upstreams[0].UpstreamID {
+			t.Fatal("Should pin the session to the only upstream")
+		}
+	}
+
+	// with more upstreams, hashing sends most sessions elsewhere, but pinned
+	// ones stay put until they expire
+	for i := 0; i < 4; i++ {
+		upstream := config.Upstreams[0]
+		upstream.UpstreamID = uuid.New()
+		config.Upstreams = append(config.Upstreams, upstream)
+	}
+	wm.processConfig(config)
+	for _, session := range sessions {
+		if got := wm.NextUpstream("testuser", session, time.Minute); got == nil || got.UpstreamID != config.Upstreams[0].UpstreamID {
+			t.Fatalf("Session %s should stay on its pinned upstream", session)
+		}
+	}
+
+	moved := wm.NextUpstream("testuser", sessions[0], time.Minute, config.Upstreams[0].UpstreamID)
+	if moved == nil || moved.UpstreamID == config.Upstreams[0].UpstreamID {
+		t.Fatal("Should move the session off an excluded upstream")
+	}
+	if got := wm.NextUpstream("testuser", sessions[0], time.Minute); got == nil || got.UpstreamID != moved.UpstreamID {
+		t.Error("Session should stay on the upstream it moved to")
+	}
+}
+
+func TestWorkerManager_NextUpstream_SessionSharedAcrossWorkers(t *testing.T) {
+	config := createTestConfigPayload()
+	for i := 0; i < 4; i++ {
+		upstream := config.Upstreams[0]
+		upstream.UpstreamID = uuid.New()
+		config.Upstreams = append(config.Upstreams, upstream)
+	}
+	workers := make([]*WorkerManager, 2)
+	for i := range workers {
+		wm, err := NewWorkerManager(uuid.New().String(), "https://test-captain.com", "test-api-key")
+		if err != nil {
+			t.Fatalf("Failed to create WorkerManager: %v", err)
+		}
+		wm.processConfig(config)
+		workers[i] = wm
+	}
+	for i := 0; i < 20; i++ {
+		session := fmt.Sprintf("session%d", i)
+		a := workers[0].NextUpstream("testuser", session, time.Minute)
+		b := workers[1].NextUpstream("testuser", session, time.Minute)
+		if a == nil || b == nil || a.UpstreamID != b.UpstreamID {
+			t.Fatalf("Workers of a pool should send %s to the same upstream", session)
+		}
+	}
+}
+
+func TestMergeBreakerStatuses(t *testing.T) {
+	seen := UpstreamHealth{UpstreamID: uuid.New(), UpstreamTag: "seen", Status: "healthy"}
+	idle := UpstreamHealth{UpstreamID: uuid.New(), UpstreamTag: "idle", Status: UpstreamStatusEjected}
+	merged := mergeBreakerStatuses([]UpstreamHealth{seen}, []UpstreamHealth{
+		{UpstreamID: seen.UpstreamID, UpstreamTag: "seen", Status: UpstreamStatusRecovering},
+		idle,
+	})
+	if len(merged) != 2 {
+		t.Fatalf("Should add ejected upstreams without traffic, got %d entries", len(merged))
+	}
+	if merged[0].Status != UpstreamStatusRecovering {
+		t.Errorf("Should override status with breaker state, got %s", merged[0].Status)
+	}
+	if merged[1].Status != UpstreamStatusEjected {
+		t.Errorf("Should report ejected status, got %s", merged[1].Status)
+	}
+}
+
 func createTestUserForWorker(username, password string) *User {
 	userID := uuid.New()
 	return &User{
-		ID:          userID,
-		Username:    username,
-		Password:    password,
-		Status:      "active",
-		IpWhitelist: []string{"127.0.0.1"},
+		ID:               userID,
+		Username:         username,
+		PasswordVerifier: passwordVerifier(password),
+		Status:           "active",
+		IpWhitelist:      []string{"127.0.0.1"},
 		Pools: []PoolLimit{
 			{
 				Tag:       "test-pool",
@@ -261,7 +428,6 @@ func createTestUserForWorker(username, password string) *User {
 				DataUsage: 0,
 			},
 		},
-		Sessions: make(map[string]Upstream),
 	}
 }
 
@@ -282,7 +448,7 @@ func createTestConfigPayloadForWorker() ConfigPayload {
 				UpstreamPassword: "pass",
 				UpstreamHost:     "127.0.0.1",
 				UpstreamPort:     3128,
-				UpstreamProvider: "test",
+				UpstreamProvider: "netnut",
 				Weight:           1,
 			},
 		},
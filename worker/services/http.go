@@ -1,13 +1,17 @@
 package services
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -77,7 +81,7 @@ func (s *HTTP) callback(inConn net.Conn) {
 			log.Printf("http(s) conn handler crashed with err : %s \nstack: %s", err, string(debug.Stack()))
 		}
 	}()
-	req, err := utils.NewHTTPRequest(&inConn, 4096, s.worker.VerifyUser)
+	req, err := utils.NewHTTPRequest(&inConn, 4096, s.worker.VerifyUser, s.worker.VerifyIP)
 	if err != nil {
 		if err != io.EOF {
 			log.Printf("decoder error , form %s, ERR:%s", inConn.RemoteAddr(), err)
@@ -85,9 +89,21 @@ func (s *HTTP) callback(inConn net.Conn) {
 		utils.CloseConn(&inConn)
 		return
 	}
+	if !s.worker.AllowClientIP(req.User, utils.ClientIP(inConn)) {
+		log.Printf("client ip %s not allowed for user %s", inConn.RemoteAddr(), req.User)
+		inConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		utils.CloseConn(&inConn)
+		return
+	}
+	if err := s.worker.ValidateTargeting(req.Tag); err != nil {
+		log.Printf("targeting rejected for user %s: %s", req.User, err)
+		fmt.Fprintf(inConn, "HTTP/1.1 400 Bad Request\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err)
+		utils.CloseConn(&inConn)
+		return
+	}
 	address := req.Host
 
-	if err := s.worker.AddUserConnection(req.User); err != nil {
+	if err := s.worker.AddUserConnection(req.User, inConn); err != nil {
 		log.Printf("add user connection failed, err: %s", err)
 		inConn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\n\r\n"))
 		utils.CloseConn(&inConn)
@@ -117,6 +133,7 @@ func (s *HTTP) callback(inConn net.Conn) {
 		} else {
 			log.Printf("connect to %s fail, ERR:%s", address, err)
 		}
+		s.worker.RemoveUserConnection(req.User, inConn)
 		utils.CloseConn(&inConn)
 	}
 }
@@ -132,27 +149,20 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	}
 
 	var outConn net.Conn
-	var upstream *manager.Upstream
 
 	if useProxy {
 		if s.worker.HasUpstreams() {
-			upstream = s.worker.NextUpstream(req.User, req.Tag.Session)
-			if upstream != nil {
-				log.Printf("[Upstream] Connecting to: %s (tag: %s)", upstream.GetAddress(), upstream.UpstreamTag)
-				connectStart := time.Now()
-				out, err := s.outPool.GetConnFromConnectionPool(upstream.GetAddress())
-				if err != nil {
-					outConn, err = utils.ConnectHost(upstream.GetAddress(), *s.cfg.Timeout)
-				} else {
-					log.Println("[Upstream] Using connection from pool")
-					outConn = out.(net.Conn)
-				}
-				connectLatency := time.Since(connectStart)
-				s.worker.RecordUpstreamLatency(upstream, connectLatency, nil)
-			} else {
-				outConn, err = utils.ConnectHost(address, *s.cfg.Timeout)
-				err = fmt.Errorf("no upstream available")
+			// a request the client got wrong is not the upstreams' fault, so it
+			// is parsed before any of them is tried
+			var upstreamReq *upstreamRequest
+			upstreamReq, err = newUpstreamRequest(req.HeadBuf)
+			if err != nil {
+				utils.CloseConn(inConn)
+				return
 			}
+			_, outConn, err = dialUpstream(s.worker, &s.outPool, *s.cfg.Timeout, req.User, req.Tag, func(upstream *manager.Upstream, outConn *net.Conn) error {
+				return connectUpstream(upstreamReq, req.Tag, upstream, outConn)
+			})
 		} else {
 			err = fmt.Errorf("no upstream configured")
 		}
@@ -161,7 +171,7 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	}
 
 	if err != nil {
-		log.Printf("connect to %s , err:%s", "", err)
+		log.Printf("connect to %s , err:%s", address, err)
 		utils.CloseConn(inConn)
 		return
 	}
@@ -169,15 +179,11 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 	outAddr := outConn.RemoteAddr().String()
 	outLocalAddr := outConn.LocalAddr().String()
 
-	if req.IsHTTPS() && !useProxy {
+	// the upstream's reply to a CONNECT was consumed by the handshake
+	if req.IsHTTPS() {
 		req.HTTPSReply()
 	}
-	if useProxy {
-		err := connectUpstream(req, upstream, &outConn)
-		if err != nil {
-			return err
-		}
-	} else {
+	if !useProxy {
 		outConn.Write(req.HeadBuf)
 	}
 
@@ -198,13 +204,33 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 		destPort = uint16(p)
 	}
 
-	s.worker.IncrementConnection()
+	s.worker.IncrementConnection("http")
 
-	utils.IoBind((*inConn), outConn, func(isSrcErr bool, err error) {
+	startedAt := time.Now()
+	sniffer := &responseSniffer{Conn: outConn}
+	utils.IoBindShared((*inConn), sniffer, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s -%s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
-		s.worker.DecrementConnection(err != nil)
-		s.worker.RecordDataUsage(bytesSent, bytesReceived, req.User, sourceIP, destHost, destPort, req.IsHTTPS())
-		s.worker.RemoveUserConnection(req.User)
+		s.worker.DecrementConnection("http", err != nil)
+		protocol := manager.ProtocolHTTP
+		if req.IsHTTPS() {
+			protocol = manager.ProtocolHTTPS
+		}
+		s.worker.RecordDataUsage(bytesSent, bytesReceived, 1, req.User, sourceIP, destHost, destPort, protocol)
+		entry := manager.AccessLogEntry{
+			Timestamp:     startedAt,
+			Username:      req.User,
+			Domain:        destHost,
+			BytesSent:     atomic.LoadUint64(&bytesSent),
+			BytesReceived: atomic.LoadUint64(&bytesReceived),
+			RequestMethod: req.Method,
+			SourceIP:      sourceIP,
+		}
+		if !req.IsHTTPS() {
+			entry.FullURL = req.URL
+			entry.StatusCode, entry.ContentType = sniffer.Response()
+		}
+		s.worker.RecordAccess(entry)
+		s.worker.RemoveUserConnection(req.User, *inConn)
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
 	}, func(n int, isDownload bool) {
@@ -214,11 +240,53 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 			atomic.AddUint64(&bytesSent, uint64(n))
 		}
 		s.worker.AddThroughput(uint64(n))
-	}, 0)
+	}, s.worker.UserBandwidthLimiter(req.User))
 	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
 	return
 }
 
+// responseHeadLimit caps how much of an upstream response is kept to read its
+// status line and headers from.
+const responseHeadLimit = 4096
+
+// responseSniffer passes an upstream connection through unchanged while
+// keeping a copy of the start of the response for the access log.
+type responseSniffer struct {
+	net.Conn
+	mu   sync.Mutex
+	head []byte
+}
+
+func (r *responseSniffer) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		r.mu.Lock()
+		if room := responseHeadLimit - len(r.head); room > 0 {
+			if n < room {
+				room = n
+			}
+			r.head = append(r.head, p[:room]...)
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+// Response returns the status code and content type of the response. Both are
+// zero if its header did not arrive in full within responseHeadLimit bytes.
+// On a keep-alive connection only the first response is seen.
+func (r *responseSniffer) Response() (statusCode uint16, contentType string) {
+	r.mu.Lock()
+	head := r.head
+	r.mu.Unlock()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return 0, ""
+	}
+	resp.Body.Close()
+	return uint16(resp.StatusCode), resp.Header.Get("Content-Type")
+}
+
 func (s *HTTP) OutToUDP(inConn *net.Conn) (err error) {
 	return
 }
@@ -3,6 +3,7 @@ package services
 import (
 	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -417,6 +418,30 @@ func TestHTTP_Callback_IPv6Host(t *testing.T) {
 	http.callback(conn)
 }
 
+func TestHTTP_responseSniffer_ParsesResponseHead(t *testing.T) {
+	body := strings.Repeat("x", 2*responseHeadLimit)
+	conn := &MockConn{data: []byte("HTTP/1.1 404 Not Found\r\nContent-Type: text/html\r\n\r\n" + body)}
+	sniffer := &responseSniffer{Conn: conn}
+	if _, err := io.Copy(io.Discard, sniffer); err != nil {
+		t.Fatalf("Read through sniffer failed: %v", err)
+	}
+	if len(sniffer.head) != responseHeadLimit {
+		t.Errorf("Expected %d bytes kept, got %d", responseHeadLimit, len(sniffer.head))
+	}
+	status, contentType := sniffer.Response()
+	if status != 404 || contentType != "text/html" {
+		t.Errorf("Expected 404 text/html, got %d %q", status, contentType)
+	}
+}
+
+func TestHTTP_responseSniffer_NotHTTP(t *testing.T) {
+	sniffer := &responseSniffer{Conn: &MockConn{data: []byte{0x16, 0x03, 0x01, 0x00}}}
+	io.Copy(io.Discard, sniffer)
+	if status, contentType := sniffer.Response(); status != 0 || contentType != "" {
+		t.Errorf("Expected no status for a non-HTTP response, got %d %q", status, contentType)
+	}
+}
+
 type MockConn struct {
 	data   []byte
 	pos    int
@@ -481,3 +506,107 @@ func (m *MockConnWithAddr) LocalAddr() net.Addr {
 func (m *MockConnWithAddr) RemoteAddr() net.Addr {
 	return m.remoteAddr
 }
+
+func TestHTTP_connectUpstream_ConnectReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		wantErr bool
+	}{
+		{"HTTP/1.1 200 Connection established\r\n\r\n", false},
+		{"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", true},
+		{"HTTP/1.1 502 Bad Gateway\r\n\r\n", true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		reply := tt.reply
+		go func() {
+			buf := make([]byte, 4096)
+			server.Read(buf)
+			server.Write([]byte(reply + "tunnel"))
+		}()
+		upstreamReq, err := newUpstreamRequest([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("Failed to parse request: %v", err)
+		}
+		upstream := &manager.Upstream{
+			UpstreamProvider: "geonode",
+			UpstreamUsername: "acct",
+			UpstreamPassword: "secret",
+		}
+		var conn net.Conn = client
+		err = connectUpstream(upstreamReq, utils.Tag{}, upstream, &conn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.reply, tt.wantErr, err)
+		}
+		if err == nil {
+			// bytes after the reply belong to the tunnel
+			rest := make([]byte, len("tunnel"))
+			if _, err := io.ReadFull(client, rest); err != nil || string(rest) != "tunnel" {
+				t.Errorf("Expected the tunnel data to be left unread, got %q (%v)", rest, err)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHTTP_connectUpstream_StreamsPartialBody(t *testing.T) {
+	head := "POST /upload HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic Y2xpZW50\r\nContent-Length: 100000\r\n\r\n"
+	upstreamReq, err := newUpstreamRequest([]byte(head + "first-chunk"))
+	if err != nil {
+		t.Fatalf("A body larger than the first read should not fail the request: %v", err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sent := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, _ := server.Read(buf)
+		sent <- string(buf[:n])
+	}()
+	upstream := &manager.Upstream{
+		UpstreamProvider: "geonode",
+		UpstreamUsername: "acct",
+		UpstreamPassword: "secret",
+	}
+	var conn net.Conn = client
+	if err := connectUpstream(upstreamReq, utils.Tag{}, upstream, &conn); err != nil {
+		t.Fatalf("connectUpstream failed: %v", err)
+	}
+	got := <-sent
+	if !strings.HasPrefix(got, "POST http://example.com/upload HTTP/1.1\r\n") {
+		t.Errorf("Expected the request line in absolute form, got %q", got)
+	}
+	if strings.Contains(got, "Y2xpZW50") || strings.Count(got, "Proxy-Authorization") != 1 {
+		t.Errorf("Expected only the upstream's credentials, got %q", got)
+	}
+	if !strings.HasSuffix(got, "\r\n\r\nfirst-chunk") {
+		t.Errorf("Expected the buffered body after the head, got %q", got)
+	}
+}
+
+func TestHTTP_newUpstreamRequest_IncompleteHead(t *testing.T) {
+	if _, err := newUpstreamRequest([]byte("GET http://example.com/ HTTP/1.1\r\nHost: exa")); err == nil {
+		t.Error("Should reject a request whose head was cut off")
+	}
+}
+
+func TestHTTP_runHandshake_SilentUpstreamTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	upstreamReq, _ := newUpstreamRequest([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	var conn net.Conn = client
+	started := time.Now()
+	err := runHandshake(&manager.Upstream{}, &conn, 100, func(upstream *manager.Upstream, outConn *net.Conn) error {
+		return connectUpstream(upstreamReq, utils.Tag{}, upstream, outConn)
+	})
+	if err == nil {
+		t.Fatal("Should fail when the upstream never replies")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Should give up after the timeout, took %s", elapsed)
+	}
+}
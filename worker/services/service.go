@@ -12,7 +12,9 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/snail007/goproxy/manager"
 	"github.com/snail007/goproxy/utils"
 )
@@ -62,27 +64,164 @@ func Run(name string, worker *manager.WorkerManager) (service *ServiceItem, err
 	return
 }
 
-func connectUpstream(req *utils.HTTPRequest, upstream *manager.Upstream, outConn *net.Conn) error {
-	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.HeadBuf)))
-	if err != nil {
-		utils.CloseConn(outConn)
+// maxUpstreamAttempts bounds how many upstreams a single client request tries
+// before giving up.
+const maxUpstreamAttempts = 3
+
+// dialUpstream connects to the next healthy upstream and runs handshake on the
+// new connection. When the dial or the handshake fails it moves on to another
+// upstream within the same client request. Every attempt is reported to the
+// worker so that failing upstreams get ejected.
+func dialUpstream(worker *manager.WorkerManager, outPool *utils.OutPool, timeout int, user string, tag utils.Tag, handshake func(upstream *manager.Upstream, outConn *net.Conn) error) (upstream *manager.Upstream, outConn net.Conn, err error) {
+	// the session lifetime in the username is in minutes
+	lifetime := time.Duration(tag.Lifetime) * time.Minute
+	tried := make([]uuid.UUID, 0, maxUpstreamAttempts)
+	for attempt := 1; attempt <= maxUpstreamAttempts; attempt++ {
+		upstream = worker.NextUpstream(user, tag.Session, lifetime, tried...)
+		if upstream == nil {
+			break
+		}
+		tried = append(tried, upstream.UpstreamID)
+		log.Printf("[Upstream] Connecting to: %s (tag: %s, attempt: %d)", upstream.GetAddress(), upstream.UpstreamTag, attempt)
+		connectStart := time.Now()
+		out, poolErr := outPool.GetConnFromConnectionPool(upstream.GetAddress())
+		if poolErr != nil {
+			outConn, err = utils.ConnectHost(upstream.GetAddress(), timeout)
+		} else {
+			log.Println("[Upstream] Using connection from pool")
+			outConn, err = out.(net.Conn), nil
+		}
+		connectLatency := time.Since(connectStart)
+		if err == nil {
+			if err = runHandshake(upstream, &outConn, timeout, handshake); err != nil {
+				utils.CloseConn(&outConn)
+			}
+		}
+		worker.RecordUpstreamLatency(upstream, connectLatency, err)
+		if err == nil {
+			return upstream, outConn, nil
+		}
+		log.Printf("[Upstream] %s (tag: %s) failed: %s", upstream.GetAddress(), upstream.UpstreamTag, err)
+	}
+	if err == nil {
+		err = fmt.Errorf("no upstream available")
+	}
+	return nil, nil, err
+}
+
+// runHandshake runs handshake on outConn within timeout milliseconds, so an
+// upstream that accepts the connection but never answers fails like one that
+// refused it instead of holding the client.
+func runHandshake(upstream *manager.Upstream, outConn *net.Conn, timeout int, handshake func(upstream *manager.Upstream, outConn *net.Conn) error) error {
+	(*outConn).SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	if err := handshake(upstream, outConn); err != nil {
 		return err
 	}
-	httpReq.Header.Del("Proxy-Authorization")
+	return (*outConn).SetDeadline(time.Time{})
+}
+
+// maxConnectResponseSize bounds the upstream's reply to a CONNECT.
+const maxConnectResponseSize = 8 << 10
+
+// upstreamRequest is a client request as it is forwarded to an HTTP upstream:
+// its head without the client's Proxy-Authorization, followed by whatever
+// part of the body arrived with it. The rest of the body is streamed once the
+// upstream accepted the request.
+type upstreamRequest struct {
+	method string
+	lines  []string
+	body   []byte
+}
+
+// newUpstreamRequest parses the head at the start of headBuf. An error means
+// the client sent a request no upstream could serve.
+func newUpstreamRequest(headBuf []byte) (*upstreamRequest, error) {
+	end := bytes.Index(headBuf, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, fmt.Errorf("request head exceeds %d bytes", len(headBuf))
+	}
+	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(headBuf[:end+4])))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(headBuf[:end]), "\r\n")
+	// upstreams expect the absolute form, which WriteProxy used to send
+	target := httpReq.RequestURI
+	if httpReq.Method != http.MethodConnect && !httpReq.URL.IsAbs() {
+		target = "http://" + httpReq.Host + httpReq.RequestURI
+	}
+	kept := []string{httpReq.Method + " " + target + " " + httpReq.Proto}
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Proxy-Authorization") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return &upstreamRequest{method: httpReq.Method, lines: kept, body: headBuf[end+4:]}, nil
+}
+
+// connectUpstream forwards the client's request to an HTTP upstream with the
+// upstream's credentials. For a CONNECT it also reads the upstream's reply, so
+// a refused tunnel, such as a 407, fails the handshake; the caller then owes
+// the client its own 200.
+func connectUpstream(req *upstreamRequest, tag utils.Tag, upstream *manager.Upstream, outConn *net.Conn) error {
+	var buf bytes.Buffer
+	for _, line := range req.lines {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
 	if upstream.UpstreamUsername != "" && upstream.UpstreamPassword != "" {
-		tag := convertTag(upstream.UpstreamUsername, upstream.UpstreamPassword, req.Tag, upstream.UpstreamProvider)
-		log.Printf("[Upstream] Using tag: %s", tag)
-		token := base64.StdEncoding.EncodeToString([]byte(tag))
-		httpReq.Header.Set("Proxy-Authorization", "Basic "+token)
+		username, password, err := upstream.Credentials(tag)
+		if err != nil {
+			return err
+		}
+		log.Printf("[Upstream] Using tag: %s", username)
+		token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		buf.WriteString("Proxy-Authorization: Basic " + token + "\r\n")
 		log.Printf("[Upstream] Using credentials for user: %s", upstream.UpstreamUsername)
 	}
-	var buf bytes.Buffer
-	httpReq.WriteProxy(&buf)
-	(*outConn).Write(buf.Bytes())
+	buf.WriteString("\r\n")
+	buf.Write(req.body)
+	if _, err := (*outConn).Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if req.method != http.MethodConnect {
+		return nil
+	}
+	resp, err := readConnectResponse(*outConn, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("reading upstream CONNECT reply: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upstream CONNECT failed: %s", resp.Status)
+	}
 	return nil
 }
 
-func connectUpstreamSocks(tag utils.Tag, upstream *manager.Upstream, outConn *net.Conn, address string) error {
+// readConnectResponse reads the upstream's reply to a CONNECT one byte at a
+// time, so nothing the upstream sends through the tunnel afterwards is
+// consumed.
+func readConnectResponse(conn net.Conn, req *http.Request) (*http.Response, error) {
+	head := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxConnectResponseSize {
+			return nil, fmt.Errorf("reply exceeds %d bytes", maxConnectResponseSize)
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+}
+
+// connectUpstreamSocks authenticates with a SOCKS5 upstream and asks it to
+// CONNECT to address. The host is passed on as a domain name so the upstream
+// resolves it, unless resolveLocally is set.
+func connectUpstreamSocks(tag utils.Tag, upstream *manager.Upstream, outConn *net.Conn, address string, resolveLocally bool) error {
 	_, err := (*outConn).Write([]byte{SOCKS5_VERSION, 0x01, SOCKS5_AUTH_PASSWORD})
 	if err != nil {
 		log.Printf("[Upstream] Failed to send auth request: %s", err)
@@ -98,9 +237,10 @@ func connectUpstreamSocks(tag utils.Tag, upstream *manager.Upstream, outConn *ne
 		return fmt.Errorf("upstream does not accept username/password auth")
 	}
 
-	newTag := strings.Split(convertTag(upstream.UpstreamUsername, upstream.UpstreamPassword, tag, upstream.UpstreamProvider), ":")
-	username := newTag[0]
-	password := newTag[1]
+	username, password, err := upstream.Credentials(tag)
+	if err != nil {
+		return err
+	}
 
 	authReq := []byte{0x01, byte(len(username))}
 	authReq = append(authReq, []byte(username)...)
@@ -119,34 +259,11 @@ func connectUpstreamSocks(tag utils.Tag, upstream *manager.Upstream, outConn *ne
 		return fmt.Errorf("upstream authentication failed")
 	}
 
-	host, portStr, _ := net.SplitHostPort(address)
-	port, _ := strconv.Atoi(portStr)
-
-	req := []byte{
-		0x05,
-		0x01,
-		0x00,
-	}
-
-	ips, err := net.LookupIP(host)
+	addr, err := socksAddress(address, resolveLocally)
 	if err != nil {
 		return err
 	}
-	var ip4 net.IP
-	for _, ip := range ips {
-		if v4 := ip.To4(); v4 != nil {
-			ip4 = v4
-			break
-		}
-	}
-	if ip4 == nil {
-		return fmt.Errorf("no IPv4 address found")
-	}
-
-	req = append(req, 0x01) // IPv4
-	req = append(req, ip4...)
-
-	req = append(req, byte(port>>8), byte(port))
+	req := append([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0x00}, addr...)
 
 	if _, err = (*outConn).Write(req); err != nil {
 		return err
@@ -175,62 +292,50 @@ func connectUpstreamSocks(tag utils.Tag, upstream *manager.Upstream, outConn *ne
 	return nil
 }
 
-func convertTag(username, password string, tag utils.Tag, upstream string) string {
-	newstring := ""
-	switch upstream {
-	case "netnut":
-		newstring += username
-		if tag.Country != "" && (tag.City != "" || tag.State != "") {
-			newstring += "-res_sc-" + tag.Country
-			if tag.State != "" {
-				newstring += "_" + tag.State
-			}
-			if tag.City != "" {
-				newstring += "_" + tag.City
-			}
-		} else {
-			newstring += "-res-" + tag.Country
-		}
-		if tag.Session != "" {
-			newstring += "-sid-" + tag.Session
-		}
-		newstring += ":" + password
-	case "geonode":
-		newstring += username
-		if tag.Country != "" {
-			newstring += "-country-" + tag.Country
-		}
-		if tag.State != "" {
-			newstring += "-state-" + tag.State
-		}
-		if tag.City != "" {
-			newstring += "-city-" + tag.City
-		}
-		if tag.Session != "" {
-			newstring += "-session-" + tag.Session
-		}
-		if tag.Lifetime > 0 {
-			newstring += "-lifetime-" + strconv.Itoa(tag.Lifetime)
+// socksAddress encodes host:port as a SOCKS5 ATYP, address and port. IP
+// literals are sent as they are; a domain name is sent as one unless
+// resolveLocally is set, in which case it is resolved here, preferring IPv4.
+func socksAddress(address string, resolveLocally bool) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil && resolveLocally {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
 		}
-		newstring += ":" + password
-	case "iproyal":
-		newstring += username + ":" + password
-		if tag.Country != "" {
-			newstring += "_country-" + tag.Country
+		for _, candidate := range ips {
+			if candidate.To4() != nil {
+				ip = candidate
+				break
+			}
 		}
-		if tag.City != "" {
-			newstring += "_city-" + tag.City
+		if ip == nil && len(ips) > 0 {
+			ip = ips[0]
 		}
-		if tag.Session != "" {
-			newstring += "_session-" + tag.Session
+		if ip == nil {
+			return nil, fmt.Errorf("no address found for %s", host)
 		}
-		if tag.Lifetime > 0 {
-			if tag.Lifetime < 60 {
-				newstring += "_lifetime-" + strconv.Itoa(tag.Lifetime) + "m"
-			} else {
-				newstring += "_lifetime-" + strconv.Itoa(tag.Lifetime/60) + "h"
-			}
+	}
+
+	var addr []byte
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %d bytes", len(host))
 		}
+		addr = append([]byte{SOCKS5_ATYP_DOMAIN, byte(len(host))}, host...)
+	case ip.To4() != nil:
+		addr = append([]byte{SOCKS5_ATYP_IPV4}, ip.To4()...)
+	default:
+		addr = append([]byte{SOCKS5_ATYP_IPV6}, ip.To16()...)
 	}
-	return newstring
+	return append(addr, byte(port>>8), byte(port)), nil
 }
@@ -87,7 +87,7 @@ func (s *SOCKS) callback(inConn net.Conn) {
 		return
 	}
 
-	if err := s.worker.AddUserConnection(user); err != nil {
+	if err := s.worker.AddUserConnection(user, inConn); err != nil {
 		log.Printf("add user connection failed, err: %s", err)
 		s.sendReply(&inConn, SOCKS5_REP_CONN_NOT_ALLOWED)
 		utils.CloseConn(&inConn)
@@ -97,7 +97,14 @@ func (s *SOCKS) callback(inConn net.Conn) {
 	address, cmd, err := s.handleRequest(&inConn)
 	if err != nil {
 		log.Printf("socks5 request error from %s: %s", inConn.RemoteAddr(), err)
-		s.worker.RemoveUserConnection(user)
+		s.worker.RemoveUserConnection(user, inConn)
+		utils.CloseConn(&inConn)
+		return
+	}
+	if err := s.worker.ValidateTargeting(tag); err != nil {
+		log.Printf("socks5 targeting rejected for user %s: %s", user, err)
+		s.sendReply(&inConn, SOCKS5_REP_CONN_NOT_ALLOWED)
+		s.worker.RemoveUserConnection(user, inConn)
 		utils.CloseConn(&inConn)
 		return
 	}
@@ -119,7 +126,7 @@ func (s *SOCKS) callback(inConn net.Conn) {
 		if err != nil {
 			log.Printf("socks5 udp error from %s: %s", inConn.RemoteAddr(), err)
 		}
-		s.worker.RemoveUserConnection(user)
+		s.worker.RemoveUserConnection(user, inConn)
 		utils.CloseConn(&inConn)
 		return
 	} else {
@@ -130,7 +137,7 @@ func (s *SOCKS) callback(inConn net.Conn) {
 			} else {
 				log.Printf("connect to %s fail, ERR:%s", address, err)
 			}
-			s.worker.RemoveUserConnection(user)
+			s.worker.RemoveUserConnection(user, inConn)
 			utils.CloseConn(&inConn)
 		}
 		return
@@ -180,6 +187,7 @@ func (s *SOCKS) handleUDP(inConn *net.Conn, clientAddr string, user string) erro
 		sessionsMu.Unlock()
 	}()
 
+	counted := false
 	buf := make([]byte, 65535)
 	for {
 		// Check if TCP connection is still alive
@@ -296,7 +304,7 @@ func (s *SOCKS) handleUDP(inConn *net.Conn, clientAddr string, user string) erro
 					udpConn.WriteToUDP(finalPacket, clientUDPAddr)
 
 					// Telemetry
-					s.worker.RecordDataUsage(0, uint64(rn), user, clientUDPAddr.IP.String(), tHost, uint16(tPort), false)
+					s.worker.RecordDataUsage(0, uint64(rn), 0, user, clientUDPAddr.IP.String(), tHost, uint16(tPort), manager.ProtocolUDP)
 					s.worker.AddThroughput(uint64(rn))
 				}
 			}(conn, cAddr, targetHost, targetPort)
@@ -306,7 +314,14 @@ func (s *SOCKS) handleUDP(inConn *net.Conn, clientAddr string, user string) erro
 		// Send to target
 		_, err = conn.Write(payload)
 		if err == nil {
-			s.worker.RecordDataUsage(uint64(len(payload)), 0, user, cAddr.IP.String(), targetHost, uint16(targetPort), false)
+			// the association counts as one request, however many datagrams
+			// it relays
+			var requests uint64
+			if !counted {
+				requests = 1
+				counted = true
+			}
+			s.worker.RecordDataUsage(uint64(len(payload)), 0, requests, user, cAddr.IP.String(), targetHost, uint16(targetPort), manager.ProtocolUDP)
 			s.worker.AddThroughput(uint64(len(payload)))
 		}
 	}
@@ -330,13 +345,25 @@ func (s *SOCKS) handleHandshake(inConn *net.Conn) (string, utils.Tag, error) {
 	}
 
 	hasPasswordAuth := false
+	hasNoAuth := false
 	for _, m := range methods {
 		if m == SOCKS5_AUTH_PASSWORD {
 			hasPasswordAuth = true
-			break
+		}
+		if m == SOCKS5_AUTH_NONE {
+			hasNoAuth = true
 		}
 	}
 	if !hasPasswordAuth {
+		// clients without credentials are let in when their address is
+		// whitelisted by exactly one user
+		if hasNoAuth {
+			if user, ok := s.worker.VerifyIP(utils.ClientIP(*inConn)); ok {
+				log.Printf("socks5 ip auth success for user: %s", user)
+				(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE})
+				return user, utils.Tag{}, nil
+			}
+		}
 		(*inConn).Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_NO_ACCEPT})
 		return "", utils.Tag{}, fmt.Errorf("client doesn't support password auth")
 	}
@@ -378,32 +405,15 @@ func (s *SOCKS) handlePasswordAuth(inConn *net.Conn) (string, utils.Tag, error)
 		return "", utils.Tag{}, fmt.Errorf("failed to read password: %w", err)
 	}
 
-	passwordStr := string(password)
-	tagArray := strings.Split(passwordStr, "-")
-	tag := utils.Tag{}
-	for i, v := range tagArray {
-		if v == "country" && i+1 < len(tagArray) {
-			tag.Country = tagArray[i+1]
-		}
-		if v == "state" && i+1 < len(tagArray) {
-			tag.State = tagArray[i+1]
-		}
-		if v == "city" && i+1 < len(tagArray) {
-			tag.City = tagArray[i+1]
-		}
-		if v == "session" && i+1 < len(tagArray) {
-			tag.Session = tagArray[i+1]
-		}
-		if v == "lifetime" && i+1 < len(tagArray) {
-			tag.Lifetime, _ = strconv.Atoi(tagArray[i+1])
-		}
-	}
-
-	actualPassword := tagArray[0]
+	actualPassword, tag := utils.ParseTag(string(password))
 	if !s.worker.VerifyUser(string(username), actualPassword) {
 		(*inConn).Write([]byte{0x01, 0x01})
 		return "", utils.Tag{}, fmt.Errorf("authentication failed for user: %s", string(username))
 	}
+	if !s.worker.AllowClientIP(string(username), utils.ClientIP(*inConn)) {
+		(*inConn).Write([]byte{0x01, 0x01})
+		return "", utils.Tag{}, fmt.Errorf("client ip %s not allowed for user: %s", (*inConn).RemoteAddr(), string(username))
+	}
 
 	log.Printf("socks5 auth success for user: %s", string(username))
 	(*inConn).Write([]byte{0x01, 0x00})
@@ -489,26 +499,12 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn, user s
 	}
 
 	var outConn net.Conn
-	var upstream *manager.Upstream
 
 	if useProxy {
 		if s.worker.HasUpstreams() {
-			upstream = s.worker.NextUpstream(user, tag.Session)
-			if upstream != nil {
-				log.Printf("[Upstream] Connecting to: %s (tag: %s)", upstream.GetAddress(), upstream.UpstreamTag)
-				connectStart := time.Now()
-				out, poolErr := s.outPool.GetConnFromConnectionPool(upstream.GetAddress())
-				if poolErr != nil {
-					outConn, err = utils.ConnectHost(upstream.GetAddress(), *s.cfg.Timeout)
-				} else {
-					log.Println("[Upstream] Using connection from pool")
-					outConn = out.(net.Conn)
-				}
-				connectLatency := time.Since(connectStart)
-				s.worker.RecordUpstreamLatency(upstream, connectLatency, err)
-			} else {
-				err = fmt.Errorf("no upstream available")
-			}
+			_, outConn, err = dialUpstream(s.worker, &s.outPool, *s.cfg.Timeout, user, tag, func(upstream *manager.Upstream, outConn *net.Conn) error {
+				return connectUpstreamSocks(tag, upstream, outConn, address, s.worker.ResolveLocally())
+			})
 		} else {
 			err = fmt.Errorf("no upstream configured")
 		}
@@ -528,15 +524,6 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn, user s
 	outAddr := outConn.RemoteAddr().String()
 	outLocalAddr := outConn.LocalAddr().String()
 
-	if useProxy {
-		err = connectUpstreamSocks(tag, upstream, &outConn, address)
-		if err != nil {
-			utils.CloseConn(inConn)
-			utils.CloseConn(&outConn)
-			return err
-		}
-	}
-
 	var bytesSent uint64
 	var bytesReceived uint64
 	sourceIP := strings.Split(inAddr, ":")[0]
@@ -550,13 +537,22 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn, user s
 	if p, convErr := strconv.Atoi(destPortStr); convErr == nil {
 		destPort = uint16(p)
 	}
-	s.worker.IncrementConnection()
+	s.worker.IncrementConnection("socks")
 
-	utils.IoBind((*inConn), outConn, func(isSrcErr bool, err error) {
+	startedAt := time.Now()
+	utils.IoBindShared((*inConn), outConn, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s -%s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
-		s.worker.DecrementConnection(err != nil)
-		s.worker.RecordDataUsage(bytesSent, bytesReceived, user, sourceIP, destHost, destPort, false)
-		s.worker.RemoveUserConnection(user)
+		s.worker.DecrementConnection("socks", err != nil)
+		s.worker.RecordDataUsage(bytesSent, bytesReceived, 1, user, sourceIP, destHost, destPort, manager.ProtocolSOCKS5)
+		s.worker.RecordAccess(manager.AccessLogEntry{
+			Timestamp:     startedAt,
+			Username:      user,
+			Domain:        destHost,
+			BytesSent:     atomic.LoadUint64(&bytesSent),
+			BytesReceived: atomic.LoadUint64(&bytesReceived),
+			SourceIP:      sourceIP,
+		})
+		s.worker.RemoveUserConnection(user, *inConn)
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
 	}, func(n int, isDownload bool) {
@@ -566,7 +562,7 @@ func (s *SOCKS) OutToTCP(useProxy bool, address string, inConn *net.Conn, user s
 			atomic.AddUint64(&bytesSent, uint64(n))
 		}
 		s.worker.AddThroughput(uint64(n))
-	}, 0)
+	}, s.worker.UserBandwidthLimiter(user))
 	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
 	return
 }
@@ -1,9 +1,11 @@
 package services
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -1138,6 +1140,88 @@ func (m *SOCKSMockConnWithAddr) RemoteAddr() net.Addr {
 	return m.remoteAddr
 }
 
+func TestSOCKS_socksAddress(t *testing.T) {
+	tests := []struct {
+		address        string
+		resolveLocally bool
+		want           []byte
+	}{
+		{"example.com:443", false, append(append([]byte{SOCKS5_ATYP_DOMAIN, 11}, "example.com"...), 0x01, 0xBB)},
+		{"192.168.1.1:80", false, []byte{SOCKS5_ATYP_IPV4, 192, 168, 1, 1, 0x00, 0x50}},
+		{"[2001:db8::1]:8080", false, []byte{SOCKS5_ATYP_IPV6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x1F, 0x90}},
+		{"127.0.0.1:80", true, []byte{SOCKS5_ATYP_IPV4, 127, 0, 0, 1, 0x00, 0x50}},
+	}
+	for _, tt := range tests {
+		got, err := socksAddress(tt.address, tt.resolveLocally)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.address, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.address, tt.want, got)
+		}
+	}
+}
+
+func TestSOCKS_socksAddress_ResolveLocally(t *testing.T) {
+	got, err := socksAddress("localhost:80", true)
+	if err != nil {
+		t.Skipf("localhost does not resolve here: %v", err)
+	}
+	if got[0] != SOCKS5_ATYP_IPV4 && got[0] != SOCKS5_ATYP_IPV6 {
+		t.Errorf("Expected a resolved address, got ATYP %d", got[0])
+	}
+}
+
+func TestSOCKS_socksAddress_Invalid(t *testing.T) {
+	for _, address := range []string{
+		"example.com",
+		"example.com:http",
+		"example.com:70000",
+		strings.Repeat("a", 256) + ":80",
+	} {
+		if _, err := socksAddress(address, false); err == nil {
+			t.Errorf("Expected %.20s to be rejected", address)
+		}
+	}
+}
+
+func TestSOCKS_connectUpstreamSocks_SendsDomain(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	upstream := &manager.Upstream{
+		UpstreamProvider: "geonode",
+		UpstreamUsername: "acct",
+		UpstreamPassword: "secret",
+	}
+	request := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 3)
+		io.ReadFull(server, buf)
+		server.Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_PASSWORD})
+		header := make([]byte, 2)
+		io.ReadFull(server, header)
+		io.ReadFull(server, make([]byte, int(header[1])))
+		plen := make([]byte, 1)
+		io.ReadFull(server, plen)
+		io.ReadFull(server, make([]byte, int(plen[0])))
+		server.Write([]byte{0x01, 0x00})
+		req := make([]byte, 4+1+len("example.com")+2)
+		io.ReadFull(server, req)
+		request <- req
+		server.Write([]byte{SOCKS5_VERSION, 0x00, 0x00, SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+	}()
+	var conn net.Conn = client
+	if err := connectUpstreamSocks(utils.Tag{}, upstream, &conn, "example.com:443", false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := append(append([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0x00, SOCKS5_ATYP_DOMAIN, 11}, "example.com"...), 0x01, 0xBB)
+	if got := <-request; !bytes.Equal(got, want) {
+		t.Errorf("Expected CONNECT %v, got %v", want, got)
+	}
+}
+
 type SOCKSMockConnWithTCPAddr struct {
 	SOCKSMockConn
 }
@@ -20,9 +20,26 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), bytesPreSec float64) {
+	var srcLimiter, dstLimiter *rate.Limiter
+	if bytesPreSec > 0 {
+		srcLimiter = newRateLimiter(bytesPreSec)
+		dstLimiter = newRateLimiter(bytesPreSec)
+	}
+	ioBind(dst, src, fn, cfn, srcLimiter, dstLimiter)
+}
+
+// IoBindShared is IoBind with both directions drawing from limiter, which may
+// also be shared with other connections. A nil limiter does not limit.
+func IoBindShared(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), limiter *rate.Limiter) {
+	ioBind(dst, src, fn, cfn, limiter, limiter)
+}
+
+func ioBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), srcLimiter, dstLimiter *rate.Limiter) {
 	var one = &sync.Once{}
 	go func() {
 		defer func() {
@@ -32,9 +49,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 		}()
 		var err error
 		var isSrcErr bool
-		if bytesPreSec > 0 {
+		if srcLimiter != nil {
 			newreader := NewReader(src)
-			newreader.SetRateLimit(bytesPreSec)
+			newreader.SetLimiter(srcLimiter)
 			_, isSrcErr, err = ioCopy(dst, newreader, func(c int) {
 				cfn(c, false)
 			})
@@ -58,9 +75,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 		}()
 		var err error
 		var isSrcErr bool
-		if bytesPreSec > 0 {
+		if dstLimiter != nil {
 			newReader := NewReader(dst)
-			newReader.SetRateLimit(bytesPreSec)
+			newReader.SetLimiter(dstLimiter)
 			_, isSrcErr, err = ioCopy(src, newReader, func(c int) {
 				cfn(c, true)
 			})
@@ -194,6 +211,16 @@ func HTTPGet(URL string, timeout int) (err error) {
 	return
 }
 
+// ClientIP returns the IP part of the connection's remote address.
+func ClientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 func CloseConn(conn *net.Conn) {
 	if conn != nil && *conn != nil {
 		(*conn).SetDeadline(time.Now().Add(time.Millisecond))
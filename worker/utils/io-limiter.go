@@ -54,10 +54,21 @@ func NewWriterWithContext(w io.Writer, ctx context.Context) *Writer {
 	}
 }
 
+func newRateLimiter(bytesPerSec float64) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
+	limiter.AllowN(time.Now(), burstLimit) // spend initial burst
+	return limiter
+}
+
 // SetRateLimit sets rate limit (bytes/sec) to the reader.
 func (s *Reader) SetRateLimit(bytesPerSec float64) {
-	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
-	s.limiter.AllowN(time.Now(), burstLimit) // spend initial burst
+	s.limiter = newRateLimiter(bytesPerSec)
+}
+
+// SetLimiter makes the reader wait on limiter, which may be shared with other
+// readers. Its burst must cover the largest single read.
+func (s *Reader) SetLimiter(limiter *rate.Limiter) {
+	s.limiter = limiter
 }
 
 // Read reads bytes into p.
@@ -77,8 +88,7 @@ func (s *Reader) Read(p []byte) (int, error) {
 
 // SetRateLimit sets rate limit (bytes/sec) to the writer.
 func (s *Writer) SetRateLimit(bytesPerSec float64) {
-	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
-	s.limiter.AllowN(time.Now(), burstLimit) // spend initial burst
+	s.limiter = newRateLimiter(bytesPerSec)
 }
 
 // Write writes bytes from p.
@@ -13,6 +13,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/torchlabssoftware/subnetwork_system/providers"
 )
 
 type Checker struct {
@@ -246,31 +248,56 @@ func (ba *BasicAuth) Total() (n int) {
 }*/
 
 type HTTPRequest struct {
-	HeadBuf   []byte
-	conn      *net.Conn
-	Host      string
-	Method    string
-	URL       string
-	hostOrURL string
-	Validator func(string, string) bool
-	User      string
-	Tag       Tag
+	HeadBuf     []byte
+	conn        *net.Conn
+	Host        string
+	Method      string
+	URL         string
+	hostOrURL   string
+	Validator   func(string, string) bool
+	IPValidator func(string) (string, bool)
+	User        string
+	Tag         Tag
 }
 
-type Tag struct {
-	Country  string
-	State    string
-	City     string
-	Session  string
-	Lifetime int
+// Tag is the targeting a client asks for in its proxy password.
+type Tag = providers.Targeting
+
+// ParseTag splits a client password of the form
+// password-country-us-state-ny-city-newyork-session-abc-lifetime-30 into the
+// password itself and the targeting that follows it. A key without a value is
+// ignored.
+func ParseTag(password string) (string, Tag) {
+	tagArray := strings.Split(password, "-")
+	tag := Tag{}
+	for i := 1; i+1 < len(tagArray); i++ {
+		value := tagArray[i+1]
+		switch tagArray[i] {
+		case "country":
+			tag.Country = value
+		case "state":
+			tag.State = value
+		case "city":
+			tag.City = value
+		case "session":
+			tag.Session = value
+		case "lifetime":
+			tag.Lifetime, _ = strconv.Atoi(value)
+		default:
+			continue
+		}
+		i++
+	}
+	return tagArray[0], tag
 }
 
-func NewHTTPRequest(inConn *net.Conn, bufSize int, validator func(string, string) bool) (req HTTPRequest, err error) {
+func NewHTTPRequest(inConn *net.Conn, bufSize int, validator func(string, string) bool, ipValidator func(string) (string, bool)) (req HTTPRequest, err error) {
 	buf := make([]byte, bufSize)
 	len := 0
 	req = HTTPRequest{
-		conn:      inConn,
-		Validator: validator,
+		conn:        inConn,
+		Validator:   validator,
+		IPValidator: ipValidator,
 	}
 	len, err = (*inConn).Read(buf[:])
 	if err != nil {
@@ -341,6 +368,14 @@ func (req *HTTPRequest) BasicAuth() (err error) {
 
 	authorization, err := req.getHeader("Proxy-Authorization")
 	if err != nil {
+		if req.IPValidator != nil {
+			if user, ok := req.IPValidator(ClientIP(*req.conn)); ok {
+				req.User = user
+				req.Tag = Tag{}
+				err = nil
+				return
+			}
+		}
 		fmt.Fprint((*req.conn),
 			"HTTP/1.1 407 Proxy Authentication Required\r\n"+
 				"Proxy-Authenticate: Basic realm=\"Proxy\"\r\n"+
@@ -364,28 +399,16 @@ func (req *HTTPRequest) BasicAuth() (err error) {
 	}
 
 	authOk := false
-	u := strings.Split(strings.Trim(string(user), " "), ":")
-	tagArray := strings.Split(u[1], "-")
-	req.Tag = Tag{}
-	for i, v := range tagArray {
-		if v == "country" {
-			req.Tag.Country = tagArray[i+1]
-		}
-		if v == "state" {
-			req.Tag.State = tagArray[i+1]
-		}
-		if v == "city" {
-			req.Tag.City = tagArray[i+1]
-		}
-		if v == "session" {
-			req.Tag.Session = tagArray[i+1]
-		}
-		if v == "lifetime" {
-			req.Tag.Lifetime, _ = strconv.Atoi(tagArray[i+1])
-		}
+	u := strings.SplitN(strings.Trim(string(user), " "), ":", 2)
+	if len(u) != 2 {
+		err = fmt.Errorf("authorization data error,ERR:%s", authorization)
+		CloseConn(req.conn)
+		return
 	}
+	password, tag := ParseTag(u[1])
+	req.Tag = tag
 	if req.Validator != nil {
-		authOk = req.Validator(u[0], tagArray[0])
+		authOk = req.Validator(u[0], password)
 	}
 	if !authOk {
 		fmt.Fprint((*req.conn), "HTTP/1.1 401 Unauthorized\r\n\r\nUnauthorized")
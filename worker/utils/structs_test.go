@@ -3,6 +3,7 @@ package utils
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strings"
@@ -163,7 +164,7 @@ func TestHTTPRequest_Lifecycle(t *testing.T) {
 		req := fmt.Sprintf("GET /index.html HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)
 		c.Write([]byte(req))
 	}()
-	req, err := NewHTTPRequest(&s, 1024, validator)
+	req, err := NewHTTPRequest(&s, 1024, validator, nil)
 	if err != nil {
 		t.Fatalf("NewHTTPRequest failed: %v", err)
 	}
@@ -191,7 +192,7 @@ func TestHTTPRequest_HTTPS(t *testing.T) {
 		req := fmt.Sprintf("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)
 		c.Write([]byte(req))
 	}()
-	req, err := NewHTTPRequest(&s, 1024, validator)
+	req, err := NewHTTPRequest(&s, 1024, validator, nil)
 	if err != nil {
 		t.Fatalf("NewHTTPRequest failed: %v", err)
 	}
@@ -211,6 +212,86 @@ func TestHTTPRequest_HTTPS(t *testing.T) {
 	req.HTTPSReply()
 }
 
+func TestHTTPRequest_IPAuth(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	go func() {
+		c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	}()
+
+	ipValidator := func(ip string) (string, bool) { return "ipuser", true }
+	req, err := NewHTTPRequest(&s, 1024, nil, ipValidator)
+	if err != nil {
+		t.Fatalf("NewHTTPRequest failed: %v", err)
+	}
+	if req.User != "ipuser" {
+		t.Errorf("Expected user ipuser, got %s", req.User)
+	}
+	if req.Host != "example.com:443" {
+		t.Errorf("Expected host example.com:443, got %s", req.Host)
+	}
+}
+
+func TestHTTPRequest_BasicAuthTargeting(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	var gotPassword string
+	validator := func(u, p string) bool {
+		gotPassword = p
+		return true
+	}
+	go func() {
+		auth := base64.StdEncoding.EncodeToString([]byte("user:pass-country-us-city-miami-session-abc-lifetime-30"))
+		c.Write([]byte(fmt.Sprintf("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)))
+	}()
+	req, err := NewHTTPRequest(&s, 1024, validator, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPRequest failed: %v", err)
+	}
+	if gotPassword != "pass" {
+		t.Errorf("Expected password pass, got %s", gotPassword)
+	}
+	want := Tag{Country: "us", City: "miami", Session: "abc", Lifetime: 30}
+	if req.Tag != want {
+		t.Errorf("Expected tag %+v, got %+v", want, req.Tag)
+	}
+}
+
+func TestHTTPRequest_BasicAuthMalformed(t *testing.T) {
+	for _, credentials := range []string{"user", "user:pass-country", "user:pass-city-"} {
+		s, c := net.Pipe()
+		go func() {
+			auth := base64.StdEncoding.EncodeToString([]byte(credentials))
+			c.Write([]byte(fmt.Sprintf("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n", auth)))
+			io.Copy(io.Discard, c)
+		}()
+		req, err := NewHTTPRequest(&s, 1024, func(u, p string) bool { return true }, nil)
+		if credentials == "user" {
+			if err == nil {
+				t.Error("Credentials without a password should be rejected")
+			}
+		} else if err != nil || req.Tag != (Tag{}) {
+			t.Errorf("%q: expected no targeting, got %+v (%v)", credentials, req.Tag, err)
+		}
+		s.Close()
+		c.Close()
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	password, tag := ParseTag("secret-country-us-state-ny-city-newyork-session-s1-lifetime-45")
+	want := Tag{Country: "us", State: "ny", City: "newyork", Session: "s1", Lifetime: 45}
+	if password != "secret" || tag != want {
+		t.Errorf("Unexpected parse: %s %+v", password, tag)
+	}
+	if password, tag := ParseTag("secret"); password != "secret" || tag != (Tag{}) {
+		t.Errorf("Plain password should carry no targeting: %s %+v", password, tag)
+	}
+}
+
 func TestHTTPRequest_GetBasicAuthUser(t *testing.T) {
 	auth := base64.StdEncoding.EncodeToString([]byte("testuser:secret"))
 	req := HTTPRequest{